@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func runChat(args []string) error {
+	fs := flag.NewFlagSet("chat", flag.ExitOnError)
+	open := common(fs)
+	listen := fs.Bool("listen", false, "Keep the connection open and print incoming messages")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && !*listen {
+		return errors.New("no message given")
+	}
+	c, err := open()
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(c.server + "/ws")
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.token)
+
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("connect: %s", resp.Status)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	name := c.state.DeviceName
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": "hello", "device": name}); err != nil {
+		return err
+	}
+
+	text := strings.Join(fs.Args(), " ")
+	if text != "" {
+		if err := conn.WriteJSON(map[string]string{"type": "chat", "text": text}); err != nil {
+			return err
+		}
+	}
+
+	if !*listen {
+		// Let the server relay the message before the connection closes
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		return nil
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		conn.Close()
+	}()
+
+	for {
+		var msg struct {
+			Type      string `json:"type"`
+			From      string `json:"from"`
+			Text      string `json:"text"`
+			Timestamp int64  `json:"timestamp"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if msg.Type != "chat" {
+			continue
+		}
+		fmt.Printf("%s %s: %s\n", time.Unix(msg.Timestamp, 0).Format("15:04:05"), msg.From, msg.Text)
+	}
+}
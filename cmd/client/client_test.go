@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// testServer serves TUS uploads and downloads like the real server and
+// records the requests it receives. While fail is set, upload chunks past
+// that offset are rejected.
+type testServer struct {
+	index *catalog.Index
+	url   string
+
+	mu       sync.Mutex
+	fail     int64    // reject PATCH requests at or beyond this offset, 0 accepts all
+	offsets  []string // Upload-Offset of every PATCH
+	ranges   []string // Range of every download
+	ifRanges []string // If-Range of every download
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := upload.NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := download.NewHandler(cfg, logger, index, backend)
+
+	s := &testServer{index: index}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.TUS.BasePath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			s.mu.Lock()
+			offset := r.Header.Get("Upload-Offset")
+			s.offsets = append(s.offsets, offset)
+			n, _ := strconv.ParseInt(offset, 10, 64)
+			reject := s.fail > 0 && n >= s.fail
+			s.mu.Unlock()
+			if reject {
+				http.Error(w, "connection lost", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		uploads.HandleRequest(w, r)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.ifRanges = append(s.ifRanges, r.Header.Get("If-Range"))
+		s.mu.Unlock()
+		downloads.HandleDownload(w, r)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	s.url = server.URL
+	return s
+}
+
+// failAt makes upload chunks at or beyond offset fail, 0 accepts all, and
+// forgets the requests seen so far
+func (s *testServer) failAt(offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = offset
+	s.offsets = nil
+}
+
+// requests returns the Upload-Offset of every PATCH and the Range and
+// If-Range of every download so far
+func (s *testServer) requests() (offsets, ranges, ifRanges []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.offsets...), append([]string(nil), s.ranges...), append([]string(nil), s.ifRanges...)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestClient returns a client of s keeping its state in a temporary
+// directory
+func newTestClient(t *testing.T, s *testServer) *client {
+	t.Helper()
+	st, err := loadState(filepath.Join(t.TempDir(), "client.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{server: s.url, http: &http.Client{}, state: st}
+}
+
+// uploaded returns the only file in the catalog
+func (s *testServer) uploaded(t *testing.T) *catalog.FileMeta {
+	t.Helper()
+	files, err := s.index.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files on the server, want 1", len(files))
+	}
+	return files[0]
+}
+
+func TestUploadResume(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	content := "0123456789abcdefghij"
+	name := filepath.Join(t.TempDir(), "build.txt")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := uploadOptions{folder: "builds", chunkSize: 4, retries: 1}
+
+	// The connection drops after two chunks
+	s.failAt(8)
+	if err := c.upload(name, opts); err == nil || !strings.Contains(err.Error(), "run the command again to resume") {
+		t.Fatalf("interrupted upload: %v", err)
+	}
+	if len(c.state.Uploads) != 1 {
+		t.Fatalf("unfinished uploads %v", c.state.Uploads)
+	}
+
+	// Running again with the saved state continues where it stopped
+	reloaded, err := loadState(c.state.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.state = reloaded
+	s.failAt(0)
+	if err := c.upload(name, opts); err != nil {
+		t.Fatal(err)
+	}
+	if offsets, _, _ := s.requests(); strings.Join(offsets, ",") != "8,12,16" {
+		t.Errorf("resumed with chunks at %v, want 8, 12 and 16", offsets)
+	}
+	if len(c.state.Uploads) != 0 {
+		t.Errorf("finished upload still saved: %v", c.state.Uploads)
+	}
+
+	meta := s.uploaded(t)
+	if meta.Name != "build.txt" || meta.RelativePath != "builds/build.txt" || meta.Size != int64(len(content)) || meta.SHA256 != sha256Hex(content) {
+		t.Errorf("uploaded %+v", meta)
+	}
+}
+
+func TestUploadRestartsExpiredUpload(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	name := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(name, []byte("some notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server no longer knows the saved upload
+	key := fmt.Sprintf("%s|%s|%d|%d", c.server, abs, info.Size(), info.ModTime().UnixNano())
+	c.state.Uploads[key] = s.url + "/tus/files/gone"
+
+	if err := c.upload(name, uploadOptions{chunkSize: 1 << 20, retries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if meta := s.uploaded(t); meta.Size != 10 {
+		t.Errorf("uploaded %+v", meta)
+	}
+	if len(c.state.Uploads) != 0 {
+		t.Errorf("unfinished uploads %v", c.state.Uploads)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := "the quick brown fox jumps over the lazy dog"
+
+	tests := []struct {
+		name    string
+		part    string // left by an earlier attempt, "" for none
+		stale   bool   // the client lists an older version of the file
+		rangeOf string // Range of the request, "" when there was none
+		err     string // part of the expected error, "" for success
+	}{
+		{"whole file", "", false, "", ""},
+		{"resume", content[:10], false, "bytes=10-", ""},
+		{"complete part", content, false, "", ""},
+		{"longer part", content + "tail", false, "", ""},
+		// The part does not belong to the file: the result is discarded
+		{"SHA-256 mismatch", "THE QUICK ", false, "bytes=10-", "SHA-256 mismatch"},
+		// The file changed since it was listed: If-Range fails and the
+		// server sends the new version, which does not match the listing
+		{"changed file", content[:10], true, "bytes=10-", "file changed on the server"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c := newTestClient(t, s)
+
+			name := filepath.Join(t.TempDir(), "fox.txt")
+			if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.upload(name, uploadOptions{chunkSize: 1 << 20, retries: 1}); err != nil {
+				t.Fatal(err)
+			}
+			meta := s.uploaded(t)
+			if tt.stale {
+				listed := *meta
+				listed.SHA256 = sha256Hex("an older version")
+				meta = &listed
+			}
+
+			target := filepath.Join(t.TempDir(), "out", "fox.txt")
+			if tt.part != "" {
+				if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(target+".part", []byte(tt.part), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := c.download(meta, target, 1)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("download: %v, want %q", err, tt.err)
+			}
+			_, ranges, ifRanges := s.requests()
+			if strings.Join(ranges, ",") != tt.rangeOf {
+				t.Errorf("ranges %q, want %q", ranges, tt.rangeOf)
+			}
+			if tt.rangeOf != "" && ifRanges[0] != `"`+meta.SHA256+`"` {
+				t.Errorf("If-Range %q", ifRanges[0])
+			}
+
+			data, rerr := os.ReadFile(target)
+			if tt.err != "" {
+				if rerr == nil {
+					t.Errorf("failed download left %q", data)
+				}
+				return
+			}
+			if rerr != nil || string(data) != content {
+				t.Errorf("downloaded %q, %v", data, rerr)
+			}
+			if _, err := os.Stat(target + ".part"); !os.IsNotExist(err) {
+				t.Errorf("part file left: %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadAfterMismatch(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	content := "checked content"
+
+	name := filepath.Join(t.TempDir(), "checked.txt")
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.upload(name, uploadOptions{chunkSize: 1 << 20, retries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	meta := s.uploaded(t)
+
+	target := filepath.Join(t.TempDir(), "checked.txt")
+	if err := os.WriteFile(target+".part", []byte("CHECKED"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.download(meta, target, 1); err == nil || !strings.Contains(err.Error(), "SHA-256 mismatch") {
+		t.Fatalf("corrupt part: %v", err)
+	}
+	// The corrupt part is removed, so the next attempt starts over
+	if _, err := os.Stat(target + ".part"); !os.IsNotExist(err) {
+		t.Fatalf("corrupt part kept: %v", err)
+	}
+	if err := c.download(meta, target, 1); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != content {
+		t.Errorf("downloaded %q", data)
+	}
+	_, ranges, _ := s.requests()
+	if last := ranges[len(ranges)-1]; last != "" {
+		t.Errorf("retry asked for range %q", last)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+)
+
+func runDownload(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	open := common(fs)
+	output := fs.String("o", ".", "Target folder, or file name when downloading one file")
+	retries := fs.Int("retries", 5, "Attempts before giving up")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("no file IDs given")
+	}
+	if *retries <= 0 {
+		return errors.New("-retries must be positive")
+	}
+	c, err := open()
+	if err != nil {
+		return err
+	}
+
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*catalog.FileMeta, len(files))
+	for _, meta := range files {
+		byID[meta.ID] = meta
+	}
+
+	for _, id := range fs.Args() {
+		meta := byID[id]
+		if meta == nil {
+			return fmt.Errorf("%s: file not found", id)
+		}
+
+		target := *output
+		if info, err := os.Stat(target); (err == nil && info.IsDir()) || fs.NArg() > 1 || strings.HasSuffix(target, string(os.PathSeparator)) {
+			target = filepath.Join(target, filepath.Base(filepath.FromSlash(meta.Name)))
+		}
+		if err := c.download(meta, target, *retries); err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// download fetches a file into target. Data is written to target.part
+// first; a partial file left by an interrupted download is resumed with a
+// range request. The SHA-256 of the result is checked before it is renamed
+// into place.
+func (c *client) download(meta *catalog.FileMeta, target string, retries int) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	part := target + ".part"
+
+	failures := 0
+	for {
+		done, err := c.fetchRange(meta, part)
+		if err == nil && done {
+			break
+		}
+		failures++
+		if failures >= retries {
+			fmt.Fprintln(os.Stderr)
+			if err == nil {
+				err = errors.New("download incomplete")
+			}
+			return fmt.Errorf("download failed, run the command again to resume: %w", err)
+		}
+		time.Sleep(time.Duration(failures) * time.Second)
+	}
+	fmt.Fprintln(os.Stderr)
+
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return err
+	}
+	if meta.SHA256 != "" && sum != meta.SHA256 {
+		os.Remove(part)
+		return fmt.Errorf("SHA-256 mismatch: got %s, want %s", sum, meta.SHA256)
+	}
+	if err := os.Rename(part, target); err != nil {
+		return err
+	}
+	if meta.Modified != nil {
+		os.Chtimes(target, *meta.Modified, *meta.Modified)
+	}
+
+	fmt.Printf("Downloaded %s (%d bytes, sha256 %s)\n", target, meta.Size, sum)
+	return nil
+}
+
+// fetchRange appends what is missing from part and reports whether the
+// file is complete
+func (c *client) fetchRange(meta *catalog.FileMeta, part string) (bool, error) {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if offset > meta.Size {
+		// Left over from a different version of the file
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		offset, _ = f.Seek(0, io.SeekStart)
+	}
+	if offset == meta.Size {
+		return true, nil
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// Only resume when the file is still the same
+		header.Set("If-Range", `"`+meta.SHA256+`"`)
+	}
+	resp, err := c.request(http.MethodGet, "/files/"+meta.ID, nil, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server sent the whole file
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	default:
+		return false, responseError(resp)
+	}
+
+	if want := reprSHA256(resp.Header.Get("Repr-Digest")); want != "" && meta.SHA256 != "" && want != meta.SHA256 {
+		return false, errors.New("file changed on the server while downloading")
+	}
+
+	w := &progressWriter{w: f, name: filepath.Base(part), done: offset, total: meta.Size}
+	n, err := io.CopyBuffer(w, resp.Body, make([]byte, 1<<20))
+	return offset+n == meta.Size, err
+}
+
+// reprSHA256 returns the hex SHA-256 from a Repr-Digest header
+func reprSHA256(header string) string {
+	for _, field := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || name != "sha-256" {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.Trim(value, ":"))
+		if err != nil {
+			return ""
+		}
+		return hex.EncodeToString(sum)
+	}
+	return ""
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressWriter prints how much of a download has arrived
+type progressWriter struct {
+	w     io.Writer
+	name  string
+	done  int64
+	total int64
+	last  time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= 200*time.Millisecond || p.done == p.total {
+		p.last = now
+		fmt.Fprintf(os.Stderr, "\r%s: %d%%", strings.TrimSuffix(p.name, ".part"), percent(p.done, p.total))
+	}
+	return n, err
+}
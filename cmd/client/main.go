@@ -0,0 +1,350 @@
+// Command client talks to an EasySync server from scripts: it pairs with the
+// server, uploads files over TUS and downloads them with resume, lists files
+// and sends chat messages.
+//
+//	client discover
+//	client pair -server http://192.168.1.20:3280 -pairing-token TOKEN
+//	client upload build/app.apk
+//	client list
+//	client download -o out/ <file-id>
+//	client chat "build 142 is ready"
+//
+// The server address and device token are saved by pair in the client state
+// file and can be overridden with -server and -token or the EASYSYNC_SERVER
+// and EASYSYNC_TOKEN environment variables.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/discovery"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: client <command> [flags] [arguments]
+
+Commands:
+  discover   find servers on the local network
+  pair       pair this machine with a server
+  upload     upload files, resuming interrupted uploads
+  download   download files by ID, resuming partial downloads
+  list       list the files on the server
+  chat       send chat messages, or print incoming ones with -listen
+
+Run "client <command> -h" for the flags of a command.
+`
+
+// state is what the client keeps between runs
+type state struct {
+	Server     string            `json:"server"`
+	Token      string            `json:"token"`
+	DeviceID   string            `json:"device_id"`
+	DeviceName string            `json:"device_name"`
+	Uploads    map[string]string `json:"uploads,omitempty"` // unfinished uploads, file key to upload URL
+
+	path string
+}
+
+func defaultStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "easysync", "client.json")
+}
+
+func loadState(path string) (*state, error) {
+	st := &state{path: path, Uploads: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if st.Uploads == nil {
+		st.Uploads = make(map[string]string)
+	}
+	return st, nil
+}
+
+func (st *state) save() error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// client is a paired connection to a server
+type client struct {
+	server string // base URL without trailing slash
+	token  string
+	http   *http.Client
+	state  *state
+}
+
+// common registers the flags every command accepts and returns a function
+// that opens the client once the flags are parsed
+func common(fs *flag.FlagSet) func() (*client, error) {
+	statePath := fs.String("state", defaultStatePath(), "Client state file")
+	server := fs.String("server", os.Getenv("EASYSYNC_SERVER"), "Server URL, like http://192.168.1.20:3280")
+	token := fs.String("token", os.Getenv("EASYSYNC_TOKEN"), "Device token")
+
+	return func() (*client, error) {
+		st, err := loadState(*statePath)
+		if err != nil {
+			return nil, err
+		}
+		c := &client{server: st.Server, token: st.Token, http: &http.Client{}, state: st}
+		if *server != "" {
+			c.server = *server
+		}
+		if *token != "" {
+			c.token = *token
+		}
+		c.server = strings.TrimRight(c.server, "/")
+		if c.server == "" {
+			return nil, errors.New("no server: run pair or pass -server")
+		}
+		return c, nil
+	}
+}
+
+// request sends an authenticated request to the server
+func (c *client) request(method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// url resolves path against the server; absolute URLs are kept
+func (c *client) url(path string) string {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return c.server + path
+}
+
+// getJSON fetches path and decodes the JSON response into v
+func (c *client) getJSON(path string, v interface{}) error {
+	resp, err := c.request(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError turns an unexpected response into an error, using the error
+// message of the server when there is one
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, body.Error)
+	}
+	if text := strings.TrimSpace(string(data)); text != "" {
+		return fmt.Errorf("%s: %s", resp.Status, text)
+	}
+	return errors.New(resp.Status)
+}
+
+// files returns the files on the server
+func (c *client) files() ([]*catalog.FileMeta, error) {
+	var list struct {
+		Files []*catalog.FileMeta `json:"files"`
+	}
+	if err := c.getJSON("/api/files", &list); err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func([]string) error{
+		"discover": runDiscover,
+		"pair":     runPair,
+		"upload":   runUpload,
+		"download": runDownload,
+		"list":     runList,
+		"chat":     runChat,
+	}
+
+	name, args := os.Args[1], os.Args[2:]
+	if name == "-h" || name == "-help" || name == "--help" || name == "help" {
+		fmt.Print(usage)
+		return
+	}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "client: unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err := run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "client %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func runDiscover(args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "How long to listen for servers")
+	fs.Parse(args)
+
+	cfg := config.DefaultConfig()
+	cfg.MDNS.Enabled = true
+	// Servers announcing the same name as this machine are skipped by the
+	// browser, so browse under a name of our own
+	cfg.MDNS.DeviceName = "easysync-client-" + uuid.New().String()[:8]
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	mdns := discovery.NewMDnsDiscovery(cfg, logger)
+	services, err := mdns.DiscoverServices(*timeout)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		fmt.Fprintln(os.Stderr, "No servers found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL")
+	for _, service := range services {
+		fmt.Fprintf(w, "%s\t%s\n", service.DeviceName, mdns.GetServiceURL(service))
+	}
+	return w.Flush()
+}
+
+func runPair(args []string) error {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	open := common(fs)
+	pairingToken := fs.String("pairing-token", "", "Pairing token shown by the server (required)")
+	hostname, _ := os.Hostname()
+	deviceName := fs.String("name", hostname, "Device name shown to other devices")
+	fs.Parse(args)
+
+	if *pairingToken == "" {
+		return errors.New("-pairing-token is required")
+	}
+	c, err := open()
+	if err != nil {
+		return err
+	}
+
+	deviceID := c.state.DeviceID
+	if deviceID == "" {
+		deviceID = uuid.New().String()
+	}
+	body, err := json.Marshal(map[string]string{
+		"token":       *pairingToken,
+		"device_id":   deviceID,
+		"device_name": *deviceName,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Post(c.url("/api/pair"), "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var paired struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&paired); err != nil {
+		return err
+	}
+
+	c.state.Server = c.server
+	c.state.Token = paired.Token
+	c.state.DeviceID = deviceID
+	c.state.DeviceName = *deviceName
+	if err := c.state.save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Paired with %s as %q, token valid for %s\n", c.server, *deviceName, time.Duration(paired.ExpiresIn)*time.Second)
+	return nil
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	open := common(fs)
+	asJSON := fs.Bool("json", false, "Print the file metadata as JSON")
+	fs.Parse(args)
+
+	c, err := open()
+	if err != nil {
+		return err
+	}
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(files)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSIZE\tCREATED\tPATH")
+	for _, meta := range files {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", meta.ID, meta.Size, meta.Created.Local().Format("2006-01-02 15:04"), meta.Path)
+	}
+	return w.Flush()
+}
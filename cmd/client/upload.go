@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tusVersion = "1.0.0"
+
+// uploadOptions apply to every file of an upload command
+type uploadOptions struct {
+	folder    string // folder on the server, sent as the relative path
+	chunkSize int64
+	retries   int
+}
+
+func runUpload(args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	open := common(fs)
+	folder := fs.String("folder", "", "Folder on the server to upload into")
+	chunkMB := fs.Int("chunk", 8, "Size of each upload request in MB")
+	retries := fs.Int("retries", 5, "Attempts per chunk before giving up")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("no files given")
+	}
+	if *chunkMB <= 0 || *retries <= 0 {
+		return errors.New("-chunk and -retries must be positive")
+	}
+	c, err := open()
+	if err != nil {
+		return err
+	}
+
+	opts := uploadOptions{folder: *folder, chunkSize: int64(*chunkMB) << 20, retries: *retries}
+	for _, name := range fs.Args() {
+		if err := c.upload(name, opts); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// upload sends one file with the TUS protocol. The upload URL is kept in the
+// state file until the upload completes, so running the command again
+// resumes where an interrupted upload stopped.
+func (c *client) upload(name string, opts uploadOptions) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("is a directory")
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s|%s|%d|%d", c.server, abs, info.Size(), info.ModTime().UnixNano())
+
+	location, offset := "", int64(0)
+	if saved := c.state.Uploads[key]; saved != "" {
+		if offset, err = c.uploadOffset(saved); err == nil {
+			location = saved
+			fmt.Fprintf(os.Stderr, "Resuming %s at %d of %d bytes\n", name, offset, info.Size())
+		} else {
+			delete(c.state.Uploads, key)
+		}
+	}
+	if location == "" {
+		if location, err = c.createUpload(info, opts.folder); err != nil {
+			return err
+		}
+		c.state.Uploads[key] = location
+		if err := c.state.save(); err != nil {
+			return err
+		}
+	}
+
+	failures := 0
+	// Empty files are complete once created
+	for offset < info.Size() {
+		n := min(opts.chunkSize, info.Size()-offset)
+		next, err := c.patch(location, io.NewSectionReader(f, offset, n), offset, n)
+		if err == nil {
+			offset, failures = next, 0
+			fmt.Fprintf(os.Stderr, "\r%s: %d%%", filepath.Base(name), percent(offset, info.Size()))
+			continue
+		}
+
+		failures++
+		if failures >= opts.retries {
+			fmt.Fprintln(os.Stderr)
+			return fmt.Errorf("upload failed, run the command again to resume: %w", err)
+		}
+		time.Sleep(time.Duration(failures) * time.Second)
+		// Ask the server how much it has before sending more
+		if current, herr := c.uploadOffset(location); herr == nil {
+			offset = current
+		}
+	}
+	if info.Size() > 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+
+	delete(c.state.Uploads, key)
+	if err := c.state.save(); err != nil {
+		return err
+	}
+	fmt.Printf("Uploaded %s (%d bytes)\n", name, info.Size())
+	return nil
+}
+
+// createUpload starts a TUS upload and returns its URL
+func (c *client) createUpload(info os.FileInfo, folder string) (string, error) {
+	metadata := map[string]string{
+		"filename": info.Name(),
+		"mtime":    strconv.FormatInt(info.ModTime().Unix(), 10),
+	}
+	if typ := mime.TypeByExtension(filepath.Ext(info.Name())); typ != "" {
+		metadata["filetype"] = typ
+	}
+	if folder != "" {
+		metadata["relativePath"] = path.Join(filepath.ToSlash(folder), info.Name())
+	}
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Upload-Length", strconv.FormatInt(info.Size(), 10))
+	header.Set("Upload-Metadata", strings.Join(pairs, ","))
+
+	resp, err := c.request(http.MethodPost, "/tus/files/", nil, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("server returned no upload URL: %w", err)
+	}
+	return location.String(), nil
+}
+
+// uploadOffset asks the server how many bytes of an upload it has
+func (c *client) uploadOffset(location string) (int64, error) {
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+
+	resp, err := c.request(http.MethodHead, location, nil, header)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// patch sends n bytes at offset and returns the new offset
+func (c *client) patch(location string, body io.Reader, offset, n int64) (int64, error) {
+	header := http.Header{}
+	header.Set("Tus-Resumable", tusVersion)
+	header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	header.Set("Content-Type", "application/offset+octet-stream")
+
+	req, err := http.NewRequest(http.MethodPatch, c.url(location), body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header = header
+	req.ContentLength = n
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, responseError(resp)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+func percent(done, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	return done * 100 / total
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/thumbnail"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// adminName is recorded as the device name for files deleted from the
+// command line
+const adminName = "admin"
+
+// configFlag registers -config and returns a function loading the
+// configuration once the flags are parsed
+func configFlag(fs *flag.FlagSet) func() (*config.Config, error) {
+	path := fs.String("config", "", "Path to configuration file (YAML)")
+	return func() (*config.Config, error) {
+		return config.Load(*path)
+	}
+}
+
+// adminLogger keeps the output of commands to warnings and errors
+func adminLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	return logger
+}
+
+// openState loads the configuration and checks the data directory exists,
+// so a wrong -config does not quietly start an empty state
+func openState(load func() (*config.Config, error)) (*config.Config, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(cfg.Storage.DataDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("data directory %s not found, check -config", cfg.Storage.DataDir)
+	}
+	return cfg, nil
+}
+
+// dispatch runs one command of a group like "devices list"
+func dispatch(args []string, commands map[string]func([]string) error) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(args) == 0 {
+		return fmt.Errorf("missing command, one of: %s", strings.Join(names, ", "))
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q, one of: %s", args[0], strings.Join(names, ", "))
+	}
+	return run(args[1:])
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func runDevices(args []string) error {
+	return dispatch(args, map[string]func([]string) error{
+		"list":   runDevicesList,
+		"revoke": runDevicesRevoke,
+	})
+}
+
+func runDevicesList(args []string) error {
+	fs := flag.NewFlagSet("devices list", flag.ExitOnError)
+	load := configFlag(fs)
+	asJSON := fs.Bool("json", false, "Print the devices as JSON")
+	fs.Parse(args)
+
+	cfg, err := openState(load)
+	if err != nil {
+		return err
+	}
+	auth, err := security.NewAuthService(cfg, adminLogger())
+	if err != nil {
+		return err
+	}
+	devices, err := auth.ListDevices()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(devices)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPAIRED\tLAST SEEN")
+	for _, device := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", device.ID, device.Name, formatTime(device.Created), formatTime(device.LastSeen))
+	}
+	return w.Flush()
+}
+
+func runDevicesRevoke(args []string) error {
+	fs := flag.NewFlagSet("devices revoke", flag.ExitOnError)
+	load := configFlag(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("no device IDs given")
+	}
+	cfg, err := openState(load)
+	if err != nil {
+		return err
+	}
+	auth, err := security.NewAuthService(cfg, adminLogger())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range fs.Args() {
+		if err := auth.RemoveDevice(id); err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		fmt.Printf("Revoked %s\n", id)
+	}
+	fmt.Println("Tokens of revoked devices are rejected from now on; run \"pair new-token\" so they cannot pair again.")
+	return nil
+}
+
+func runPair(args []string) error {
+	return dispatch(args, map[string]func([]string) error{
+		"new-token": runPairNewToken,
+	})
+}
+
+func runPairNewToken(args []string) error {
+	fs := flag.NewFlagSet("pair new-token", flag.ExitOnError)
+	load := configFlag(fs)
+	fs.Parse(args)
+
+	cfg, err := openState(load)
+	if err != nil {
+		return err
+	}
+	auth, err := security.NewAuthService(cfg, adminLogger())
+	if err != nil {
+		return err
+	}
+
+	token, err := auth.RotatePairingToken()
+	if err != nil {
+		return err
+	}
+	cfg.Security.PairingToken = token
+	if err := cfg.WritePairingInfo(cfg.GetAddr()); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+
+	fmt.Println(token)
+	return nil
+}
+
+func runFiles(args []string) error {
+	return dispatch(args, map[string]func([]string) error{
+		"list": runFilesList,
+		"rm":   runFilesRemove,
+		"gc":   runFilesGC,
+	})
+}
+
+func runFilesList(args []string) error {
+	fs := flag.NewFlagSet("files list", flag.ExitOnError)
+	load := configFlag(fs)
+	asJSON := fs.Bool("json", false, "Print the file metadata as JSON")
+	trash := fs.Bool("trash", false, "List the files in the trash instead")
+	fs.Parse(args)
+
+	cfg, err := openState(load)
+	if err != nil {
+		return err
+	}
+	index, err := catalog.NewIndex(cfg, adminLogger())
+	if err != nil {
+		return err
+	}
+
+	if *trash {
+		entries, err := index.ListTrash()
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(entries)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSIZE\tDELETED\tBY\tPATH")
+		for _, entry := range entries {
+			by := entry.DeletedByName
+			if by == "" {
+				by = "-"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", entry.File.ID, entry.File.Size, formatTime(entry.Deleted), by, entry.File.Path)
+		}
+		return w.Flush()
+	}
+
+	files, err := index.List()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(files)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSIZE\tCREATED\tPATH")
+	for _, meta := range files {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", meta.ID, meta.Size, formatTime(meta.Created), meta.Path)
+	}
+	return w.Flush()
+}
+
+// fileStore is the part of the server that removes files
+type fileStore struct {
+	downloads *download.Handler
+	uploads   *upload.TusHandler
+}
+
+// openFiles wires the file handling like the server does, so removed files
+// take their thumbnails and stored content with them
+func openFiles(cfg *config.Config, logger *logrus.Logger) (*fileStore, error) {
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file index: %w", err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	uploads, err := upload.NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		return nil, err
+	}
+	thumbnails, err := thumbnail.NewService(cfg, logger, index, backend, uploads)
+	if err != nil {
+		return nil, err
+	}
+
+	downloads := download.NewHandler(cfg, logger, index, backend)
+	downloads.OnPurge(thumbnails.Remove)
+	return &fileStore{downloads: downloads, uploads: uploads}, nil
+}
+
+func runFilesRemove(args []string) error {
+	fs := flag.NewFlagSet("files rm", flag.ExitOnError)
+	load := configFlag(fs)
+	purge := fs.Bool("purge", false, "Remove the files for good instead of moving them to the trash; also empties them from the trash")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("no file IDs given")
+	}
+	cfg, err := openState(load)
+	if err != nil {
+		return err
+	}
+	files, err := openFiles(cfg, adminLogger())
+	if err != nil {
+		return err
+	}
+
+	for _, id := range fs.Args() {
+		err := files.downloads.DeleteFile(id, "", adminName)
+		if errors.Is(err, catalog.ErrNotFound) && *purge && cfg.Trash.Enabled {
+			// Purging also removes files that already are in the trash
+			err = nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+
+		if cfg.Trash.Enabled && !*purge {
+			fmt.Printf("Moved %s to the trash\n", id)
+			continue
+		}
+		if cfg.Trash.Enabled {
+			if err := files.downloads.PurgeFile(id); err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		fmt.Printf("Deleted %s\n", id)
+	}
+	return nil
+}
+
+func runFilesGC(args []string) error {
+	fs := flag.NewFlagSet("files gc", flag.ExitOnError)
+	load := configFlag(fs)
+	uploadAge := fs.Duration("uploads", 7*24*time.Hour, "Remove unfinished uploads idle for longer than this")
+	fs.Parse(args)
+
+	if *uploadAge <= 0 {
+		return errors.New("-uploads must be positive")
+	}
+	cfg, err := openState(load)
+	if err != nil {
+		return err
+	}
+	files, err := openFiles(cfg, adminLogger())
+	if err != nil {
+		return err
+	}
+
+	report, err := files.downloads.CollectGarbage(context.Background())
+	if err != nil {
+		return err
+	}
+	uploads, uploadBytes, err := files.uploads.RemoveStaleUploads(*uploadAge)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Trash: %d expired files purged\n", report.TrashPurged)
+	fmt.Printf("Content: %d stale references dropped, %d unused blobs removed (%d bytes)\n", report.BlobRefs, report.BlobsRemoved, report.BytesFreed)
+	fmt.Printf("Uploads: %d stale uploads removed (%d bytes)\n", uploads, uploadBytes)
+	return nil
+}
+
+func runConfig(args []string) error {
+	return dispatch(args, map[string]func([]string) error{
+		"validate":       runConfigValidate,
+		"print-defaults": runConfigPrintDefaults,
+	})
+}
+
+func runConfigValidate(args []string) error {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	load := configFlag(fs)
+	fs.Parse(args)
+
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, line)
+		}
+		return errors.New("configuration is invalid")
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+func runConfigPrintDefaults(args []string) error {
+	fs := flag.NewFlagSet("config print-defaults", flag.ExitOnError)
+	fs.Parse(args)
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(config.DefaultConfig()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// writeConfig writes a configuration with its storage in a temporary
+// directory, followed by extra YAML, and returns its path and the loaded
+// configuration
+func writeConfig(t *testing.T, extra string) (string, *config.Config) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, sub := range []string{"uploads", "data"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := fmt.Sprintf("storage:\n  upload_dir: %q\n  data_dir: %q\n%s", filepath.Join(dir, "uploads"), filepath.Join(dir, "data"), extra)
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, cfg
+}
+
+// captureStdout returns what run prints to standard output
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+
+	err = run()
+	w.Close()
+	os.Stdout = stdout
+	return <-output, err
+}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestDispatch(t *testing.T) {
+	commands := map[string]func([]string) error{
+		"list": func(args []string) error { return fmt.Errorf("list %v", args) },
+		"rm":   func([]string) error { return nil },
+	}
+
+	if err := dispatch(nil, commands); err == nil || !strings.Contains(err.Error(), "one of: list, rm") {
+		t.Errorf("missing command: %v", err)
+	}
+	if err := dispatch([]string{"purge"}, commands); err == nil || !strings.Contains(err.Error(), `unknown command "purge"`) {
+		t.Errorf("unknown command: %v", err)
+	}
+	if err := dispatch([]string{"list", "-json"}, commands); err == nil || err.Error() != "list [-json]" {
+		t.Errorf("list: %v", err)
+	}
+}
+
+func TestOpenStateMissingDataDir(t *testing.T) {
+	path, cfg := writeConfig(t, "")
+	if err := os.Remove(cfg.Storage.DataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := captureStdout(t, func() error { return runDevices([]string{"list", "-config", path}) }); err == nil || !strings.Contains(err.Error(), "check -config") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := os.Stat(cfg.Storage.DataDir); !os.IsNotExist(err) {
+		t.Error("data directory created")
+	}
+}
+
+func TestDevicesCommands(t *testing.T) {
+	path, cfg := writeConfig(t, "")
+	server, err := security.NewAuthService(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"phone-id", "laptop-id"} {
+		if _, err := server.CreateDevice(id, strings.TrimSuffix(id, "-id")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := server.GenerateDeviceToken("phone-id", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := captureStdout(t, func() error { return runDevices([]string{"list", "-config", path, "-json"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var devices []*security.Device
+	if err := json.Unmarshal([]byte(out), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].ID != "phone-id" || devices[1].ID != "laptop-id" {
+		t.Errorf("listed %s", out)
+	}
+
+	out, err = captureStdout(t, func() error { return runDevices([]string{"list", "-config", path}) })
+	if err != nil || !strings.HasPrefix(out, "ID") || !strings.Contains(out, "laptop-id") {
+		t.Errorf("table %q, %v", out, err)
+	}
+
+	// Revoking from the command line takes effect in the running server
+	out, err = captureStdout(t, func() error { return runDevices([]string{"revoke", "-config", path, "phone-id"}) })
+	if err != nil || !strings.HasPrefix(out, "Revoked phone-id\n") {
+		t.Fatalf("revoke: %q, %v", out, err)
+	}
+	if _, err := server.ValidateToken(token); err == nil {
+		t.Error("token of the revoked device accepted by the server")
+	}
+
+	_, err = captureStdout(t, func() error { return runDevices([]string{"revoke", "-config", path, "phone-id"}) })
+	if !errors.Is(err, security.ErrDeviceNotFound) {
+		t.Errorf("revoking again: %v", err)
+	}
+}
+
+func TestPairNewToken(t *testing.T) {
+	path, cfg := writeConfig(t, "")
+	server, err := security.NewAuthService(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := server.GetPairingToken()
+
+	out, err := captureStdout(t, func() error { return runPair([]string{"new-token", "-config", path}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimSpace(out)
+	if token == "" || token == old {
+		t.Fatalf("new token %q", token)
+	}
+	if server.ValidatePairingToken(old) || !server.ValidatePairingToken(token) {
+		t.Error("server did not pick up the new token")
+	}
+	info, err := os.ReadFile(filepath.Join(cfg.Storage.DataDir, cfg.Storage.PairingTokenFile))
+	if err != nil || !strings.Contains(string(info), token) {
+		t.Errorf("pairing info %q, %v", info, err)
+	}
+
+	path, _ = writeConfig(t, "security:\n  pairing_token: fixed\n")
+	_, err = captureStdout(t, func() error { return runPair([]string{"new-token", "-config", path}) })
+	if !errors.Is(err, security.ErrPairingTokenConfigured) {
+		t.Errorf("configured token: %v", err)
+	}
+}
+
+// storeFile stores content as a file of the index in cfg
+func storeFile(t *testing.T, cfg *config.Config, id, content string) {
+	t.Helper()
+	index, err := catalog.NewIndex(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.UploadDir, id+".txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta := &catalog.FileMeta{ID: id, Name: id + ".txt", Path: id + ".txt", Size: int64(len(content)), Created: time.Now()}
+	if err := index.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilesCommands(t *testing.T) {
+	path, cfg := writeConfig(t, "trash:\n  enabled: true\n")
+	storeFile(t, cfg, "report", "numbers")
+	storeFile(t, cfg, "notes", "text")
+
+	list := func(args ...string) []string {
+		t.Helper()
+		out, err := captureStdout(t, func() error { return runFiles(append([]string{"list", "-config", path}, args...)) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+			ids = append(ids, strings.Fields(line)[0])
+		}
+		return ids
+	}
+	if ids := list(); len(ids) != 2 {
+		t.Errorf("files %v", ids)
+	}
+
+	out, err := captureStdout(t, func() error { return runFiles([]string{"rm", "-config", path, "report"}) })
+	if err != nil || out != "Moved report to the trash\n" {
+		t.Fatalf("rm: %q, %v", out, err)
+	}
+	if ids := list(); len(ids) != 1 || ids[0] != "notes" {
+		t.Errorf("files after rm %v", ids)
+	}
+	if ids := list("-trash"); len(ids) != 1 || ids[0] != "report" {
+		t.Errorf("trash %v", ids)
+	}
+
+	// Purging also removes files already in the trash
+	out, err = captureStdout(t, func() error { return runFiles([]string{"rm", "-config", path, "-purge", "report", "notes"}) })
+	if err != nil || out != "Deleted report\nDeleted notes\n" {
+		t.Fatalf("rm -purge: %q, %v", out, err)
+	}
+	if ids := list("-trash"); len(ids) != 0 {
+		t.Errorf("trash after purge %v", ids)
+	}
+	for _, id := range []string{"report", "notes"} {
+		if _, err := os.Stat(filepath.Join(cfg.Storage.UploadDir, id+".txt")); !os.IsNotExist(err) {
+			t.Errorf("%s still stored: %v", id, err)
+		}
+	}
+
+	_, err = captureStdout(t, func() error { return runFiles([]string{"rm", "-config", path, "missing"}) })
+	if !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("rm of an unknown file: %v", err)
+	}
+
+	out, err = captureStdout(t, func() error { return runFiles([]string{"gc", "-config", path}) })
+	if err != nil || !strings.HasPrefix(out, "Trash: 0 expired files purged\n") || !strings.Contains(out, "Uploads: 0 stale uploads removed") {
+		t.Errorf("gc: %q, %v", out, err)
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	path, _ := writeConfig(t, "")
+	out, err := captureStdout(t, func() error { return runConfig([]string{"validate", "-config", path}) })
+	if err != nil || out != "Configuration is valid\n" {
+		t.Errorf("validate: %q, %v", out, err)
+	}
+
+	path, _ = writeConfig(t, "server:\n  port: 70000\n")
+	if _, err := captureStdout(t, func() error { return runConfig([]string{"validate", "-config", path}) }); err == nil {
+		t.Error("invalid port accepted")
+	}
+
+	out, err = captureStdout(t, func() error { return runConfig([]string{"print-defaults"}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := &config.Config{}
+	if err := yaml.Unmarshal([]byte(out), printed); err != nil {
+		t.Fatal(err)
+	}
+	defaults := config.DefaultConfig()
+	if printed.Server.Port != defaults.Server.Port || printed.TUS.BasePath != defaults.TUS.BasePath || printed.Validate() != nil {
+		t.Errorf("printed defaults %+v", printed.Server)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+)
+
+// certWarnPeriod is how long before a certificate expires doctor warns
+const certWarnPeriod = 30 * 24 * time.Hour
+
+// checkup collects the results of doctor
+type checkup struct {
+	failures int
+	warnings int
+}
+
+func (c *checkup) ok(format string, args ...interface{}) {
+	fmt.Printf("ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *checkup) warn(format string, args ...interface{}) {
+	c.warnings++
+	fmt.Printf("warn  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *checkup) fail(format string, args ...interface{}) {
+	c.failures++
+	fmt.Printf("FAIL  %s\n", fmt.Sprintf(format, args...))
+}
+
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML)")
+	fs.Parse(args)
+
+	c := &checkup{}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		c.fail("configuration: %v", err)
+		return errors.New("the configuration does not load")
+	}
+
+	c.checkConfig(cfg, *configPath)
+	c.checkDirectory("upload directory", cfg.Storage.UploadDir)
+	c.checkDirectory("data directory", cfg.Storage.DataDir)
+	c.checkPrivate("auth state", filepath.Join(cfg.Storage.DataDir, security.StateFileName))
+	c.checkPort(cfg)
+	if cfg.Server.HTTPS {
+		c.checkCertificate(cfg)
+	}
+
+	switch {
+	case c.failures > 0:
+		return fmt.Errorf("problems found: %d", c.failures)
+	case c.warnings > 0:
+		fmt.Printf("\nWarnings: %d\n", c.warnings)
+	default:
+		fmt.Println("\nNo problems found")
+	}
+	return nil
+}
+
+func (c *checkup) checkConfig(cfg *config.Config, path string) {
+	source := "defaults and environment"
+	if path != "" {
+		source = path
+	}
+	if err := cfg.Validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			c.fail("configuration: %s", line)
+		}
+	} else {
+		c.ok("configuration from %s is valid", source)
+	}
+
+	// A configuration holding secrets should not be readable by everyone
+	secrets := cfg.Security.JWTSecret != "" || cfg.Security.PairingToken != "" || cfg.Storage.S3.SecretKey != ""
+	if path != "" && secrets {
+		c.checkPrivate("configuration file", path)
+	}
+}
+
+// checkDirectory checks a directory exists, or can be created, and is writable
+func (c *checkup) checkDirectory(name, dir string) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(dir)
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if err := writable(parent); err != nil {
+			c.fail("%s %s does not exist and cannot be created: %v", name, dir, err)
+			return
+		}
+		c.warn("%s %s does not exist yet, it is created on start", name, dir)
+		return
+	}
+	if err != nil {
+		c.fail("%s %s: %v", name, dir, err)
+		return
+	}
+	if !info.IsDir() {
+		c.fail("%s %s is not a directory", name, dir)
+		return
+	}
+	if err := writable(dir); err != nil {
+		c.fail("%s %s is not writable: %v", name, dir, err)
+		return
+	}
+	c.ok("%s %s is writable", name, dir)
+}
+
+func writable(dir string) error {
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkPrivate warns when a file holding secrets is readable by others
+func (c *checkup) checkPrivate(name, path string) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		c.fail("%s %s: %v", name, path, err)
+		return
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		c.warn("%s %s holds secrets but has mode %s, run chmod 600", name, path, info.Mode().Perm())
+		return
+	}
+	c.ok("%s %s is only accessible by its owner", name, path)
+}
+
+// checkPort checks the configured address is free, or taken by a running
+// server
+func (c *checkup) checkPort(cfg *config.Config) {
+	addr := cfg.GetAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		ln.Close()
+		c.ok("address %s is free", addr)
+		return
+	}
+	if runningServer(cfg) {
+		c.ok("address %s is used by a running server", addr)
+		return
+	}
+	c.warn("address %s is unavailable (%v), the server falls back to ports %d-%d or a random port", addr, err, cfg.Server.Port+1, cfg.Server.Port+2)
+}
+
+// runningServer reports whether the configured port answers health checks
+func runningServer(cfg *config.Config) bool {
+	scheme := "http"
+	if cfg.Server.HTTPS {
+		scheme = "https"
+	}
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		// Only asking whether it is our server, the certificate is checked separately
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Get(fmt.Sprintf("%s://127.0.0.1:%d/health", scheme, cfg.Server.Port))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// checkCertificate checks the certificate and key load and the certificate
+// is valid for a while
+func (c *checkup) checkCertificate(cfg *config.Config) {
+	if cfg.Server.CertFile == "" || cfg.Server.KeyFile == "" {
+		// Reported by the configuration check
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(cfg.Server.CertFile, cfg.Server.KeyFile)
+	if err != nil {
+		c.fail("certificate: %v", err)
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		c.fail("certificate %s: %v", cfg.Server.CertFile, err)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		c.fail("certificate %s is not valid before %s", cfg.Server.CertFile, cert.NotBefore.Local().Format(time.DateTime))
+	case now.After(cert.NotAfter):
+		c.fail("certificate %s expired on %s", cfg.Server.CertFile, cert.NotAfter.Local().Format(time.DateTime))
+	case cert.NotAfter.Sub(now) < certWarnPeriod:
+		c.warn("certificate %s expires on %s", cfg.Server.CertFile, cert.NotAfter.Local().Format(time.DateTime))
+	default:
+		c.ok("certificate %s for %s is valid until %s", cfg.Server.CertFile, certNames(cert), cert.NotAfter.Local().Format(time.DateTime))
+	}
+
+	c.checkPrivate("private key", cfg.Server.KeyFile)
+}
+
+func certNames(cert *x509.Certificate) string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		return cert.Subject.CommonName
+	}
+	return strings.Join(names, ", ")
+}
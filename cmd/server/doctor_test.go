@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+)
+
+// run returns the failures and warnings of one check
+func run(t *testing.T, check func(c *checkup)) (int, int) {
+	t.Helper()
+	c := &checkup{}
+	if _, err := captureStdout(t, func() error { check(c); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return c.failures, c.warnings
+}
+
+func TestCheckDirectory(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		failures int
+		warnings int
+	}{
+		{"writable", dir, 0, 0},
+		{"created on start", filepath.Join(dir, "new", "data"), 0, 1},
+		{"not a directory", file, 1, 0},
+		{"below a file", filepath.Join(file, "data"), 1, 0},
+	}
+	for _, tt := range tests {
+		failures, warnings := run(t, func(c *checkup) { c.checkDirectory("data directory", tt.dir) })
+		if failures != tt.failures || warnings != tt.warnings {
+			t.Errorf("%s: %d failures and %d warnings, want %d and %d", tt.name, failures, warnings, tt.failures, tt.warnings)
+		}
+	}
+}
+
+func TestCheckPrivate(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		mode     os.FileMode // 0 for a missing file
+		warnings int
+	}{
+		{0600, 0},
+		{0640, 1},
+		{0644, 1},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "state-"+strconv.Itoa(int(tt.mode)))
+		if tt.mode != 0 {
+			if err := os.WriteFile(path, nil, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		failures, warnings := run(t, func(c *checkup) { c.checkPrivate("auth state", path) })
+		if failures != 0 || warnings != tt.warnings {
+			t.Errorf("mode %s: %d failures and %d warnings, want %d warnings", tt.mode, failures, warnings, tt.warnings)
+		}
+	}
+}
+
+func TestCheckPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := config.DefaultConfig()
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = ln.Addr().(*net.TCPAddr).Port
+
+	// Taken by something that is not the server
+	if failures, warnings := run(t, func(c *checkup) { c.checkPort(cfg) }); failures != 0 || warnings != 1 {
+		t.Errorf("taken port: %d failures and %d warnings", failures, warnings)
+	}
+
+	// Taken by a running server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	defer server.Close()
+	if failures, warnings := run(t, func(c *checkup) { c.checkPort(cfg) }); failures != 0 || warnings != 0 {
+		t.Errorf("running server: %d failures and %d warnings", failures, warnings)
+	}
+
+	// Free
+	server.Close()
+	if failures, warnings := run(t, func(c *checkup) { c.checkPort(cfg) }); failures != 0 || warnings != 0 {
+		t.Errorf("free port: %d failures and %d warnings", failures, warnings)
+	}
+}
+
+// writeCertificate writes a self-signed certificate valid from notBefore to
+// notAfter and its key, and returns their paths
+func writeCertificate(t *testing.T, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "easysync.local"},
+		DNSNames:     []string{"easysync.local"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCheckCertificate(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	_, otherKey := writeCertificate(t, now.Add(-day), now.Add(365*day))
+
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		wrongKey  bool
+		failures  int
+		warnings  int
+	}{
+		{"valid", now.Add(-day), now.Add(365 * day), false, 0, 0},
+		{"expiring soon", now.Add(-day), now.Add(10 * day), false, 0, 1},
+		{"expired", now.Add(-365 * day), now.Add(-day), false, 1, 0},
+		{"not yet valid", now.Add(day), now.Add(365 * day), false, 1, 0},
+		{"key of another certificate", now.Add(-day), now.Add(365 * day), true, 1, 0},
+	}
+	for _, tt := range tests {
+		cfg := config.DefaultConfig()
+		cfg.Server.HTTPS = true
+		cfg.Server.CertFile, cfg.Server.KeyFile = writeCertificate(t, tt.notBefore, tt.notAfter)
+		if tt.wrongKey {
+			cfg.Server.KeyFile = otherKey
+		}
+
+		failures, warnings := run(t, func(c *checkup) { c.checkCertificate(cfg) })
+		if failures != tt.failures || warnings != tt.warnings {
+			t.Errorf("%s: %d failures and %d warnings, want %d and %d", tt.name, failures, warnings, tt.failures, tt.warnings)
+		}
+	}
+}
+
+func TestRunDoctor(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	server := "server:\n  host: 127.0.0.1\n  port: " + strconv.Itoa(port) + "\n"
+
+	path, _ := writeConfig(t, server)
+	if out, err := captureStdout(t, func() error { return runDoctor([]string{"-config", path}) }); err != nil {
+		t.Errorf("healthy setup: %v\n%s", err, out)
+	}
+
+	// A configuration holding secrets readable by others is a warning
+	path, _ = writeConfig(t, server+"security:\n  jwt_secret: secret\n")
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := captureStdout(t, func() error { return runDoctor([]string{"-config", path}) })
+	if err != nil || !strings.Contains(out, "warn  configuration file "+path+" holds secrets") {
+		t.Errorf("readable configuration: %v\n%s", err, out)
+	}
+
+	path, cfg := writeConfig(t, server)
+	if err := os.Remove(cfg.Storage.UploadDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.Storage.UploadDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := captureStdout(t, func() error { return runDoctor([]string{"-config", path}) }); err == nil {
+		t.Error("upload directory that is a file passed")
+	}
+
+	if _, err := captureStdout(t, func() error { return runDoctor([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}) }); err == nil {
+		t.Error("missing configuration passed")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,11 +16,71 @@ import (
 	"github.com/easy-sync/easy-sync/pkg/discovery"
 )
 
+const usage = `Usage: server [command] [flags] [arguments]
+
+Commands:
+  serve                     run the server (the default)
+  devices list              list the paired devices
+  devices revoke <id>...    unpair devices and reject their tokens
+  pair new-token            replace the pairing token
+  files list                list the stored files, or the trash with -trash
+  files rm <id>...          delete files, into the trash unless -purge
+  files gc                  purge expired trash, unused content and stale uploads
+  config validate           check the configuration
+  config print-defaults     print the default configuration as YAML
+  doctor                    check ports, directories, permissions and certificates
+
+The commands other than serve work on the state in storage.data_dir and can
+run while the server is running. Every command accepts -config.
+`
+
 func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		// Flags only, as before there were commands
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+			fmt.Print(usage)
+			return
+		}
+		runServe(args)
+		return
+	}
+
+	commands := map[string]func([]string) error{
+		"devices": runDevices,
+		"pair":    runPair,
+		"files":   runFiles,
+		"config":  runConfig,
+		"doctor":  runDoctor,
+	}
+
+	name := args[0]
+	switch name {
+	case "serve":
+		runServe(args[1:])
+		return
+	case "help":
+		fmt.Print(usage)
+		return
+	}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "server: unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+	if err := run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "server %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// runServe starts the server and blocks until it is stopped by a signal
+func runServe(args []string) {
 	// Parse command-line flags
-	configPath := flag.String("config", "", "Path to configuration file (YAML)")
-	showVersion := flag.Bool("version", false, "Show version information")
-	flag.Parse()
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to configuration file (YAML)")
+	showVersion := fs.Bool("version", false, "Show version information")
+	fs.Parse(args)
 
 	// Show version if requested
 	if *showVersion {
@@ -0,0 +1,229 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BatchDirName is the directory inside the index holding batch records
+const BatchDirName = "batches"
+
+// Batch states
+const (
+	BatchInProgress = "in_progress"
+	BatchCompleted  = "completed"
+)
+
+// Batch groups the uploads of one transfer, such as a folder sent from a
+// phone, so the receiver can treat them as a single item
+type Batch struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Device        string    `json:"device"`
+	DeviceID      string    `json:"device_id,omitempty"` // paired device that started the transfer, unset without a device token
+	Root          string    `json:"root,omitempty"`      // folder inside the upload directory, forward slashes
+	FileCount     int       `json:"file_count"`
+	TotalSize     int64     `json:"total_size"`
+	ExpectedFiles int       `json:"expected_files,omitempty"`
+	ExpectedSize  int64     `json:"expected_size,omitempty"`
+	Pending       int       `json:"pending"`
+	Files         []string  `json:"files"`
+	State         string    `json:"state"`
+	Label         string    `json:"label"`
+	Created       time.Time `json:"created"`
+	Updated       time.Time `json:"updated"`
+}
+
+var batchIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidBatchID reports whether id may be used as a batch ID
+func ValidBatchID(id string) bool {
+	return batchIDPattern.MatchString(id)
+}
+
+// updateState derives the batch state and label from its counters. Without
+// an expected file count a batch counts as completed whenever no upload of
+// it is in flight.
+func (b *Batch) updateState() {
+	if b.Pending > 0 || (b.ExpectedFiles > 0 && b.FileCount < b.ExpectedFiles) {
+		b.State = BatchInProgress
+	} else {
+		b.State = BatchCompleted
+	}
+	b.Label = b.label()
+}
+
+// label returns a short description such as "Photos/2026-10 (143 files)"
+func (b *Batch) label() string {
+	name := b.Name
+	if name == "" {
+		name = b.ID
+	}
+	if b.FileCount == 1 {
+		return fmt.Sprintf("%s (1 file)", name)
+	}
+	return fmt.Sprintf("%s (%d files)", name, b.FileCount)
+}
+
+func (i *Index) batchPath(id string) string {
+	return filepath.Join(i.dir, BatchDirName, id+".json")
+}
+
+// GetBatch returns the batch record for id
+func (i *Index) GetBatch(id string) (*Batch, error) {
+	if !ValidBatchID(id) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.loadBatch(id)
+}
+
+func (i *Index) loadBatch(id string) (*Batch, error) {
+	data, err := os.ReadFile(i.batchPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var batch Batch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, fmt.Errorf("failed to parse batch: %w", err)
+	}
+	return &batch, nil
+}
+
+// UpdateBatch loads the batch record for id, creating it when missing,
+// applies fn and saves the result
+func (i *Index) UpdateBatch(id string, fn func(*Batch) error) (*Batch, error) {
+	if !ValidBatchID(id) {
+		return nil, fmt.Errorf("invalid batch ID %q", id)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	batch, err := i.loadBatch(id)
+	if err == ErrNotFound {
+		batch = &Batch{ID: id, Files: []string{}, Created: time.Now()}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := fn(batch); err != nil {
+		return nil, err
+	}
+	batch.updateState()
+	batch.Updated = time.Now()
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(i.batchPath(id)), 0755); err != nil {
+		return nil, err
+	}
+	tmp := i.batchPath(id) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, i.batchPath(id)); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// ListBatches returns all batch records, newest first
+func (i *Index) ListBatches() ([]*Batch, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries, err := os.ReadDir(filepath.Join(i.dir, BatchDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Batch{}, nil
+		}
+		return nil, err
+	}
+
+	batches := make([]*Batch, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		batch, err := i.loadBatch(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			i.logger.WithError(err).WithField("file", entry.Name()).Warn("Skipping unreadable batch")
+			continue
+		}
+		batches = append(batches, batch)
+	}
+
+	sort.Slice(batches, func(a, b int) bool { return batches[a].Created.After(batches[b].Created) })
+	return batches, nil
+}
+
+// BatchFiles returns the metadata of the files belonging to a batch
+func (i *Index) BatchFiles(batch *Batch) []*FileMeta {
+	files := make([]*FileMeta, 0, len(batch.Files))
+	for _, id := range batch.Files {
+		meta, err := i.Get(id)
+		if err != nil {
+			continue
+		}
+		files = append(files, meta)
+	}
+	return files
+}
+
+// RemoveFromBatch drops a deleted file from the batch it belongs to
+func (i *Index) RemoveFromBatch(meta *FileMeta) error {
+	if meta.BatchID == "" {
+		return nil
+	}
+
+	_, err := i.UpdateBatch(meta.BatchID, func(b *Batch) error {
+		for n, id := range b.Files {
+			if id == meta.ID {
+				b.Files = append(b.Files[:n], b.Files[n+1:]...)
+				b.FileCount--
+				b.TotalSize -= meta.Size
+				break
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// AddToBatch puts a restored file back into its batch
+func (i *Index) AddToBatch(meta *FileMeta) error {
+	if meta.BatchID == "" {
+		return nil
+	}
+
+	_, err := i.UpdateBatch(meta.BatchID, func(b *Batch) error {
+		for _, id := range b.Files {
+			if id == meta.ID {
+				return nil
+			}
+		}
+		b.Files = append(b.Files, meta.ID)
+		b.FileCount++
+		b.TotalSize += meta.Size
+		return nil
+	})
+	return err
+}
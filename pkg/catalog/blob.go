@@ -0,0 +1,186 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlobDirName is the storage folder holding the content addressed copies of
+// uploaded files. Stored files are hard links to these blobs, so identical
+// content is stored only once.
+const BlobDirName = ".blobs"
+
+// BlobRecordDirName is the directory inside the index holding blob reference counts
+const BlobRecordDirName = "blobs"
+
+// Blob records which files share one stored copy of some content
+type Blob struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Refs    []string  `json:"refs"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated,omitempty"` // last change of the references
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidSHA256 reports whether sum is a lowercase hex SHA-256 digest
+func ValidSHA256(sum string) bool {
+	return sha256Pattern.MatchString(sum)
+}
+
+// BlobKey returns the storage key of the content with the given digest
+func BlobKey(sum string) string {
+	return path.Join(BlobDirName, sum[:2], sum)
+}
+
+func (i *Index) blobRecordPath(sum string) string {
+	return filepath.Join(i.dir, BlobRecordDirName, sum+".json")
+}
+
+// GetBlob returns the blob record for a digest
+func (i *Index) GetBlob(sum string) (*Blob, error) {
+	if !ValidSHA256(sum) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.loadBlob(sum)
+}
+
+func (i *Index) loadBlob(sum string) (*Blob, error) {
+	data, err := os.ReadFile(i.blobRecordPath(sum))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var blob Blob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("failed to parse blob record: %w", err)
+	}
+	return &blob, nil
+}
+
+func (i *Index) saveBlob(blob *Blob) error {
+	blob.Updated = time.Now()
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+
+	path := i.blobRecordPath(blob.SHA256)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// AddBlobRef records that file id references the blob with the given digest
+func (i *Index) AddBlobRef(sum string, size int64, id string) error {
+	if !ValidSHA256(sum) {
+		return fmt.Errorf("invalid SHA-256 %q", sum)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	blob, err := i.loadBlob(sum)
+	if err == ErrNotFound {
+		blob = &Blob{SHA256: sum, Size: size, Refs: []string{}, Created: time.Now()}
+	} else if err != nil {
+		return err
+	}
+
+	for _, ref := range blob.Refs {
+		if ref == id {
+			return nil
+		}
+	}
+	blob.Refs = append(blob.Refs, id)
+	return i.saveBlob(blob)
+}
+
+// ReleaseBlob drops the reference of file id. The record is removed once no
+// file references the blob any more; it reports whether that happened so the
+// caller can delete the stored content.
+func (i *Index) ReleaseBlob(sum, id string) (bool, error) {
+	if !ValidSHA256(sum) {
+		return false, nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	blob, err := i.loadBlob(sum)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	refs := blob.Refs[:0]
+	for _, ref := range blob.Refs {
+		if ref != id {
+			refs = append(refs, ref)
+		}
+	}
+	blob.Refs = refs
+
+	if len(blob.Refs) > 0 {
+		return false, i.saveBlob(blob)
+	}
+
+	if err := os.Remove(i.blobRecordPath(sum)); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// ListBlobs returns all blob records, oldest first
+func (i *Index) ListBlobs() ([]*Blob, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	dir := filepath.Join(i.dir, BlobRecordDirName)
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Blob{}, nil
+		}
+		return nil, err
+	}
+
+	blobs := make([]*Blob, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		sum, ok := strings.CutSuffix(dirEntry.Name(), ".json")
+		if dirEntry.IsDir() || !ok || !ValidSHA256(sum) {
+			continue
+		}
+
+		blob, err := i.loadBlob(sum)
+		if err != nil {
+			i.logger.WithError(err).WithField("file", dirEntry.Name()).Warn("Skipping unreadable blob record")
+			continue
+		}
+		blobs = append(blobs, blob)
+	}
+
+	sort.Slice(blobs, func(a, b int) bool { return blobs[a].Created.Before(blobs[b].Created) })
+	return blobs, nil
+}
@@ -0,0 +1,71 @@
+package catalog
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestIndex(t *testing.T) *Index {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestBlobRefs(t *testing.T) {
+	index := newTestIndex(t)
+	sum := strings.Repeat("ab", 32)
+
+	for _, id := range []string{"a", "b", "a"} {
+		if err := index.AddBlobRef(sum, 7, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob, err := index.GetBlob(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Size != 7 || strings.Join(blob.Refs, ",") != "a,b" {
+		t.Errorf("blob %+v, want one reference per file", blob)
+	}
+
+	if last, err := index.ReleaseBlob(sum, "a"); err != nil || last {
+		t.Errorf("first release: last=%v, err=%v", last, err)
+	}
+	if blob, err := index.GetBlob(sum); err != nil || strings.Join(blob.Refs, ",") != "b" {
+		t.Errorf("after first release: %+v, %v", blob, err)
+	}
+	if last, err := index.ReleaseBlob(sum, "b"); err != nil || !last {
+		t.Errorf("last release: last=%v, err=%v", last, err)
+	}
+	if _, err := index.GetBlob(sum); err != ErrNotFound {
+		t.Errorf("record after last release: %v", err)
+	}
+	if blobs, err := index.ListBlobs(); err != nil || len(blobs) != 0 {
+		t.Errorf("remaining blobs %v, %v", blobs, err)
+	}
+
+	// Unknown content and invalid digests release nothing
+	if last, err := index.ReleaseBlob(sum, "b"); err != nil || last {
+		t.Errorf("release of unknown blob: last=%v, err=%v", last, err)
+	}
+	if last, err := index.ReleaseBlob("../x", "b"); err != nil || last {
+		t.Errorf("release of invalid digest: last=%v, err=%v", last, err)
+	}
+	if err := index.AddBlobRef("../x", 1, "a"); err == nil {
+		t.Error("invalid digest accepted")
+	}
+}
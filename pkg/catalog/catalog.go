@@ -0,0 +1,288 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// IndexDirName is the directory under Storage.DataDir holding the metadata index
+const IndexDirName = "index"
+
+// FileMeta describes a completed upload. Path is the storage key of the
+// file: relative to the storage root and always using forward slashes.
+type FileMeta struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	MimeType string    `json:"mime_type"`
+	SHA256   string    `json:"sha256"`
+	BLAKE3   string    `json:"blake3,omitempty"` // computed on request
+	MD5      string    `json:"md5,omitempty"`    // computed on request
+	UploadID string    `json:"upload_id"`
+	Created  time.Time `json:"created"`
+	Device   string    `json:"device"`
+	DeviceID string    `json:"device_id,omitempty"` // paired device that uploaded the file, unset without a device token
+	Pinned   bool      `json:"pinned,omitempty"`    // exempt from retention rules
+
+	// Modification time reported by the uploading device
+	Modified *time.Time `json:"modified,omitempty"`
+
+	// Set for uploads that are part of a folder or multi-file transfer
+	RelativePath string `json:"relative_path,omitempty"`
+	BatchID      string `json:"batch_id,omitempty"`
+
+	// Set for images with readable metadata
+	Photo *PhotoMeta `json:"photo,omitempty"`
+}
+
+// PhotoMeta holds what is known about a photo from its EXIF data. Width and
+// Height are the displayed size, with the orientation already applied.
+type PhotoMeta struct {
+	TakenAt     *time.Time `json:"taken_at,omitempty"`
+	Make        string     `json:"make,omitempty"`
+	Model       string     `json:"model,omitempty"`
+	Orientation int        `json:"orientation,omitempty"` // EXIF orientation 1-8
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	GPS         *GPS       `json:"gps,omitempty"`
+	GPSStripped bool       `json:"gps_stripped,omitempty"` // the location was removed from the file
+}
+
+// GPS is the location a photo was taken at
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"` // meters above sea level
+}
+
+// Index stores file metadata by ID so files can be resolved regardless of
+// where they are placed inside the upload directory
+type Index struct {
+	dir       string
+	uploadDir string
+	suffix    string
+	logger    *logrus.Logger
+	mu        sync.RWMutex
+	usage     usageCounter
+}
+
+func NewIndex(cfg *config.Config, logger *logrus.Logger) (*Index, error) {
+	dir := filepath.Join(cfg.Storage.DataDir, IndexDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	return &Index{
+		dir:       dir,
+		uploadDir: cfg.Storage.UploadDir,
+		suffix:    cfg.TUS.MetaSuffix,
+		logger:    logger,
+	}, nil
+}
+
+// ErrNotFound is returned when no metadata exists for an ID
+var ErrNotFound = fmt.Errorf("file not found")
+
+func (i *Index) metaPath(id string) string {
+	return filepath.Join(i.dir, id+i.suffix)
+}
+
+// validID rejects IDs that could escape the index directory
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// Get returns the metadata for id
+func (i *Index) Get(id string) (*FileMeta, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.load(i.metaPath(id))
+}
+
+func (i *Index) load(path string) (*FileMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var meta FileMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// Save writes the metadata record, replacing any previous one
+func (i *Index) Save(meta *FileMeta) error {
+	if !validID(meta.ID) {
+		return fmt.Errorf("invalid file ID %q", meta.ID)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.save(meta)
+}
+
+func (i *Index) save(meta *FileMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// The replaced record no longer counts toward the usage
+	var previous *FileMeta
+	if !i.usage.counted.IsZero() {
+		previous, _ = i.load(i.metaPath(meta.ID))
+	}
+
+	// Write to a temporary file first so readers never see a partial record
+	tmp := i.metaPath(meta.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, i.metaPath(meta.ID)); err != nil {
+		return err
+	}
+
+	i.usage.addFile(previous, -1)
+	i.usage.addFile(meta, 1)
+	return nil
+}
+
+// Update loads the metadata record for id, applies fn and saves the result,
+// so changes made meanwhile by others are not lost
+func (i *Index) Update(id string, fn func(*FileMeta) error) (*FileMeta, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	meta, err := i.load(i.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(meta); err != nil {
+		return nil, err
+	}
+	if err := i.save(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Delete removes the metadata record for id
+func (i *Index) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var meta *FileMeta
+	if !i.usage.counted.IsZero() {
+		meta, _ = i.load(i.metaPath(id))
+	}
+	if err := os.Remove(i.metaPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	i.usage.addFile(meta, -1)
+	return nil
+}
+
+// List returns all metadata records, newest first
+func (i *Index) List() ([]*FileMeta, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.list()
+}
+
+func (i *Index) list() ([]*FileMeta, error) {
+	entries, err := os.ReadDir(i.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*FileMeta, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), i.suffix) {
+			continue
+		}
+
+		meta, err := i.load(filepath.Join(i.dir, entry.Name()))
+		if err != nil {
+			i.logger.WithError(err).WithField("file", entry.Name()).Warn("Skipping unreadable metadata")
+			continue
+		}
+		files = append(files, meta)
+	}
+
+	sort.Slice(files, func(a, b int) bool { return files[a].Created.After(files[b].Created) })
+	return files, nil
+}
+
+// ImportLegacy moves metadata of the old layout, where completed uploads were
+// stored as UploadDir/<id> with UploadDir/<id>.meta next to them, into the index
+func (i *Index) ImportLegacy() (int, error) {
+	entries, err := os.ReadDir(i.uploadDir)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), i.suffix) {
+			continue
+		}
+
+		legacyPath := filepath.Join(i.uploadDir, entry.Name())
+		meta, err := i.load(legacyPath)
+		if err != nil {
+			i.logger.WithError(err).WithField("file", entry.Name()).Warn("Skipping unreadable legacy metadata")
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), i.suffix)
+		if meta.ID == "" {
+			meta.ID = id
+		}
+		if meta.Path == "" {
+			meta.Path = id
+		}
+
+		if err := i.Save(meta); err != nil {
+			return imported, err
+		}
+		if err := os.Remove(legacyPath); err != nil {
+			i.logger.WithError(err).Warn("Failed to remove legacy metadata file")
+		}
+		imported++
+	}
+
+	return imported, nil
+}
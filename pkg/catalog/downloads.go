@@ -0,0 +1,114 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DownloadDirName is the directory inside the index holding download history
+const DownloadDirName = "downloads"
+
+// maxDownloadRecords is how many downloads are remembered per file
+const maxDownloadRecords = 100
+
+// DownloadRecord describes one client's download of a file, which may span
+// many range requests
+type DownloadRecord struct {
+	FileID       string    `json:"file_id"`
+	Device       string    `json:"device,omitempty"` // empty for clients that sent no token
+	DeviceName   string    `json:"device_name,omitempty"`
+	Remote       string    `json:"remote"`
+	Size         int64     `json:"size"`
+	BytesServed  int64     `json:"bytes_served"`  // including bytes sent more than once
+	BytesCovered int64     `json:"bytes_covered"` // distinct bytes of the file sent
+	Requests     int       `json:"requests"`      // responses and multipart parts that carried content
+	Completed    bool      `json:"completed"`     // every byte of the file was sent
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`     // completion, or the last activity of an abandoned download
+	Duration     float64   `json:"duration"`     // seconds
+	AverageRate  float64   `json:"average_rate"` // bytes per second
+}
+
+func (i *Index) downloadsPath(fileID string) string {
+	return filepath.Join(i.dir, DownloadDirName, fileID+".json")
+}
+
+// Downloads returns the recorded downloads of a file, newest first
+func (i *Index) Downloads(fileID string) ([]*DownloadRecord, error) {
+	if !validID(fileID) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.loadDownloads(fileID)
+}
+
+func (i *Index) loadDownloads(fileID string) ([]*DownloadRecord, error) {
+	data, err := os.ReadFile(i.downloadsPath(fileID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*DownloadRecord{}, nil
+		}
+		return nil, err
+	}
+
+	var records []*DownloadRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse download history: %w", err)
+	}
+	return records, nil
+}
+
+// AddDownload records a finished or abandoned download. Only the most
+// recent downloads of each file are kept.
+func (i *Index) AddDownload(record *DownloadRecord) error {
+	if !validID(record.FileID) {
+		return fmt.Errorf("invalid file ID %q", record.FileID)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	records, err := i.loadDownloads(record.FileID)
+	if err != nil {
+		return err
+	}
+	records = append([]*DownloadRecord{record}, records...)
+	if len(records) > maxDownloadRecords {
+		records = records[:maxDownloadRecords]
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	p := i.downloadsPath(record.FileID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// DeleteDownloads forgets the download history of a deleted file
+func (i *Index) DeleteDownloads(fileID string) error {
+	if !validID(fileID) {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := os.Remove(i.downloadsPath(fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MessagesFileName is the file inside the index holding the chat history,
+// one JSON message per line
+const MessagesFileName = "messages.jsonl"
+
+// maxMessagesSize bounds the chat history; once the file grows beyond it the
+// oldest messages are dropped until half of it is left
+var maxMessagesSize int64 = 8 << 20
+
+// Message is a chat message relayed between devices
+type Message struct {
+	ID         string    `json:"id"`
+	Text       string    `json:"text"`
+	Device     string    `json:"device,omitempty"` // paired device that sent it
+	DeviceName string    `json:"device_name,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func (i *Index) messagesPath() string {
+	return filepath.Join(i.dir, MessagesFileName)
+}
+
+// AddMessage appends a message to the chat history
+func (i *Index) AddMessage(msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	f, err := os.OpenFile(i.messagesPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if info.Size() > maxMessagesSize {
+		return i.trimMessages()
+	}
+	return nil
+}
+
+// trimMessages drops the oldest messages, keeping at most half of
+// maxMessagesSize. The caller holds the lock.
+func (i *Index) trimMessages() error {
+	p := i.messagesPath()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	// Cut at the start of a line
+	cut := len(data) - int(maxMessagesSize/2)
+	if cut <= 0 {
+		return nil
+	}
+	if n := bytes.IndexByte(data[cut-1:], '\n'); n >= 0 {
+		cut += n
+	} else {
+		cut = len(data)
+	}
+
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data[cut:], 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return err
+	}
+
+	i.logger.WithField("bytes", cut).Info("Dropped the oldest chat messages")
+	return nil
+}
+
+// Messages returns the chat history, oldest first. Lines that cannot be
+// parsed, such as one cut short by a crash, are skipped.
+func (i *Index) Messages() ([]*Message, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	f, err := os.Open(i.messagesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Message{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	messages := make([]*Message, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			i.logger.WithError(err).Warn("Skipping unreadable chat message")
+			continue
+		}
+		messages = append(messages, &msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chat history: %w", err)
+	}
+	return messages, nil
+}
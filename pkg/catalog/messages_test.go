@@ -0,0 +1,74 @@
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	index := newTestIndex(t)
+
+	messages, err := index.Messages()
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("empty history: %v, %v", messages, err)
+	}
+
+	for n := 0; n < 3; n++ {
+		msg := &Message{ID: fmt.Sprint(n), Text: "message", Device: "phone", Time: time.Unix(int64(n), 0)}
+		if err := index.AddMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A line cut short by a crash is skipped
+	f, err := os.OpenFile(index.messagesPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"3","te`)
+	f.Close()
+
+	messages, err = index.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || messages[0].ID != "0" || messages[2].ID != "2" {
+		t.Errorf("history %+v", messages)
+	}
+}
+
+func TestTrimMessages(t *testing.T) {
+	index := newTestIndex(t)
+	defer func(size int64) { maxMessagesSize = size }(maxMessagesSize)
+	maxMessagesSize = 1000
+
+	text := strings.Repeat("x", 50)
+	for n := 0; n < 100; n++ {
+		if err := index.AddMessage(&Message{ID: fmt.Sprint(n), Text: text, Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(index.messagesPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxMessagesSize {
+			t.Fatalf("history of %d bytes", info.Size())
+		}
+	}
+
+	messages, err := index.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) == 0 || len(messages) >= 100 || messages[len(messages)-1].ID != "99" {
+		t.Fatalf("%d messages kept", len(messages))
+	}
+	// Only whole messages are kept, the newest in order
+	for n, msg := range messages {
+		if msg.ID != fmt.Sprint(100-len(messages)+n) || msg.Text != text {
+			t.Errorf("message %d: %+v", n, msg)
+		}
+	}
+}
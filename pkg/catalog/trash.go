@@ -0,0 +1,198 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TrashDirName is the directory inside the index holding deleted files
+const TrashDirName = "trash"
+
+// ErrExists is returned when restoring a file whose ID is in use again
+var ErrExists = fmt.Errorf("file already exists")
+
+// TrashEntry is a deleted file kept until it is restored or purged. The
+// stored content stays where it was, so its name is not reused meanwhile.
+type TrashEntry struct {
+	File          *FileMeta `json:"file"`
+	Deleted       time.Time `json:"deleted"`
+	DeletedBy     string    `json:"deleted_by,omitempty"` // device that deleted the file
+	DeletedByName string    `json:"deleted_by_name,omitempty"`
+}
+
+func (i *Index) trashPath(id string) string {
+	return filepath.Join(i.dir, TrashDirName, id+".json")
+}
+
+// MoveToTrash replaces the metadata record for id with a trash entry, so the
+// file disappears from List until it is restored
+func (i *Index) MoveToTrash(id, device, deviceName string) (*TrashEntry, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	meta, err := i.load(i.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &TrashEntry{
+		File:          meta,
+		Deleted:       time.Now(),
+		DeletedBy:     device,
+		DeletedByName: deviceName,
+	}
+	if err := i.saveTrash(entry); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(i.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	i.usage.addFile(meta, -1)
+	i.usage.addTrash(meta, 1)
+	return entry, nil
+}
+
+func (i *Index) saveTrash(entry *TrashEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	p := i.trashPath(entry.File.ID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// GetTrash returns the trash entry for id
+func (i *Index) GetTrash(id string) (*TrashEntry, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.loadTrash(i.trashPath(id))
+}
+
+func (i *Index) loadTrash(path string) (*TrashEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse trash entry: %w", err)
+	}
+	if entry.File == nil {
+		return nil, fmt.Errorf("trash entry without file")
+	}
+	return &entry, nil
+}
+
+// ListTrash returns all trash entries, most recently deleted first
+func (i *Index) ListTrash() ([]*TrashEntry, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.listTrash()
+}
+
+func (i *Index) listTrash() ([]*TrashEntry, error) {
+	dir := filepath.Join(i.dir, TrashDirName)
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*TrashEntry{}, nil
+		}
+		return nil, err
+	}
+
+	entries := make([]*TrashEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+
+		entry, err := i.loadTrash(filepath.Join(dir, dirEntry.Name()))
+		if err != nil {
+			i.logger.WithError(err).WithField("file", dirEntry.Name()).Warn("Skipping unreadable trash entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Deleted.After(entries[b].Deleted) })
+	return entries, nil
+}
+
+// RestoreFromTrash turns the trash entry for id back into a metadata record
+func (i *Index) RestoreFromTrash(id string) (*FileMeta, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entry, err := i.loadTrash(i.trashPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(i.metaPath(id)); err == nil {
+		return nil, ErrExists
+	}
+
+	if err := i.save(entry.File); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(i.trashPath(id)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	i.usage.addTrash(entry.File, -1)
+	return entry.File, nil
+}
+
+// DeleteTrash removes the trash entry for id
+func (i *Index) DeleteTrash(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var entry *TrashEntry
+	if !i.usage.counted.IsZero() {
+		entry, _ = i.loadTrash(i.trashPath(id))
+	}
+	if err := os.Remove(i.trashPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if entry != nil {
+		i.usage.addTrash(entry.File, -1)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package catalog
+
+import "time"
+
+// usageRecountInterval is how long the running usage totals are trusted
+// before they are counted again from the records, which picks up changes
+// other processes made to the index
+const usageRecountInterval = 10 * time.Minute
+
+// Tally is the number and total size of a set of files
+type Tally struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+func (t *Tally) add(meta *FileMeta, n int) {
+	t.Bytes += int64(n) * meta.Size
+	t.Files += n
+}
+
+// Usage is the storage taken by the files in the index. Devices is keyed by
+// FileMeta.DeviceID, files uploaded without a device token count under "".
+type Usage struct {
+	Devices map[string]Tally
+	Trash   Tally
+}
+
+// usageCounter keeps the usage up to date as records change, so quota
+// checks do not read every record. It is guarded by Index.mu and idle until
+// the usage is first asked for.
+type usageCounter struct {
+	usage   Usage
+	counted time.Time
+}
+
+func (c *usageCounter) addFile(meta *FileMeta, n int) {
+	if c.counted.IsZero() || meta == nil {
+		return
+	}
+	t := c.usage.Devices[meta.DeviceID]
+	t.add(meta, n)
+	if t.Files > 0 {
+		c.usage.Devices[meta.DeviceID] = t
+	} else {
+		delete(c.usage.Devices, meta.DeviceID)
+	}
+}
+
+func (c *usageCounter) addTrash(meta *FileMeta, n int) {
+	if c.counted.IsZero() || meta == nil {
+		return
+	}
+	c.usage.Trash.add(meta, n)
+}
+
+// Usage returns the storage taken by the files in the list and in the trash
+func (i *Index) Usage() (Usage, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if time.Since(i.usage.counted) >= usageRecountInterval {
+		if err := i.countUsage(); err != nil {
+			return Usage{}, err
+		}
+	}
+
+	usage := Usage{
+		Devices: make(map[string]Tally, len(i.usage.usage.Devices)),
+		Trash:   i.usage.usage.Trash,
+	}
+	for device, t := range i.usage.usage.Devices {
+		usage.Devices[device] = t
+	}
+	return usage, nil
+}
+
+// countUsage counts the usage from the records; the caller holds the write lock
+func (i *Index) countUsage() error {
+	files, err := i.list()
+	if err != nil {
+		return err
+	}
+	trash, err := i.listTrash()
+	if err != nil {
+		return err
+	}
+
+	i.usage = usageCounter{
+		usage:   Usage{Devices: make(map[string]Tally)},
+		counted: time.Now(),
+	}
+	for _, meta := range files {
+		i.usage.addFile(meta, 1)
+	}
+	for _, entry := range trash {
+		i.usage.addTrash(entry.File, 1)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package clipboard
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// DirName is the directory under Storage.DataDir holding the clipboard
+// history and the images in it
+const DirName = "clipboard"
+
+const historyFileName = "history.json"
+
+var (
+	// ErrNotFound is returned for items that are not in the history
+	ErrNotFound = errors.New("clipboard item not found")
+	// ErrTooLarge is returned for text or images over the configured limit
+	ErrTooLarge = errors.New("clipboard item too large")
+	// ErrInvalid is returned for empty items and unsupported content
+	ErrInvalid = errors.New("invalid clipboard item")
+)
+
+// imageTypes are the image formats accepted on the clipboard
+var imageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Item is a clipboard item in the history. Image content is kept in a file
+// next to the history rather than in it.
+type Item = websocket.ClipboardItem
+
+// Service keeps the recent clipboard items and relays new ones to the
+// devices that opted in to clipboard sync
+type Service struct {
+	config   *config.Config
+	logger   *logrus.Logger
+	dir      string
+	maxText  int64
+	maxImage int64
+
+	mu      sync.Mutex
+	history []*Item // oldest first
+	deliver func(item Item)
+}
+
+func NewService(cfg *config.Config, logger *logrus.Logger) (*Service, error) {
+	s := &Service{
+		config: cfg,
+		logger: logger,
+		dir:    filepath.Join(cfg.Storage.DataDir, DirName),
+	}
+
+	var err error
+	if s.maxText, err = cfg.GetClipboardMaxTextBytes(); err != nil {
+		return nil, fmt.Errorf("invalid clipboard max_text_size: %w", err)
+	}
+	if s.maxImage, err = cfg.GetClipboardMaxImageBytes(); err != nil {
+		return nil, fmt.Errorf("invalid clipboard max_image_size: %w", err)
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create clipboard directory: %w", err)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Service) historyPath() string {
+	return filepath.Join(s.dir, historyFileName)
+}
+
+func (s *Service) imagePath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *Service) load() error {
+	data, err := os.ReadFile(s.historyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read clipboard history: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.history); err != nil {
+		return fmt.Errorf("failed to parse clipboard history: %w", err)
+	}
+	return nil
+}
+
+// save writes the history; the caller holds s.mu
+func (s *Service) save() error {
+	data, err := json.MarshalIndent(s.history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.historyPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.historyPath())
+}
+
+// SendTo relays new clipboard items to the devices connected to manager and
+// accepts the items they push
+func (s *Service) SendTo(manager *websocket.Manager) {
+	s.mu.Lock()
+	s.deliver = manager.BroadcastClipboard
+	s.mu.Unlock()
+
+	manager.HandleClipboard(func(deviceID, deviceName string, item websocket.ClipboardItem) error {
+		var data []byte
+		if item.Kind == websocket.ClipboardImage {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(item.Data); err != nil {
+				return fmt.Errorf("%w: image data is not base64", ErrInvalid)
+			}
+		}
+		_, err := s.Push(deviceID, deviceName, item.Kind, item.Text, data)
+		return err
+	})
+}
+
+// Push adds text or an image copied on a device to the history and sends it
+// to the other devices
+func (s *Service) Push(deviceID, deviceName, kind, text string, image []byte) (*Item, error) {
+	item := &Item{
+		ID:         uuid.New().String(),
+		Kind:       kind,
+		Device:     deviceID,
+		DeviceName: deviceName,
+		Time:       time.Now().Unix(),
+	}
+
+	switch kind {
+	case websocket.ClipboardText:
+		if text == "" {
+			return nil, fmt.Errorf("%w: text is empty", ErrInvalid)
+		}
+		if s.maxText > 0 && int64(len(text)) > s.maxText {
+			return nil, fmt.Errorf("%w: text exceeds %d bytes", ErrTooLarge, s.maxText)
+		}
+		item.Text = text
+		item.Size = len(text)
+	case websocket.ClipboardImage:
+		if len(image) == 0 {
+			return nil, fmt.Errorf("%w: image is empty", ErrInvalid)
+		}
+		if s.maxImage > 0 && int64(len(image)) > s.maxImage {
+			return nil, fmt.Errorf("%w: image exceeds %d bytes", ErrTooLarge, s.maxImage)
+		}
+		mimeType := http.DetectContentType(image)
+		if !imageTypes[mimeType] {
+			return nil, fmt.Errorf("%w: unsupported image type %s", ErrInvalid, mimeType)
+		}
+		item.MimeType = mimeType
+		item.Size = len(image)
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %q", ErrInvalid, kind)
+	}
+
+	s.mu.Lock()
+	if item.Kind == websocket.ClipboardImage {
+		if err := os.WriteFile(s.imagePath(item.ID), image, 0644); err != nil {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("failed to store clipboard image: %w", err)
+		}
+	}
+	s.history = append(s.history, item)
+	s.trim()
+	if err := s.save(); err != nil {
+		s.logger.WithError(err).Warn("Failed to save clipboard history")
+	}
+	deliver := s.deliver
+	s.mu.Unlock()
+
+	s.logger.WithFields(logrus.Fields{
+		"id":     item.ID,
+		"kind":   item.Kind,
+		"size":   item.Size,
+		"device": deviceID,
+	}).Info("Clipboard item pushed")
+
+	if deliver != nil {
+		sent := *item
+		if sent.Kind == websocket.ClipboardImage {
+			sent.Data = base64.StdEncoding.EncodeToString(image)
+		}
+		deliver(sent)
+	}
+	return item, nil
+}
+
+// trim drops the oldest items beyond the history size; the caller holds s.mu
+func (s *Service) trim() {
+	keep := max(s.config.Clipboard.History, 0)
+	for len(s.history) > keep {
+		s.removeImage(s.history[0])
+		s.history = s.history[1:]
+	}
+}
+
+func (s *Service) removeImage(item *Item) {
+	if item.Kind != websocket.ClipboardImage {
+		return
+	}
+	if err := os.Remove(s.imagePath(item.ID)); err != nil && !os.IsNotExist(err) {
+		s.logger.WithError(err).WithField("id", item.ID).Warn("Failed to remove clipboard image")
+	}
+}
+
+// History returns the recent clipboard items, newest first. Images are
+// listed without their content.
+func (s *Service) History() []*Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := make([]*Item, 0, len(s.history))
+	for n := len(s.history) - 1; n >= 0; n-- {
+		items = append(items, s.history[n])
+	}
+	return items
+}
+
+// Image returns an image in the history with its content
+func (s *Service) Image(id string) (*Item, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range s.history {
+		if item.ID != id || item.Kind != websocket.ClipboardImage {
+			continue
+		}
+		data, err := os.ReadFile(s.imagePath(item.ID))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil, ErrNotFound
+			}
+			return nil, nil, err
+		}
+		return item, data, nil
+	}
+	return nil, nil, ErrNotFound
+}
+
+// Clear removes every item from the history and returns how many were
+// removed
+func (s *Service) Clear() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.history)
+	for _, item := range s.history {
+		s.removeImage(item)
+	}
+	s.history = nil
+	if err := s.save(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -26,6 +27,22 @@ type Config struct {
 		DataDir          string `json:"data_dir" yaml:"data_dir"`
 		MaxFileSize      string `json:"max_file_size" yaml:"max_file_size"`       // size string like "10GB"
 		PairingTokenFile string `json:"pairing_token_file" yaml:"pairing_token_file"` // filename only
+		Layout           string `json:"layout" yaml:"layout"`                         // flat, device or date
+		Dedup            bool   `json:"dedup" yaml:"dedup"`                           // store identical content once
+		Backend          string `json:"backend" yaml:"backend"`                       // local or s3
+
+		// S3 compatible object storage, used when Backend is "s3". Uploads
+		// are still staged in UploadDir until they complete.
+		S3 struct {
+			Endpoint  string `json:"endpoint" yaml:"endpoint"` // e.g. "https://s3.amazonaws.com" or "http://127.0.0.1:9000"
+			Region    string `json:"region" yaml:"region"`
+			Bucket    string `json:"bucket" yaml:"bucket"`
+			Prefix    string `json:"prefix" yaml:"prefix"` // key prefix inside the bucket
+			AccessKey string `json:"access_key" yaml:"access_key"`
+			SecretKey string `json:"secret_key" yaml:"secret_key"`
+			PathStyle bool   `json:"path_style" yaml:"path_style"` // use endpoint/bucket/key instead of bucket.endpoint/key
+			PartSize  string `json:"part_size" yaml:"part_size"`   // multipart upload part size like "64MB"
+		} `json:"s3" yaml:"s3"`
 	} `json:"storage" yaml:"storage"`
 
 	WebSocket struct {
@@ -54,10 +71,54 @@ type Config struct {
 		DeviceName  string `json:"device_name" yaml:"device_name"`
 	} `json:"mdns" yaml:"mdns"`
 
+	Quota struct {
+		MaxTotalSize   string `json:"max_total_size" yaml:"max_total_size"`     // size string, empty means unlimited
+		MaxDeviceSize  string `json:"max_device_size" yaml:"max_device_size"`   // size string, empty means unlimited
+		MaxDeviceFiles int    `json:"max_device_files" yaml:"max_device_files"` // 0 means unlimited
+		MinFreeSpace   string `json:"min_free_space" yaml:"min_free_space"`     // size string, empty disables the guard
+	} `json:"quota" yaml:"quota"`
+
+	Throttle struct {
+		UploadRate       string `json:"upload_rate" yaml:"upload_rate"`               // size per second for all uploads, empty means unlimited
+		DeviceUploadRate string `json:"device_upload_rate" yaml:"device_upload_rate"` // size per second per device, empty means unlimited
+		MaxDeviceUploads int    `json:"max_device_uploads" yaml:"max_device_uploads"` // concurrent transfers per device, 0 means unlimited
+	} `json:"throttle" yaml:"throttle"`
+
+	Thumbnails struct {
+		Enabled bool   `json:"enabled" yaml:"enabled"`
+		Sizes   []int  `json:"sizes" yaml:"sizes"`     // longest edge in pixels, the first is served by default
+		Quality int    `json:"quality" yaml:"quality"` // JPEG quality 1-100
+		Video   bool   `json:"video" yaml:"video"`     // poster frames for videos, needs ffmpeg
+		FFmpeg  string `json:"ffmpeg" yaml:"ffmpeg"`   // ffmpeg binary, looked up in PATH unless absolute
+	} `json:"thumbnails" yaml:"thumbnails"`
+
+	Photos struct {
+		Exif     bool `json:"exif" yaml:"exif"`           // record EXIF metadata of uploaded images
+		StripGPS bool `json:"strip_gps" yaml:"strip_gps"` // remove the location before a photo is stored
+	} `json:"photos" yaml:"photos"`
+
+	Download struct {
+		Sendfile bool `json:"sendfile" yaml:"sendfile"` // let the kernel copy local files to the socket
+	} `json:"download" yaml:"download"`
+
+	Clipboard struct {
+		Enabled      bool   `json:"enabled" yaml:"enabled"`               // relay clipboard items between devices
+		MaxTextSize  string `json:"max_text_size" yaml:"max_text_size"`   // size string, independent of websocket.read_limit
+		MaxImageSize string `json:"max_image_size" yaml:"max_image_size"` // size string, independent of websocket.read_limit
+		History      int    `json:"history" yaml:"history"`               // recent items kept on the server, 0 keeps none
+	} `json:"clipboard" yaml:"clipboard"`
+
+	Trash struct {
+		Enabled   bool   `json:"enabled" yaml:"enabled"`     // keep deleted files so they can be restored
+		Retention string `json:"retention" yaml:"retention"` // duration string like "720h", empty keeps files until purged
+		MaxSize   string `json:"max_size" yaml:"max_size"`   // size string, oldest files are purged beyond it, empty means unlimited
+	} `json:"trash" yaml:"trash"`
+
 	TUS struct {
 		BasePath   string `json:"base_path" yaml:"base_path"`
 		TempSuffix string `json:"temp_suffix" yaml:"temp_suffix"`
 		MetaSuffix string `json:"meta_suffix" yaml:"meta_suffix"`
+		InfoSuffix string `json:"info_suffix" yaml:"info_suffix"`
 	} `json:"tus" yaml:"tus"`
 
 	CORS struct {
@@ -70,6 +131,102 @@ type Config struct {
 		Level  string `json:"level" yaml:"level"`
 		Format string `json:"format" yaml:"format"`
 	} `json:"logging" yaml:"logging"`
+
+	Hooks []Hook `json:"hooks" yaml:"hooks"`
+
+	Shares []Share `json:"shares" yaml:"shares"`
+
+	SyncFolders []SyncFolder `json:"sync_folders" yaml:"sync_folders"`
+
+	Retention struct {
+		Enabled  bool            `json:"enabled" yaml:"enabled"`   // enforce the rules in the background
+		Interval string          `json:"interval" yaml:"interval"` // duration string, how often the rules are enforced
+		Rules    []RetentionRule `json:"rules" yaml:"rules"`
+	} `json:"retention" yaml:"retention"`
+}
+
+// Hook runs an action when an upload reaches one of the given events
+type Hook struct {
+	Name      string   `json:"name" yaml:"name"`
+	Events    []string `json:"events" yaml:"events"`         // created, progress, completed, terminated, failed
+	MimeTypes []string `json:"mime_types" yaml:"mime_types"` // patterns like "image/*", empty matches all
+	Action    string   `json:"action" yaml:"action"`         // command, move or webhook
+	Command   []string `json:"command" yaml:"command"`       // program and arguments for "command"
+	Target    string   `json:"target" yaml:"target"`         // folder inside the storage for "move"
+	URL       string   `json:"url" yaml:"url"`               // endpoint for "webhook"
+	Timeout   string   `json:"timeout" yaml:"timeout"`       // duration string, default "30s"
+}
+
+func (h *Hook) GetTimeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return 30 * time.Second, nil
+	}
+	return ParseDuration(h.Timeout)
+}
+
+// Share symlink policies
+const (
+	SymlinksDeny   = "deny"   // never follow symbolic links
+	SymlinksInside = "inside" // follow links whose target stays inside the share
+	SymlinksFollow = "follow" // follow every link
+)
+
+// Share is a folder of this computer that paired devices may browse and
+// download from without anyone uploading it first
+type Share struct {
+	Name     string   `json:"name" yaml:"name"`         // used in URLs: letters, digits, "-" and "_"
+	Path     string   `json:"path" yaml:"path"`         // folder on this computer
+	Writable bool     `json:"writable" yaml:"writable"` // allow uploads, new folders and deletes
+	Devices  []string `json:"devices" yaml:"devices"`   // device IDs allowed, empty allows every paired device
+	Symlinks string   `json:"symlinks" yaml:"symlinks"` // deny, inside or follow, default "inside"
+}
+
+// SyncFolder is a folder inside the storage that devices keep in sync with
+// a local folder. Files are uploaded through TUS and downloaded from /files.
+type SyncFolder struct {
+	Name    string   `json:"name" yaml:"name"`       // used in URLs: letters, digits, "-" and "_"
+	Folder  string   `json:"folder" yaml:"folder"`   // folder inside the storage
+	Devices []string `json:"devices" yaml:"devices"` // device IDs allowed, empty allows every paired device
+}
+
+// Retention actions
+const (
+	RetentionDelete  = "delete"  // move the file to the trash, or remove it when the trash is disabled
+	RetentionArchive = "archive" // move the file into the target folder
+)
+
+// RetentionRule limits how long and how much of the inbox files of some
+// types are kept. A file is governed by the first rule matching its type;
+// pinned files are exempt.
+type RetentionRule struct {
+	Name      string   `json:"name" yaml:"name"`
+	MimeTypes []string `json:"mime_types" yaml:"mime_types"` // patterns like "image/*", empty matches all
+	MaxAge    string   `json:"max_age" yaml:"max_age"`       // duration string like "72h" or "30d", empty means no age limit
+	MaxSize   string   `json:"max_size" yaml:"max_size"`     // size string, the oldest files beyond it are affected, empty means unlimited
+	Action    string   `json:"action" yaml:"action"`         // delete or archive
+	Target    string   `json:"target" yaml:"target"`         // folder inside the storage for "archive"
+}
+
+// GetMaxAge returns the age limit of the rule, 0 means no limit. Besides
+// duration strings, whole days like "30d" are accepted.
+func (r *RetentionRule) GetMaxAge() (time.Duration, error) {
+	s := strings.TrimSpace(r.MaxAge)
+	if s == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", r.MaxAge)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return ParseDuration(s)
+}
+
+// GetMaxBytes returns the size limit of the rule in bytes, 0 means unlimited
+func (r *RetentionRule) GetMaxBytes() (int64, error) {
+	return parseOptionalSize(r.MaxSize)
 }
 
 func DefaultConfig() *Config {
@@ -95,6 +252,12 @@ func DefaultConfig() *Config {
 	cfg.Storage.DataDir = filepath.Join(homeDir, "EasySync", "Data")
 	cfg.Storage.MaxFileSize = "10GB"
 	cfg.Storage.PairingTokenFile = "pairing-token.txt"
+	cfg.Storage.Layout = "flat"
+	cfg.Storage.Dedup = true
+	cfg.Storage.Backend = "local"
+	cfg.Storage.S3.Region = "us-east-1"
+	cfg.Storage.S3.PathStyle = true
+	cfg.Storage.S3.PartSize = "64MB"
 
 	// WebSocket defaults
 	cfg.WebSocket.ReadBufferSize = 1024
@@ -119,10 +282,51 @@ func DefaultConfig() *Config {
 	cfg.MDNS.ServiceName = "_lanxfer._tcp"
 	cfg.MDNS.DeviceName = hostname
 
+	// Quota defaults
+	cfg.Quota.MaxTotalSize = ""
+	cfg.Quota.MaxDeviceSize = ""
+	cfg.Quota.MaxDeviceFiles = 0
+	cfg.Quota.MinFreeSpace = "1GB"
+
+	// Throttle defaults
+	cfg.Throttle.UploadRate = ""
+	cfg.Throttle.DeviceUploadRate = ""
+	cfg.Throttle.MaxDeviceUploads = 0
+
+	// Thumbnail defaults
+	cfg.Thumbnails.Enabled = true
+	cfg.Thumbnails.Sizes = []int{256, 1024}
+	cfg.Thumbnails.Quality = 80
+	cfg.Thumbnails.Video = true
+	cfg.Thumbnails.FFmpeg = "ffmpeg"
+
+	// Photo defaults
+	cfg.Photos.Exif = true
+	cfg.Photos.StripGPS = false
+
+	// Download defaults
+	cfg.Download.Sendfile = true
+
+	// Clipboard defaults
+	cfg.Clipboard.Enabled = true
+	cfg.Clipboard.MaxTextSize = "64KB"
+	cfg.Clipboard.MaxImageSize = "2MB"
+	cfg.Clipboard.History = 20
+
+	// Trash defaults
+	cfg.Trash.Enabled = true
+	cfg.Trash.Retention = "720h" // 30 days
+	cfg.Trash.MaxSize = ""
+
+	// Retention defaults
+	cfg.Retention.Enabled = false
+	cfg.Retention.Interval = "1h"
+
 	// TUS defaults
 	cfg.TUS.BasePath = "/tus/files"
 	cfg.TUS.TempSuffix = ".part"
 	cfg.TUS.MetaSuffix = ".meta"
+	cfg.TUS.InfoSuffix = ".info"
 
 	// CORS defaults
 	cfg.CORS.AllowedOrigins = []string{"*"}
@@ -158,6 +362,9 @@ func LoadFromFile(filepath string) (*Config, error) {
 	// Expand home directory paths
 	config.Storage.UploadDir = expandPath(config.Storage.UploadDir)
 	config.Storage.DataDir = expandPath(config.Storage.DataDir)
+	for i := range config.Shares {
+		config.Shares[i].Path = expandPath(config.Shares[i].Path)
+	}
 
 	return config, nil
 }
@@ -199,6 +406,39 @@ func LoadFromEnv(config *Config) {
 	if v := os.Getenv("EASYSYNC_STORAGE_PAIRING_TOKEN_FILE"); v != "" {
 		config.Storage.PairingTokenFile = v
 	}
+	if v := os.Getenv("EASYSYNC_STORAGE_LAYOUT"); v != "" {
+		config.Storage.Layout = v
+	}
+	if v := os.Getenv("EASYSYNC_STORAGE_DEDUP"); v != "" {
+		config.Storage.Dedup = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_STORAGE_BACKEND"); v != "" {
+		config.Storage.Backend = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_ENDPOINT"); v != "" {
+		config.Storage.S3.Endpoint = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_REGION"); v != "" {
+		config.Storage.S3.Region = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_BUCKET"); v != "" {
+		config.Storage.S3.Bucket = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_PREFIX"); v != "" {
+		config.Storage.S3.Prefix = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_ACCESS_KEY"); v != "" {
+		config.Storage.S3.AccessKey = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_SECRET_KEY"); v != "" {
+		config.Storage.S3.SecretKey = v
+	}
+	if v := os.Getenv("EASYSYNC_S3_PATH_STYLE"); v != "" {
+		config.Storage.S3.PathStyle = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_S3_PART_SIZE"); v != "" {
+		config.Storage.S3.PartSize = v
+	}
 
 	// WebSocket
 	if v := os.Getenv("EASYSYNC_WEBSOCKET_READ_BUFFER_SIZE"); v != "" {
@@ -259,6 +499,94 @@ func LoadFromEnv(config *Config) {
 		config.MDNS.DeviceName = v
 	}
 
+	// Quota
+	if v := os.Getenv("EASYSYNC_QUOTA_MAX_TOTAL_SIZE"); v != "" {
+		config.Quota.MaxTotalSize = v
+	}
+	if v := os.Getenv("EASYSYNC_QUOTA_MAX_DEVICE_SIZE"); v != "" {
+		config.Quota.MaxDeviceSize = v
+	}
+	if v := os.Getenv("EASYSYNC_QUOTA_MAX_DEVICE_FILES"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			config.Quota.MaxDeviceFiles = i
+		}
+	}
+	if v := os.Getenv("EASYSYNC_QUOTA_MIN_FREE_SPACE"); v != "" {
+		config.Quota.MinFreeSpace = v
+	}
+
+	// Throttle
+	if v := os.Getenv("EASYSYNC_THROTTLE_UPLOAD_RATE"); v != "" {
+		config.Throttle.UploadRate = v
+	}
+	if v := os.Getenv("EASYSYNC_THROTTLE_DEVICE_UPLOAD_RATE"); v != "" {
+		config.Throttle.DeviceUploadRate = v
+	}
+	if v := os.Getenv("EASYSYNC_THROTTLE_MAX_DEVICE_UPLOADS"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			config.Throttle.MaxDeviceUploads = i
+		}
+	}
+
+	// Thumbnails
+	if v := os.Getenv("EASYSYNC_THUMBNAILS_ENABLED"); v != "" {
+		config.Thumbnails.Enabled = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_THUMBNAILS_VIDEO"); v != "" {
+		config.Thumbnails.Video = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_THUMBNAILS_FFMPEG"); v != "" {
+		config.Thumbnails.FFmpeg = v
+	}
+
+	// Photos
+	if v := os.Getenv("EASYSYNC_PHOTOS_EXIF"); v != "" {
+		config.Photos.Exif = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_PHOTOS_STRIP_GPS"); v != "" {
+		config.Photos.StripGPS = v == "true"
+	}
+
+	// Download
+	if v := os.Getenv("EASYSYNC_DOWNLOAD_SENDFILE"); v != "" {
+		config.Download.Sendfile = v == "true"
+	}
+
+	// Clipboard
+	if v := os.Getenv("EASYSYNC_CLIPBOARD_ENABLED"); v != "" {
+		config.Clipboard.Enabled = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_CLIPBOARD_MAX_TEXT_SIZE"); v != "" {
+		config.Clipboard.MaxTextSize = v
+	}
+	if v := os.Getenv("EASYSYNC_CLIPBOARD_MAX_IMAGE_SIZE"); v != "" {
+		config.Clipboard.MaxImageSize = v
+	}
+	if v := os.Getenv("EASYSYNC_CLIPBOARD_HISTORY"); v != "" {
+		if i, err := strconv.Atoi(v); err == nil {
+			config.Clipboard.History = i
+		}
+	}
+
+	// Trash
+	if v := os.Getenv("EASYSYNC_TRASH_ENABLED"); v != "" {
+		config.Trash.Enabled = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_TRASH_RETENTION"); v != "" {
+		config.Trash.Retention = v
+	}
+	if v := os.Getenv("EASYSYNC_TRASH_MAX_SIZE"); v != "" {
+		config.Trash.MaxSize = v
+	}
+
+	// Retention
+	if v := os.Getenv("EASYSYNC_RETENTION_ENABLED"); v != "" {
+		config.Retention.Enabled = v == "true"
+	}
+	if v := os.Getenv("EASYSYNC_RETENTION_INTERVAL"); v != "" {
+		config.Retention.Interval = v
+	}
+
 	// TUS
 	if v := os.Getenv("EASYSYNC_TUS_BASE_PATH"); v != "" {
 		config.TUS.BasePath = v
@@ -269,6 +597,9 @@ func LoadFromEnv(config *Config) {
 	if v := os.Getenv("EASYSYNC_TUS_META_SUFFIX"); v != "" {
 		config.TUS.MetaSuffix = v
 	}
+	if v := os.Getenv("EASYSYNC_TUS_INFO_SUFFIX"); v != "" {
+		config.TUS.InfoSuffix = v
+	}
 
 	// Logging
 	if v := os.Getenv("EASYSYNC_LOGGING_LEVEL"); v != "" {
@@ -372,15 +703,20 @@ func ParseSize(s string) (int64, error) {
 		return 0, fmt.Errorf("empty size string")
 	}
 
-	multipliers := map[string]int64{
-		"B":  1,
-		"KB": 1024,
-		"MB": 1024 * 1024,
-		"GB": 1024 * 1024 * 1024,
-		"TB": 1024 * 1024 * 1024 * 1024,
+	// Longer suffixes first, otherwise "10GB" would match "B"
+	multipliers := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1024 * 1024 * 1024 * 1024},
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
 	}
 
-	for suffix, multiplier := range multipliers {
+	for _, m := range multipliers {
+		suffix, multiplier := m.suffix, m.multiplier
 		if strings.HasSuffix(s, suffix) {
 			numStr := strings.TrimSuffix(s, suffix)
 			numStr = strings.TrimSpace(numStr)
@@ -414,6 +750,72 @@ func (c *Config) GetMaxFileSizeBytes() (int64, error) {
 	return ParseSize(c.Storage.MaxFileSize)
 }
 
+// parseOptionalSize parses a size string, treating an empty string as 0 (unlimited)
+func parseOptionalSize(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	return ParseSize(s)
+}
+
+// GetQuotaMaxTotalBytes returns the inbox quota in bytes, 0 means unlimited
+func (c *Config) GetQuotaMaxTotalBytes() (int64, error) {
+	return parseOptionalSize(c.Quota.MaxTotalSize)
+}
+
+// GetQuotaMaxDeviceBytes returns the per-device quota in bytes, 0 means unlimited
+func (c *Config) GetQuotaMaxDeviceBytes() (int64, error) {
+	return parseOptionalSize(c.Quota.MaxDeviceSize)
+}
+
+// GetQuotaMinFreeBytes returns the minimum free disk space in bytes, 0 disables the guard
+func (c *Config) GetQuotaMinFreeBytes() (int64, error) {
+	return parseOptionalSize(c.Quota.MinFreeSpace)
+}
+
+// GetClipboardMaxTextBytes returns the largest clipboard text in bytes
+func (c *Config) GetClipboardMaxTextBytes() (int64, error) {
+	return ParseSize(c.Clipboard.MaxTextSize)
+}
+
+// GetClipboardMaxImageBytes returns the largest clipboard image in bytes
+func (c *Config) GetClipboardMaxImageBytes() (int64, error) {
+	return ParseSize(c.Clipboard.MaxImageSize)
+}
+
+// GetTrashRetention returns how long deleted files are kept, 0 keeps them until purged
+func (c *Config) GetTrashRetention() (time.Duration, error) {
+	if strings.TrimSpace(c.Trash.Retention) == "" {
+		return 0, nil
+	}
+	return ParseDuration(c.Trash.Retention)
+}
+
+// GetTrashMaxBytes returns the trash size limit in bytes, 0 means unlimited
+func (c *Config) GetTrashMaxBytes() (int64, error) {
+	return parseOptionalSize(c.Trash.MaxSize)
+}
+
+// GetRetentionInterval returns how often the retention rules are enforced
+func (c *Config) GetRetentionInterval() (time.Duration, error) {
+	return ParseDuration(c.Retention.Interval)
+}
+
+// GetThrottleUploadRate returns the total upload rate in bytes per second, 0 means unlimited
+func (c *Config) GetThrottleUploadRate() (int64, error) {
+	return parseOptionalSize(c.Throttle.UploadRate)
+}
+
+// GetThrottleDeviceUploadRate returns the per-device upload rate in bytes per second, 0 means unlimited
+func (c *Config) GetThrottleDeviceUploadRate() (int64, error) {
+	return parseOptionalSize(c.Throttle.DeviceUploadRate)
+}
+
+// GetS3PartSizeBytes returns the part size of S3 multipart uploads in bytes
+func (c *Config) GetS3PartSizeBytes() (int64, error) {
+	return ParseSize(c.Storage.S3.PartSize)
+}
+
 // GetShutdownTimeout returns the shutdown timeout as time.Duration
 func (c *Config) GetShutdownTimeout() (time.Duration, error) {
 	return ParseDuration(c.Server.ShutdownTimeout)
@@ -442,4 +844,188 @@ func (c *Config) GetWebSocketPingPeriod() (time.Duration, error) {
 // GetWebSocketPingMessageInterval returns the WebSocket ping message interval as time.Duration
 func (c *Config) GetWebSocketPingMessageInterval() (time.Duration, error) {
 	return ParseDuration(c.WebSocket.PingMessageInterval)
-}
\ No newline at end of file
+}
+// Validate checks the settings that can be checked without touching the
+// system, reporting every problem found. Shared folders, sync folders and
+// hooks are checked further when the server starts.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	duration := func(field, value string) {
+		_, err := ParseDuration(value)
+		check(field, err)
+	}
+	size := func(field, value string) {
+		_, err := ParseSize(value)
+		check(field, err)
+	}
+	optionalSize := func(field, value string) {
+		_, err := parseOptionalSize(value)
+		check(field, err)
+	}
+
+	if c.Server.Port < 0 || c.Server.Port > 65535 {
+		invalid("server.port", "%d is not a valid port", c.Server.Port)
+	}
+	if c.Server.HTTPS && (c.Server.CertFile == "" || c.Server.KeyFile == "") {
+		invalid("server.https", "cert_file and key_file are required")
+	}
+	duration("server.shutdown_timeout", c.Server.ShutdownTimeout)
+
+	if c.Storage.UploadDir == "" {
+		invalid("storage.upload_dir", "is required")
+	}
+	if c.Storage.DataDir == "" {
+		invalid("storage.data_dir", "is required")
+	}
+	size("storage.max_file_size", c.Storage.MaxFileSize)
+	switch c.Storage.Layout {
+	case "", "flat", "device", "date":
+	default:
+		invalid("storage.layout", "unknown layout %q, use flat, device or date", c.Storage.Layout)
+	}
+	switch c.Storage.Backend {
+	case "", "local":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			invalid("storage.s3", "endpoint and bucket are required")
+		}
+		size("storage.s3.part_size", c.Storage.S3.PartSize)
+	default:
+		invalid("storage.backend", "unknown backend %q, use local or s3", c.Storage.Backend)
+	}
+
+	duration("websocket.read_timeout", c.WebSocket.ReadTimeout)
+	duration("websocket.write_timeout", c.WebSocket.WriteTimeout)
+	duration("websocket.ping_period", c.WebSocket.PingPeriod)
+	duration("websocket.ping_message_interval", c.WebSocket.PingMessageInterval)
+	if c.WebSocket.ReadLimit <= 0 {
+		invalid("websocket.read_limit", "must be positive")
+	}
+
+	duration("security.jwt_token_expiry", c.Security.JWTTokenExpiry)
+
+	optionalSize("quota.max_total_size", c.Quota.MaxTotalSize)
+	optionalSize("quota.max_device_size", c.Quota.MaxDeviceSize)
+	optionalSize("quota.min_free_space", c.Quota.MinFreeSpace)
+	if c.Quota.MaxDeviceFiles < 0 {
+		invalid("quota.max_device_files", "must not be negative")
+	}
+
+	optionalSize("throttle.upload_rate", c.Throttle.UploadRate)
+	optionalSize("throttle.device_upload_rate", c.Throttle.DeviceUploadRate)
+	if c.Throttle.MaxDeviceUploads < 0 {
+		invalid("throttle.max_device_uploads", "must not be negative")
+	}
+
+	if c.Thumbnails.Enabled {
+		for _, px := range c.Thumbnails.Sizes {
+			if px < 16 || px > 4096 {
+				invalid("thumbnails.sizes", "%d must be between 16 and 4096", px)
+			}
+		}
+	}
+
+	if c.Clipboard.Enabled {
+		size("clipboard.max_text_size", c.Clipboard.MaxTextSize)
+		size("clipboard.max_image_size", c.Clipboard.MaxImageSize)
+	}
+
+	_, err := c.GetTrashRetention()
+	check("trash.retention", err)
+	optionalSize("trash.max_size", c.Trash.MaxSize)
+
+	if c.Retention.Enabled {
+		if interval, err := c.GetRetentionInterval(); err != nil {
+			check("retention.interval", err)
+		} else if interval <= 0 {
+			invalid("retention.interval", "must be positive")
+		}
+	}
+	for i, rule := range c.Retention.Rules {
+		field := fmt.Sprintf("retention.rules[%d]", i)
+		maxAge, ageErr := rule.GetMaxAge()
+		check(field+".max_age", ageErr)
+		maxBytes, sizeErr := rule.GetMaxBytes()
+		check(field+".max_size", sizeErr)
+		if ageErr == nil && sizeErr == nil && maxAge == 0 && maxBytes == 0 {
+			invalid(field, "needs max_age or max_size")
+		}
+		switch rule.Action {
+		case RetentionDelete:
+		case RetentionArchive:
+			if rule.Target == "" {
+				invalid(field+".target", "archive action requires a target folder")
+			}
+		default:
+			invalid(field+".action", "unknown action %q", rule.Action)
+		}
+	}
+
+	for i, hook := range c.Hooks {
+		field := fmt.Sprintf("hooks[%d]", i)
+		switch hook.Action {
+		case "command":
+			if len(hook.Command) == 0 {
+				invalid(field+".command", "command action requires a command")
+			}
+		case "move":
+			if hook.Target == "" {
+				invalid(field+".target", "move action requires a target folder")
+			}
+		case "webhook":
+			if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+				invalid(field+".url", "webhook action requires an http(s) URL")
+			}
+		default:
+			invalid(field+".action", "unknown action %q", hook.Action)
+		}
+		_, err := hook.GetTimeout()
+		check(field+".timeout", err)
+	}
+
+	for i, share := range c.Shares {
+		field := fmt.Sprintf("shares[%d]", i)
+		if share.Name == "" {
+			invalid(field+".name", "is required")
+		}
+		if share.Path == "" {
+			invalid(field+".path", "is required")
+		}
+		switch share.Symlinks {
+		case "", SymlinksDeny, SymlinksInside, SymlinksFollow:
+		default:
+			invalid(field+".symlinks", "unknown symlink policy %q", share.Symlinks)
+		}
+	}
+
+	for i, folder := range c.SyncFolders {
+		field := fmt.Sprintf("sync_folders[%d]", i)
+		if folder.Name == "" {
+			invalid(field+".name", "is required")
+		}
+		if folder.Folder == "" {
+			invalid(field+".folder", "is required")
+		}
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace":
+	default:
+		invalid("logging.level", "unknown level %q", c.Logging.Level)
+	}
+	switch c.Logging.Format {
+	case "", "text", "json":
+	default:
+		invalid("logging.format", "unknown format %q, use text or json", c.Logging.Format)
+	}
+
+	return errors.Join(errs...)
+}
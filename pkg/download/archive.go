@@ -0,0 +1,262 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// Archive formats
+const (
+	ArchiveZip = "zip"
+	ArchiveTar = "tar"
+)
+
+// ErrArchiveFormat is returned for archive formats other than zip and tar
+var ErrArchiveFormat = errors.New("unsupported archive format")
+
+// MissingFilesError lists the requested files that do not exist
+type MissingFilesError struct {
+	IDs []string
+}
+
+func (e *MissingFilesError) Error() string {
+	return fmt.Sprintf("%d file(s) not found", len(e.IDs))
+}
+
+// ArchiveFiles resolves the files of an archive request: the given file IDs
+// followed by the files of the batch, each file once. The suggested archive
+// name is the batch name when a batch is given.
+func (h *Handler) ArchiveFiles(r *http.Request, ids []string, batchID string) ([]*catalog.FileMeta, string, error) {
+	name := ""
+	if batchID != "" {
+		batch, err := h.index.GetBatch(batchID)
+		if err != nil {
+			return nil, "", err
+		}
+		ids = append(append([]string{}, ids...), batch.Files...)
+		name = batch.Name
+	}
+
+	var files []*catalog.FileMeta
+	var missing []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		meta, err := h.index.Get(id)
+		if err == nil {
+			// The archive cannot report errors once streaming has started,
+			// so missing content is detected up front
+			_, err = h.backend.Stat(r.Context(), meta.Path)
+		}
+		if errors.Is(err, catalog.ErrNotFound) || errors.Is(err, storage.ErrNotExist) {
+			missing = append(missing, id)
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		files = append(files, meta)
+	}
+
+	if len(missing) > 0 {
+		return nil, "", &MissingFilesError{IDs: missing}
+	}
+	return files, name, nil
+}
+
+// ServeArchive streams files as a ZIP or TAR archive. Entries keep the
+// relative path of folder uploads; names that occur more than once get
+// " (1)", " (2)", ... appended. Nothing is buffered on disk, so the response
+// has no Content-Length.
+func (h *Handler) ServeArchive(w http.ResponseWriter, r *http.Request, name, format string, files []*catalog.FileMeta) error {
+	if format == "" {
+		format = ArchiveZip
+	}
+	if format != ArchiveZip && format != ArchiveTar {
+		return ErrArchiveFormat
+	}
+
+	if name == "" {
+		name = "easy-sync-" + time.Now().Format("20060102-150405")
+	}
+	fileName := upload.SanitizeFileName(name)
+	if !strings.EqualFold(filepath.Ext(fileName), "."+format) {
+		fileName += "." + format
+	}
+
+	if format == ArchiveZip {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fileName))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	var aw archiveWriter
+	if format == ArchiveZip {
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	} else {
+		aw = &tarArchive{tw: tar.NewWriter(w)}
+	}
+
+	var size int64
+	names := newArchiveNames()
+	for _, meta := range files {
+		entry := names.add(entryPath(meta))
+		if err := h.writeEntry(r, aw, entry, meta); err != nil {
+			// The status line is gone; leaving out the closing records
+			// makes the client see a broken archive rather than a
+			// complete one with files missing
+			h.logger.WithError(err).WithFields(logrus.Fields{
+				"file_id": meta.ID,
+				"entry":   entry,
+			}).Error("Failed to write archive entry")
+			return nil
+		}
+		size += meta.Size
+	}
+	if err := aw.Close(); err != nil {
+		h.logger.WithError(err).Error("Failed to finish archive")
+		return nil
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"archive": fileName,
+		"files":   len(files),
+		"size":    size,
+		"remote":  r.RemoteAddr,
+	}).Info("Archive downloaded")
+	return nil
+}
+
+func (h *Handler) writeEntry(r *http.Request, aw archiveWriter, entry string, meta *catalog.FileMeta) error {
+	begun := time.Now()
+	src, closer, err := h.openObject(r.Context(), meta.Path, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	dst, err := aw.Create(entry, meta.Size, meta.Created)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	h.sessions.served(r, &content{fileID: meta.ID, uploader: meta.DeviceID, name: meta.Name, size: meta.Size}, begun, 0, n)
+	if err != nil {
+		return err
+	}
+	if n != meta.Size {
+		return fmt.Errorf("stored size %d differs from recorded size %d", n, meta.Size)
+	}
+	return nil
+}
+
+// entryPath returns the path of a file inside an archive: its relative path
+// for folder uploads, otherwise its original name
+func entryPath(meta *catalog.FileMeta) string {
+	if rel := upload.SanitizeRelativePath(meta.RelativePath); rel != "" {
+		return rel
+	}
+	name := meta.Name
+	if name == "" {
+		name = path.Base(meta.Path)
+	}
+	return upload.SanitizeFileName(name)
+}
+
+// archiveNames hands out unique entry paths. Names are compared case
+// insensitively because archives are commonly extracted on filesystems that
+// do not distinguish case, and a file may not share its path with a folder.
+type archiveNames struct {
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+func newArchiveNames() *archiveNames {
+	return &archiveNames{files: make(map[string]bool), dirs: make(map[string]bool)}
+}
+
+func (n *archiveNames) add(entry string) string {
+	segments := strings.Split(entry, "/")
+
+	dir := ""
+	for _, segment := range segments[:len(segments)-1] {
+		candidate := path.Join(dir, segment)
+		for i := 1; n.files[strings.ToLower(candidate)]; i++ {
+			candidate = path.Join(dir, fmt.Sprintf("%s (%d)", segment, i))
+		}
+		n.dirs[strings.ToLower(candidate)] = true
+		dir = candidate
+	}
+
+	name := segments[len(segments)-1]
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := path.Join(dir, name)
+	for i := 1; n.files[strings.ToLower(candidate)] || n.dirs[strings.ToLower(candidate)]; i++ {
+		candidate = path.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+	n.files[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// archiveWriter adds files to a ZIP or TAR stream
+type archiveWriter interface {
+	Create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	// Entries are stored, not deflated: most transferred files are photos
+	// and videos that do not compress, and storing keeps the CPU idle
+	return a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	})
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+}
+
+func (a *tarArchive) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime.Truncate(time.Second),
+	})
+	return a.tw, err
+}
+
+func (a *tarArchive) Close() error {
+	return a.tw.Close()
+}
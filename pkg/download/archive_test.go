@@ -0,0 +1,275 @@
+package download
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/security"
+)
+
+// storeNamed stores content as a file with the given original name and
+// relative path
+func storeNamed(t *testing.T, h *Handler, id, name, relativePath, content string) *catalog.FileMeta {
+	t.Helper()
+	storeFile(t, h, id, content)
+	meta, err := h.index.Update(id, func(m *catalog.FileMeta) error {
+		m.Name = name
+		m.RelativePath = relativePath
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// serveArchive requests an archive of files as the paired device
+func serveArchive(t *testing.T, h *Handler, device, name, format string, files []*catalog.FileMeta) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/api/archive", nil)
+	if device != "" {
+		r = r.WithContext(security.WithDevice(r.Context(), device, device+" name"))
+	}
+	w := httptest.NewRecorder()
+	if err := h.ServeArchive(w, r, name, format, files); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+// readArchive lists the entries of a ZIP or TAR archive in order
+func readArchive(t *testing.T, format string, data []byte) []archiveEntry {
+	t.Helper()
+	var entries []archiveEntry
+
+	if format == ArchiveZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if f.Method != zip.Store {
+				t.Errorf("%s compressed with method %d", f.Name, f.Method)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, archiveEntry{f.Name, string(content)})
+		}
+		return entries
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, archiveEntry{hdr.Name, string(content)})
+	}
+}
+
+func TestArchiveNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		expect  []string
+	}{
+		{"same name twice", []string{"a.txt", "a.txt", "a.txt"}, []string{"a.txt", "a (1).txt", "a (2).txt"}},
+		{"case differences", []string{"Report.pdf", "report.PDF"}, []string{"Report.pdf", "report (1).PDF"}},
+		{"file before folder", []string{"docs", "docs/x.txt", "docs/y.txt"}, []string{"docs", "docs (1)/x.txt", "docs (1)/y.txt"}},
+		{"folder before file", []string{"docs/x.txt", "docs", "DOCS"}, []string{"docs/x.txt", "docs (1)", "DOCS (2)"}},
+		{"same file in one folder", []string{"a/b.txt", "a/b.txt"}, []string{"a/b.txt", "a/b (1).txt"}},
+		{"no extension", []string{"README", "readme"}, []string{"README", "readme (1)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := newArchiveNames()
+			var got []string
+			for _, entry := range tt.entries {
+				got = append(got, names.add(entry))
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got %q, want %q", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestServeArchive(t *testing.T) {
+	for _, format := range []string{ArchiveZip, ArchiveTar} {
+		t.Run(format, func(t *testing.T) {
+			h := newTestHandler(t, false)
+			files := []*catalog.FileMeta{
+				storeNamed(t, h, "a1", "a.txt", "", "first"),
+				storeNamed(t, h, "a2", "a.txt", "", "second"),
+				storeNamed(t, h, "a3", "A.TXT", "", "third"),
+				storeNamed(t, h, "f1", "Trip", "", "a file named like the folder"),
+				storeNamed(t, h, "p1", "1.jpg", "Trip/1.jpg", "photo one"),
+				storeNamed(t, h, "p2", "2.jpg", "Trip/day 2/2.jpg", "photo two"),
+				storeNamed(t, h, "e1", "empty.txt", "", ""),
+			}
+
+			w := serveArchive(t, h, "", "Holiday", format, files)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			contentType := map[string]string{ArchiveZip: "application/zip", ArchiveTar: "application/x-tar"}[format]
+			if got := w.Header().Get("Content-Type"); got != contentType {
+				t.Errorf("Content-Type %s", got)
+			}
+			if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, `filename="Holiday.`+format+`"`) {
+				t.Errorf("Content-Disposition %s", got)
+			}
+
+			expect := []archiveEntry{
+				{"a.txt", "first"},
+				{"a (1).txt", "second"},
+				{"A (2).TXT", "third"},
+				{"Trip", "a file named like the folder"},
+				{"Trip (1)/1.jpg", "photo one"},
+				{"Trip (1)/day 2/2.jpg", "photo two"},
+				{"empty.txt", ""},
+			}
+			if got := readArchive(t, format, w.Body.Bytes()); !reflect.DeepEqual(got, expect) {
+				t.Errorf("entries %q, want %q", got, expect)
+			}
+		})
+	}
+}
+
+func TestServeArchiveFormat(t *testing.T) {
+	h := newTestHandler(t, false)
+	files := []*catalog.FileMeta{storeFile(t, h, "a", "content")}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/archive", nil)
+	w := httptest.NewRecorder()
+	if err := h.ServeArchive(w, r, "", "rar", files); !errors.Is(err, ErrArchiveFormat) {
+		t.Errorf("rar: %v", err)
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || len(w.Header()) != 0 {
+		t.Error("response written for an unsupported format")
+	}
+
+	// The extension is added unless the name already has it
+	for name, expect := range map[string]string{"photos.ZIP": "photos.ZIP", "photos": "photos.zip", "a/b": "b.zip"} {
+		w := serveArchive(t, h, "", name, "", files)
+		if got := w.Header().Get("Content-Disposition"); !strings.Contains(got, `filename="`+expect+`"`) {
+			t.Errorf("%s: Content-Disposition %s", name, got)
+		}
+	}
+}
+
+func TestArchiveReceipts(t *testing.T) {
+	h := newTestHandler(t, false)
+	sent := captureReceipts(h)
+
+	var files []*catalog.FileMeta
+	for id, uploader := range map[string]string{"mine": "laptop-id", "theirs": "phone-id", "anonymous": ""} {
+		storeFile(t, h, id, "content of "+id)
+		meta, err := h.index.Update(id, func(m *catalog.FileMeta) error {
+			// The claimed label must not decide who hears about downloads
+			m.Device = "laptop-id"
+			m.DeviceID = uploader
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, meta)
+	}
+
+	serveArchive(t, h, "laptop-id", "", ArchiveZip, files)
+
+	got := sent()
+	if len(got) != 1 || got[0].to != "phone-id" {
+		t.Fatalf("receipts %+v, want one to phone-id", got)
+	}
+	if got[0].receipt.Device != "laptop-id" || got[0].receipt.Size != int64(len("content of theirs")) {
+		t.Errorf("receipt %+v", got[0].receipt)
+	}
+
+	for _, meta := range files {
+		records, _, err := h.DownloadHistory(meta.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || !records[0].Completed || records[0].Device != "laptop-id" {
+			t.Errorf("%s: history %+v", meta.ID, records)
+		}
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	h := newTestHandler(t, false)
+	r := httptest.NewRequest(http.MethodPost, "/api/archive", nil)
+	for _, id := range []string{"a", "b", "c", "gone"} {
+		storeFile(t, h, id, "content of "+id)
+	}
+	if _, err := h.index.UpdateBatch("trip", func(b *catalog.Batch) error {
+		b.Name = "Trip"
+		b.Files = []string{"b", "c"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, name, err := h.ArchiveFiles(r, []string{"a", "b", "a"}, "trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, meta := range files {
+		ids = append(ids, meta.ID)
+	}
+	if name != "Trip" || strings.Join(ids, ",") != "a,b,c" {
+		t.Errorf("got %s with %v", name, ids)
+	}
+
+	if _, _, err := h.ArchiveFiles(r, nil, "unknown"); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("unknown batch: %v", err)
+	}
+
+	// Files without metadata or content are reported up front
+	if err := h.backend.Delete(r.Context(), "gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = h.ArchiveFiles(r, []string{"a", "missing", "gone"}, "")
+	var missing *MissingFilesError
+	if !errors.As(err, &missing) {
+		t.Fatalf("got %v, want MissingFilesError", err)
+	}
+	sort.Strings(missing.IDs)
+	if !reflect.DeepEqual(missing.IDs, []string{"gone", "missing"}) || missing.Error() != "2 file(s) not found" {
+		t.Errorf("missing %v: %s", missing.IDs, missing.Error())
+	}
+}
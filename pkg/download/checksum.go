@@ -0,0 +1,370 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"lukechampine.com/blake3"
+)
+
+// Checksum algorithms
+const (
+	AlgorithmSHA256 = "sha256"
+	AlgorithmBLAKE3 = "blake3"
+	AlgorithmMD5    = "md5"
+)
+
+// syncChecksumSize is the largest file hashed while the request waits.
+// Larger files are hashed by a background job the client polls.
+const syncChecksumSize = 64 << 20
+
+// maxChecksumJobs limits how many files are hashed at the same time
+const maxChecksumJobs = 2
+
+// checksumJob hashes one file with one or more algorithms in a single pass
+type checksumJob struct {
+	id         string
+	fileID     string
+	algorithms []string
+	size       int64
+	started    time.Time
+	hashed     atomic.Int64
+	running    atomic.Bool
+	done       chan struct{}
+
+	// Set before done is closed
+	checksums map[string]string
+	err       error
+}
+
+// checksumJobs runs checksum jobs, at most one per file and set of algorithms
+type checksumJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*checksumJob
+	slots chan struct{}
+}
+
+func newChecksumJobs() *checksumJobs {
+	return &checksumJobs{
+		jobs:  make(map[string]*checksumJob),
+		slots: make(chan struct{}, maxChecksumJobs),
+	}
+}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case AlgorithmSHA256:
+		return sha256.New()
+	case AlgorithmBLAKE3:
+		return blake3.New(32, nil)
+	case AlgorithmMD5:
+		return md5.New()
+	}
+	return nil
+}
+
+// cachedChecksum returns the checksum recorded in meta, if any
+func cachedChecksum(meta *catalog.FileMeta, algorithm string) string {
+	switch algorithm {
+	case AlgorithmSHA256:
+		return meta.SHA256
+	case AlgorithmBLAKE3:
+		return meta.BLAKE3
+	case AlgorithmMD5:
+		return meta.MD5
+	}
+	return ""
+}
+
+// parseAlgorithms reads the algorithm query parameters, which may be
+// repeated or comma separated. SHA-256 is the default.
+func parseAlgorithms(r *http.Request) ([]string, error) {
+	seen := make(map[string]bool)
+	var algorithms []string
+	for _, value := range r.URL.Query()["algorithm"] {
+		for _, algorithm := range strings.Split(value, ",") {
+			algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+			algorithm = strings.ReplaceAll(algorithm, "-", "")
+			if algorithm == "" || seen[algorithm] {
+				continue
+			}
+			if newChecksumHash(algorithm) == nil {
+				return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+			}
+			seen[algorithm] = true
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	if len(algorithms) == 0 {
+		algorithms = []string{AlgorithmSHA256}
+	}
+	return algorithms, nil
+}
+
+// HandleChecksum returns checksums of a file as JSON. Checksums are cached in
+// the file's metadata; missing ones are computed, right away for small files
+// and by a background job for large ones, in which case 202 is returned with
+// the job's progress and the client asks again.
+func (h *Handler) HandleChecksum(w http.ResponseWriter, r *http.Request) {
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+	fileID = strings.TrimSuffix(fileID, "/checksum")
+	if fileID == "" {
+		http.Error(w, "File ID required", http.StatusBadRequest)
+		return
+	}
+
+	algorithms, err := parseAlgorithms(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	meta, object, ok := h.resolve(w, r, fileID)
+	if !ok {
+		return
+	}
+
+	var missing []string
+	for _, algorithm := range algorithms {
+		if cachedChecksum(meta, algorithm) == "" {
+			missing = append(missing, algorithm)
+		}
+	}
+
+	if len(missing) > 0 {
+		job := h.checksums.start(h, meta, missing, object.Size)
+
+		if object.Size <= syncChecksumSize {
+			select {
+			case <-job.done:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		select {
+		case <-job.done:
+			if job.err != nil {
+				h.logger.WithError(job.err).WithField("file_id", fileID).Error("Failed to calculate checksum")
+				writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": "Failed to calculate checksum"})
+				return
+			}
+			for algorithm, sum := range job.checksums {
+				setChecksum(meta, algorithm, sum)
+			}
+		default:
+			status := "queued"
+			if job.running.Load() {
+				status = "running"
+			}
+			w.Header().Set("Retry-After", "2")
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{
+				"file_id":      fileID,
+				"status":       status,
+				"job_id":       job.id,
+				"algorithms":   job.algorithms,
+				"size":         job.size,
+				"bytes_hashed": job.hashed.Load(),
+				"started":      job.started,
+			})
+			return
+		}
+	}
+
+	checksums := make(map[string]string, len(algorithms))
+	for _, algorithm := range algorithms {
+		checksums[algorithm] = cachedChecksum(meta, algorithm)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"file_id":   fileID,
+		"status":    "done",
+		"size":      object.Size,
+		"checksums": checksums,
+	})
+}
+
+// start returns the job computing algorithms for meta, starting it unless it
+// is already running or has finished successfully. A job that failed is
+// replaced, so every request after a failure retries.
+func (j *checksumJobs) start(h *Handler, meta *catalog.FileMeta, algorithms []string, size int64) *checksumJob {
+	sorted := append([]string{}, algorithms...)
+	sort.Strings(sorted)
+	key := meta.ID + "|" + strings.Join(sorted, ",")
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if job, ok := j.jobs[key]; ok {
+		select {
+		case <-job.done:
+			if job.err == nil {
+				return job
+			}
+			delete(j.jobs, key)
+		default:
+			return job
+		}
+	}
+
+	job := &checksumJob{
+		id:         uuid.NewString(),
+		fileID:     meta.ID,
+		algorithms: sorted,
+		size:       size,
+		started:    time.Now(),
+		done:       make(chan struct{}),
+	}
+	j.jobs[key] = job
+
+	go func() {
+		j.slots <- struct{}{}
+		job.running.Store(true)
+		job.checksums, job.err = h.computeChecksums(job, meta.Path)
+		<-j.slots
+
+		// Results live on in the metadata; failures stay until the next
+		// request replaces them
+		if job.err == nil {
+			j.mu.Lock()
+			delete(j.jobs, key)
+			j.mu.Unlock()
+		}
+		close(job.done)
+	}()
+
+	return job
+}
+
+// computeChecksums hashes the stored object at key and records the results
+// in the file's metadata
+func (h *Handler) computeChecksums(job *checksumJob, key string) (map[string]string, error) {
+	started := time.Now()
+
+	src, err := h.backend.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	hashes := make(map[string]hash.Hash, len(job.algorithms))
+	writers := make([]io.Writer, 0, len(job.algorithms))
+	for _, algorithm := range job.algorithms {
+		hashes[algorithm] = newChecksumHash(algorithm)
+		writers = append(writers, hashes[algorithm])
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), &countingReader{r: src, n: &job.hashed}); err != nil {
+		return nil, err
+	}
+
+	checksums := make(map[string]string, len(hashes))
+	for algorithm, hasher := range hashes {
+		checksums[algorithm] = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	if _, err := h.index.Update(job.fileID, func(meta *catalog.FileMeta) error {
+		for algorithm, sum := range checksums {
+			setChecksum(meta, algorithm, sum)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to record checksums: %w", err)
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"file_id":    job.fileID,
+		"algorithms": strings.Join(job.algorithms, ","),
+		"size":       job.hashed.Load(),
+		"duration":   time.Since(started),
+	}).Info("Checksums calculated")
+	return checksums, nil
+}
+
+func setChecksum(meta *catalog.FileMeta, algorithm, sum string) {
+	switch algorithm {
+	case AlgorithmSHA256:
+		meta.SHA256 = sum
+	case AlgorithmBLAKE3:
+		meta.BLAKE3 = sum
+	case AlgorithmMD5:
+		meta.MD5 = sum
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// reprDigest formats the recorded checksums of meta as a Repr-Digest header
+// (RFC 9530), which describes the whole file and so also fits 206 responses
+func reprDigest(meta *catalog.FileMeta) string {
+	var fields []string
+	if sum := digestBase64(meta.SHA256); sum != "" {
+		fields = append(fields, "sha-256=:"+sum+":")
+	}
+	if sum := digestBase64(meta.MD5); sum != "" {
+		fields = append(fields, "md5=:"+sum+":")
+	}
+	return strings.Join(fields, ", ")
+}
+
+// instanceDigest formats the recorded checksums of meta as a Digest header
+// (RFC 3230) for clients that predate Repr-Digest
+func instanceDigest(meta *catalog.FileMeta) string {
+	var fields []string
+	if sum := digestBase64(meta.SHA256); sum != "" {
+		fields = append(fields, "SHA-256="+sum)
+	}
+	if sum := digestBase64(meta.MD5); sum != "" {
+		fields = append(fields, "MD5="+sum)
+	}
+	return strings.Join(fields, ",")
+}
+
+func digestBase64(sum string) string {
+	raw, err := hex.DecodeString(sum)
+	if err != nil || len(raw) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
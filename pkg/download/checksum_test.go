@@ -0,0 +1,117 @@
+package download
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitJob waits for a checksum job to finish
+func waitJob(t *testing.T, job *checksumJob) {
+	t.Helper()
+	select {
+	case <-job.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("checksum job did not finish")
+	}
+}
+
+func TestChecksumJobLifecycle(t *testing.T) {
+	h := newTestHandler(t, false)
+	meta := storeFile(t, h, "report", "quarterly numbers")
+	ctx := context.Background()
+
+	// Queued while all slots are taken; asking again joins the same job,
+	// whatever the order of the algorithms
+	for i := 0; i < maxChecksumJobs; i++ {
+		h.checksums.slots <- struct{}{}
+	}
+	job := h.checksums.start(h, meta, []string{AlgorithmMD5, AlgorithmBLAKE3}, meta.Size)
+	if again := h.checksums.start(h, meta, []string{AlgorithmBLAKE3, AlgorithmMD5}, meta.Size); again != job {
+		t.Error("second request started another job")
+	}
+	if other := h.checksums.start(h, meta, []string{AlgorithmMD5}, meta.Size); other == job {
+		t.Error("different algorithms share a job")
+	}
+	if job.running.Load() {
+		t.Error("job running without a slot")
+	}
+	for i := 0; i < maxChecksumJobs; i++ {
+		<-h.checksums.slots
+	}
+
+	waitJob(t, job)
+	if job.err != nil {
+		t.Fatal(job.err)
+	}
+	sum := md5.Sum([]byte("quarterly numbers"))
+	if job.checksums[AlgorithmMD5] != hex.EncodeToString(sum[:]) || job.checksums[AlgorithmBLAKE3] == "" {
+		t.Errorf("checksums %v", job.checksums)
+	}
+	saved, err := h.index.Get(meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.MD5 != job.checksums[AlgorithmMD5] || saved.BLAKE3 != job.checksums[AlgorithmBLAKE3] {
+		t.Errorf("checksums not recorded: %+v", saved)
+	}
+
+	// Finished jobs are forgotten, their results live in the metadata
+	if next := h.checksums.start(h, meta, []string{AlgorithmMD5, AlgorithmBLAKE3}, meta.Size); next == job {
+		t.Error("finished job reused")
+	} else {
+		waitJob(t, next)
+	}
+
+	// A failure is kept until the next request, which starts over
+	if err := h.backend.Delete(ctx, meta.Path); err != nil {
+		t.Fatal(err)
+	}
+	failed := h.checksums.start(h, meta, []string{AlgorithmSHA256}, meta.Size)
+	waitJob(t, failed)
+	if failed.err == nil {
+		t.Fatal("job over a missing file succeeded")
+	}
+	storeFile(t, h, "report", "quarterly numbers")
+	retry := h.checksums.start(h, meta, []string{AlgorithmSHA256}, meta.Size)
+	if retry == failed {
+		t.Fatal("failed job returned again")
+	}
+	waitJob(t, retry)
+	if retry.err != nil || retry.checksums[AlgorithmSHA256] != meta.SHA256 {
+		t.Errorf("retry returned %v, %v", retry.checksums, retry.err)
+	}
+}
+
+func TestHandleChecksum(t *testing.T) {
+	h := newTestHandler(t, false)
+	meta := storeFile(t, h, "report", "quarterly numbers")
+
+	tests := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"", 200, `"sha256":"` + meta.SHA256 + `"`},
+		{"?algorithm=md5", 200, `"md5":"`},
+		{"?algorithm=SHA-256,blake3&algorithm=md5", 200, `"blake3":"`},
+		{"?algorithm=crc32", 400, "unsupported algorithm"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.HandleChecksum(w, httptest.NewRequest(http.MethodGet, "/files/report/checksum"+tt.query, nil))
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: %d %s", tt.query, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	h.HandleChecksum(w, httptest.NewRequest(http.MethodGet, "/files/missing/checksum", nil))
+	if w.Code != 404 {
+		t.Errorf("missing file: %d", w.Code)
+	}
+}
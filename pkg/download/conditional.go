@@ -0,0 +1,135 @@
+package download
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// precondition is the outcome of evaluating the conditional request headers
+type precondition int
+
+const (
+	preconditionPassed precondition = iota
+	preconditionNotModified
+	preconditionFailed
+)
+
+// fileETag returns the strong entity tag of a file, derived from its content
+// hash. Files without a recorded hash have no entity tag.
+func fileETag(sum string) string {
+	if sum == "" {
+		return ""
+	}
+	return `"` + sum + `"`
+}
+
+// checkPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since in the order given by RFC 7232 section 6
+func checkPreconditions(r *http.Request, etag string, modTime time.Time) precondition {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatches(im, etag, true) {
+			return preconditionFailed
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && !modTime.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && modTime.Truncate(time.Second).After(t) {
+			return preconditionFailed
+		}
+	}
+
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, etag, false) {
+			if safe {
+				return preconditionNotModified
+			}
+			return preconditionFailed
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && safe && !modTime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.Truncate(time.Second).After(t) {
+			return preconditionNotModified
+		}
+	}
+
+	return preconditionPassed
+}
+
+// ifRangeMatches reports whether a Range request may be answered partially.
+// If-Range holds either an entity tag, which must match strongly, or the
+// exact Last-Modified date.
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		tag, _ := scanETag(ir)
+		return tag != "" && etagsMatch(tag, etag, true)
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && modTime.Truncate(time.Second).Equal(t)
+}
+
+// etagListMatches checks etag against an If-Match or If-None-Match list.
+// Strong comparison is used for If-Match, weak comparison otherwise.
+func etagListMatches(list, etag string, strong bool) bool {
+	// The file exists, which is all "*" asks for
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			break
+		}
+		tag, rest := scanETag(list)
+		if tag == "" {
+			return false
+		}
+		if etagsMatch(tag, etag, strong) {
+			return true
+		}
+		list = rest
+	}
+	return false
+}
+
+// etagsMatch compares two entity tags. Weak tags never match strongly.
+func etagsMatch(a, b string, strong bool) bool {
+	if strong {
+		return a == b && !strings.HasPrefix(a, "W/") && !strings.HasPrefix(b, "W/")
+	}
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// scanETag reads the entity tag at the start of s and returns it with the
+// remainder of s. An empty tag is returned when s does not start with one.
+func scanETag(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	for i := start + 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		case c == 0x21 || (c >= 0x23 && c <= 0x7E) || c >= 0x80:
+			// etagc
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package download
+
+import "time"
+
+// cpuTime is not measured on Windows
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
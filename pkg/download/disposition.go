@@ -0,0 +1,131 @@
+package download
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// inlineTypes are the MIME types browsers render without running content
+// from the file. HTML, SVG and XML can carry scripts and are always
+// downloaded.
+var inlineTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/avif": true,
+	"image/bmp":  true,
+
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+	"video/quicktime": true,
+
+	"audio/mpeg": true,
+	"audio/mp4":  true,
+	"audio/aac":  true,
+	"audio/ogg":  true,
+	"audio/wav":  true,
+	"audio/flac": true,
+	"audio/webm": true,
+
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// inlineCSP keeps inline responses from loading or running anything.
+// Sandboxing stops Chrome's PDF viewer, so PDFs get the policy without it.
+const (
+	inlineCSP    = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+	inlineCSPBox = inlineCSP + "; sandbox"
+)
+
+// InlineAllowed reports whether files of mimeType may be shown in the browser
+func InlineAllowed(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	return inlineTypes[mediaType]
+}
+
+// wantsInline reports whether the request asks to display the file rather
+// than save it
+func wantsInline(r *http.Request) bool {
+	switch r.URL.Query().Get("inline") {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+// setDisposition sets Content-Disposition for fileName. Inline responses are
+// only given for safe types and carry a restrictive Content-Security-Policy.
+func setDisposition(w http.ResponseWriter, r *http.Request, fileName, mimeType string) {
+	disposition := "attachment"
+	if wantsInline(r) && InlineAllowed(mimeType) {
+		disposition = "inline"
+		if strings.HasPrefix(mimeType, "application/pdf") {
+			w.Header().Set("Content-Security-Policy", inlineCSP)
+		} else {
+			w.Header().Set("Content-Security-Policy", inlineCSPBox)
+		}
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, fileName))
+}
+
+// contentDisposition formats a Content-Disposition header. Names that are
+// not plain ASCII are sent as an RFC 5987 filename* parameter, with an ASCII
+// approximation in filename for clients that do not understand it.
+func contentDisposition(disposition, fileName string) string {
+	fallback := asciiFileName(fileName)
+	header := disposition + `; filename="` + fallback + `"`
+	if fallback != fileName {
+		header += "; filename*=UTF-8''" + encodeRFC5987(fileName)
+	}
+	return header
+}
+
+// asciiFileName replaces everything but printable ASCII, as well as the
+// quote and backslash that would end or escape the quoted string, with "_"
+func asciiFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7E || r == '"' || r == '\\' {
+			b.WriteByte('_')
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// encodeRFC5987 percent-encodes name as the value of an ext-value, leaving
+// only attr-char unescaped
+func encodeRFC5987(name string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0F])
+	}
+	return b.String()
+}
+
+// isAttrChar reports whether c is an attr-char of RFC 5987
+func isAttrChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,146 @@
+package download
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name        string
+		disposition string
+		fileName    string
+		expect      string
+	}{
+		{"ASCII", "attachment", "report 2026.pdf", `attachment; filename="report 2026.pdf"`},
+		{"inline", "inline", "photo.jpg", `inline; filename="photo.jpg"`},
+		{"Chinese", "attachment", "照片.jpg",
+			`attachment; filename="__.jpg"; filename*=UTF-8''%E7%85%A7%E7%89%87.jpg`},
+		{"quotes", "attachment", `say "hi".txt`,
+			`attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"backslash", "attachment", `a\b.txt`,
+			`attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`},
+		{"control characters", "attachment", "a\r\nb.txt",
+			`attachment; filename="a__b.txt"; filename*=UTF-8''a%0D%0Ab.txt`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentDisposition(tt.disposition, tt.fileName)
+			if got != tt.expect {
+				t.Errorf("got %s, want %s", got, tt.expect)
+			}
+
+			// The standard parser prefers filename* and recovers the name
+			_, params, err := mime.ParseMediaType(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params["filename"] != tt.fileName {
+				t.Errorf("parsed name %q, want %q", params["filename"], tt.fileName)
+			}
+		})
+	}
+}
+
+func TestASCIIFileName(t *testing.T) {
+	tests := map[string]string{
+		"plain.txt":      "plain.txt",
+		"文件 (1).pdf":     "__ (1).pdf",
+		`"quoted"`:       "_quoted_",
+		`back\slash`:     "back_slash",
+		"tab\there":      "tab_here",
+		"del\x7f":        "del_",
+		"émoji 😀.png":    "_moji _.png",
+		"~!#$&+-.^_`|{}": "~!#$&+-.^_`|{}",
+	}
+	for name, expect := range tests {
+		if got := asciiFileName(name); got != expect {
+			t.Errorf("asciiFileName(%q) = %q, want %q", name, got, expect)
+		}
+	}
+}
+
+func TestEncodeRFC5987(t *testing.T) {
+	tests := map[string]string{
+		"abcXYZ019":      "abcXYZ019",
+		"!#$&+-.^_`|~":   "!#$&+-.^_`|~",
+		"a b":            "a%20b",
+		"中文.txt":         "%E4%B8%AD%E6%96%87.txt",
+		`"\'%*;=`:        "%22%5C%27%25%2A%3B%3D",
+		"(1)[2]{3}/4?5@": "%281%29%5B2%5D%7B3%7D%2F4%3F5%40",
+	}
+	for name, expect := range tests {
+		got := encodeRFC5987(name)
+		if got != expect {
+			t.Errorf("encodeRFC5987(%q) = %q, want %q", name, got, expect)
+		}
+		if decoded, err := url.PathUnescape(got); err != nil || decoded != name {
+			t.Errorf("%q does not decode back: %q, %v", got, decoded, err)
+		}
+	}
+}
+
+func TestInlineAllowed(t *testing.T) {
+	tests := map[string]bool{
+		"image/jpeg":                true,
+		"image/PNG":                 true,
+		"video/mp4":                 true,
+		"audio/mpeg":                true,
+		"application/pdf":           true,
+		"text/plain; charset=utf-8": true,
+		"text/html":                 false,
+		"text/html; charset=utf-8":  false,
+		"image/svg+xml":             false,
+		"application/xhtml+xml":     false,
+		"text/xml":                  false,
+		"application/javascript":    false,
+		"application/octet-stream":  false,
+		"":                          false,
+		"not a type;;":              false,
+	}
+	for mimeType, expect := range tests {
+		if got := InlineAllowed(mimeType); got != expect {
+			t.Errorf("InlineAllowed(%q) = %v, want %v", mimeType, got, expect)
+		}
+	}
+}
+
+func TestSetDisposition(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		mimeType    string
+		disposition string
+		csp         string
+	}{
+		{"download by default", "", "image/jpeg", "attachment", ""},
+		{"inline image", "?inline=1", "image/jpeg", "inline", inlineCSPBox},
+		{"inline text", "?inline=true", "text/plain; charset=utf-8", "inline", inlineCSPBox},
+		{"inline PDF without sandbox", "?inline=1", "application/pdf", "inline", inlineCSP},
+		{"HTML is downloaded", "?inline=1", "text/html", "attachment", ""},
+		{"SVG is downloaded", "?inline=1", "image/svg+xml", "attachment", ""},
+		{"unknown inline value", "?inline=yes", "image/jpeg", "attachment", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files/id"+tt.query, nil)
+			w := httptest.NewRecorder()
+			setDisposition(w, r, "file", tt.mimeType)
+
+			if got := w.Header().Get("Content-Disposition"); got != tt.disposition+`; filename="file"` {
+				t.Errorf("Content-Disposition %s", got)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); got != tt.csp {
+				t.Errorf("Content-Security-Policy %q, want %q", got, tt.csp)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options %q", got)
+			}
+		})
+	}
+}
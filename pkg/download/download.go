@@ -1,50 +1,58 @@
 package download
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/easy-sync/easy-sync/pkg/catalog"
 	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/storage"
 )
 
 type Handler struct {
-	config *config.Config
-	logger *logrus.Logger
+	config    *config.Config
+	logger    *logrus.Logger
+	index     *catalog.Index
+	backend   storage.Backend
+	sendfile  bool
+	sessions  *sessions
+	checksums *checksumJobs
+
+	trashMu sync.Mutex // serializes restoring and purging
+	purgeMu sync.Mutex
+	purged  []func(fileID string)
 }
 
-type FileMetadata struct {
-	ID       string    `json:"id"`
-	Name     string    `json:"name"`
-	Size     int64     `json:"size"`
-	MimeType string    `json:"mime_type"`
-	SHA256   string    `json:"sha256"`
-	UploadID string    `json:"upload_id"`
-	Created  time.Time `json:"created"`
-	Device   string    `json:"device"`
-}
-
-func NewHandler(cfg *config.Config, logger *logrus.Logger) *Handler {
-	return &Handler{
-		config: cfg,
-		logger: logger,
+func NewHandler(cfg *config.Config, logger *logrus.Logger, index *catalog.Index, backend storage.Backend) *Handler {
+	h := &Handler{
+		config:    cfg,
+		logger:    logger,
+		index:     index,
+		backend:   backend,
+		sendfile:  cfg.Download.Sendfile,
+		sessions:  newSessions(index, logger),
+		checksums: newChecksumJobs(),
 	}
+	if cfg.Trash.Enabled {
+		go h.expireTrash()
+	}
+	return h
 }
 
 func (h *Handler) HandleDownload(w http.ResponseWriter, r *http.Request) {
 	// Add CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Range, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Range, Authorization, If-Match, If-None-Match, If-Modified-Since, If-Unmodified-Since, If-Range")
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Range, Content-Length, Content-Disposition, ETag, Last-Modified, Digest, Repr-Digest")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusNoContent)
@@ -57,60 +65,116 @@ func (h *Handler) HandleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(h.config.Storage.UploadDir, fileID)
-	metaPath := filepath.Join(h.config.Storage.UploadDir, fileID+".meta")
-
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	// Resolve the file through the metadata index
+	meta, object, ok := h.resolve(w, r, fileID)
+	if !ok {
 		return
 	}
 
-	// Load metadata
-	meta, err := h.loadMetadata(metaPath)
-	if err != nil {
-		h.logger.WithError(err).Warn("Failed to load file metadata")
-		// Continue without metadata
-		meta = &FileMetadata{
-			ID:   fileID,
-			Name: fileID,
-			Size: h.getFileSize(filePath),
-		}
+	fileName := meta.Name
+	if fileName == "" {
+		fileName = fileID
 	}
+	h.serveContent(w, r, &content{
+		id:       meta.ID,
+		fileID:   meta.ID,
+		uploader: meta.DeviceID,
+		name:     fileName,
+		mimeType: meta.MimeType,
+		etag:     fileETag(meta.SHA256),
+		digest:   instanceDigest(meta),
+		repr:     reprDigest(meta),
+		size:     object.Size,
+		modTime:  object.ModTime,
+		open: func(ctx context.Context, offset, length int64) (io.Reader, io.Closer, error) {
+			return h.openObject(ctx, meta.Path, offset, length)
+		},
+	})
+}
 
-	// Get file info
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
-		return
-	}
+// content is a file to be served: a stored upload or a file of a share
+type content struct {
+	id       string // for logging
+	fileID   string // set for uploads, whose downloads are tracked
+	uploader string // paired device that uploaded the file, if known
+	name     string
+	mimeType string
+	etag     string
+	digest   string // Digest header of the whole file, if its checksums are known
+	repr     string // Repr-Digest header
+	size     int64
+	modTime  time.Time
+
+	// open returns length bytes starting at offset, a negative length reads
+	// to the end
+	open func(ctx context.Context, offset, length int64) (io.Reader, io.Closer, error)
+}
 
+// serveContent answers a GET or HEAD request for c, honouring conditional
+// and range requests
+func (h *Handler) serveContent(w http.ResponseWriter, r *http.Request, c *content) {
 	// Set content type
-	if meta.MimeType != "" {
-		w.Header().Set("Content-Type", meta.MimeType)
+	if c.mimeType != "" {
+		w.Header().Set("Content-Type", c.mimeType)
 	} else {
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
 
 	// Set content disposition
-	fileName := meta.Name
-	if fileName == "" {
-		fileName = fileID
+	setDisposition(w, r, c.name, c.mimeType)
+
+	// Validators for caches and resumed downloads
+	w.Header().Set("Accept-Ranges", "bytes")
+	if c.etag != "" {
+		w.Header().Set("ETag", c.etag)
+	}
+	if !c.modTime.IsZero() {
+		w.Header().Set("Last-Modified", c.modTime.UTC().Format(http.TimeFormat))
+	}
+	if c.repr != "" {
+		w.Header().Set("Repr-Digest", c.repr)
 	}
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
 
-	// Set content length
-	w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+	switch checkPreconditions(r, c.etag, c.modTime) {
+	case preconditionNotModified:
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Content-Security-Policy")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case preconditionFailed:
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
 
-	// Handle range requests
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
-		h.handleRangeRequest(w, r, filePath, fileInfo.Size())
+	// Handle range requests; a stale If-Range asks for the whole file
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && ifRangeMatches(r, c.etag, c.modTime) {
+		ranges, err := parseRange(rangeHeader, c.size)
+		if errors.Is(err, errUnsatisfiable) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", c.size))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if ranges != nil {
+			h.serveRanges(w, r, c, ranges)
+			return
+		}
+		// Malformed range headers are ignored
+	}
+
+	// Set content length; Digest describes the body, so only full responses
+	// carry it
+	w.Header().Set("Content-Length", strconv.FormatInt(c.size, 10))
+	if c.digest != "" {
+		w.Header().Set("Digest", c.digest)
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
 	// Serve file
-	h.serveFile(w, r, filePath, meta)
+	h.serveFile(w, r, c)
 }
 
 func (h *Handler) HandleSHA256(w http.ResponseWriter, r *http.Request) {
@@ -132,126 +196,101 @@ func (h *Handler) HandleSHA256(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := filepath.Join(h.config.Storage.UploadDir, fileID)
-	metaPath := filepath.Join(h.config.Storage.UploadDir, fileID+".meta")
-
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-
-	// Try to get SHA256 from metadata first
-	meta, err := h.loadMetadata(metaPath)
-	if err == nil && meta.SHA256 != "" {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(meta.SHA256))
+	meta, object, ok := h.resolve(w, r, fileID)
+	if !ok {
 		return
 	}
 
-	// Calculate SHA256 if not in metadata
-	sha256, err := h.calculateSHA256(filePath)
-	if err != nil {
-		h.logger.WithError(err).Error("Failed to calculate SHA256")
-		http.Error(w, "Failed to calculate checksum", http.StatusInternalServerError)
-		return
+	// Calculate SHA256 if not in metadata, sharing a job already running
+	// for /checksum and recording the result
+	if meta.SHA256 == "" {
+		job := h.checksums.start(h, meta, []string{AlgorithmSHA256}, object.Size)
+		select {
+		case <-job.done:
+		case <-r.Context().Done():
+			return
+		}
+		if job.err != nil {
+			h.logger.WithError(job.err).Error("Failed to calculate SHA256")
+			http.Error(w, "Failed to calculate checksum", http.StatusInternalServerError)
+			return
+		}
+		meta.SHA256 = job.checksums[AlgorithmSHA256]
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(sha256))
+	w.Write([]byte(meta.SHA256))
 }
 
-func (h *Handler) handleRangeRequest(w http.ResponseWriter, r *http.Request, filePath string, fileSize int64) {
-	rangeHeader := r.Header.Get("Range")
-
-	// Parse range header
-	ranges := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
-	if len(ranges) != 2 {
-		http.Error(w, "Invalid range header", http.StatusBadRequest)
-		return
-	}
-
-	var start, end int64
-	var err error
-
-	if ranges[0] != "" {
-		start, err = strconv.ParseInt(ranges[0], 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid range start", http.StatusBadRequest)
-			return
+// resolve looks up the metadata and stored object of a file, writing an
+// error response when it cannot be found
+func (h *Handler) resolve(w http.ResponseWriter, r *http.Request, fileID string) (*catalog.FileMeta, *storage.ObjectInfo, bool) {
+	meta, err := h.index.Get(fileID)
+	if err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			h.logger.WithError(err).Error("Failed to load file metadata")
+			http.Error(w, "Failed to load file metadata", http.StatusInternalServerError)
 		}
+		return nil, nil, false
 	}
 
-	if ranges[1] != "" {
-		end, err = strconv.ParseInt(ranges[1], 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid range end", http.StatusBadRequest)
-			return
+	object, err := h.backend.Stat(r.Context(), meta.Path)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			h.logger.WithError(err).Error("Failed to get file info")
+			http.Error(w, "Failed to get file info", http.StatusInternalServerError)
 		}
-	} else {
-		end = fileSize - 1
-	}
-
-	// Validate range
-	if start < 0 || end >= fileSize || start > end {
-		http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
-		return
+		return nil, nil, false
 	}
 
-	// Set range headers
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
-	w.WriteHeader(http.StatusPartialContent)
-
-	// Serve range
-	h.serveFileRange(w, filePath, start, end)
+	return meta, object, true
 }
 
-func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, filePath string, meta *FileMetadata) {
-	file, err := os.Open(filePath)
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, c *content) {
+	begun := time.Now()
+	file, closer, err := c.open(r.Context(), 0, -1)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	defer closer.Close()
 
-	// Use sendfile for efficient copying if available
-	// For simplicity, we'll use io.Copy which is still efficient
-	_, err = io.Copy(w, file)
+	n, err := h.copyTo(w, file)
+	h.sessions.served(r, c, begun, 0, n)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to serve file")
 		return
 	}
 
 	h.logger.WithFields(logrus.Fields{
-		"file_id":   meta.ID,
-		"file_name": meta.Name,
-		"size":      meta.Size,
+		"file_id":   c.id,
+		"file_name": c.name,
+		"size":      c.size,
 		"remote":    r.RemoteAddr,
 	}).Info("File downloaded")
 }
 
-func (h *Handler) serveFileRange(w http.ResponseWriter, filePath string, start, end int64) {
-	file, err := os.Open(filePath)
+// serveFileRange copies bytes start to end of c to w and reports whether all
+// of them were written
+func (h *Handler) serveFileRange(w io.Writer, r *http.Request, c *content, start, end int64) bool {
+	begun := time.Now()
+	file, closer, err := c.open(r.Context(), start, end-start+1)
 	if err != nil {
-		http.Error(w, "Failed to open file", http.StatusInternalServerError)
-		return
-	}
-	defer file.Close()
-
-	// Seek to start position
-	_, err = file.Seek(start, io.SeekStart)
-	if err != nil {
-		http.Error(w, "Failed to seek file", http.StatusInternalServerError)
-		return
+		h.logger.WithError(err).Error("Failed to open file range")
+		return false
 	}
+	defer closer.Close()
 
 	// Copy specified range
-	limitedReader := io.LimitReader(file, end-start+1)
-	_, err = io.Copy(w, limitedReader)
+	n, err := h.copyTo(w, file)
+	h.sessions.served(r, c, begun, start, n)
 	if err != nil {
 		h.logger.WithError(err).Error("Failed to serve file range")
-		return
+		return false
 	}
 
 	h.logger.WithFields(logrus.Fields{
@@ -259,100 +298,11 @@ func (h *Handler) serveFileRange(w http.ResponseWriter, filePath string, start,
 		"end":   end,
 		"size":  end - start + 1,
 	}).Debug("File range served")
+	return true
 }
 
-func (h *Handler) loadMetadata(metaPath string) (*FileMetadata, error) {
-	file, err := os.Open(metaPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var meta FileMetadata
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&meta); err != nil {
-		return nil, err
-	}
-
-	return &meta, nil
-}
-
-func (h *Handler) getFileSize(filePath string) int64 {
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		return 0
-	}
-	return fileInfo.Size()
-}
-
-func (h *Handler) calculateSHA256(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
-}
-
-func (h *Handler) ListFiles() ([]*FileMetadata, error) {
-	files := make([]*FileMetadata, 0)
-
-	entries, err := os.ReadDir(h.config.Storage.UploadDir)
-	if err != nil {
-		return nil, err
-	}
-
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		// Skip metadata files
-		if strings.HasSuffix(entry.Name(), ".meta") {
-			continue
-		}
-
-		// Try to load metadata
-		metaPath := filepath.Join(h.config.Storage.UploadDir, entry.Name()+".meta")
-		meta, err := h.loadMetadata(metaPath)
-		if err != nil {
-			// Create minimal metadata from file info
-			filePath := filepath.Join(h.config.Storage.UploadDir, entry.Name())
-			meta = &FileMetadata{
-				ID:   entry.Name(),
-				Name: entry.Name(),
-				Size: h.getFileSize(filePath),
-			}
-		}
-
-		files = append(files, meta)
-	}
-
-	return files, nil
-}
-
-func (h *Handler) DeleteFile(fileID string) error {
-	filePath := filepath.Join(h.config.Storage.UploadDir, fileID)
-	metaPath := filepath.Join(h.config.Storage.UploadDir, fileID+".meta")
-
-	// Delete file
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete file: %w", err)
-	}
-
-	// Delete metadata
-	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
-		h.logger.WithError(err).Warn("Failed to delete metadata file")
-	}
-
-	h.logger.WithField("file_id", fileID).Info("File deleted")
-	return nil
+func (h *Handler) ListFiles() ([]*catalog.FileMeta, error) {
+	return h.index.List()
 }
 
 func (h *Handler) GenerateDownloadURL(fileID string, expires time.Duration) (string, error) {
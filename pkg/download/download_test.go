@@ -0,0 +1,101 @@
+package download
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestHandler returns a handler over an empty local storage
+func newTestHandler(tb testing.TB, sendfile bool) *Handler {
+	tb.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = tb.TempDir()
+	cfg.Storage.DataDir = tb.TempDir()
+	cfg.Download.Sendfile = sendfile
+	cfg.Trash.Enabled = false
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewHandler(cfg, logger, index, backend)
+}
+
+// storeFile stores content as a completed upload with the given ID
+func storeFile(tb testing.TB, h *Handler, id, content string) *catalog.FileMeta {
+	tb.Helper()
+
+	sum := sha256.Sum256([]byte(content))
+	meta := &catalog.FileMeta{
+		ID:       id,
+		Name:     id + ".txt",
+		Path:     id + ".txt",
+		Size:     int64(len(content)),
+		MimeType: "text/plain",
+		SHA256:   hex.EncodeToString(sum[:]),
+		Created:  time.Now(),
+		Device:   "desktop",
+	}
+	if err := h.backend.Put(context.Background(), meta.Path, strings.NewReader(content), meta.Size); err != nil {
+		tb.Fatal(err)
+	}
+	if err := h.index.Save(meta); err != nil {
+		tb.Fatal(err)
+	}
+	return meta
+}
+
+// download requests a file with the given headers
+func download(h *Handler, method, id string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/files/"+id, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	h.HandleDownload(w, r)
+	return w
+}
+
+func TestHandleDownload(t *testing.T) {
+	for _, sendfile := range []bool{false, true} {
+		h := newTestHandler(t, sendfile)
+		storeFile(t, h, "report", "quarterly numbers")
+
+		w := download(h, http.MethodGet, "report", nil)
+		if w.Code != http.StatusOK || w.Body.String() != "quarterly numbers" {
+			t.Errorf("sendfile %v: GET returned %d %q", sendfile, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Length"); got != "17" {
+			t.Errorf("sendfile %v: Content-Length %q", sendfile, got)
+		}
+
+		w = download(h, http.MethodHead, "report", nil)
+		if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("sendfile %v: HEAD returned %d with %d bytes", sendfile, w.Code, w.Body.Len())
+		}
+
+		if w := download(h, http.MethodGet, "missing", nil); w.Code != http.StatusNotFound {
+			t.Errorf("sendfile %v: GET of a missing file returned %d", sendfile, w.Code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/sirupsen/logrus"
+)
+
+// blobGracePeriod keeps recently changed blob records out of garbage
+// collection, as an upload records its blob reference just before its
+// metadata
+const blobGracePeriod = time.Hour
+
+// GarbageReport tells what CollectGarbage removed
+type GarbageReport struct {
+	TrashPurged  int   `json:"trash_purged"`  // files past the trash retention or size limit
+	BlobRefs     int   `json:"blob_refs"`     // blob references of files that are gone or changed
+	BlobsRemoved int   `json:"blobs_removed"` // stored content no file references any more
+	BytesFreed   int64 `json:"bytes_freed"`   // size of the removed blobs
+}
+
+// CollectGarbage purges files the trash limits no longer allow and releases
+// stored content left behind by files that were removed without releasing
+// it, for example when the server stopped halfway through a delete
+func (h *Handler) CollectGarbage(ctx context.Context) (*GarbageReport, error) {
+	report := &GarbageReport{}
+	if h.config.Trash.Enabled {
+		report.TrashPurged = h.purgeTrash(loadTrashLimits(h), time.Now())
+	}
+
+	blobs, err := h.index.ListBlobs()
+	if err != nil {
+		return report, err
+	}
+
+	h.trashMu.Lock()
+	defer h.trashMu.Unlock()
+
+	for _, blob := range blobs {
+		if time.Since(blob.Updated) < blobGracePeriod {
+			continue
+		}
+		for _, id := range blob.Refs {
+			if h.referencesBlob(id, blob.SHA256) {
+				continue
+			}
+
+			last, err := h.index.ReleaseBlob(blob.SHA256, id)
+			if err != nil {
+				return report, err
+			}
+			report.BlobRefs++
+			if !last {
+				continue
+			}
+
+			if err := h.backend.Delete(ctx, catalog.BlobKey(blob.SHA256)); err != nil {
+				return report, err
+			}
+			report.BlobsRemoved++
+			report.BytesFreed += blob.Size
+
+			h.logger.WithFields(logrus.Fields{
+				"sha256": blob.SHA256,
+				"size":   blob.Size,
+			}).Info("Unreferenced content removed")
+		}
+	}
+	return report, nil
+}
+
+// referencesBlob reports whether id is a file in the list or in the trash
+// with the given content. Read errors count as a reference, so nothing is
+// released by mistake.
+func (h *Handler) referencesBlob(id, sum string) bool {
+	meta, err := h.index.Get(id)
+	if errors.Is(err, catalog.ErrNotFound) {
+		var entry *catalog.TrashEntry
+		if entry, err = h.index.GetTrash(id); err == nil {
+			meta = entry.File
+		}
+	}
+	if err != nil {
+		return !errors.Is(err, catalog.ErrNotFound)
+	}
+	return meta.SHA256 == sum
+}
@@ -0,0 +1,56 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/easy-sync/easy-sync/pkg/upload"
+)
+
+// ServeLocalFile answers a GET or HEAD request with a file that is not part
+// of the storage, such as a file of a shared folder, with the same range and
+// conditional request handling as uploads. The caller opens the file, so the
+// path checks it did apply to exactly this file, and closes it afterwards.
+func (h *Handler) ServeLocalFile(w http.ResponseWriter, r *http.Request, file *os.File, name string) {
+	info, err := file.Stat()
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to get file info")
+		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+		return
+	}
+
+	h.serveContent(w, r, &content{
+		id:       file.Name(),
+		name:     name,
+		mimeType: upload.DetectMimeTypeReader(io.NewSectionReader(file, 0, info.Size()), name, ""),
+		etag:     localETag(info),
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		open: func(ctx context.Context, offset, length int64) (io.Reader, io.Closer, error) {
+			// Parts of a multipart response are served one after another,
+			// so seeking the shared handle is safe
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return nil, nil, err
+			}
+			// The announced length holds even if the file grows meanwhile
+			if length < 0 {
+				length = info.Size() - offset
+			}
+			return &io.LimitedReader{R: file, N: length}, noClose{}, nil
+		},
+	})
+}
+
+// noClose leaves closing the file to the caller of ServeLocalFile
+type noClose struct{}
+
+func (noClose) Close() error { return nil }
+
+// localETag derives an entity tag from the size and modification time of a
+// file, as there is no content hash for files outside the storage
+func localETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
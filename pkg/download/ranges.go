@@ -0,0 +1,175 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges limits how many ranges one request may ask for
+const maxRanges = 64
+
+// errUnsatisfiable is returned when none of the requested ranges overlaps the file
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a validated range of a file
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+// parseRange parses a Range header as defined in RFC 7233. Ranges past the
+// end of the file are dropped and ends are clamped to the file size.
+// errUnsatisfiable is returned when no range remains; a nil slice means the
+// header is malformed or unreasonable and the whole file should be sent.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		// Unknown range unit
+		return nil, nil
+	}
+
+	specs := strings.Split(header[len(prefix):], ",")
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	var total int64
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var br byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			br = byteRange{start: start, length: end - start + 1}
+		}
+
+		ranges = append(ranges, br)
+		total += br.length
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	// Overlapping or excessive ranges would make the response larger than
+	// the file itself; send the file instead
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// serveRanges answers a satisfiable Range request with 206, as a single part
+// or as multipart/byteranges
+func (h *Handler) serveRanges(w http.ResponseWriter, r *http.Request, c *content, ranges []byteRange) {
+	size := c.size
+	if len(ranges) == 1 {
+		br := ranges[0]
+		w.Header().Set("Content-Range", br.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(br.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method != http.MethodHead {
+			h.serveFileRange(w, r, c, br.start, br.start+br.length-1)
+		}
+		return
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	partHeader := func(br byteRange) textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {br.contentRange(size)},
+		}
+	}
+
+	// Measure the multipart framing so Content-Length can be announced
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	var length int64
+	for _, br := range ranges {
+		mw.CreatePart(partHeader(br))
+		length += br.length
+	}
+	mw.Close()
+	length += int64(counter)
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// The multipart writer does not buffer, so each part's content can be
+	// written straight to the connection after its header
+	var out io.Writer = w
+	if h.sendfile {
+		out = rawWriter(w)
+	}
+	body := multipart.NewWriter(out)
+	body.SetBoundary(mw.Boundary())
+	for _, br := range ranges {
+		if _, err := body.CreatePart(partHeader(br)); err != nil {
+			return
+		}
+		if !h.serveFileRange(out, r, c, br.start, br.start+br.length-1) {
+			return
+		}
+	}
+	body.Close()
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,185 @@
+package download
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		// Single ranges
+		{"bytes=0-4", 10, []byteRange{{0, 5}}, nil},
+		{"bytes=5-", 10, []byteRange{{5, 5}}, nil},
+		{"bytes=8-100", 10, []byteRange{{8, 2}}, nil},
+		{"bytes= 2 - 3 ", 10, []byteRange{{2, 2}}, nil},
+
+		// Suffix ranges
+		{"bytes=-3", 10, []byteRange{{7, 3}}, nil},
+		{"bytes=-10", 10, []byteRange{{0, 10}}, nil},
+		{"bytes=-100", 10, []byteRange{{0, 10}}, nil},
+		{"bytes=-0", 10, nil, errUnsatisfiable},
+		{"bytes=-5", 0, nil, errUnsatisfiable},
+
+		// Multiple ranges
+		{"bytes=0-1,4-5", 10, []byteRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1, -2", 10, []byteRange{{0, 2}, {8, 2}}, nil},
+		{"bytes=0-1,20-30", 10, []byteRange{{0, 2}}, nil},
+		{"bytes=0-1,,4-5", 10, []byteRange{{0, 2}, {4, 2}}, nil},
+
+		// Unsatisfiable
+		{"bytes=10-", 10, nil, errUnsatisfiable},
+		{"bytes=20-30,40-", 10, nil, errUnsatisfiable},
+		{"bytes=0-", 0, nil, errUnsatisfiable},
+
+		// Malformed or excessive, the whole file is sent
+		{"items=0-4", 10, nil, nil},
+		{"bytes=4", 10, nil, nil},
+		{"bytes=5-4", 10, nil, nil},
+		{"bytes=a-b", 10, nil, nil},
+		{"bytes=--1", 10, nil, nil},
+		{"bytes=0-9,0-9", 10, nil, nil},
+		{"bytes=" + strings.Repeat("0-0,", maxRanges) + "1-1", 10, nil, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, tt.size)
+		if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRange(%q, %d) = %v, %v, want %v, %v", tt.header, tt.size, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 30, 45, 500, time.UTC)
+	date := modTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		ifRange string
+		etag    string
+		modTime time.Time
+		want    bool
+	}{
+		{"", `"abc"`, modTime, true},
+		{`"abc"`, `"abc"`, modTime, true},
+		{`"abc"`, `"def"`, modTime, false},
+		{`W/"abc"`, `"abc"`, modTime, false},
+		{`"abc"`, `W/"abc"`, modTime, false},
+		{`"abc"`, "", modTime, false},
+		{date, `"abc"`, modTime, true},
+		{date, "", modTime, true},
+		{modTime.Add(time.Second).Format(http.TimeFormat), `"abc"`, modTime, false},
+		{modTime.Add(-time.Second).Format(http.TimeFormat), `"abc"`, modTime, false},
+		{date, `"abc"`, time.Time{}, false},
+		{"yesterday", `"abc"`, modTime, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/files/report", nil)
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		if got := ifRangeMatches(r, tt.etag, tt.modTime); got != tt.want {
+			t.Errorf("ifRangeMatches(%q, %q, %v) = %v, want %v", tt.ifRange, tt.etag, tt.modTime, got, tt.want)
+		}
+	}
+}
+
+func TestServeRanges(t *testing.T) {
+	const content = "0123456789"
+
+	type part struct {
+		contentRange string
+		body         string
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+		parts  []part // a single part is sent without multipart framing
+	}{
+		{"full", nil, http.StatusOK, []part{{"", content}}},
+		{"range", http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, []part{{"bytes 2-5/10", "2345"}}},
+		{"open range", http.Header{"Range": {"bytes=7-"}}, http.StatusPartialContent, []part{{"bytes 7-9/10", "789"}}},
+		{"suffix", http.Header{"Range": {"bytes=-3"}}, http.StatusPartialContent, []part{{"bytes 7-9/10", "789"}}},
+		{"long suffix", http.Header{"Range": {"bytes=-50"}}, http.StatusPartialContent, []part{{"bytes 0-9/10", content}}},
+		{"multi", http.Header{"Range": {"bytes=0-1,-2"}}, http.StatusPartialContent, []part{{"bytes 0-1/10", "01"}, {"bytes 8-9/10", "89"}}},
+		{"multi partly past end", http.Header{"Range": {"bytes=1-2,30-40,4-"}}, http.StatusPartialContent, []part{{"bytes 1-2/10", "12"}, {"bytes 4-9/10", "456789"}}},
+		{"overlapping", http.Header{"Range": {"bytes=0-7,2-9"}}, http.StatusOK, []part{{"", content}}},
+		{"malformed", http.Header{"Range": {"bytes=x"}}, http.StatusOK, []part{{"", content}}},
+		{"unsatisfiable", http.Header{"Range": {"bytes=10-"}}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{"if-range etag", http.Header{"Range": {"bytes=-3"}, "If-Range": {"ETAG"}}, http.StatusPartialContent, []part{{"bytes 7-9/10", "789"}}},
+		{"if-range date", http.Header{"Range": {"bytes=-3"}, "If-Range": {"DATE"}}, http.StatusPartialContent, []part{{"bytes 7-9/10", "789"}}},
+		{"stale if-range etag", http.Header{"Range": {"bytes=-3"}, "If-Range": {`"stale"`}}, http.StatusOK, []part{{"", content}}},
+		{"stale if-range date", http.Header{"Range": {"bytes=-3"}, "If-Range": {"Mon, 01 Jan 2001 00:00:00 GMT"}}, http.StatusOK, []part{{"", content}}},
+		{"weak if-range", http.Header{"Range": {"bytes=-3"}, "If-Range": {"W/ETAG"}}, http.StatusOK, []part{{"", content}}},
+	}
+
+	for _, sendfile := range []bool{false, true} {
+		h := newTestHandler(t, sendfile)
+		storeFile(t, h, "digits", content)
+		head := download(h, http.MethodHead, "digits", nil).Header()
+		etag, date := head.Get("ETag"), head.Get("Last-Modified")
+
+		for _, tt := range tests {
+			header := http.Header{}
+			for key, values := range tt.header {
+				v := strings.NewReplacer("ETAG", etag, "DATE", date).Replace(values[0])
+				header.Set(key, v)
+			}
+			w := download(h, http.MethodGet, "digits", header)
+			name := tt.name
+			if sendfile {
+				name += " with sendfile"
+			}
+			if w.Code != tt.status {
+				t.Errorf("%s: status %d, want %d", name, w.Code, tt.status)
+				continue
+			}
+			if tt.status == http.StatusRequestedRangeNotSatisfiable {
+				if got := w.Header().Get("Content-Range"); got != "bytes */10" {
+					t.Errorf("%s: Content-Range %q", name, got)
+				}
+				continue
+			}
+
+			length := w.Body.Len()
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(length) {
+				t.Errorf("%s: Content-Length %s for %d bytes", name, got, length)
+			}
+
+			var got []part
+			mediaType, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+			if mediaType == "multipart/byteranges" {
+				mr := multipart.NewReader(w.Body, params["boundary"])
+				for {
+					p, err := mr.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+					body, _ := io.ReadAll(p)
+					got = append(got, part{p.Header.Get("Content-Range"), string(body)})
+				}
+			} else {
+				got = []part{{w.Header().Get("Content-Range"), w.Body.String()}}
+			}
+			if !reflect.DeepEqual(got, tt.parts) {
+				t.Errorf("%s: got %+v, want %+v", name, got, tt.parts)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/easy-sync/easy-sync/pkg/storage"
+)
+
+// openObject opens length bytes of the object at key starting at offset, a
+// negative length reads to the end. With Sendfile enabled, files of the local
+// backend are returned as *os.File or an *io.LimitedReader over one, which
+// the network stack passes to sendfile(2).
+func (h *Handler) openObject(ctx context.Context, key string, offset, length int64) (io.Reader, io.Closer, error) {
+	if local, ok := h.backend.(*storage.Local); ok && h.sendfile {
+		p, err := local.Path(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil, storage.ErrNotExist
+			}
+			return nil, nil, err
+		}
+		if offset > 0 {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				file.Close()
+				return nil, nil, err
+			}
+		}
+		if length < 0 {
+			return file, file, nil
+		}
+		return &io.LimitedReader{R: file, N: length}, file, nil
+	}
+
+	var rc io.ReadCloser
+	var err error
+	if offset == 0 && length < 0 {
+		rc, err = h.backend.Get(ctx, key)
+	} else {
+		rc, err = h.backend.GetRange(ctx, key, offset, length)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, rc, nil
+}
+
+// copyTo writes src to the response. With Sendfile enabled the copy goes
+// through the ReaderFrom of the net/http connection, which lets the kernel
+// move file contents to the socket without passing them through user space.
+func (h *Handler) copyTo(w io.Writer, src io.Reader) (int64, error) {
+	if h.sendfile {
+		w = rawWriter(w)
+		if rf, ok := w.(io.ReaderFrom); ok {
+			return rf.ReadFrom(src)
+		}
+	}
+	return io.Copy(w, src)
+}
+
+// rawWriter returns the innermost writer below wrappers such as gin's
+// response writer, which hide the ReaderFrom of net/http. gin holds the
+// status code back until the first write, so it is sent first.
+func rawWriter(w io.Writer) io.Writer {
+	if g, ok := w.(interface{ WriteHeaderNow() }); ok {
+		g.WriteHeaderNow()
+	}
+	for {
+		if _, ok := w.(io.ReaderFrom); ok {
+			return w
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return w
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,78 @@
+package download
+
+import (
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// benchFileSize is the size of the file downloaded by the benchmarks
+const benchFileSize = 32 << 20
+
+// benchmarkServe downloads a file over loopback through the same gin stack
+// as the server. Besides the throughput it reports the CPU time of the whole
+// process, client and server together, as cpu-ns/op. Compare the modes with
+//
+//	go test -run '^$' -bench Serve -benchmem ./pkg/download
+func benchmarkServe(b *testing.B, sendfile bool, rangeHeader string) {
+	h := newTestHandler(b, sendfile)
+	data := make([]byte, benchFileSize)
+	rand.Read(data)
+	storeFile(b, h, "bench", string(data))
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.GET("/files/:id", func(c *gin.Context) { h.HandleDownload(c.Writer, c.Request) })
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/files/bench", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	b.ResetTimer()
+	startCPU, measured := cpuTime()
+	for i := 0; i < b.N; i++ {
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if i == 0 {
+			b.SetBytes(n)
+		}
+	}
+	b.StopTimer()
+
+	if endCPU, ok := cpuTime(); ok && measured {
+		b.ReportMetric(float64(endCPU-startCPU)/float64(b.N), "cpu-ns/op")
+	}
+}
+
+func BenchmarkServeSendfile(b *testing.B) {
+	benchmarkServe(b, true, "")
+}
+
+func BenchmarkServeCopy(b *testing.B) {
+	benchmarkServe(b, false, "")
+}
+
+func BenchmarkServeRangeSendfile(b *testing.B) {
+	benchmarkServe(b, true, "bytes=1048576-")
+}
+
+func BenchmarkServeRangeCopy(b *testing.B) {
+	benchmarkServe(b, false, "bytes=1048576-")
+}
@@ -0,0 +1,265 @@
+package download
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionIdle is how long a download may pause before it is recorded as
+// abandoned. Resuming later starts a new session.
+const sessionIdle = 10 * time.Minute
+
+// sessionKey identifies the download of one file by one client. Clients
+// without a token are told apart by their address.
+type sessionKey struct {
+	fileID string
+	client string
+}
+
+// session collects the requests of one download
+type session struct {
+	record     catalog.DownloadRecord
+	uploader   string
+	fileName   string
+	covered    []byteRange // sorted and merged
+	lastActive time.Time
+}
+
+// sessions tracks downloads in progress across range requests and records
+// them once every byte was sent or the client went away
+type sessions struct {
+	index  *catalog.Index
+	logger *logrus.Logger
+
+	mu       sync.Mutex
+	active   map[sessionKey]*session
+	receipts func(uploader string, receipt websocket.DownloadReceipt)
+}
+
+func newSessions(index *catalog.Index, logger *logrus.Logger) *sessions {
+	t := &sessions{
+		index:  index,
+		logger: logger,
+		active: make(map[sessionKey]*session),
+	}
+	go t.expire()
+	return t
+}
+
+// SendReceiptsTo delivers a download_completed message to the device that
+// uploaded a file whenever another client finished downloading it
+func (h *Handler) SendReceiptsTo(manager *websocket.Manager) {
+	h.sessions.mu.Lock()
+	defer h.sessions.mu.Unlock()
+
+	h.sessions.receipts = func(uploader string, receipt websocket.DownloadReceipt) {
+		manager.SendToDevice(uploader, websocket.Message{
+			Type:      websocket.MessageTypeDownloadCompleted,
+			ID:        receipt.FileID,
+			Timestamp: time.Now().Unix(),
+			From:      receipt.DeviceName,
+			Download:  &receipt,
+		})
+	}
+}
+
+// DownloadHistory returns the recorded downloads of a file and those still
+// in progress, newest first
+func (h *Handler) DownloadHistory(fileID string) ([]*catalog.DownloadRecord, []*catalog.DownloadRecord, error) {
+	if _, err := h.index.Get(fileID); err != nil {
+		return nil, nil, err
+	}
+	records, err := h.index.Downloads(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, h.sessions.inProgress(fileID), nil
+}
+
+// served accounts n bytes of c starting at offset, sent from begun until
+// now, to the client of r. Serving an empty file completes its download.
+func (t *sessions) served(r *http.Request, c *content, begun time.Time, offset, n int64) {
+	if c.fileID == "" || (n <= 0 && c.size > 0) {
+		return
+	}
+
+	device, deviceName := security.DeviceFromContext(r.Context())
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	key := sessionKey{fileID: c.fileID, client: device}
+	if device == "" {
+		key.client = "@" + remote
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	s, ok := t.active[key]
+	if !ok {
+		s = &session{
+			record: catalog.DownloadRecord{
+				FileID:     c.fileID,
+				Device:     device,
+				DeviceName: deviceName,
+				Remote:     remote,
+				Size:       c.size,
+				Started:    begun,
+			},
+			uploader: c.uploader,
+			fileName: c.name,
+		}
+		t.active[key] = s
+	}
+	s.record.Requests++
+	if n > 0 {
+		s.record.BytesServed += n
+		s.covered = addRange(s.covered, byteRange{start: offset, length: n})
+		s.record.BytesCovered = coveredBytes(s.covered)
+	}
+	s.lastActive = now
+
+	complete := s.record.BytesCovered >= s.record.Size
+	if complete {
+		delete(t.active, key)
+	}
+	receipts := t.receipts
+	t.mu.Unlock()
+
+	if !complete {
+		return
+	}
+	t.finish(s, true, now)
+
+	// Receipts go to the paired device that uploaded the file; files
+	// uploaded without a token have no one to tell
+	if receipts != nil && s.uploader != "" && s.uploader != device {
+		receipts(s.uploader, websocket.DownloadReceipt{
+			FileID:      s.record.FileID,
+			FileName:    s.fileName,
+			Size:        s.record.Size,
+			Device:      s.record.Device,
+			DeviceName:  s.record.DeviceName,
+			Remote:      s.record.Remote,
+			Started:     s.record.Started.Unix(),
+			Finished:    s.record.Finished.Unix(),
+			Duration:    s.record.Duration,
+			AverageRate: s.record.AverageRate,
+			Requests:    s.record.Requests,
+		})
+	}
+}
+
+// finish completes the record of s and stores it
+func (t *sessions) finish(s *session, completed bool, finished time.Time) {
+	s.record.Completed = completed
+	s.record.Finished = finished
+	s.record.Duration = finished.Sub(s.record.Started).Seconds()
+	if s.record.Duration > 0 {
+		s.record.AverageRate = float64(s.record.BytesServed) / s.record.Duration
+	}
+
+	if err := t.index.AddDownload(&s.record); err != nil {
+		t.logger.WithError(err).WithField("file_id", s.record.FileID).Warn("Failed to record download")
+	}
+
+	t.logger.WithFields(logrus.Fields{
+		"file_id":   s.record.FileID,
+		"device":    s.record.Device,
+		"remote":    s.record.Remote,
+		"completed": completed,
+		"bytes":     s.record.BytesServed,
+		"requests":  s.record.Requests,
+		"duration":  s.record.Duration,
+	}).Info("Download session finished")
+}
+
+// expire records sessions without activity for sessionIdle as abandoned
+func (t *sessions) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var idle []*session
+		t.mu.Lock()
+		for key, s := range t.active {
+			if now.Sub(s.lastActive) >= sessionIdle {
+				idle = append(idle, s)
+				delete(t.active, key)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, s := range idle {
+			t.finish(s, false, s.lastActive)
+		}
+	}
+}
+
+// inProgress returns snapshots of the active sessions of a file
+func (t *sessions) inProgress(fileID string) []*catalog.DownloadRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	records := make([]*catalog.DownloadRecord, 0)
+	for key, s := range t.active {
+		if key.fileID != fileID {
+			continue
+		}
+		record := s.record
+		record.Finished = s.lastActive
+		record.Duration = s.lastActive.Sub(record.Started).Seconds()
+		if record.Duration > 0 {
+			record.AverageRate = float64(record.BytesServed) / record.Duration
+		}
+		records = append(records, &record)
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Started.After(records[b].Started) })
+	return records
+}
+
+// addRange adds br to the sorted, merged ranges, merging it with any range
+// it overlaps or touches
+func addRange(ranges []byteRange, br byteRange) []byteRange {
+	start, end := br.start, br.start+br.length
+
+	merged := make([]byteRange, 0, len(ranges)+1)
+	inserted := false
+	for _, r := range ranges {
+		rEnd := r.start + r.length
+		switch {
+		case rEnd < start:
+			merged = append(merged, r)
+		case r.start > end:
+			if !inserted {
+				merged = append(merged, byteRange{start: start, length: end - start})
+				inserted = true
+			}
+			merged = append(merged, r)
+		default:
+			start = min(start, r.start)
+			end = max(end, rEnd)
+		}
+	}
+	if !inserted {
+		merged = append(merged, byteRange{start: start, length: end - start})
+	}
+	return merged
+}
+
+func coveredBytes(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
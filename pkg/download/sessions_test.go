@@ -0,0 +1,130 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+)
+
+// downloadAs downloads a file as the paired device, or anonymously when
+// device is empty
+func downloadAs(h *Handler, device, id string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/files/"+id, nil)
+	if device != "" {
+		r = r.WithContext(security.WithDevice(r.Context(), device, device+" name"))
+	}
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	h.HandleDownload(w, r)
+	return w
+}
+
+type sentReceipt struct {
+	to      string
+	receipt websocket.DownloadReceipt
+}
+
+// captureReceipts records the receipts h sends
+func captureReceipts(h *Handler) func() []sentReceipt {
+	var mu sync.Mutex
+	var sent []sentReceipt
+	h.sessions.mu.Lock()
+	h.sessions.receipts = func(uploader string, receipt websocket.DownloadReceipt) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, sentReceipt{uploader, receipt})
+	}
+	h.sessions.mu.Unlock()
+
+	return func() []sentReceipt {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentReceipt(nil), sent...)
+	}
+}
+
+func TestDownloadReceipts(t *testing.T) {
+	tests := []struct {
+		name     string
+		uploader string // paired device that uploaded the file
+		device   string // downloading device
+		want     string // receipt recipient, empty for none
+	}{
+		{"paired uploader", "phone-id", "laptop-id", "phone-id"},
+		{"anonymous download", "phone-id", "", "phone-id"},
+		{"own download", "phone-id", "phone-id", ""},
+		{"anonymous upload", "", "laptop-id", ""},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, false)
+		sent := captureReceipts(h)
+		meta := storeFile(t, h, "photo", "0123456789")
+		// The label a client claims must not decide who hears about downloads
+		if _, err := h.index.Update(meta.ID, func(m *catalog.FileMeta) error {
+			m.Device = "laptop-id"
+			m.DeviceID = tt.uploader
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Fetched in two ranges, a receipt follows the second
+		downloadAs(h, tt.device, "photo", http.Header{"Range": {"bytes=0-4"}})
+		if got := sent(); len(got) != 0 {
+			t.Errorf("%s: receipt after half the file: %+v", tt.name, got)
+		}
+		downloadAs(h, tt.device, "photo", http.Header{"Range": {"bytes=5-"}})
+
+		got := sent()
+		switch {
+		case tt.want == "" && len(got) != 0:
+			t.Errorf("%s: unexpected receipt %+v", tt.name, got)
+		case tt.want != "" && (len(got) != 1 || got[0].to != tt.want):
+			t.Errorf("%s: receipts %+v, want one to %s", tt.name, got, tt.want)
+		case tt.want != "" && (got[0].receipt.Device != tt.device || got[0].receipt.Requests != 2 || got[0].receipt.Size != 10):
+			t.Errorf("%s: receipt %+v", tt.name, got[0].receipt)
+		}
+
+		records, active, err := h.DownloadHistory("photo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || !records[0].Completed || records[0].BytesCovered != 10 || len(active) != 0 {
+			t.Errorf("%s: history %+v, active %+v", tt.name, records, active)
+		}
+	}
+}
+
+func TestEmptyDownloadCompletes(t *testing.T) {
+	h := newTestHandler(t, false)
+	sent := captureReceipts(h)
+	meta := storeFile(t, h, "empty", "")
+	if _, err := h.index.Update(meta.ID, func(m *catalog.FileMeta) error {
+		m.DeviceID = "phone-id"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := downloadAs(h, "laptop-id", "empty", nil); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("GET returned %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	records, active, err := h.DownloadHistory("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].Completed || records[0].Device != "laptop-id" || len(active) != 0 {
+		t.Errorf("history %+v, active %+v", records, active)
+	}
+	if got := sent(); len(got) != 1 || got[0].to != "phone-id" {
+		t.Errorf("receipts %+v", got)
+	}
+}
@@ -0,0 +1,288 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/sirupsen/logrus"
+)
+
+// trashCheckInterval is how often the trash is checked for files to purge
+const trashCheckInterval = time.Hour
+
+// TrashedFile is a file in the trash as reported to clients
+type TrashedFile struct {
+	*catalog.TrashEntry
+	Expires *time.Time `json:"expires,omitempty"` // when the file is purged, unset when it is kept until purged
+}
+
+// TrashSummary describes the trash and its limits
+type TrashSummary struct {
+	Files     []*TrashedFile `json:"files"`
+	TotalSize int64          `json:"total_size"`
+	Retention float64        `json:"retention"` // seconds, 0 keeps files until purged
+	MaxSize   int64          `json:"max_size"`  // 0 means unlimited
+}
+
+// trashLimits holds the parsed trash settings, zero values mean unlimited
+type trashLimits struct {
+	retention time.Duration
+	maxBytes  int64
+}
+
+func loadTrashLimits(h *Handler) trashLimits {
+	var limits trashLimits
+	var err error
+
+	if limits.retention, err = h.config.GetTrashRetention(); err != nil {
+		h.logger.WithError(err).Warn("Invalid trash retention, deleted files are kept until purged")
+	}
+	if limits.maxBytes, err = h.config.GetTrashMaxBytes(); err != nil {
+		h.logger.WithError(err).Warn("Invalid trash size limit, trash size is unlimited")
+	}
+	return limits
+}
+
+// OnPurge registers fn to be called with the ID of every file removed for
+// good, so data derived from it can be dropped as well
+func (h *Handler) OnPurge(fn func(fileID string)) {
+	h.purgeMu.Lock()
+	defer h.purgeMu.Unlock()
+
+	h.purged = append(h.purged, fn)
+}
+
+// DeleteFile moves a file to the trash, recording the device that deleted
+// it. With the trash disabled the file is removed right away.
+func (h *Handler) DeleteFile(fileID, device, deviceName string) error {
+	if !h.config.Trash.Enabled {
+		meta, err := h.index.Get(fileID)
+		if err != nil {
+			return err
+		}
+		if err := h.removeContent(meta); err != nil {
+			return err
+		}
+		if err := h.index.Delete(fileID); err != nil {
+			h.logger.WithError(err).Warn("Failed to delete metadata file")
+		}
+		if err := h.index.RemoveFromBatch(meta); err != nil {
+			h.logger.WithError(err).Warn("Failed to update batch of deleted file")
+		}
+		return nil
+	}
+
+	entry, err := h.index.MoveToTrash(fileID, device, deviceName)
+	if err != nil {
+		return err
+	}
+	if err := h.index.RemoveFromBatch(entry.File); err != nil {
+		h.logger.WithError(err).Warn("Failed to update batch of deleted file")
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"file_id": fileID,
+		"path":    entry.File.Path,
+		"device":  device,
+	}).Info("File moved to trash")
+
+	// A full trash makes room right away rather than at the next check
+	h.purgeTrash(loadTrashLimits(h), time.Now())
+	return nil
+}
+
+// Trash lists the files in the trash, most recently deleted first
+func (h *Handler) Trash() (*TrashSummary, error) {
+	entries, err := h.index.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	limits := loadTrashLimits(h)
+	summary := &TrashSummary{
+		Files:     make([]*TrashedFile, 0, len(entries)),
+		Retention: limits.retention.Seconds(),
+		MaxSize:   limits.maxBytes,
+	}
+	for _, entry := range entries {
+		file := &TrashedFile{TrashEntry: entry}
+		if limits.retention > 0 {
+			expires := entry.Deleted.Add(limits.retention)
+			file.Expires = &expires
+		}
+		summary.Files = append(summary.Files, file)
+		summary.TotalSize += entry.File.Size
+	}
+	return summary, nil
+}
+
+// RestoreFile moves a file out of the trash and back into the file list
+func (h *Handler) RestoreFile(fileID string) (*catalog.FileMeta, error) {
+	h.trashMu.Lock()
+	defer h.trashMu.Unlock()
+
+	meta, err := h.index.RestoreFromTrash(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.index.AddToBatch(meta); err != nil {
+		h.logger.WithError(err).Warn("Failed to update batch of restored file")
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"file_id": fileID,
+		"path":    meta.Path,
+	}).Info("File restored from trash")
+	return meta, nil
+}
+
+// PurgeFile removes a file in the trash for good
+func (h *Handler) PurgeFile(fileID string) error {
+	h.trashMu.Lock()
+	defer h.trashMu.Unlock()
+
+	return h.purgeFile(fileID)
+}
+
+func (h *Handler) purgeFile(fileID string) error {
+	entry, err := h.index.GetTrash(fileID)
+	if err != nil {
+		return err
+	}
+	if err := h.removeContent(entry.File); err != nil {
+		return err
+	}
+	return h.index.DeleteTrash(fileID)
+}
+
+// EmptyTrash removes every file in the trash for good and returns how many
+// were removed
+func (h *Handler) EmptyTrash() (int, error) {
+	h.trashMu.Lock()
+	defer h.trashMu.Unlock()
+
+	entries, err := h.index.ListTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		if err := h.purgeFile(entry.File.ID); err != nil {
+			if errors.Is(err, catalog.ErrNotFound) {
+				continue
+			}
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// removeContent deletes the stored content of a file together with
+// everything kept about it except its metadata record
+func (h *Handler) removeContent(meta *catalog.FileMeta) error {
+	ctx := context.Background()
+
+	// Delete file
+	if err := h.backend.Delete(ctx, meta.Path); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	if err := h.index.DeleteDownloads(meta.ID); err != nil {
+		h.logger.WithError(err).Warn("Failed to delete download history")
+	}
+	if last, err := h.index.ReleaseBlob(meta.SHA256, meta.ID); err != nil {
+		h.logger.WithError(err).Warn("Failed to release stored content")
+	} else if last {
+		if err := h.backend.Delete(ctx, catalog.BlobKey(meta.SHA256)); err != nil {
+			h.logger.WithError(err).Warn("Failed to remove stored content")
+		}
+	}
+
+	h.purgeMu.Lock()
+	purged := h.purged
+	h.purgeMu.Unlock()
+	for _, fn := range purged {
+		fn(meta.ID)
+	}
+
+	h.logger.WithFields(logrus.Fields{
+		"file_id": meta.ID,
+		"path":    meta.Path,
+	}).Info("File deleted")
+	return nil
+}
+
+// expireTrash purges files that outlived the retention period, checking
+// once at startup and then every trashCheckInterval
+func (h *Handler) expireTrash() {
+	limits := loadTrashLimits(h)
+	if limits.retention <= 0 && limits.maxBytes <= 0 {
+		return
+	}
+
+	h.purgeTrash(limits, time.Now())
+
+	ticker := time.NewTicker(trashCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.purgeTrash(limits, now)
+	}
+}
+
+// purgeTrash removes files deleted longer than the retention period ago,
+// then the oldest files until the trash fits its size limit. It returns how
+// many files were purged.
+func (h *Handler) purgeTrash(limits trashLimits, now time.Time) int {
+	if limits.retention <= 0 && limits.maxBytes <= 0 {
+		return 0
+	}
+
+	h.trashMu.Lock()
+	defer h.trashMu.Unlock()
+
+	entries, err := h.index.ListTrash()
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to list trash")
+		return 0
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.File.Size
+	}
+
+	purged := 0
+	// Entries are sorted newest first, so purge from the end
+	for n := len(entries) - 1; n >= 0; n-- {
+		entry := entries[n]
+		expired := limits.retention > 0 && now.Sub(entry.Deleted) >= limits.retention
+		oversized := limits.maxBytes > 0 && total > limits.maxBytes
+		if !expired && !oversized {
+			break
+		}
+
+		if err := h.purgeFile(entry.File.ID); err != nil && !errors.Is(err, catalog.ErrNotFound) {
+			h.logger.WithError(err).WithField("file_id", entry.File.ID).Warn("Failed to purge file from trash")
+			continue
+		}
+		total -= entry.File.Size
+		purged++
+
+		reason := "retention"
+		if !expired {
+			reason = "size"
+		}
+		h.logger.WithFields(logrus.Fields{
+			"file_id": entry.File.ID,
+			"deleted": entry.Deleted,
+			"reason":  reason,
+		}).Info("File purged from trash")
+	}
+	return purged
+}
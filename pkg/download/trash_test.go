@@ -0,0 +1,345 @@
+package download
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// newTrashHandler returns a handler with the trash enabled and no limits,
+// together with an upload handler on the same storage
+func newTrashHandler(t *testing.T) (*Handler, *upload.TusHandler) {
+	t.Helper()
+	h := newTestHandler(t, false)
+	h.config.Trash.Enabled = true
+	h.config.Trash.Retention = ""
+	h.config.Trash.MaxSize = ""
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	uploads, err := upload.NewTusHandler(h.config, logger, h.index, h.backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, uploads
+}
+
+// tusUpload uploads content as fileName through the TUS protocol
+func tusUpload(t *testing.T, h *Handler, uploads *upload.TusHandler, fileName, content string) *catalog.FileMeta {
+	t.Helper()
+	base := h.config.TUS.BasePath
+
+	r := httptest.NewRequest(http.MethodPost, base+"/", nil)
+	r.Header.Set("Tus-Resumable", "1.0.0")
+	r.Header.Set("Upload-Length", strconv.Itoa(len(content)))
+	r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(fileName)))
+	w := httptest.NewRecorder()
+	uploads.HandleRequest(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create returned %d: %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest(http.MethodPatch, location.Path, strings.NewReader(content))
+	r.Header.Set("Tus-Resumable", "1.0.0")
+	r.Header.Set("Upload-Offset", "0")
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	w = httptest.NewRecorder()
+	uploads.HandleRequest(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("patch returned %d: %s", w.Code, w.Body.String())
+	}
+
+	meta, err := h.index.Get(path.Base(location.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func readStored(t *testing.T, h *Handler, meta *catalog.FileMeta) string {
+	t.Helper()
+	w := download(h, http.MethodGet, meta.ID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download of %s returned %d", meta.ID, w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestRestoreAfterSameNameUpload(t *testing.T) {
+	h, uploads := newTrashHandler(t)
+
+	old := tusUpload(t, h, uploads, "notes.txt", "old notes")
+	if err := h.DeleteFile(old.ID, "phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.index.Get(old.ID); !errors.Is(err, catalog.ErrNotFound) {
+		t.Fatalf("trashed file still listed: %v", err)
+	}
+
+	// The trashed file keeps its place, the new upload gets another name
+	current := tusUpload(t, h, uploads, "notes.txt", "new notes")
+	if current.Path == old.Path {
+		t.Fatalf("new upload stored over the trashed file at %s", current.Path)
+	}
+
+	restored, err := h.RestoreFile(old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Path != old.Path {
+		t.Errorf("restored to %s, want %s", restored.Path, old.Path)
+	}
+	if got := readStored(t, h, restored); got != "old notes" {
+		t.Errorf("restored content %q", got)
+	}
+	if got := readStored(t, h, current); got != "new notes" {
+		t.Errorf("new content %q", got)
+	}
+
+	if _, err := h.RestoreFile(old.ID); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("second restore: %v", err)
+	}
+}
+
+func TestPurgeReleasesBlob(t *testing.T) {
+	h, uploads := newTrashHandler(t)
+	ctx := context.Background()
+	var purged []string
+	h.OnPurge(func(id string) { purged = append(purged, id) })
+
+	a := tusUpload(t, h, uploads, "a.txt", "shared content")
+	b := tusUpload(t, h, uploads, "b.txt", "shared content")
+	blobKey := catalog.BlobKey(a.SHA256)
+
+	if err := h.DeleteFile(a.ID, "phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	// Trashed files keep their reference until they are purged
+	if blob, err := h.index.GetBlob(a.SHA256); err != nil || len(blob.Refs) != 2 {
+		t.Fatalf("blob after delete: %+v, %v", blob, err)
+	}
+
+	if err := h.PurgeFile(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := h.index.GetBlob(a.SHA256)
+	if err != nil || len(blob.Refs) != 1 || blob.Refs[0] != b.ID {
+		t.Fatalf("blob after first purge: %+v, %v", blob, err)
+	}
+	if _, err := h.backend.Stat(ctx, blobKey); err != nil {
+		t.Errorf("blob removed while still referenced: %v", err)
+	}
+	if got := readStored(t, h, b); got != "shared content" {
+		t.Errorf("remaining file reads %q", got)
+	}
+
+	if err := h.DeleteFile(b.ID, "phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.PurgeFile(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.index.GetBlob(a.SHA256); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("blob record after last purge: %v", err)
+	}
+	if _, err := h.backend.Stat(ctx, blobKey); err == nil {
+		t.Error("blob kept after its last reference was purged")
+	}
+	if strings.Join(purged, ",") != a.ID+","+b.ID {
+		t.Errorf("purge callbacks for %v", purged)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	h, _ := newTrashHandler(t)
+	ids := []string{"oldest", "older", "newer", "newest"}
+	for _, id := range ids {
+		storeFile(t, h, id, "0123456789")
+		if err := h.DeleteFile(id, "phone-id", "Phone"); err != nil {
+			t.Fatal(err)
+		}
+		// Keep the deletion times apart so the order is certain
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	trashed := func() []string {
+		entries, err := h.index.ListTrash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, entry := range entries {
+			ids = append(ids, entry.File.ID)
+		}
+		return ids
+	}
+
+	now := time.Now()
+	if n := h.purgeTrash(trashLimits{}, now); n != 0 {
+		t.Errorf("purged %d without limits", n)
+	}
+	if n := h.purgeTrash(trashLimits{retention: time.Hour, maxBytes: 40}, now); n != 0 {
+		t.Errorf("purged %d within the limits", n)
+	}
+
+	// The oldest files go first until the rest fits
+	if n := h.purgeTrash(trashLimits{maxBytes: 25}, now); n != 2 {
+		t.Errorf("purged %d files, want 2", n)
+	}
+	if got := strings.Join(trashed(), ","); got != "newest,newer" {
+		t.Errorf("trash holds %s", got)
+	}
+	for _, id := range ids[:2] {
+		if _, err := os.Stat(filepath.Join(h.config.Storage.UploadDir, id+".txt")); !os.IsNotExist(err) {
+			t.Errorf("content of %s kept: %v", id, err)
+		}
+	}
+
+	if n := h.purgeTrash(trashLimits{retention: time.Hour}, now.Add(2*time.Hour)); n != 2 {
+		t.Errorf("purged %d expired files, want 2", n)
+	}
+	if got := trashed(); len(got) != 0 {
+		t.Errorf("trash holds %v", got)
+	}
+}
+
+func TestDeleteFillsTrash(t *testing.T) {
+	h, _ := newTrashHandler(t)
+	h.config.Trash.MaxSize = "15B"
+
+	for _, id := range []string{"first", "second"} {
+		storeFile(t, h, id, "0123456789")
+		if err := h.DeleteFile(id, "phone-id", "Phone"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	summary, err := h.Trash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Files) != 1 || summary.Files[0].File.ID != "second" || summary.TotalSize != 10 || summary.MaxSize != 15 {
+		t.Errorf("trash %+v", summary)
+	}
+}
+
+func TestReferencesBlob(t *testing.T) {
+	h, _ := newTrashHandler(t)
+	indexDir := filepath.Join(h.config.Storage.DataDir, catalog.IndexDirName)
+
+	listed := storeFile(t, h, "listed", "content")
+	trashed := storeFile(t, h, "trashed", "content")
+	if err := h.DeleteFile(trashed.ID, "phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	storeFile(t, h, "broken", "content")
+	if err := os.WriteFile(filepath.Join(indexDir, "broken"+h.config.TUS.MetaSuffix), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(indexDir, catalog.TrashDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(indexDir, catalog.TrashDirName, "broken-trash.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := listed.SHA256
+	tests := []struct {
+		name   string
+		id     string
+		sum    string
+		expect bool
+	}{
+		{"listed file", "listed", sum, true},
+		{"listed file with other content", "listed", strings.Repeat("0", 64), false},
+		{"trashed file", "trashed", sum, true},
+		{"unknown file", "gone", sum, false},
+		{"unreadable metadata", "broken", sum, true},
+		{"unreadable trash entry", "broken-trash", sum, true},
+	}
+	for _, tt := range tests {
+		if got := h.referencesBlob(tt.id, tt.sum); got != tt.expect {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.expect)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	h, uploads := newTrashHandler(t)
+	ctx := context.Background()
+
+	kept := tusUpload(t, h, uploads, "kept.txt", "kept content")
+	lost := tusUpload(t, h, uploads, "lost.txt", "lost content")
+	// The metadata of lost is gone without its blob reference being released,
+	// as after a crash in the middle of a delete
+	if err := h.backend.Delete(ctx, lost.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.index.Delete(lost.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recently changed records are left alone
+	report, err := h.CollectGarbage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlobRefs != 0 || report.BlobsRemoved != 0 {
+		t.Errorf("report within the grace period: %+v", report)
+	}
+
+	// Age the records past the grace period
+	dir := filepath.Join(h.config.Storage.DataDir, catalog.IndexDirName, catalog.BlobRecordDirName)
+	for _, meta := range []*catalog.FileMeta{kept, lost} {
+		blob, err := h.index.GetBlob(meta.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Updated = time.Now().Add(-2 * blobGracePeriod)
+		data, err := json.Marshal(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, meta.SHA256+".json"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = h.CollectGarbage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.BlobRefs != 1 || report.BlobsRemoved != 1 || report.BytesFreed != lost.Size {
+		t.Errorf("report %+v", report)
+	}
+	if _, err := h.backend.Stat(ctx, catalog.BlobKey(lost.SHA256)); err == nil {
+		t.Error("unreferenced blob kept")
+	}
+	if _, err := h.index.GetBlob(kept.SHA256); err != nil {
+		t.Errorf("referenced blob released: %v", err)
+	}
+	if got := readStored(t, h, kept); got != "kept content" {
+		t.Errorf("kept file reads %q", got)
+	}
+}
@@ -0,0 +1,164 @@
+package foldersync
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Delta actions, what a device must do to bring its folder in sync
+const (
+	ActionUpload       = "upload"        // send the local file with a TUS upload
+	ActionDownload     = "download"      // fetch the server file from /files/{file_id}
+	ActionDeleteLocal  = "delete_local"  // the file was deleted on the server
+	ActionDeleteRemote = "delete_remote" // delete the server file, passing base
+	ActionConflict     = "conflict"      // both sides changed: upload the local file as conflict_path, then download
+)
+
+// LocalFile is a file in the folder on the device. Base is the SHA-256 of
+// the version the device last synced, empty for files it never synced.
+// Files deleted on the device since the last sync are listed with Deleted
+// set, otherwise they are downloaded again.
+type LocalFile struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256"`
+	Base     string    `json:"base,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// Action is one step of a delta. The file fields describe the server
+// version for downloads and conflicts and the local version otherwise.
+type Action struct {
+	Action       string    `json:"action"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	Modified     time.Time `json:"modified"`
+	SHA256       string    `json:"sha256"`
+	FileID       string    `json:"file_id,omitempty"`
+	Base         string    `json:"base,omitempty"`          // pass as syncBase or base when uploading or deleting
+	ConflictPath string    `json:"conflict_path,omitempty"` // where the local version of a conflict goes
+}
+
+// Delta is what a device must do to bring its folder in sync with the server
+type Delta struct {
+	Folder  string    `json:"folder"`
+	Cursor  int64     `json:"cursor"`
+	Actions []*Action `json:"actions"`
+}
+
+// Delta compares the files of a device with the folder on the server. A side
+// changed a file when its version differs from the base the device last
+// synced; when both did, the server version is kept and the local one
+// becomes a conflict copy. A change wins over a deletion on the other side.
+func (s *Service) Delta(f *Folder, deviceID, deviceName string, local []LocalFile) (*Delta, error) {
+	f.mu.Lock()
+	manifest, err := s.manifest(f)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	server := make(map[string]*Entry, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		server[entry.Path] = entry
+	}
+
+	delta := &Delta{Folder: f.Name, Cursor: manifest.Cursor, Actions: []*Action{}}
+	seen := make(map[string]bool, len(local))
+	now := time.Now()
+	for _, lf := range local {
+		rel, err := cleanPath(lf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", lf.Path, err)
+		}
+		if seen[rel] {
+			return nil, fmt.Errorf("%q listed twice: %w", lf.Path, ErrInvalidPath)
+		}
+		seen[rel] = true
+		lf.Path = rel
+
+		if action := compare(lf, server[rel], deviceName, now); action != nil {
+			delta.Actions = append(delta.Actions, action)
+		}
+	}
+
+	// Files the device has never seen
+	for _, entry := range manifest.Files {
+		if !seen[entry.Path] {
+			delta.Actions = append(delta.Actions, serverAction(ActionDownload, entry))
+		}
+	}
+
+	sort.SliceStable(delta.Actions, func(a, b int) bool {
+		return delta.Actions[a].Path < delta.Actions[b].Path
+	})
+
+	if err := f.journal.synced(deviceID, manifest.Cursor); err != nil {
+		s.logger.WithError(err).WithField("sync_folder", f.Name).Warn("Failed to save sync state")
+	}
+	return delta, nil
+}
+
+// compare decides what to do with one file listed by the device, nil when
+// both sides agree
+func compare(lf LocalFile, server *Entry, deviceName string, now time.Time) *Action {
+	if lf.Deleted {
+		switch {
+		case server == nil:
+			return nil
+		case server.SHA256 == lf.Base:
+			action := serverAction(ActionDeleteRemote, server)
+			action.Base = lf.Base
+			return action
+		default:
+			// Changed on the server after the device deleted it
+			return serverAction(ActionDownload, server)
+		}
+	}
+
+	if server == nil {
+		if lf.Base != "" && lf.SHA256 == lf.Base {
+			return localAction(ActionDeleteLocal, lf)
+		}
+		return localAction(ActionUpload, lf)
+	}
+
+	switch {
+	case server.SHA256 == lf.SHA256:
+		return nil
+	case server.SHA256 == lf.Base:
+		action := localAction(ActionUpload, lf)
+		action.FileID = server.FileID
+		return action
+	case lf.SHA256 == lf.Base:
+		return serverAction(ActionDownload, server)
+	default:
+		action := serverAction(ActionConflict, server)
+		action.ConflictPath = conflictPath(lf.Path, deviceName, now)
+		return action
+	}
+}
+
+func serverAction(kind string, entry *Entry) *Action {
+	return &Action{
+		Action:   kind,
+		Path:     entry.Path,
+		Size:     entry.Size,
+		Modified: entry.Modified,
+		SHA256:   entry.SHA256,
+		FileID:   entry.FileID,
+	}
+}
+
+func localAction(kind string, lf LocalFile) *Action {
+	return &Action{
+		Action:   kind,
+		Path:     lf.Path,
+		Size:     lf.Size,
+		Modified: lf.Modified,
+		SHA256:   lf.SHA256,
+		Base:     lf.Base,
+	}
+}
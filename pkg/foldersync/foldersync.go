@@ -0,0 +1,485 @@
+package foldersync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// Upload metadata keys that make a TUS upload part of a sync folder
+const (
+	MetaFolder = "syncFolder" // name of the sync folder
+	MetaPath   = "syncPath"   // path inside the sync folder
+	MetaBase   = "syncBase"   // SHA-256 of the server version the change is based on, empty for new files
+)
+
+// VersionsDirName is the folder inside the storage that replaced and deleted
+// versions of synced files are moved to before they go to the trash, so the
+// trash keeps them without blocking their path. Restored versions show up
+// there.
+const VersionsDirName = "sync-versions"
+
+var (
+	// ErrNotFound is returned for unknown sync folders and files
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when a device may not use a sync folder
+	ErrForbidden = errors.New("access denied")
+	// ErrInvalidPath is returned for paths that are empty, leave the folder
+	// or would be stored under a different name
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrConflict is returned when the server version of a file is not the
+	// one a change is based on
+	ErrConflict = errors.New("file changed on the server")
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Folder is a configured sync folder
+type Folder struct {
+	config.SyncFolder
+	root    string // sanitized folder inside the storage
+	devices map[string]bool
+	journal *journal
+
+	mu       sync.Mutex        // serializes changes to the folder
+	reserved map[string]string // paths claimed by uploads in flight, to upload ID
+}
+
+// Info describes a sync folder to a device
+type Info struct {
+	Name     string     `json:"name"`
+	Folder   string     `json:"folder"`
+	Files    int        `json:"files"`
+	Size     int64      `json:"size"`
+	Cursor   int64      `json:"cursor"`              // sequence number of the last journal entry
+	LastSync *time.Time `json:"last_sync,omitempty"` // last delta requested by the device
+}
+
+// Entry is a file in a sync folder. Path is relative to the folder.
+type Entry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256"`
+	FileID   string    `json:"file_id"` // download from /files/{file_id}
+}
+
+// Manifest lists the files of a sync folder
+type Manifest struct {
+	Folder string   `json:"folder"`
+	Cursor int64    `json:"cursor"`
+	Files  []*Entry `json:"files"`
+}
+
+// Service keeps the configured sync folders. Files are uploaded through the
+// TUS handler with the sync metadata keys and downloaded through the
+// download handler; the service places uploads at their path, keeps a
+// journal of the changes and computes what a device must do to catch up.
+type Service struct {
+	config    *config.Config
+	logger    *logrus.Logger
+	index     *catalog.Index
+	auth      *security.AuthService
+	downloads *download.Handler
+	uploads   *upload.TusHandler
+	folders   map[string]*Folder
+	order     []string
+}
+
+func NewService(cfg *config.Config, logger *logrus.Logger, index *catalog.Index, auth *security.AuthService, downloads *download.Handler, uploads *upload.TusHandler) (*Service, error) {
+	s := &Service{
+		config:    cfg,
+		logger:    logger,
+		index:     index,
+		auth:      auth,
+		downloads: downloads,
+		uploads:   uploads,
+		folders:   make(map[string]*Folder),
+	}
+
+	for i, fc := range cfg.SyncFolders {
+		f, err := s.newFolder(fc)
+		if err != nil {
+			name := fc.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("invalid sync folder %s: %w", name, err)
+		}
+		if _, dup := s.folders[f.Name]; dup {
+			return nil, fmt.Errorf("duplicate sync folder name %q", f.Name)
+		}
+		for _, other := range s.folders {
+			if within(f.root, other.root) || within(other.root, f.root) {
+				return nil, fmt.Errorf("sync folders %s and %s overlap", other.Name, f.Name)
+			}
+		}
+		s.folders[f.Name] = f
+		s.order = append(s.order, f.Name)
+
+		logger.WithFields(logrus.Fields{
+			"sync_folder": f.Name,
+			"folder":      f.root,
+		}).Info("Syncing folder")
+	}
+
+	if len(s.folders) > 0 {
+		uploads.HandlePlacement(s.place)
+		uploads.Subscribe(s.HandleUploadEvent)
+	}
+	return s, nil
+}
+
+func (s *Service) newFolder(fc config.SyncFolder) (*Folder, error) {
+	if !namePattern.MatchString(fc.Name) {
+		return nil, fmt.Errorf("name must consist of letters, digits, \"-\" and \"_\"")
+	}
+
+	root := upload.SanitizeRelativePath(fc.Folder)
+	if root == "" {
+		return nil, fmt.Errorf("folder is required")
+	}
+	if within(root, VersionsDirName) || within(VersionsDirName, root) {
+		return nil, fmt.Errorf("folder %s is reserved", root)
+	}
+
+	j, err := openJournal(s.config, fc.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Folder{
+		SyncFolder: fc,
+		root:       root,
+		journal:    j,
+		reserved:   make(map[string]string),
+	}
+	if len(fc.Devices) > 0 {
+		f.devices = make(map[string]bool)
+		for _, id := range fc.Devices {
+			f.devices[id] = true
+		}
+	}
+	return f, nil
+}
+
+// within reports whether p is dir or lies inside it
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+func (f *Folder) allowed(deviceID string) bool {
+	return f.devices == nil || f.devices[deviceID]
+}
+
+// List returns the sync folders deviceID may use
+func (s *Service) List(deviceID string) ([]Info, error) {
+	files, err := s.index.List()
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]Info, 0, len(s.order))
+	for _, name := range s.order {
+		f := s.folders[name]
+		if !f.allowed(deviceID) {
+			continue
+		}
+
+		info := Info{Name: f.Name, Folder: f.root, Cursor: f.journal.cursor()}
+		for _, meta := range files {
+			if within(meta.Path, f.root) && meta.Path != f.root {
+				info.Files++
+				info.Size += meta.Size
+			}
+		}
+		if state, ok := f.journal.device(deviceID); ok {
+			info.LastSync = &state.LastSync
+		}
+		folders = append(folders, info)
+	}
+	return folders, nil
+}
+
+// Get returns the sync folder called name if deviceID may use it
+func (s *Service) Get(name, deviceID string) (*Folder, error) {
+	f, ok := s.folders[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !f.allowed(deviceID) {
+		return nil, ErrForbidden
+	}
+	return f, nil
+}
+
+// cleanPath checks a path sent by a device. Paths must already be in the
+// form the server stores them in, otherwise the device would never see its
+// file in the manifest under the same name.
+func cleanPath(p string) (string, error) {
+	clean := upload.SanitizeRelativePath(p)
+	if clean == "" || clean != strings.Trim(p, "/") {
+		return "", ErrInvalidPath
+	}
+	return clean, nil
+}
+
+// files returns the files in the folder by path; the caller holds f.mu
+func (s *Service) files(f *Folder) (map[string]*catalog.FileMeta, error) {
+	all, err := s.index.List()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*catalog.FileMeta)
+	for _, meta := range all {
+		if !strings.HasPrefix(meta.Path, f.root+"/") {
+			continue
+		}
+		rel := strings.TrimPrefix(meta.Path, f.root+"/")
+		// Two records for one path should not happen; keep the newest
+		if prev := files[rel]; prev == nil || meta.Created.After(prev.Created) {
+			files[rel] = meta
+		}
+	}
+	return files, nil
+}
+
+// Manifest lists the files in the folder, sorted by path
+func (s *Service) Manifest(f *Folder) (*Manifest, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return s.manifest(f)
+}
+
+func (s *Service) manifest(f *Folder) (*Manifest, error) {
+	files, err := s.files(f)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Folder: f.Name,
+		Cursor: f.journal.cursor(),
+		Files:  make([]*Entry, 0, len(files)),
+	}
+	for rel, meta := range files {
+		manifest.Files = append(manifest.Files, newEntry(rel, meta))
+	}
+	sort.Slice(manifest.Files, func(a, b int) bool {
+		return manifest.Files[a].Path < manifest.Files[b].Path
+	})
+	return manifest, nil
+}
+
+func newEntry(rel string, meta *catalog.FileMeta) *Entry {
+	modified := meta.Created
+	if meta.Modified != nil {
+		modified = *meta.Modified
+	}
+	return &Entry{
+		Path:     rel,
+		Size:     meta.Size,
+		Modified: modified,
+		SHA256:   meta.SHA256,
+		FileID:   meta.ID,
+	}
+}
+
+// Delete removes a file a device deleted locally. base is the SHA-256 of the
+// version the device last synced; ErrConflict is returned when the file
+// changed on the server since.
+func (s *Service) Delete(f *Folder, deviceID, deviceName, p, base string) error {
+	rel, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	files, err := s.files(f)
+	if err != nil {
+		return err
+	}
+	current := files[rel]
+	if current == nil {
+		return ErrNotFound
+	}
+	if base != "" && current.SHA256 != base {
+		return ErrConflict
+	}
+
+	if err := s.retire(f, current, deviceID, deviceName); err != nil {
+		return err
+	}
+
+	f.journal.append(&JournalEntry{
+		Op:         OpDelete,
+		Path:       rel,
+		FileID:     current.ID,
+		SHA256:     current.SHA256,
+		Device:     deviceID,
+		DeviceName: deviceName,
+	}, s.logger)
+	return nil
+}
+
+// retire removes the current version of a file from its path. With the
+// trash enabled the file is moved out of the way first, since trashed files
+// keep their storage path. The caller holds f.mu.
+func (s *Service) retire(f *Folder, meta *catalog.FileMeta, deviceID, deviceName string) error {
+	if s.config.Trash.Enabled {
+		dir := path.Join(VersionsDirName, f.Name, path.Dir(strings.TrimPrefix(meta.Path, f.root+"/")))
+		moved, err := s.uploads.Relocate(context.Background(), meta, dir)
+		if err != nil {
+			return fmt.Errorf("failed to move previous version: %w", err)
+		}
+		meta = moved
+	}
+	return s.downloads.DeleteFile(meta.ID, deviceID, deviceName)
+}
+
+// conflictPath names the copy of a file kept when two devices changed it
+func conflictPath(rel, deviceName string, at time.Time) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if deviceName == "" {
+		deviceName = "unknown device"
+	}
+	// A separator in the name would cut the copy name short
+	deviceName = strings.NewReplacer("/", "_", `\`, "_").Replace(deviceName)
+	copyName := upload.SanitizeFileName(fmt.Sprintf("%s (conflict %s %s)%s", stem, deviceName, at.Format("2006-01-02 150405"), ext))
+	return path.Join(dir, copyName)
+}
+
+// uploader returns the paired device that created an upload and its name.
+// Only the device verified from the upload's token counts; the device
+// metadata is chosen by the client.
+func (s *Service) uploader(event upload.Event) (string, string, bool) {
+	if event.DeviceID == "" || !s.auth.IsDeviceTrusted(event.DeviceID) {
+		return "", "", false
+	}
+	name := event.DeviceName
+	if device, err := s.auth.GetDevice(event.DeviceID); err == nil && device.Name != "" {
+		name = device.Name
+	}
+	return event.DeviceID, name, true
+}
+
+// place puts uploads made for a sync folder at their path. When the server
+// version is the one the upload is based on it is replaced, otherwise the
+// upload is kept next to it as a conflict copy.
+func (s *Service) place(ctx context.Context, event upload.Event, sum string) (string, error) {
+	name := event.MetaData[MetaFolder]
+	if name == "" {
+		return "", nil
+	}
+
+	deviceID, deviceName, ok := s.uploader(event)
+	if !ok {
+		return "", fmt.Errorf("sync uploads require a paired device: %w", ErrForbidden)
+	}
+	f, err := s.Get(name, deviceID)
+	if err != nil {
+		return "", fmt.Errorf("sync folder %s: %w", name, err)
+	}
+	rel, err := cleanPath(event.MetaData[MetaPath])
+	if err != nil {
+		return "", fmt.Errorf("sync path %q: %w", event.MetaData[MetaPath], err)
+	}
+	base := event.MetaData[MetaBase]
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	files, err := s.files(f)
+	if err != nil {
+		return "", err
+	}
+	current := files[rel]
+	claimed := f.reserved[rel] != "" && f.reserved[rel] != event.UploadID
+
+	switch {
+	case claimed:
+		// Another device is uploading the same path right now
+		rel = conflictPath(rel, deviceName, time.Now())
+	case current == nil:
+		// New, or deleted on the server while changed on the device; the
+		// change wins over the deletion
+	case current.SHA256 == base || current.SHA256 == sum:
+		if err := s.retire(f, current, deviceID, deviceName); err != nil {
+			return "", err
+		}
+	default:
+		rel = conflictPath(rel, deviceName, time.Now())
+	}
+
+	f.reserved[rel] = event.UploadID
+	return path.Join(f.root, rel), nil
+}
+
+// HandleUploadEvent records completed sync uploads in the journal and
+// releases the paths of uploads that ended
+func (s *Service) HandleUploadEvent(event upload.Event) {
+	switch event.Type {
+	case upload.EventCompleted, upload.EventFailed, upload.EventTerminated:
+	default:
+		return
+	}
+	f := s.folders[event.MetaData[MetaFolder]]
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for rel, id := range f.reserved {
+		if id == event.UploadID {
+			delete(f.reserved, rel)
+		}
+	}
+
+	if event.Type != upload.EventCompleted || event.File == nil || !strings.HasPrefix(event.File.Path, f.root+"/") {
+		return
+	}
+
+	deviceID, deviceName, _ := s.uploader(event)
+	entry := &JournalEntry{
+		Op:         OpPut,
+		Path:       strings.TrimPrefix(event.File.Path, f.root+"/"),
+		FileID:     event.File.ID,
+		SHA256:     event.File.SHA256,
+		Size:       event.File.Size,
+		Device:     deviceID,
+		DeviceName: deviceName,
+	}
+	if wanted := event.MetaData[MetaPath]; entry.Path != strings.Trim(wanted, "/") {
+		entry.Op = OpConflict
+		entry.ConflictOf = wanted
+	}
+	f.journal.append(entry, s.logger)
+
+	s.logger.WithFields(logrus.Fields{
+		"sync_folder": f.Name,
+		"op":          entry.Op,
+		"path":        entry.Path,
+		"device":      deviceID,
+	}).Info("Sync folder updated")
+}
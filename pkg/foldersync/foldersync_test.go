@@ -0,0 +1,268 @@
+package foldersync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompare(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server := &Entry{Path: "notes.txt", SHA256: "server", FileID: "file-1"}
+
+	tests := []struct {
+		name     string
+		local    LocalFile
+		server   *Entry
+		action   string // empty when both sides agree
+		conflict bool
+	}{
+		{"unchanged", LocalFile{SHA256: "server", Base: "server"}, server, "", false},
+		{"same content without base", LocalFile{SHA256: "server"}, server, "", false},
+		{"changed locally", LocalFile{SHA256: "local", Base: "server"}, server, ActionUpload, false},
+		{"changed on the server", LocalFile{SHA256: "old", Base: "old"}, server, ActionDownload, false},
+		{"changed on both", LocalFile{SHA256: "local", Base: "old"}, server, ActionConflict, true},
+		{"new on both", LocalFile{SHA256: "local"}, server, ActionConflict, true},
+		{"new locally", LocalFile{SHA256: "local"}, nil, ActionUpload, false},
+		{"deleted on the server", LocalFile{SHA256: "old", Base: "old"}, nil, ActionDeleteLocal, false},
+		{"deleted on the server, changed locally", LocalFile{SHA256: "local", Base: "old"}, nil, ActionUpload, false},
+		{"deleted locally", LocalFile{SHA256: "server", Base: "server", Deleted: true}, server, ActionDeleteRemote, false},
+		{"deleted locally, changed on the server", LocalFile{SHA256: "old", Base: "old", Deleted: true}, server, ActionDownload, false},
+		{"deleted on both", LocalFile{SHA256: "old", Base: "old", Deleted: true}, nil, "", false},
+	}
+	for _, tt := range tests {
+		tt.local.Path = "notes.txt"
+		action := compare(tt.local, tt.server, "laptop", now)
+		if tt.action == "" {
+			if action != nil {
+				t.Errorf("%s: got %s, want nothing", tt.name, action.Action)
+			}
+			continue
+		}
+		if action == nil || action.Action != tt.action {
+			t.Errorf("%s: got %+v, want %s", tt.name, action, tt.action)
+			continue
+		}
+		if got := action.ConflictPath != ""; got != tt.conflict {
+			t.Errorf("%s: conflict path %q", tt.name, action.ConflictPath)
+		}
+		if tt.action == ActionDeleteRemote && action.Base != tt.local.Base {
+			t.Errorf("%s: base %q, want %q", tt.name, action.Base, tt.local.Base)
+		}
+	}
+}
+
+func TestConflictPath(t *testing.T) {
+	at := time.Date(2024, 5, 1, 13, 4, 5, 0, time.UTC)
+	tests := []struct {
+		rel, device, want string
+	}{
+		{"notes.txt", "laptop", "notes (conflict laptop 2024-05-01 130405).txt"},
+		{"docs/plan.tar.gz", "phone", "docs/plan.tar (conflict phone 2024-05-01 130405).gz"},
+		{"README", "", "README (conflict unknown device 2024-05-01 130405)"},
+		{"a.txt", "my/phone", "a (conflict my_phone 2024-05-01 130405).txt"},
+	}
+	for _, tt := range tests {
+		if got := conflictPath(tt.rel, tt.device, at); got != tt.want {
+			t.Errorf("conflictPath(%q, %q) = %q, want %q", tt.rel, tt.device, got, tt.want)
+		}
+	}
+}
+
+type testService struct {
+	*Service
+	backend storage.Backend
+}
+
+// newTestService returns a service with the sync folder "docs", stored in
+// the folder "synced", and the paired devices "laptop-id" and "phone-id".
+// Only the laptop may use the folder.
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Trash.Enabled = true
+	cfg.SyncFolders = []config.SyncFolder{{Name: "docs", Folder: "synced", Devices: []string{"laptop-id"}}}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	auth, err := security.NewAuthService(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, name := range map[string]string{"laptop-id": "laptop", "phone-id": "phone"} {
+		if _, err := auth.CreateDevice(id, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := upload.NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewService(cfg, logger, index, auth, download.NewHandler(cfg, logger, index, backend), uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testService{Service: s, backend: backend}
+}
+
+// store puts a synced file at rel
+func (s *testService) store(t *testing.T, rel, sum string) *catalog.FileMeta {
+	t.Helper()
+	meta := &catalog.FileMeta{
+		ID:      "file-" + sum,
+		Name:    rel,
+		Path:    "synced/" + rel,
+		Size:    int64(len(sum)),
+		SHA256:  sum,
+		Created: time.Now(),
+	}
+	if err := s.backend.Put(context.Background(), meta.Path, strings.NewReader(sum), meta.Size); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.index.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// syncUpload is the completed upload of rel to the sync folder based on the
+// server version base, created with the token of deviceID
+func syncUpload(id, deviceID, rel, base string) upload.Event {
+	return upload.Event{
+		Type:       upload.EventCompleted,
+		UploadID:   id,
+		Device:     "laptop-id",
+		DeviceID:   deviceID,
+		DeviceName: "claimed name",
+		MetaData:   map[string]string{MetaFolder: "docs", MetaPath: rel, MetaBase: base, "device": "laptop-id"},
+	}
+}
+
+func TestPlaceRequiresVerifiedDevice(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		deviceID string
+		want     error
+	}{
+		// The device metadata names the laptop, but there is no token
+		{"anonymous", "", ErrForbidden},
+		{"unpaired", "stranger-id", ErrForbidden},
+		{"not allowed in the folder", "phone-id", ErrForbidden},
+		{"allowed", "laptop-id", nil},
+	}
+	for _, tt := range tests {
+		target, err := s.place(ctx, syncUpload(tt.name, tt.deviceID, "notes.txt", ""), "new")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: place returned %q, %v, want %v", tt.name, target, err, tt.want)
+		}
+	}
+
+	// Uploads outside sync folders are left to the layout
+	if target, err := s.place(ctx, upload.Event{UploadID: "plain", MetaData: map[string]string{}}, "new"); target != "" || err != nil {
+		t.Errorf("plain upload placed at %q, %v", target, err)
+	}
+}
+
+func TestPlace(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string // SHA-256 of the server version, empty for none
+		claimed bool   // another upload of the same path is in flight
+		path    string
+		base    string
+		sum     string
+		want    string // target, "conflict" for a conflict copy
+		retired bool   // the server version is replaced
+		err     error
+	}{
+		{"new file", "", false, "notes.txt", "", "new", "synced/notes.txt", false, nil},
+		{"new file in a folder", "", false, "a/b/notes.txt", "", "new", "synced/a/b/notes.txt", false, nil},
+		{"base matches", "v1", false, "notes.txt", "v1", "v2", "synced/notes.txt", true, nil},
+		{"same content", "v1", false, "notes.txt", "", "v1", "synced/notes.txt", true, nil},
+		{"base differs", "v2", false, "notes.txt", "v1", "v3", "conflict", false, nil},
+		{"no base", "v2", false, "notes.txt", "", "v3", "conflict", false, nil},
+		{"claimed", "", true, "notes.txt", "", "new", "conflict", false, nil},
+		{"path leaves the folder", "", false, "../notes.txt", "", "new", "", false, ErrInvalidPath},
+		{"unclean path", "", false, "a//notes.txt", "", "new", "", false, ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		s := newTestService(t)
+		ctx := context.Background()
+
+		var current *catalog.FileMeta
+		if tt.current != "" {
+			current = s.store(t, "notes.txt", tt.current)
+		}
+		if tt.claimed {
+			if _, err := s.place(ctx, syncUpload("other", "laptop-id", tt.path, ""), tt.sum); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		target, err := s.place(ctx, syncUpload("upload", "laptop-id", tt.path, tt.base), tt.sum)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: place returned %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		switch {
+		case tt.want == "conflict":
+			// Named after the paired device, not the name the upload claims
+			if !strings.HasPrefix(target, "synced/notes (conflict laptop ") || !strings.HasSuffix(target, ").txt") {
+				t.Errorf("%s: conflict copy at %q", tt.name, target)
+			}
+		case target != tt.want:
+			t.Errorf("%s: placed at %q, want %q", tt.name, target, tt.want)
+		}
+
+		if current != nil {
+			_, err := s.index.Get(current.ID)
+			if retired := errors.Is(err, catalog.ErrNotFound); retired != tt.retired {
+				t.Errorf("%s: server version retired: %v, want %v", tt.name, retired, tt.retired)
+			}
+			if _, err := s.index.GetTrash(current.ID); tt.retired && err != nil {
+				t.Errorf("%s: replaced version not in the trash: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestJournalRecordsVerifiedDevice(t *testing.T) {
+	s := newTestService(t)
+	event := syncUpload("upload", "laptop-id", "notes.txt", "")
+	event.File = s.store(t, "notes.txt", "v1")
+	s.HandleUploadEvent(event)
+
+	entries, err := s.folders["docs"].journal.read(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Op != OpPut || entries[0].Device != "laptop-id" || entries[0].DeviceName != "laptop" {
+		t.Errorf("journal %+v", entries)
+	}
+}
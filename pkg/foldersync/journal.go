@@ -0,0 +1,192 @@
+package foldersync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// DirName is the directory under Storage.DataDir holding the journal and
+// device states of every sync folder
+const DirName = "sync"
+
+// Journal operations
+const (
+	OpPut      = "put"      // a file was uploaded to its path
+	OpConflict = "conflict" // an upload was kept as a conflict copy
+	OpDelete   = "delete"   // a device deleted a file
+)
+
+// JournalEntry records one change a device made to a sync folder
+type JournalEntry struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Op         string    `json:"op"`
+	Path       string    `json:"path"`
+	FileID     string    `json:"file_id"`
+	SHA256     string    `json:"sha256"`
+	Size       int64     `json:"size,omitempty"`
+	Device     string    `json:"device"`
+	DeviceName string    `json:"device_name,omitempty"`
+	ConflictOf string    `json:"conflict_of,omitempty"` // path the conflict copy was uploaded for
+}
+
+// DeviceState is what the server knows about a device syncing a folder
+type DeviceState struct {
+	Cursor   int64     `json:"cursor"` // journal position at the last delta
+	LastSync time.Time `json:"last_sync"`
+}
+
+// journal appends the changes of a sync folder to a file with one JSON entry
+// per line, and keeps the state of the devices syncing it
+type journal struct {
+	path      string
+	statePath string
+
+	mu     sync.Mutex
+	seq    int64
+	states map[string]*DeviceState
+}
+
+func openJournal(cfg *config.Config, name string) (*journal, error) {
+	dir := filepath.Join(cfg.Storage.DataDir, DirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create sync directory: %w", err)
+	}
+
+	j := &journal{
+		path:      filepath.Join(dir, name+".jsonl"),
+		statePath: filepath.Join(dir, name+".state.json"),
+		states:    make(map[string]*DeviceState),
+	}
+
+	entries, err := j.read(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		j.seq = entries[len(entries)-1].Seq
+	}
+
+	data, err := os.ReadFile(j.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read sync state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &j.states); err != nil {
+			return nil, fmt.Errorf("failed to parse sync state: %w", err)
+		}
+	}
+	return j, nil
+}
+
+func (j *journal) cursor() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.seq
+}
+
+// append numbers entry and writes it to the journal. A failed write is
+// logged: the change itself has already been made.
+func (j *journal) append(entry *JournalEntry, logger *logrus.Logger) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	entry.Seq = j.seq
+	entry.Time = time.Now()
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
+			_, err = f.Write(append(data, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		logger.WithError(err).WithField("path", entry.Path).Warn("Failed to write sync journal")
+	}
+}
+
+// read returns the entries after seq, oldest first. Lines that cannot be
+// parsed, such as one cut short by a crash, are skipped.
+func (j *journal) read(since int64) ([]*JournalEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*JournalEntry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]*JournalEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Seq <= since {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sync journal: %w", err)
+	}
+	return entries, nil
+}
+
+func (j *journal) device(deviceID string) (DeviceState, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	state, ok := j.states[deviceID]
+	if !ok {
+		return DeviceState{}, false
+	}
+	return *state, true
+}
+
+// synced records that a device caught up to cursor
+func (j *journal) synced(deviceID string, cursor int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.states[deviceID] = &DeviceState{Cursor: cursor, LastSync: time.Now()}
+
+	data, err := json.MarshalIndent(j.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.statePath)
+}
+
+// Journal returns the changes made to the folder after the entry numbered
+// since, oldest first and at most limit of them
+func (s *Service) Journal(f *Folder, since int64, limit int) ([]*JournalEntry, error) {
+	f.journal.mu.Lock()
+	entries, err := f.journal.read(since)
+	f.journal.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
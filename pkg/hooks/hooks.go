@@ -0,0 +1,332 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// Built-in hook actions
+const (
+	ActionCommand = "command"
+	ActionMove    = "move"
+	ActionWebhook = "webhook"
+)
+
+// queueSize is how many events may wait for the pipeline. Uploads never wait
+// for it; events that do not fit are dropped, see upload.EventQueue.
+const queueSize = 1024
+
+// maxOutputLog limits how much command output is logged
+const maxOutputLog = 4096
+
+type hook struct {
+	config.Hook
+	events  map[upload.EventType]bool
+	timeout time.Duration
+}
+
+// Pipeline runs the configured hooks for upload events. Events are handled
+// one at a time in the order they occurred, and the hooks of an event run in
+// configuration order, so a hook sees the effects of the ones before it.
+type Pipeline struct {
+	config  *config.Config
+	logger  *logrus.Logger
+	uploads *upload.TusHandler
+	backend storage.Backend
+	hooks   []hook
+	client  *http.Client
+	queue   *upload.EventQueue
+}
+
+func NewPipeline(cfg *config.Config, logger *logrus.Logger, uploads *upload.TusHandler, backend storage.Backend) (*Pipeline, error) {
+	p := &Pipeline{
+		config:  cfg,
+		logger:  logger,
+		uploads: uploads,
+		backend: backend,
+		client:  newWebhookClient(),
+		queue:   upload.NewEventQueue("hooks", queueSize, logger),
+	}
+
+	for i, hc := range cfg.Hooks {
+		h, err := newHook(hc)
+		if err != nil {
+			name := hc.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("invalid hook %s: %w", name, err)
+		}
+		p.hooks = append(p.hooks, h)
+	}
+
+	if len(p.hooks) > 0 {
+		uploads.Subscribe(p.queue.Push)
+		go p.queue.Run(p.process)
+		logger.WithField("hooks", len(p.hooks)).Info("Upload hooks enabled")
+	}
+
+	return p, nil
+}
+
+func newHook(hc config.Hook) (hook, error) {
+	h := hook{Hook: hc, events: make(map[upload.EventType]bool)}
+
+	events := hc.Events
+	if len(events) == 0 {
+		events = []string{string(upload.EventCompleted)}
+	}
+	for _, name := range events {
+		switch typ := upload.EventType(name); typ {
+		case upload.EventCreated, upload.EventProgress, upload.EventCompleted, upload.EventTerminated, upload.EventFailed:
+			h.events[typ] = true
+		default:
+			return h, fmt.Errorf("unknown event %q", name)
+		}
+	}
+
+	for _, pattern := range hc.MimeTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return h, fmt.Errorf("invalid MIME pattern %q", pattern)
+		}
+	}
+
+	switch hc.Action {
+	case ActionCommand:
+		if len(hc.Command) == 0 {
+			return h, fmt.Errorf("command action requires a command")
+		}
+	case ActionMove:
+		if upload.SanitizeRelativePath(hc.Target) == "" {
+			return h, fmt.Errorf("move action requires a target folder")
+		}
+		for typ := range h.events {
+			if typ != upload.EventCompleted {
+				return h, fmt.Errorf("move action only applies to completed uploads")
+			}
+		}
+	case ActionWebhook:
+		u, err := url.Parse(hc.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return h, fmt.Errorf("webhook action requires an http(s) URL")
+		}
+	default:
+		return h, fmt.Errorf("unknown action %q", hc.Action)
+	}
+
+	timeout, err := hc.GetTimeout()
+	if err != nil {
+		return h, fmt.Errorf("invalid timeout: %w", err)
+	}
+	h.timeout = timeout
+
+	return h, nil
+}
+
+func (p *Pipeline) process(event upload.Event) {
+	for _, h := range p.hooks {
+		if !h.matches(event) {
+			continue
+		}
+
+		logger := p.logger.WithFields(logrus.Fields{
+			"hook":      h.Name,
+			"action":    h.Action,
+			"event":     event.Type,
+			"upload_id": event.UploadID,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		var err error
+		switch h.Action {
+		case ActionCommand:
+			err = p.runCommand(ctx, h, event, logger)
+		case ActionMove:
+			err = p.move(ctx, h, &event)
+		case ActionWebhook:
+			err = p.postWebhook(ctx, h, event)
+		}
+		cancel()
+
+		if err != nil {
+			logger.WithError(err).Warn("Hook failed")
+		} else {
+			logger.Debug("Hook finished")
+		}
+	}
+}
+
+// matches reports whether the hook applies to the event
+func (h *hook) matches(event upload.Event) bool {
+	if !h.events[event.Type] {
+		return false
+	}
+	if len(h.MimeTypes) == 0 {
+		return true
+	}
+
+	mimeType := event.MetaData["filetype"]
+	if event.File != nil {
+		mimeType = event.File.MimeType
+	}
+	base := strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+
+	for _, pattern := range h.MimeTypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runCommand runs the hook command with the event described in EASYSYNC_*
+// environment variables
+func (p *Pipeline) runCommand(ctx context.Context, h hook, event upload.Event, logger *logrus.Entry) error {
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), p.commandEnv(event)...)
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > maxOutputLog {
+		output = output[:maxOutputLog]
+	}
+	if len(output) > 0 {
+		logger.WithField("output", string(output)).Debug("Hook command output")
+	}
+	return err
+}
+
+func (p *Pipeline) commandEnv(event upload.Event) []string {
+	env := []string{
+		"EASYSYNC_EVENT=" + string(event.Type),
+		"EASYSYNC_UPLOAD_ID=" + event.UploadID,
+		"EASYSYNC_FILE_NAME=" + event.FileName,
+		"EASYSYNC_FILE_SIZE=" + strconv.FormatInt(event.Size, 10),
+		"EASYSYNC_OFFSET=" + strconv.FormatInt(event.Offset, 10),
+		"EASYSYNC_DEVICE=" + event.Device,
+		"EASYSYNC_DEVICE_NAME=" + event.DeviceName,
+	}
+	if event.Error != "" {
+		env = append(env, "EASYSYNC_ERROR="+event.Error)
+	}
+
+	if file := event.File; file != nil {
+		env = append(env,
+			"EASYSYNC_FILE_ID="+file.ID,
+			"EASYSYNC_FILE_KEY="+file.Path,
+			"EASYSYNC_MIME_TYPE="+file.MimeType,
+			"EASYSYNC_SHA256="+file.SHA256,
+		)
+		// Local files can be handed to the command directly
+		if local, ok := p.backend.(*storage.Local); ok {
+			if filePath, err := local.Path(file.Path); err == nil {
+				env = append(env, "EASYSYNC_FILE_PATH="+filePath)
+			}
+		}
+	}
+
+	for key, value := range event.MetaData {
+		env = append(env, "EASYSYNC_META_"+envName(key)+"="+value)
+	}
+	return env
+}
+
+// envName turns a metadata key such as "relativePath" into "RELATIVEPATH"
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+// move relocates the completed file and updates the event for later hooks
+func (p *Pipeline) move(ctx context.Context, h hook, event *upload.Event) error {
+	if event.File == nil {
+		return nil
+	}
+
+	moved, err := p.uploads.Relocate(ctx, event.File, h.Target)
+	if err != nil {
+		return err
+	}
+	event.File = moved
+	return nil
+}
+
+// newWebhookClient returns the client posting webhooks. It only connects to
+// loopback and private addresses, checked after name resolution so a public
+// host name cannot point the server at the internet, and ignores proxy
+// settings for the same reason. Redirects are checked the same way.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: checkWebhookAddr}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// checkWebhookAddr refuses connections to addresses outside the local network
+func checkWebhookAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !(ip.IsLoopback() || ip.IsPrivate()) {
+		return fmt.Errorf("webhook address %s is not on the local network", host)
+	}
+	return nil
+}
+
+func (p *Pipeline) postWebhook(ctx context.Context, h hook, event upload.Event) error {
+	body, err := json.Marshal(struct {
+		Hook string `json:"hook"`
+		upload.Event
+	}{Hook: h.Name, Event: event})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-EasySync-Event", string(event.Type))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
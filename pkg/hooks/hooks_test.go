@@ -0,0 +1,340 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestPipeline returns a pipeline running hooks against temporary storage
+func newTestPipeline(t *testing.T, hooks ...config.Hook) (*Pipeline, *catalog.Index) {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Hooks = hooks
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := upload.NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPipeline(cfg, logger, uploads, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, index
+}
+
+// storeFile adds a completed file to the storage and the index
+func storeFile(t *testing.T, p *Pipeline, index *catalog.Index, key, mimeType string) *catalog.FileMeta {
+	t.Helper()
+	content := "hook test"
+	if err := p.backend.Put(context.Background(), key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	meta := &catalog.FileMeta{
+		ID:       "file-1",
+		Name:     filepath.Base(key),
+		Path:     key,
+		Size:     int64(len(content)),
+		MimeType: mimeType,
+		SHA256:   strings.Repeat("0", 64),
+		Created:  time.Now(),
+	}
+	if err := index.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func completed(meta *catalog.FileMeta) upload.Event {
+	return upload.Event{
+		Type:       upload.EventCompleted,
+		UploadID:   meta.ID,
+		FileName:   meta.Name,
+		Size:       meta.Size,
+		Offset:     meta.Size,
+		Device:     "phone",
+		DeviceID:   "phone-id",
+		DeviceName: "Phone",
+		MetaData:   map[string]string{"filename": meta.Name, "relativePath": "Camera/" + meta.Name},
+		File:       meta,
+	}
+}
+
+// envCommand returns a command writing the EASYSYNC_* environment to out
+func envCommand(t *testing.T, out string) []string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook command test needs a POSIX shell")
+	}
+	return []string{"sh", "-c", `env | grep '^EASYSYNC_' > "$0"`, out}
+}
+
+func readEnv(t *testing.T, file string) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+func TestNewHook(t *testing.T) {
+	tests := []struct {
+		name string
+		hook config.Hook
+		ok   bool
+	}{
+		{"command", config.Hook{Action: ActionCommand, Command: []string{"true"}}, true},
+		{"command without program", config.Hook{Action: ActionCommand}, false},
+		{"move", config.Hook{Action: ActionMove, Target: "Photos"}, true},
+		{"move outside storage", config.Hook{Action: ActionMove, Target: "../.."}, false},
+		{"move on created", config.Hook{Action: ActionMove, Target: "Photos", Events: []string{"created"}}, false},
+		{"webhook", config.Hook{Action: ActionWebhook, URL: "http://127.0.0.1:8080/hook"}, true},
+		{"webhook without scheme", config.Hook{Action: ActionWebhook, URL: "127.0.0.1:8080"}, false},
+		{"unknown event", config.Hook{Action: ActionCommand, Command: []string{"true"}, Events: []string{"done"}}, false},
+		{"invalid pattern", config.Hook{Action: ActionCommand, Command: []string{"true"}, MimeTypes: []string{"image/["}}, false},
+		{"invalid timeout", config.Hook{Action: ActionCommand, Command: []string{"true"}, Timeout: "soon"}, false},
+		{"unknown action", config.Hook{Action: "email"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newHook(tt.hook)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHookMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		hook   config.Hook
+		event  upload.Event
+		expect bool
+	}{
+		{"completed by default", config.Hook{}, upload.Event{Type: upload.EventCompleted}, true},
+		{"other events not by default", config.Hook{}, upload.Event{Type: upload.EventCreated}, false},
+		{"listed event", config.Hook{Events: []string{"created", "failed"}}, upload.Event{Type: upload.EventFailed}, true},
+		{"unlisted event", config.Hook{Events: []string{"created"}}, upload.Event{Type: upload.EventCompleted}, false},
+		{"MIME glob", config.Hook{MimeTypes: []string{"image/*"}},
+			upload.Event{Type: upload.EventCompleted, File: &catalog.FileMeta{MimeType: "image/jpeg"}}, true},
+		{"MIME glob mismatch", config.Hook{MimeTypes: []string{"image/*"}},
+			upload.Event{Type: upload.EventCompleted, File: &catalog.FileMeta{MimeType: "video/mp4"}}, false},
+		{"MIME parameters and case", config.Hook{MimeTypes: []string{"Text/Plain"}},
+			upload.Event{Type: upload.EventCompleted, File: &catalog.FileMeta{MimeType: "text/plain; charset=utf-8"}}, true},
+		{"stored type wins over the client hint", config.Hook{MimeTypes: []string{"image/*"}},
+			upload.Event{Type: upload.EventCompleted, MetaData: map[string]string{"filetype": "image/png"}, File: &catalog.FileMeta{MimeType: "text/html"}}, false},
+		{"client hint before completion", config.Hook{Events: []string{"created"}, MimeTypes: []string{"image/*"}},
+			upload.Event{Type: upload.EventCreated, MetaData: map[string]string{"filetype": "image/png"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.hook.Action = ActionCommand
+			tt.hook.Command = []string{"true"}
+			h, err := newHook(tt.hook)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := h.matches(tt.event); got != tt.expect {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestCommandEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	p, index := newTestPipeline(t, config.Hook{Name: "env", Action: ActionCommand, Command: envCommand(t, out)})
+	meta := storeFile(t, p, index, "IMG_1.jpg", "image/jpeg")
+
+	p.process(completed(meta))
+
+	env := readEnv(t, out)
+	filePath := filepath.Join(p.config.Storage.UploadDir, "IMG_1.jpg")
+	expected := map[string]string{
+		"EASYSYNC_EVENT":             "completed",
+		"EASYSYNC_UPLOAD_ID":         "file-1",
+		"EASYSYNC_FILE_NAME":         "IMG_1.jpg",
+		"EASYSYNC_FILE_SIZE":         "9",
+		"EASYSYNC_OFFSET":            "9",
+		"EASYSYNC_DEVICE":            "phone",
+		"EASYSYNC_DEVICE_NAME":       "Phone",
+		"EASYSYNC_FILE_ID":           "file-1",
+		"EASYSYNC_FILE_KEY":          "IMG_1.jpg",
+		"EASYSYNC_FILE_PATH":         filePath,
+		"EASYSYNC_MIME_TYPE":         "image/jpeg",
+		"EASYSYNC_SHA256":            meta.SHA256,
+		"EASYSYNC_META_FILENAME":     "IMG_1.jpg",
+		"EASYSYNC_META_RELATIVEPATH": "Camera/IMG_1.jpg",
+	}
+	for key, value := range expected {
+		if env[key] != value {
+			t.Errorf("%s = %q, want %q", key, env[key], value)
+		}
+	}
+	if _, ok := env["EASYSYNC_ERROR"]; ok {
+		t.Error("EASYSYNC_ERROR set without an error")
+	}
+}
+
+func TestMoveBeforeLaterHooks(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	p, index := newTestPipeline(t,
+		config.Hook{Name: "photos", Action: ActionMove, Target: "Photos", MimeTypes: []string{"image/*"}},
+		config.Hook{Name: "env", Action: ActionCommand, Command: envCommand(t, out)},
+	)
+	meta := storeFile(t, p, index, "IMG_1.jpg", "image/jpeg")
+
+	p.process(completed(meta))
+
+	moved, err := index.Get(meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Path != "Photos/IMG_1.jpg" {
+		t.Errorf("path %s, want Photos/IMG_1.jpg", moved.Path)
+	}
+	if _, err := os.Stat(filepath.Join(p.config.Storage.UploadDir, "Photos", "IMG_1.jpg")); err != nil {
+		t.Error(err)
+	}
+	if key := readEnv(t, out)["EASYSYNC_FILE_KEY"]; key != "Photos/IMG_1.jpg" {
+		t.Errorf("later hook saw %s, want the moved file", key)
+	}
+
+	// Files not matching the MIME filter stay where they are
+	other := storeFile(t, p, index, "notes.txt", "text/plain")
+	other.ID = "file-2"
+	if err := index.Save(other); err != nil {
+		t.Fatal(err)
+	}
+	p.process(completed(other))
+	if current, err := index.Get("file-2"); err != nil || current.Path != "notes.txt" {
+		t.Errorf("text file moved: %+v, %v", current, err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body struct {
+		Hook string `json:"hook"`
+		upload.Event
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- r
+	}))
+	defer server.Close()
+
+	p, index := newTestPipeline(t, config.Hook{Name: "notify", Action: ActionWebhook, URL: server.URL + "/easysync"})
+	meta := storeFile(t, p, index, "IMG_1.jpg", "image/jpeg")
+	h := p.hooks[0]
+
+	if err := p.postWebhook(context.Background(), h, completed(meta)); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+	if r.Method != http.MethodPost || r.URL.Path != "/easysync" {
+		t.Errorf("request %s %s", r.Method, r.URL.Path)
+	}
+	if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-EasySync-Event") != "completed" {
+		t.Errorf("headers %v", r.Header)
+	}
+	if body.Hook != "notify" || body.Type != upload.EventCompleted || body.File == nil || body.File.ID != meta.ID || body.DeviceID != "phone-id" {
+		t.Errorf("body %+v", body)
+	}
+}
+
+func TestWebhookErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	p, _ := newTestPipeline(t)
+	event := upload.Event{Type: upload.EventCompleted}
+
+	h, err := newHook(config.Hook{Action: ActionWebhook, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.postWebhook(context.Background(), h, event); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("failing endpoint: %v", err)
+	}
+
+	// Public addresses are refused before connecting
+	h, err = newHook(config.Hook{Action: ActionWebhook, URL: "http://93.184.216.34/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.postWebhook(context.Background(), h, event); err == nil || !strings.Contains(err.Error(), "local network") {
+		t.Errorf("public address: %v", err)
+	}
+}
+
+func TestCheckWebhookAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:80", true},
+		{"10.1.2.3:443", true},
+		{"172.16.0.1:80", true},
+		{"192.168.1.10:8080", true},
+		{"[fd00::1]:80", true},
+		{"8.8.8.8:80", false},
+		{"172.32.0.1:80", false},
+		{"[2001:db8::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"0.0.0.0:80", false},
+		{"example.com:80", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := checkWebhookAddr("tcp", tt.address, nil)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package photo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/rwcarlsen/goexif/exif"
+	_ "golang.org/x/image/webp"
+)
+
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Supported reports whether metadata can be read from files of the MIME type
+func Supported(mimeType string) bool {
+	return imageTypes[baseMimeType(mimeType)]
+}
+
+// Extract reads the photo metadata of an image. EXIF is read from JPEG
+// files, for the other types only the dimensions are known. It returns nil
+// when nothing could be read.
+func Extract(r io.ReadSeeker, mimeType string) (*catalog.PhotoMeta, error) {
+	base := baseMimeType(mimeType)
+	if !imageTypes[base] {
+		return nil, nil
+	}
+
+	p := &catalog.PhotoMeta{}
+	if base == "image/jpeg" {
+		// Most images without EXIF fail to decode; only the dimensions are read then
+		if x, err := exif.Decode(r); err == nil {
+			readExif(x, p)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Width == 0 || p.Height == 0 {
+		cfg, _, err := image.DecodeConfig(r)
+		if err != nil {
+			if p.TakenAt == nil && p.Model == "" && p.GPS == nil {
+				return nil, fmt.Errorf("failed to read image header: %w", err)
+			}
+		} else {
+			p.Width, p.Height = cfg.Width, cfg.Height
+		}
+	}
+
+	// Orientations 5-8 turn the picture by 90 degrees
+	if p.Orientation >= 5 && p.Orientation <= 8 {
+		p.Width, p.Height = p.Height, p.Width
+	}
+	return p, nil
+}
+
+func readExif(x *exif.Exif, p *catalog.PhotoMeta) {
+	if t, err := x.DateTime(); err == nil {
+		p.TakenAt = &t
+	}
+	p.Make = stringTag(x, exif.Make)
+	p.Model = stringTag(x, exif.Model)
+
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if o, err := tag.Int(0); err == nil && o >= 1 && o <= 8 {
+			p.Orientation = o
+		}
+	}
+	if tag, err := x.Get(exif.PixelXDimension); err == nil {
+		p.Width, _ = tag.Int(0)
+	}
+	if tag, err := x.Get(exif.PixelYDimension); err == nil {
+		p.Height, _ = tag.Int(0)
+	}
+
+	lat, long, err := x.LatLong()
+	if err != nil {
+		return
+	}
+	p.GPS = &catalog.GPS{Latitude: lat, Longitude: long}
+	if tag, err := x.Get(exif.GPSAltitude); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+			alt := float64(num) / float64(den)
+			if ref, err := x.Get(exif.GPSAltitudeRef); err == nil {
+				if v, err := ref.Int(0); err == nil && v == 1 {
+					alt = -alt
+				}
+			}
+			p.GPS.Altitude = &alt
+		}
+	}
+}
+
+func stringTag(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// CanStripGPS reports whether StripGPS handles files of the MIME type. Only
+// JPEG is supported; the EXIF chunk of PNG, the EXIF and XMP chunks of WebP
+// and HEIC files keep their location.
+func CanStripGPS(mimeType string) bool {
+	return baseMimeType(mimeType) == "image/jpeg"
+}
+
+// StripGPS removes the location from the EXIF and XMP metadata of a JPEG
+// file. The file is changed in place and keeps its size: the entries of the
+// EXIF GPS directory and the values they point to are overwritten with
+// zeros, XMP GPS properties with spaces. It reports whether anything was
+// removed. Metadata segments that cannot be parsed are an error, since a
+// location in them could not be removed.
+func StripGPS(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	changed, err := stripJPEG(f, f)
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, f.Sync()
+}
+
+// HasGPS reports whether StripGPS would remove anything from the JPEG data
+// in r. Data that StripGPS could not handle is an error.
+func HasGPS(r io.ReaderAt) (bool, error) {
+	return stripJPEG(r, nil)
+}
+
+// stripJPEG walks the metadata segments of a JPEG file and removes the GPS
+// data of each APP1 segment, writing the changed segments to w unless w is nil
+func stripJPEG(r io.ReaderAt, w io.WriterAt) (bool, error) {
+	var head [4]byte
+	if _, err := r.ReadAt(head[:2], 0); err != nil {
+		return false, err
+	}
+	if head[0] != 0xFF || head[1] != 0xD8 {
+		return false, errors.New("not a JPEG file")
+	}
+
+	changed := false
+	for off := int64(2); ; {
+		if _, err := r.ReadAt(head[:2], off); err != nil {
+			return false, err
+		}
+		if head[0] != 0xFF {
+			return false, fmt.Errorf("invalid JPEG marker at offset %d", off)
+		}
+
+		marker := head[1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte
+			off++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length
+			off += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			// Image data follows, metadata only comes before it
+			return changed, nil
+		}
+
+		if _, err := r.ReadAt(head[2:4], off+2); err != nil {
+			return false, err
+		}
+		length := int64(binary.BigEndian.Uint16(head[2:4]))
+		if length < 2 {
+			return false, fmt.Errorf("invalid JPEG segment length at offset %d", off)
+		}
+
+		if marker == 0xE1 {
+			data := make([]byte, length-2)
+			if _, err := r.ReadAt(data, off+4); err != nil {
+				return false, fmt.Errorf("truncated APP1 segment at offset %d: %w", off, err)
+			}
+			stripped, err := stripAPP1(data)
+			if err != nil {
+				return false, fmt.Errorf("APP1 segment at offset %d: %w", off, err)
+			}
+			if stripped {
+				changed = true
+				if w != nil {
+					if _, err := w.WriteAt(data, off+4); err != nil {
+						return false, err
+					}
+				}
+			}
+		}
+		off += 2 + length
+	}
+}
+
+// APP1 segment signatures
+const (
+	exifHeader         = "Exif\x00\x00"
+	xmpHeader          = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpExtensionHeader = "http://ns.adobe.com/xmp/extension/\x00"
+)
+
+// stripAPP1 removes the GPS data from the contents of an APP1 segment
+func stripAPP1(data []byte) (bool, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(exifHeader)):
+		return stripTIFF(data[len(exifHeader):])
+	case bytes.HasPrefix(data, []byte(xmpHeader)), bytes.HasPrefix(data, []byte(xmpExtensionHeader)):
+		return stripXMP(data), nil
+	default:
+		return false, errors.New("unknown APP1 segment")
+	}
+}
+
+// xmpGPSPattern matches the EXIF GPS properties of XMP, written as attributes
+// (group 1 or 2 is the value) or as elements (group 3)
+var xmpGPSPattern = regexp.MustCompile(`exif:GPS\w+\s*=\s*(?:"([^"]*)"|'([^']*)')|<exif:GPS\w+(?:\s[^>]*)?>([^<]*)</exif:GPS\w+>`)
+
+// stripXMP overwrites the values of XMP GPS properties with spaces
+func stripXMP(data []byte) bool {
+	changed := false
+	for _, match := range xmpGPSPattern.FindAllSubmatchIndex(data, -1) {
+		for group := 1; group <= 3; group++ {
+			start, end := match[2*group], match[2*group+1]
+			if start < 0 {
+				continue
+			}
+			for i := start; i < end; i++ {
+				if data[i] != ' ' {
+					data[i] = ' '
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// tiffTypeSizes holds the byte size of each TIFF field type
+var tiffTypeSizes = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+const gpsInfoTag = 0x8825
+
+// stripTIFF empties the GPS directory of a TIFF structure in b
+func stripTIFF(b []byte) (bool, error) {
+	if len(b) < 8 {
+		return false, errors.New("truncated EXIF data")
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false, errors.New("invalid EXIF byte order")
+	}
+
+	inBounds := func(off uint32, size uint64) bool {
+		return uint64(off)+size <= uint64(len(b))
+	}
+
+	ifd0 := order.Uint32(b[4:8])
+	if !inBounds(ifd0, 2) {
+		return false, errors.New("invalid EXIF directory offset")
+	}
+	n := uint32(order.Uint16(b[ifd0:]))
+	if !inBounds(ifd0+2, uint64(n)*12) {
+		return false, errors.New("truncated EXIF directory")
+	}
+
+	var gps uint32
+	for i := uint32(0); i < n; i++ {
+		entry := ifd0 + 2 + i*12
+		if order.Uint16(b[entry:]) == gpsInfoTag {
+			gps = order.Uint32(b[entry+8:])
+			break
+		}
+	}
+	if gps == 0 {
+		return false, nil
+	}
+	if !inBounds(gps, 2) {
+		return false, errors.New("invalid GPS directory offset")
+	}
+
+	m := uint32(order.Uint16(b[gps:]))
+	if !inBounds(gps+2, uint64(m)*12) {
+		return false, errors.New("truncated GPS directory")
+	}
+	if m == 0 {
+		return false, nil
+	}
+
+	for i := uint32(0); i < m; i++ {
+		entry := gps + 2 + i*12
+		size := tiffTypeSizes[order.Uint16(b[entry+2:])] * uint64(order.Uint32(b[entry+4:]))
+		if size > 4 {
+			// The value is stored elsewhere in the block
+			if value := order.Uint32(b[entry+8:]); inBounds(value, size) {
+				clear(b[value : uint64(value)+size])
+			}
+		}
+	}
+
+	// An empty directory whose next directory offset is zero
+	clear(b[gps : gps+2+m*12])
+	return true, nil
+}
+
+func baseMimeType(mimeType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+}
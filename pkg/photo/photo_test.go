@@ -0,0 +1,302 @@
+package photo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// tiffField is a directory entry; values of up to four bytes are stored inline
+type tiffField struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// appendIFD appends a directory followed by its out of line values
+func appendIFD(b []byte, order byteOrder, fields []tiffField) []byte {
+	dataOff := len(b) + 2 + len(fields)*12 + 4
+	var data []byte
+
+	b = order.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		b = order.AppendUint16(b, f.tag)
+		b = order.AppendUint16(b, f.typ)
+		b = order.AppendUint32(b, f.count)
+		if len(f.value) <= 4 {
+			b = append(b, make([]byte, 4)...)
+			copy(b[len(b)-4:], f.value)
+		} else {
+			b = order.AppendUint32(b, uint32(dataOff+len(data)))
+			data = append(data, f.value...)
+		}
+	}
+	b = order.AppendUint32(b, 0)
+	return append(b, data...)
+}
+
+func rationals(order byteOrder, values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = order.AppendUint32(b, v)
+		b = order.AppendUint32(b, 1)
+	}
+	return b
+}
+
+// gpsIFDEntry is the offset of the GPSInfo entry value in buildTIFF output
+const gpsIFDEntry = 8 + 2 + 12 + 8
+
+// buildTIFF returns EXIF data with a camera make and, with gps, the location
+// 51°30'N 0°7'W
+func buildTIFF(order byteOrder, gps bool) []byte {
+	b := []byte("II")
+	if order == binary.BigEndian {
+		b = []byte("MM")
+	}
+	b = order.AppendUint16(b, 42)
+	b = order.AppendUint32(b, 8)
+
+	fields := []tiffField{{tag: 0x010F, typ: 2, count: 5, value: []byte("Test\x00")}}
+	if !gps {
+		return appendIFD(b, order, fields)
+	}
+
+	fields = append(fields, tiffField{tag: gpsInfoTag, typ: 4, count: 1})
+	b = appendIFD(b, order, fields)
+	order.PutUint32(b[gpsIFDEntry:], uint32(len(b)))
+	return appendIFD(b, order, []tiffField{
+		{tag: 0x0001, typ: 2, count: 2, value: []byte("N\x00")},
+		{tag: 0x0002, typ: 5, count: 3, value: rationals(order, 51, 30, 0)},
+		{tag: 0x0003, typ: 2, count: 2, value: []byte("W\x00")},
+		{tag: 0x0004, typ: 5, count: 3, value: rationals(order, 0, 7, 0)},
+	})
+}
+
+// segment returns a JPEG marker segment
+func segment(marker byte, data []byte) []byte {
+	length := len(data) + 2
+	return append([]byte{0xFF, marker, byte(length >> 8), byte(length)}, data...)
+}
+
+func exifSegment(tiff []byte) []byte {
+	return segment(0xE1, append([]byte(exifHeader), tiff...))
+}
+
+func xmpSegment(xmp string) []byte {
+	return segment(0xE1, append([]byte(xmpHeader), xmp...))
+}
+
+const xmpAttributes = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="51,30.0N" exif:GPSLongitude='0,7.0W' exif:ExposureTime="1/100"/>` +
+	`</rdf:RDF></x:xmpmeta>`
+
+const xmpElements = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/"><exif:GPSLatitude>51,30.0N</exif:GPSLatitude>` +
+	`<exif:GPSLongitude rdf:parseType="Literal">0,7.0W</exif:GPSLongitude><exif:ExposureTime>1/100</exif:ExposureTime></rdf:Description>` +
+	`</rdf:RDF></x:xmpmeta>`
+
+// buildJPEG returns a small JPEG image with the given segments after SOI
+func buildJPEG(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		b = append(b, s...)
+	}
+	return append(b, img.Bytes()[2:]...)
+}
+
+func TestStripTIFF(t *testing.T) {
+	outOfRange := buildTIFF(binary.LittleEndian, true)
+	binary.LittleEndian.PutUint32(outOfRange[gpsIFDEntry:], 0xFFFF)
+
+	truncatedGPS := buildTIFF(binary.BigEndian, true)
+	gps := binary.BigEndian.Uint32(truncatedGPS[gpsIFDEntry:])
+	binary.BigEndian.PutUint16(truncatedGPS[gps:], 200)
+
+	truncatedIFD0 := buildTIFF(binary.LittleEndian, false)[:12]
+
+	tests := []struct {
+		name    string
+		tiff    []byte
+		changed bool
+		fails   bool
+	}{
+		{"little-endian with GPS", buildTIFF(binary.LittleEndian, true), true, false},
+		{"big-endian with GPS", buildTIFF(binary.BigEndian, true), true, false},
+		{"little-endian without GPS", buildTIFF(binary.LittleEndian, false), false, false},
+		{"big-endian without GPS", buildTIFF(binary.BigEndian, false), false, false},
+		{"truncated header", []byte("II*\x00"), false, true},
+		{"invalid byte order", append([]byte("XX"), buildTIFF(binary.LittleEndian, true)[2:]...), false, true},
+		{"IFD0 out of range", []byte("II*\x00\xff\x00\x00\x00"), false, true},
+		{"truncated IFD0", truncatedIFD0, false, true},
+		{"GPS directory out of range", outOfRange, false, true},
+		{"truncated GPS directory", truncatedGPS, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), tt.tiff...)
+			changed, err := stripTIFF(b)
+			if (err != nil) != tt.fails {
+				t.Fatalf("error %v, want failure=%v", err, tt.fails)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed %v, want %v", changed, tt.changed)
+			}
+			if len(b) != len(tt.tiff) {
+				t.Errorf("size %d, want %d", len(b), len(tt.tiff))
+			}
+			if !changed {
+				if !bytes.Equal(b, tt.tiff) {
+					t.Error("data modified")
+				}
+				return
+			}
+
+			order := binary.ByteOrder(binary.LittleEndian)
+			if b[0] == 'M' {
+				order = binary.BigEndian
+			}
+			for _, v := range [][]byte{rationals(order.(byteOrder), 51, 30, 0), rationals(order.(byteOrder), 0, 7, 0)} {
+				if bytes.Contains(b, v) {
+					t.Error("coordinates left in the data")
+				}
+			}
+			if !bytes.Contains(b, []byte("Test\x00")) {
+				t.Error("other tags removed")
+			}
+			if gps := order.Uint32(b[gpsIFDEntry:]); order.Uint16(b[gps:]) != 0 {
+				t.Error("GPS directory not emptied")
+			}
+		})
+	}
+}
+
+func TestStripGPS(t *testing.T) {
+	le := exifSegment(buildTIFF(binary.LittleEndian, true))
+	be := exifSegment(buildTIFF(binary.BigEndian, true))
+	plain := exifSegment(buildTIFF(binary.LittleEndian, false))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		changed bool
+		fails   bool
+	}{
+		{"little-endian EXIF", buildJPEG(t, le), true, false},
+		{"big-endian EXIF", buildJPEG(t, be), true, false},
+		{"EXIF without GPS", buildJPEG(t, plain), false, false},
+		{"XMP attributes", buildJPEG(t, xmpSegment(xmpAttributes)), true, false},
+		{"XMP elements", buildJPEG(t, xmpSegment(xmpElements)), true, false},
+		{"EXIF and XMP", buildJPEG(t, le, segment(0xE0, []byte("JFIF\x00")), xmpSegment(xmpElements)), true, false},
+		{"XMP without GPS", buildJPEG(t, xmpSegment(`<x:xmpmeta xmlns:x="adobe:ns:meta/"/>`)), false, false},
+		{"no metadata", buildJPEG(t), false, false},
+		{"fill bytes", buildJPEG(t, append([]byte{0xFF, 0xFF}, le...)), true, false},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), false, true},
+		{"unknown APP1", buildJPEG(t, segment(0xE1, []byte("Vendor\x00data"))), false, true},
+		{"invalid EXIF", buildJPEG(t, exifSegment([]byte("XX*\x00\x08\x00\x00\x00"))), false, true},
+		{"segment length below two", append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}, buildJPEG(t)[2:]...), false, true},
+		{"segment longer than the file", []byte("\xFF\xD8\xFF\xE1\x10\x00Exif\x00\x00II*\x00"), false, true},
+		{"truncated file", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF"), false, true},
+		{"invalid marker", []byte("\xFF\xD8\x00\x00"), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := HasGPS(bytes.NewReader(tt.data))
+			if (err != nil) != tt.fails || found != tt.changed {
+				t.Errorf("HasGPS = %v, %v", found, err)
+			}
+
+			path := filepath.Join(t.TempDir(), "photo.jpg")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			changed, err := StripGPS(path)
+			if (err != nil) != tt.fails {
+				t.Fatalf("error %v, want failure=%v", err, tt.fails)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed %v, want %v", changed, tt.changed)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != len(tt.data) {
+				t.Errorf("size %d, want %d", len(data), len(tt.data))
+			}
+			if !changed {
+				if !bytes.Equal(data, tt.data) {
+					t.Error("file modified")
+				}
+				return
+			}
+
+			if found, err := HasGPS(bytes.NewReader(data)); err != nil || found {
+				t.Errorf("GPS left after stripping: %v, %v", found, err)
+			}
+			if bytes.Contains(data, []byte("51,30.0N")) || bytes.Contains(data, []byte("0,7.0W")) {
+				t.Error("XMP coordinates left in the file")
+			}
+			if bytes.Contains(tt.data, []byte("ExposureTime")) && !bytes.Contains(data, []byte("1/100")) {
+				t.Error("other XMP properties removed")
+			}
+			if x, err := exif.Decode(bytes.NewReader(data)); err == nil {
+				if _, _, err := x.LatLong(); err == nil {
+					t.Error("EXIF location left in the file")
+				}
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("image no longer decodes: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractGPS(t *testing.T) {
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := buildJPEG(t, exifSegment(buildTIFF(order, true)))
+		p, err := Extract(bytes.NewReader(data), "image/jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Make != "Test" || p.GPS == nil || p.GPS.Latitude != 51.5 || p.GPS.Longitude > -0.1166 || p.GPS.Longitude < -0.1167 {
+			t.Errorf("%v: read %+v, GPS %+v", order, p, p.GPS)
+		}
+		if p.Width != 8 || p.Height != 8 {
+			t.Errorf("%v: dimensions %dx%d", order, p.Width, p.Height)
+		}
+	}
+}
+
+func TestCanStripGPS(t *testing.T) {
+	for mimeType, expect := range map[string]bool{
+		"image/jpeg":                 true,
+		"image/JPEG; charset=binary": true,
+		"image/png":                  false,
+		"image/webp":                 false,
+		"image/heic":                 false,
+	} {
+		if got := CanStripGPS(mimeType); got != expect {
+			t.Errorf("CanStripGPS(%q) = %v", mimeType, got)
+		}
+	}
+}
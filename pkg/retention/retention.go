@@ -0,0 +1,337 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// Device is recorded as the deleting device of files removed by a rule; the
+// rule name is recorded as the device name
+const Device = "retention"
+
+// Reasons a rule applies to a file
+const (
+	ReasonAge  = "age"  // older than the rule's max_age
+	ReasonSize = "size" // beyond the rule's max_size
+)
+
+type rule struct {
+	config.RetentionRule
+	maxAge   time.Duration
+	maxBytes int64
+	target   string // sanitized archive folder
+}
+
+// Action is what a rule does, or would do, to one file
+type Action struct {
+	Rule     string    `json:"rule"`
+	Action   string    `json:"action"`
+	Reason   string    `json:"reason"`
+	FileID   string    `json:"file_id"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	MimeType string    `json:"mime_type"`
+	Device   string    `json:"device"`
+	Created  time.Time `json:"created"`
+	Target   string    `json:"target,omitempty"` // archive folder
+	Error    string    `json:"error,omitempty"`  // set when enforcing the action failed
+}
+
+// Report lists the actions of one evaluation of the rules
+type Report struct {
+	DryRun    bool      `json:"dry_run"`
+	Evaluated time.Time `json:"evaluated"`
+	Files     int       `json:"files"`  // files looked at
+	Pinned    int       `json:"pinned"` // files exempt because they are pinned
+	Actions   []*Action `json:"actions"`
+	Bytes     int64     `json:"bytes"`  // size of the files acted on
+	Failed    int       `json:"failed"` // actions that failed
+}
+
+// Service enforces the retention rules on the inbox, periodically when
+// enabled and on request
+type Service struct {
+	config    *config.Config
+	logger    *logrus.Logger
+	index     *catalog.Index
+	downloads *download.Handler
+	uploads   *upload.TusHandler
+	rules     []rule
+	interval  time.Duration
+
+	mu   sync.Mutex // one evaluation at a time
+	last *Report
+}
+
+func NewService(cfg *config.Config, logger *logrus.Logger, index *catalog.Index, downloads *download.Handler, uploads *upload.TusHandler) (*Service, error) {
+	s := &Service{
+		config:    cfg,
+		logger:    logger,
+		index:     index,
+		downloads: downloads,
+		uploads:   uploads,
+	}
+
+	for i, rc := range cfg.Retention.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			name := rc.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("invalid retention rule %s: %w", name, err)
+		}
+		if r.Name == "" {
+			r.Name = "#" + strconv.Itoa(i+1)
+		}
+		s.rules = append(s.rules, r)
+	}
+
+	interval, err := cfg.GetRetentionInterval()
+	if err != nil {
+		return nil, fmt.Errorf("invalid retention interval: %w", err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("retention interval must be positive")
+	}
+	s.interval = interval
+
+	if cfg.Retention.Enabled && len(s.rules) > 0 {
+		go s.run()
+		logger.WithFields(logrus.Fields{
+			"rules":    len(s.rules),
+			"interval": interval,
+		}).Info("Retention rules enabled")
+	}
+
+	return s, nil
+}
+
+func newRule(rc config.RetentionRule) (rule, error) {
+	r := rule{RetentionRule: rc}
+
+	for _, pattern := range rc.MimeTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return r, fmt.Errorf("invalid MIME pattern %q", pattern)
+		}
+	}
+
+	var err error
+	if r.maxAge, err = rc.GetMaxAge(); err != nil {
+		return r, fmt.Errorf("invalid max_age: %w", err)
+	}
+	if r.maxBytes, err = rc.GetMaxBytes(); err != nil {
+		return r, fmt.Errorf("invalid max_size: %w", err)
+	}
+	if r.maxAge <= 0 && r.maxBytes <= 0 {
+		return r, fmt.Errorf("rule needs max_age or max_size")
+	}
+
+	switch rc.Action {
+	case config.RetentionDelete:
+	case config.RetentionArchive:
+		if r.target = upload.SanitizeRelativePath(rc.Target); r.target == "" {
+			return r, fmt.Errorf("archive action requires a target folder")
+		}
+	default:
+		return r, fmt.Errorf("unknown action %q", rc.Action)
+	}
+
+	return r, nil
+}
+
+// matches reports whether the rule governs meta by its type
+func (r *rule) matches(meta *catalog.FileMeta) bool {
+	if len(r.MimeTypes) == 0 {
+		return true
+	}
+
+	base := strings.ToLower(strings.TrimSpace(strings.Split(meta.MimeType, ";")[0]))
+	for _, pattern := range r.MimeTypes {
+		if ok, _ := path.Match(strings.ToLower(pattern), base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// archived reports whether meta is already in the archive folder of the rule
+func (r *rule) archived(meta *catalog.FileMeta) bool {
+	return r.target != "" && (meta.Path == r.target || strings.HasPrefix(meta.Path, r.target+"/"))
+}
+
+// LastRun returns the report of the last enforcement, nil before the first
+func (s *Service) LastRun() *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.last
+}
+
+// Evaluate reports what the rules would do now without changing anything
+func (s *Service) Evaluate() (*Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.evaluate(time.Now())
+}
+
+// Enforce applies the rules now
+func (s *Service) Enforce(ctx context.Context) (*Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, err := s.evaluate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	report.DryRun = false
+
+	for _, action := range report.Actions {
+		if err := s.apply(ctx, action); err != nil {
+			action.Error = err.Error()
+			report.Failed++
+			s.logger.WithError(err).WithFields(logrus.Fields{
+				"rule":    action.Rule,
+				"file_id": action.FileID,
+			}).Warn("Failed to apply retention rule")
+			continue
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"rule":    action.Rule,
+			"action":  action.Action,
+			"reason":  action.Reason,
+			"file_id": action.FileID,
+			"path":    action.Path,
+		}).Info("Retention rule applied")
+	}
+
+	s.last = report
+	return report, nil
+}
+
+// evaluate assigns every unpinned file to the first rule matching its type
+// and lists the files each rule affects: those older than its age limit, then,
+// keeping the newest files, those beyond its size limit
+func (s *Service) evaluate(now time.Time) (*Report, error) {
+	report := &Report{DryRun: true, Evaluated: now, Actions: []*Action{}}
+
+	files, err := s.index.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	report.Files = len(files)
+
+	// Files are listed newest first and stay in that order per rule
+	governed := make([][]*catalog.FileMeta, len(s.rules))
+	for _, meta := range files {
+		if meta.Pinned {
+			report.Pinned++
+			continue
+		}
+		for n := range s.rules {
+			if s.rules[n].matches(meta) {
+				// Files the rule archived stay where they are
+				if !s.rules[n].archived(meta) {
+					governed[n] = append(governed[n], meta)
+				}
+				break
+			}
+		}
+	}
+
+	for n, r := range s.rules {
+		var kept int64
+		full := false
+		for _, meta := range governed[n] {
+			reason := ""
+			switch {
+			case r.maxAge > 0 && now.Sub(meta.Created) >= r.maxAge:
+				reason = ReasonAge
+			case r.maxBytes > 0 && (full || kept+meta.Size > r.maxBytes):
+				// Once the limit is reached all older files go, even
+				// smaller ones that would still fit
+				full = true
+				reason = ReasonSize
+			default:
+				kept += meta.Size
+				continue
+			}
+
+			report.Actions = append(report.Actions, &Action{
+				Rule:     r.Name,
+				Action:   r.Action,
+				Reason:   reason,
+				FileID:   meta.ID,
+				Name:     meta.Name,
+				Path:     meta.Path,
+				Size:     meta.Size,
+				SHA256:   meta.SHA256,
+				MimeType: meta.MimeType,
+				Device:   meta.Device,
+				Created:  meta.Created,
+				Target:   r.target,
+			})
+			report.Bytes += meta.Size
+		}
+	}
+
+	return report, nil
+}
+
+// apply carries out one action, unless the file changed since it was
+// evaluated
+func (s *Service) apply(ctx context.Context, action *Action) error {
+	meta, err := s.index.Get(action.FileID)
+	if err != nil {
+		return err
+	}
+	if meta.Pinned {
+		return fmt.Errorf("file was pinned")
+	}
+	if meta.Path != action.Path || meta.SHA256 != action.SHA256 || !meta.Created.Equal(action.Created) {
+		return fmt.Errorf("file changed since it was evaluated")
+	}
+
+	switch action.Action {
+	case config.RetentionDelete:
+		return s.downloads.DeleteFile(meta.ID, Device, action.Rule)
+	case config.RetentionArchive:
+		_, err := s.uploads.Relocate(ctx, meta, action.Target)
+		return err
+	}
+	return fmt.Errorf("unknown action %q", action.Action)
+}
+
+// run enforces the rules once at startup and then every interval
+func (s *Service) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if report, err := s.Enforce(context.Background()); err != nil {
+			s.logger.WithError(err).Warn("Failed to enforce retention rules")
+		} else if len(report.Actions) > 0 {
+			s.logger.WithFields(logrus.Fields{
+				"actions": len(report.Actions),
+				"bytes":   report.Bytes,
+				"failed":  report.Failed,
+			}).Info("Retention rules enforced")
+		}
+		<-ticker.C
+	}
+}
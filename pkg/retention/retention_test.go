@@ -0,0 +1,318 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestService returns a service with the given rules that is not
+// enforced periodically; the trash is disabled
+func newTestService(t *testing.T, rules ...config.RetentionRule) *Service {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Trash.Enabled = false
+	cfg.Retention.Rules = rules
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := upload.NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewService(cfg, logger, index, download.NewHandler(cfg, logger, index, backend), uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// storeFile stores a file of size bytes at filePath created at created
+func storeFile(t *testing.T, s *Service, id, filePath, mimeType string, size int, created time.Time) *catalog.FileMeta {
+	t.Helper()
+
+	full := filepath.Join(s.config.Storage.UploadDir, filepath.FromSlash(filePath))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta := &catalog.FileMeta{
+		ID:       id,
+		Name:     filepath.Base(full),
+		Path:     filePath,
+		Size:     int64(size),
+		MimeType: mimeType,
+		SHA256:   "digest-" + id,
+		Device:   "phone",
+		Created:  created,
+	}
+	if err := s.index.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// affected returns the IDs of the files in the report with their reasons
+func affected(report *Report) map[string]string {
+	ids := make(map[string]string)
+	for _, action := range report.Actions {
+		ids[action.FileID] = action.Reason
+	}
+	return ids
+}
+
+func TestNewService(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.RetentionRule
+	}{
+		{"no limit", config.RetentionRule{Action: config.RetentionDelete}},
+		{"invalid age", config.RetentionRule{MaxAge: "soon", Action: config.RetentionDelete}},
+		{"invalid size", config.RetentionRule{MaxSize: "big", Action: config.RetentionDelete}},
+		{"invalid MIME pattern", config.RetentionRule{MaxAge: "1d", MimeTypes: []string{"image/["}, Action: config.RetentionDelete}},
+		{"archive without target", config.RetentionRule{MaxAge: "1d", Action: config.RetentionArchive, Target: "../"}},
+		{"unknown action", config.RetentionRule{MaxAge: "1d", Action: "shred"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.Retention.Rules = []config.RetentionRule{tt.rule}
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			if _, err := NewService(cfg, logger, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "rule #1") {
+				t.Errorf("got %v, want an error for rule #1", err)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		rules  []config.RetentionRule
+		files  func(t *testing.T, s *Service)
+		expect map[string]string
+		pinned int
+	}{
+		{
+			name:  "age",
+			rules: []config.RetentionRule{{MaxAge: "2d", Action: config.RetentionDelete}},
+			files: func(t *testing.T, s *Service) {
+				storeFile(t, s, "new", "new.txt", "text/plain", 1, now.Add(-day))
+				storeFile(t, s, "limit", "limit.txt", "text/plain", 1, now.Add(-2*day))
+				storeFile(t, s, "old", "old.txt", "text/plain", 1, now.Add(-3*day))
+			},
+			expect: map[string]string{"limit": ReasonAge, "old": ReasonAge},
+		},
+		{
+			name:  "size limit keeps the newest files",
+			rules: []config.RetentionRule{{MaxSize: "25", Action: config.RetentionDelete}},
+			files: func(t *testing.T, s *Service) {
+				storeFile(t, s, "a", "a.txt", "text/plain", 10, now.Add(-1*time.Hour))
+				storeFile(t, s, "b", "b.txt", "text/plain", 10, now.Add(-2*time.Hour))
+				storeFile(t, s, "c", "c.txt", "text/plain", 10, now.Add(-3*time.Hour))
+				// Would still fit but is older than a file beyond the limit
+				storeFile(t, s, "d", "d.txt", "text/plain", 2, now.Add(-4*time.Hour))
+			},
+			expect: map[string]string{"c": ReasonSize, "d": ReasonSize},
+		},
+		{
+			name:  "age before size",
+			rules: []config.RetentionRule{{MaxAge: "2d", MaxSize: "10", Action: config.RetentionDelete}},
+			files: func(t *testing.T, s *Service) {
+				storeFile(t, s, "new", "new.txt", "text/plain", 8, now)
+				storeFile(t, s, "old", "old.txt", "text/plain", 1, now.Add(-3*day))
+				storeFile(t, s, "big", "big.txt", "text/plain", 8, now.Add(-time.Hour))
+			},
+			expect: map[string]string{"old": ReasonAge, "big": ReasonSize},
+		},
+		{
+			name:  "MIME patterns",
+			rules: []config.RetentionRule{{MimeTypes: []string{"image/*", "application/pdf"}, MaxAge: "1d", Action: config.RetentionDelete}},
+			files: func(t *testing.T, s *Service) {
+				old := now.Add(-2 * day)
+				storeFile(t, s, "jpeg", "a.jpg", "image/jpeg", 1, old)
+				storeFile(t, s, "png", "b.png", "IMAGE/PNG", 1, old)
+				storeFile(t, s, "pdf", "c.pdf", "application/pdf", 1, old)
+				storeFile(t, s, "text", "d.txt", "text/plain; charset=utf-8", 1, old)
+				storeFile(t, s, "unknown", "e", "", 1, old)
+			},
+			expect: map[string]string{"jpeg": ReasonAge, "png": ReasonAge, "pdf": ReasonAge},
+		},
+		{
+			name: "first matching rule",
+			rules: []config.RetentionRule{
+				{Name: "images", MimeTypes: []string{"image/*"}, MaxAge: "10d", Action: config.RetentionDelete},
+				{Name: "rest", MaxAge: "1d", Action: config.RetentionDelete},
+			},
+			files: func(t *testing.T, s *Service) {
+				storeFile(t, s, "photo", "a.jpg", "image/jpeg", 1, now.Add(-2*day))
+				storeFile(t, s, "notes", "b.txt", "text/plain", 1, now.Add(-2*day))
+			},
+			expect: map[string]string{"notes": ReasonAge},
+		},
+		{
+			name:  "pinned files are exempt",
+			rules: []config.RetentionRule{{MaxAge: "1d", MaxSize: "1", Action: config.RetentionDelete}},
+			files: func(t *testing.T, s *Service) {
+				meta := storeFile(t, s, "pinned", "a.txt", "text/plain", 5, now.Add(-2*day))
+				meta.Pinned = true
+				if err := s.index.Save(meta); err != nil {
+					t.Fatal(err)
+				}
+				storeFile(t, s, "new", "b.txt", "text/plain", 1, now)
+			},
+			expect: map[string]string{},
+			pinned: 1,
+		},
+		{
+			name: "archived files are excluded",
+			rules: []config.RetentionRule{
+				{Name: "archive", MimeTypes: []string{"text/*"}, MaxAge: "1d", Action: config.RetentionArchive, Target: "Archive"},
+				// Not applied to the files the first rule archived
+				{Name: "rest", MaxAge: "1d", Action: config.RetentionDelete},
+			},
+			files: func(t *testing.T, s *Service) {
+				old := now.Add(-2 * day)
+				storeFile(t, s, "archived", "Archive/a.txt", "text/plain", 1, old)
+				storeFile(t, s, "nested", "Archive/2024/b.txt", "text/plain", 1, old)
+				storeFile(t, s, "similar", "Archived/c.txt", "text/plain", 1, old)
+				storeFile(t, s, "inbox", "d.txt", "text/plain", 1, old)
+				storeFile(t, s, "photo", "Archive/e.jpg", "image/jpeg", 1, old)
+			},
+			expect: map[string]string{"similar": ReasonAge, "inbox": ReasonAge, "photo": ReasonAge},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, tt.rules...)
+			tt.files(t, s)
+
+			report, err := s.evaluate(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := affected(report)
+			if len(got) != len(tt.expect) {
+				t.Errorf("affected %v, want %v", got, tt.expect)
+			}
+			var bytes int64
+			for _, action := range report.Actions {
+				if tt.expect[action.FileID] != action.Reason {
+					t.Errorf("affected %v, want %v", got, tt.expect)
+					break
+				}
+				bytes += action.Size
+			}
+			if !report.DryRun || report.Bytes != bytes || report.Pinned != tt.pinned {
+				t.Errorf("report %+v", report)
+			}
+		})
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour)
+	s := newTestService(t,
+		config.RetentionRule{Name: "photos", MimeTypes: []string{"image/*"}, MaxAge: "1d", Action: config.RetentionArchive, Target: "Archive"},
+		config.RetentionRule{Name: "rest", MaxAge: "1d", Action: config.RetentionDelete},
+	)
+	storeFile(t, s, "photo", "a.jpg", "image/jpeg", 3, old)
+	storeFile(t, s, "notes", "b.txt", "text/plain", 3, old)
+
+	report, err := s.Enforce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DryRun || len(report.Actions) != 2 || report.Failed != 0 || s.LastRun() != report {
+		t.Fatalf("report %+v", report)
+	}
+
+	meta, err := s.index.Get("photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Path != "Archive/a.jpg" {
+		t.Errorf("archived to %s", meta.Path)
+	}
+	if _, err := os.Stat(filepath.Join(s.config.Storage.UploadDir, "Archive", "a.jpg")); err != nil {
+		t.Errorf("archived file: %v", err)
+	}
+	if _, err := s.index.Get("notes"); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("deleted file still indexed: %v", err)
+	}
+
+	// Archived files are not affected again
+	if report, err = s.Enforce(context.Background()); err != nil || len(report.Actions) != 0 {
+		t.Errorf("second run: %+v, %v", report, err)
+	}
+}
+
+func TestApplySkipsChangedFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(meta *catalog.FileMeta)
+	}{
+		{"pinned", func(meta *catalog.FileMeta) { meta.Pinned = true }},
+		{"moved", func(meta *catalog.FileMeta) { meta.Path = "Kept/a.txt" }},
+		{"replaced", func(meta *catalog.FileMeta) { meta.SHA256 = "other" }},
+		{"recreated", func(meta *catalog.FileMeta) { meta.Created = time.Now() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, config.RetentionRule{MaxAge: "1d", Action: config.RetentionDelete})
+			meta := storeFile(t, s, "file", "a.txt", "text/plain", 1, time.Now().Add(-48*time.Hour))
+
+			report, err := s.evaluate(time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Actions) != 1 {
+				t.Fatalf("actions %+v", report.Actions)
+			}
+
+			tt.change(meta)
+			if err := s.index.Save(meta); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.apply(context.Background(), report.Actions[0]); err == nil {
+				t.Error("changed file was deleted")
+			}
+			if _, err := s.index.Get("file"); err != nil {
+				t.Errorf("file lost: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package search
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of search results
+const (
+	KindFile    = "file"
+	KindMessage = "message"
+)
+
+// DefaultLimit and MaxLimit bound the number of results of a search
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+// Fields a term can occur in, with the weight of a match in each
+const (
+	fieldName = 1 << iota
+	fieldPath
+	fieldMime
+	fieldDevice
+	fieldExif
+	fieldText
+)
+
+var fields = []struct {
+	bit    uint16
+	name   string
+	weight float64
+}{
+	{fieldName, "name", 4},
+	{fieldPath, "path", 2},
+	{fieldMime, "mime_type", 1},
+	{fieldDevice, "device", 1},
+	{fieldExif, "exif", 1},
+	{fieldText, "text", 3},
+}
+
+// document is a file or chat message in the index
+type document struct {
+	key     string
+	kind    string
+	id      string
+	time    time.Time
+	message *catalog.Message
+	terms   map[string]uint16 // term to the fields it occurs in
+}
+
+// Hit is one search result. Files are returned with their current metadata.
+type Hit struct {
+	Kind    string            `json:"kind"`
+	Score   float64           `json:"score"`
+	Matched []string          `json:"matched"` // fields the query matched
+	File    *catalog.FileMeta `json:"file,omitempty"`
+	Message *catalog.Message  `json:"message,omitempty"`
+}
+
+// Service keeps an inverted index of file metadata and chat messages. The
+// index lives in memory: it is built from the catalog and the chat history
+// at startup and updated as uploads complete, files are purged and messages
+// are relayed.
+type Service struct {
+	logger *logrus.Logger
+	index  *catalog.Index
+	auth   *security.AuthService
+
+	mu       sync.Mutex
+	docs     map[string]*document
+	postings map[string]map[string]uint16 // term to document key to fields
+	vocab    []string                     // sorted terms, for prefix matches
+	dirty    bool                         // vocab is out of date
+}
+
+func NewService(logger *logrus.Logger, index *catalog.Index, auth *security.AuthService) (*Service, error) {
+	s := &Service{
+		logger:   logger,
+		index:    index,
+		auth:     auth,
+		docs:     make(map[string]*document),
+		postings: make(map[string]map[string]uint16),
+	}
+
+	files, err := index.List()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	if devices, err := auth.ListDevices(); err == nil {
+		for _, device := range devices {
+			names[device.ID] = device.Name
+		}
+	}
+	for _, meta := range files {
+		s.addFile(meta, names[meta.Device])
+	}
+
+	messages, err := index.Messages()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		s.addMessage(msg)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"files":    len(files),
+		"messages": len(messages),
+		"terms":    len(s.postings),
+	}).Info("Search index built")
+	return s, nil
+}
+
+// HandleUploadEvent indexes files as their uploads complete
+func (s *Service) HandleUploadEvent(event upload.Event) {
+	if event.Type != upload.EventCompleted || event.File == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addFile(event.File, event.DeviceName)
+}
+
+// RemoveFile drops a file that was removed for good
+func (s *Service) RemoveFile(fileID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(KindFile + ":" + fileID)
+}
+
+// RecordChat stores a relayed chat message in the history and indexes it
+func (s *Service) RecordChat(deviceID string, msg websocket.Message) {
+	if strings.TrimSpace(msg.Text) == "" {
+		return
+	}
+
+	record := &catalog.Message{
+		ID:         msg.ID,
+		Text:       msg.Text,
+		Device:     deviceID,
+		DeviceName: msg.From,
+		Time:       time.Unix(msg.Timestamp, 0),
+	}
+	if err := s.index.AddMessage(record); err != nil {
+		s.logger.WithError(err).Warn("Failed to store chat message")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addMessage(record)
+}
+
+func (s *Service) addFile(meta *catalog.FileMeta, deviceName string) {
+	doc := &document{
+		key:  KindFile + ":" + meta.ID,
+		kind: KindFile,
+		id:   meta.ID,
+		time: meta.Created,
+	}
+
+	terms := make(map[string]uint16)
+	add := func(field uint16, text string) {
+		for _, term := range tokenize(text) {
+			terms[term] |= field
+		}
+	}
+	add(fieldName, meta.Name)
+	add(fieldPath, meta.RelativePath)
+	add(fieldPath, meta.Path)
+	add(fieldMime, meta.MimeType)
+	add(fieldDevice, meta.Device)
+	add(fieldDevice, deviceName)
+	if photo := meta.Photo; photo != nil {
+		add(fieldExif, photo.Make)
+		add(fieldExif, photo.Model)
+		if photo.TakenAt != nil {
+			add(fieldExif, photo.TakenAt.Format("2006-01-02"))
+		}
+	}
+	doc.terms = terms
+
+	s.put(doc)
+}
+
+func (s *Service) addMessage(msg *catalog.Message) {
+	doc := &document{
+		key:     KindMessage + ":" + msg.ID,
+		kind:    KindMessage,
+		id:      msg.ID,
+		time:    msg.Time,
+		message: msg,
+	}
+
+	terms := make(map[string]uint16)
+	for _, term := range tokenize(msg.Text) {
+		terms[term] |= fieldText
+	}
+	for _, text := range []string{msg.Device, msg.DeviceName} {
+		for _, term := range tokenize(text) {
+			terms[term] |= fieldDevice
+		}
+	}
+	doc.terms = terms
+
+	s.put(doc)
+}
+
+// put adds doc to the index, replacing an earlier version
+func (s *Service) put(doc *document) {
+	s.remove(doc.key)
+
+	s.docs[doc.key] = doc
+	for term, bits := range doc.terms {
+		postings, ok := s.postings[term]
+		if !ok {
+			postings = make(map[string]uint16)
+			s.postings[term] = postings
+			s.dirty = true
+		}
+		postings[doc.key] = bits
+	}
+}
+
+func (s *Service) remove(key string) {
+	doc, ok := s.docs[key]
+	if !ok {
+		return
+	}
+
+	delete(s.docs, key)
+	for term := range doc.terms {
+		postings := s.postings[term]
+		delete(postings, key)
+		if len(postings) == 0 {
+			delete(s.postings, term)
+			s.dirty = true
+		}
+	}
+}
+
+// Search returns the files and messages matching every word of query,
+// best matches first. A word matches terms it is a prefix of, exact matches
+// score higher. kind limits the results to files or messages when set.
+func (s *Service) Search(query, kind string, limit int) []*Hit {
+	words := unique(tokenize(query))
+	if len(words) == 0 {
+		return []*Hit{}
+	}
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	s.mu.Lock()
+	if s.dirty {
+		s.vocab = s.vocab[:0]
+		for term := range s.postings {
+			s.vocab = append(s.vocab, term)
+		}
+		sort.Strings(s.vocab)
+		s.dirty = false
+	}
+
+	type match struct {
+		doc     *document
+		score   float64
+		matched uint16
+	}
+	var matches map[string]*match
+	for n, word := range words {
+		found := make(map[string]*match)
+
+		start := sort.SearchStrings(s.vocab, word)
+		for _, term := range s.vocab[start:] {
+			if !strings.HasPrefix(term, word) {
+				break
+			}
+			boost := 1.0
+			if term == word {
+				boost = 2
+			}
+			for key, bits := range s.postings[term] {
+				doc := s.docs[key]
+				if kind != "" && doc.kind != kind {
+					continue
+				}
+				// Every word must match
+				if n > 0 && matches[key] == nil {
+					continue
+				}
+				m := found[key]
+				if m == nil {
+					m = &match{doc: doc}
+					if prev := matches[key]; prev != nil {
+						m.score, m.matched = prev.score, prev.matched
+					}
+					found[key] = m
+				}
+				m.score += boost * weight(bits)
+				m.matched |= bits
+			}
+		}
+
+		matches = found
+		if len(matches) == 0 {
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	ranked := make([]*match, 0, len(matches))
+	for _, m := range matches {
+		ranked = append(ranked, m)
+	}
+	sort.Slice(ranked, func(a, b int) bool {
+		if ranked[a].score != ranked[b].score {
+			return ranked[a].score > ranked[b].score
+		}
+		return ranked[a].doc.time.After(ranked[b].doc.time)
+	})
+
+	hits := make([]*Hit, 0, min(limit, len(ranked)))
+	for _, m := range ranked {
+		if len(hits) == limit {
+			break
+		}
+
+		hit := &Hit{Kind: m.doc.kind, Score: m.score, Matched: fieldNames(m.matched)}
+		if m.doc.kind == KindFile {
+			// Files in the trash stay indexed but are not found
+			meta, err := s.index.Get(m.doc.id)
+			if err != nil {
+				if !errors.Is(err, catalog.ErrNotFound) {
+					s.logger.WithError(err).WithField("file_id", m.doc.id).Warn("Failed to load file metadata")
+				}
+				continue
+			}
+			hit.File = meta
+		} else {
+			hit.Message = m.doc.message
+		}
+		hits = append(hits, hit)
+	}
+	return hits
+}
+
+func weight(bits uint16) float64 {
+	var w float64
+	for _, f := range fields {
+		if bits&f.bit != 0 {
+			w += f.weight
+		}
+	}
+	return w
+}
+
+func fieldNames(bits uint16) []string {
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if bits&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// tokenize splits text into lower case terms. Runs of letters and digits
+// form one term; Chinese, Japanese and Korean text has no spaces between
+// words, so it is indexed as overlapping pairs of characters.
+func tokenize(text string) []string {
+	var terms []string
+	var word, cjk []rune
+
+	flushWord := func() {
+		if len(word) > 0 {
+			terms = append(terms, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		switch {
+		case len(cjk) == 1:
+			terms = append(terms, string(cjk))
+		case len(cjk) > 1:
+			for n := 0; n+1 < len(cjk); n++ {
+				terms = append(terms, string(cjk[n:n+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return terms
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func unique(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	out := terms[:0]
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			out = append(out, term)
+		}
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package search
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := security.NewAuthService(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewService(logger, index, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// addFile stores meta in the catalog and indexes it as a completed upload
+func addFile(t *testing.T, s *Service, meta *catalog.FileMeta, deviceName string) {
+	t.Helper()
+	if err := s.index.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+	s.HandleUploadEvent(upload.Event{Type: upload.EventCompleted, File: meta, DeviceName: deviceName})
+}
+
+// keys returns the kind and ID of every hit
+func keys(hits []*Hit) []string {
+	out := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		if hit.File != nil {
+			out = append(out, hit.Kind+":"+hit.File.ID)
+		} else {
+			out = append(out, hit.Kind+":"+hit.Message.ID)
+		}
+	}
+	return out
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text   string
+		expect []string
+	}{
+		{"", nil},
+		{"  ...  ", nil},
+		{"Report.PDF", []string{"report", "pdf"}},
+		{"IMG_0001 (2).jpg", []string{"img", "0001", "2", "jpg"}},
+		{"work/reports/notes.txt", []string{"work", "reports", "notes", "txt"}},
+		{"2024-05-01", []string{"2024", "05", "01"}},
+		{"Café Müller", []string{"café", "müller"}},
+		{"会", []string{"会"}},
+		{"会议记录", []string{"会议", "议记", "记录"}},
+		{"周报v2最终版", []string{"周报", "v2", "最终", "终版"}},
+		{"写真 カメラ", []string{"写真", "カメ", "メラ"}},
+		{"회의록", []string{"회의", "의록"}},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.expect)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestService(t)
+	now := time.Now()
+	taken := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	addFile(t, s, &catalog.FileMeta{ID: "report", Name: "report.pdf", Path: "report.pdf", MimeType: "application/pdf", Device: "laptop-id", Created: now}, "Laptop")
+	addFile(t, s, &catalog.FileMeta{ID: "notes", Name: "notes.txt", Path: "work/reports/notes.txt", RelativePath: "work/reports/notes.txt", MimeType: "text/plain", Created: now}, "")
+	addFile(t, s, &catalog.FileMeta{ID: "photo", Name: "IMG_0001.jpg", Path: "IMG_0001.jpg", MimeType: "image/jpeg", Created: now, Photo: &catalog.PhotoMeta{Make: "Canon", TakenAt: &taken}}, "")
+	addFile(t, s, &catalog.FileMeta{ID: "minutes", Name: "会议记录.docx", Path: "会议记录.docx", Created: now}, "")
+	s.RecordChat("phone-id", websocket.Message{ID: "chat", Text: "please send the report", From: "Phone", Timestamp: now.Unix()})
+
+	tests := []struct {
+		name   string
+		query  string
+		kind   string
+		limit  int
+		expect []string
+	}{
+		// Exact name and path matches of the file rank above the exact
+		// message text and the prefix of a folder name
+		{"ranking", "report", "", 0, []string{"file:report", "message:chat", "file:notes"}},
+		{"files only", "report", KindFile, 0, []string{"file:report", "file:notes"}},
+		{"messages only", "report", KindMessage, 0, []string{"message:chat"}},
+		{"limit", "report", "", 1, []string{"file:report"}},
+		{"prefix", "rep", "", 0, []string{"file:report", "message:chat", "file:notes"}},
+		{"every word", "report pdf", "", 0, []string{"file:report"}},
+		{"unmatched word", "report budget", "", 0, []string{}},
+		{"case", "REPORT.pdf", KindFile, 0, []string{"file:report"}},
+		{"MIME type", "image", "", 0, []string{"file:photo"}},
+		{"device name", "laptop", "", 0, []string{"file:report"}},
+		{"message device", "phone", "", 0, []string{"message:chat"}},
+		{"camera", "canon", "", 0, []string{"file:photo"}},
+		{"date taken", "2024 05", "", 0, []string{"file:photo"}},
+		{"CJK", "会议", "", 0, []string{"file:minutes"}},
+		{"CJK across pairs", "议记录", "", 0, []string{"file:minutes"}},
+		{"empty query", " - ", "", 0, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keys(s.Search(tt.query, tt.kind, tt.limit))
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.expect)
+			}
+		})
+	}
+
+	hits := s.Search("report", KindFile, 0)
+	if !reflect.DeepEqual(hits[0].Matched, []string{"name", "path"}) || hits[0].Score <= hits[1].Score {
+		t.Errorf("best hit %+v", hits[0])
+	}
+}
+
+func TestSearchTies(t *testing.T) {
+	s := newTestService(t)
+	now := time.Now()
+	for n, id := range []string{"old", "new", "older"} {
+		created := now.Add(time.Duration(n) * time.Hour)
+		if id == "older" {
+			created = now.Add(-time.Hour)
+		}
+		s.RecordChat("phone-id", websocket.Message{ID: id, Text: "hello", Timestamp: created.Unix()})
+	}
+
+	// Equal scores list the newest first
+	got := keys(s.Search("hello", "", 0))
+	if expect := []string{"message:new", "message:old", "message:older"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %v, want %v", got, expect)
+	}
+}
+
+func TestSearchRemovedFiles(t *testing.T) {
+	s := newTestService(t)
+	addFile(t, s, &catalog.FileMeta{ID: "trashed", Name: "budget.xlsx", Path: "budget.xlsx", Created: time.Now()}, "")
+	addFile(t, s, &catalog.FileMeta{ID: "purged", Name: "budget-old.xlsx", Path: "budget-old.xlsx", Created: time.Now()}, "")
+
+	// Files in the trash stay indexed but are not found
+	if _, err := s.index.MoveToTrash("trashed", "laptop-id", "Laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(s.Search("budget", "", 0)); !reflect.DeepEqual(got, []string{"file:purged"}) {
+		t.Errorf("with a file in the trash: %v", got)
+	}
+
+	s.RemoveFile("purged")
+	if got := keys(s.Search("budget", "", 0)); len(got) != 0 {
+		t.Errorf("after purge: %v", got)
+	}
+}
+
+func TestSearchIndexOnStartup(t *testing.T) {
+	s := newTestService(t)
+	addFile(t, s, &catalog.FileMeta{ID: "file", Name: "holiday.jpg", Path: "holiday.jpg", Created: time.Now()}, "")
+	s.RecordChat("phone-id", websocket.Message{ID: "chat", Text: "holiday photos", Timestamp: time.Now().Unix()})
+	s.RecordChat("phone-id", websocket.Message{ID: "blank", Text: "   "})
+
+	// A new service builds its index from the catalog and the chat history
+	rebuilt, err := NewService(s.logger, s.index, s.auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := keys(rebuilt.Search("holiday", "", 0))
+	if expect := []string{"file:file", "message:chat"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %v, want %v", got, expect)
+	}
+	if messages, _ := s.index.Messages(); len(messages) != 1 {
+		t.Errorf("stored %d messages, want the blank one skipped", len(messages))
+	}
+}
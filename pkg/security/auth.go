@@ -3,7 +3,9 @@ package security
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,11 +16,24 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrDeviceNotFound is returned for a device that is not paired
+var ErrDeviceNotFound = errors.New("device not found")
+
+// ErrPairingTokenConfigured is returned when rotating a pairing token that
+// is set in the configuration rather than generated
+var ErrPairingTokenConfigured = errors.New("pairing token is set in the configuration")
+
 type AuthService struct {
 	config  *config.Config
 	logger  *logrus.Logger
 	devices map[string]*Device
-	mutex   sync.RWMutex
+	mutex   sync.Mutex
+
+	pairingToken    string
+	tokenConfigured bool      // the pairing token comes from the configuration
+	state           authState // generated secrets as persisted, devices are kept in the map
+	statePath       string
+	stateStamp      fileStamp // state file when last read or written
 }
 
 type Claims struct {
@@ -36,34 +51,65 @@ type Device struct {
 	Trusted   bool      `json:"trusted"`
 }
 
-func NewAuthService(cfg *config.Config, logger *logrus.Logger) *AuthService {
+func NewAuthService(cfg *config.Config, logger *logrus.Logger) (*AuthService, error) {
+	a := &AuthService{
+		config:          cfg,
+		logger:          logger,
+		devices:         make(map[string]*Device),
+		tokenConfigured: cfg.Security.PairingToken != "",
+		statePath:       statePath(cfg),
+	}
+
+	// Paired devices and generated secrets survive restarts
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	changed := false
+
 	// Generate JWT secret if not provided
 	if cfg.Security.JWTSecret == "" {
-		secret, err := generateRandomToken(32)
-		if err != nil {
-			logger.WithError(err).Error("Failed to generate JWT secret")
+		if a.state.JWTSecret == "" {
+			if secret, err := generateRandomToken(32); err != nil {
+				logger.WithError(err).Error("Failed to generate JWT secret")
+			} else {
+				a.state.JWTSecret = secret
+				changed = true
+			}
+		}
+		cfg.Security.JWTSecret = a.state.JWTSecret
+		if cfg.Security.JWTSecret == "" {
 			cfg.Security.JWTSecret = cfg.Security.FallbackJWTSecret
-		} else {
-			cfg.Security.JWTSecret = secret
 		}
 	}
 
 	// Generate pairing token if not provided
-	if cfg.Security.PairingToken == "" {
-		token, err := generateRandomToken(16)
-		if err != nil {
-			logger.WithError(err).Error("Failed to generate pairing token")
+	if !a.tokenConfigured {
+		if a.state.PairingToken == "" {
+			if token, err := generateRandomToken(16); err != nil {
+				logger.WithError(err).Error("Failed to generate pairing token")
+			} else {
+				a.state.PairingToken = token
+				changed = true
+			}
+		}
+		cfg.Security.PairingToken = a.state.PairingToken
+		if cfg.Security.PairingToken == "" {
 			cfg.Security.PairingToken = cfg.Security.FallbackPairingToken
-		} else {
-			cfg.Security.PairingToken = token
 		}
 	}
+	a.pairingToken = cfg.Security.PairingToken
 
-	return &AuthService{
-		config:  cfg,
-		logger:  logger,
-		devices: make(map[string]*Device),
+	if a.state.Created.IsZero() {
+		a.state.Created = time.Now()
+		changed = true
 	}
+
+	if changed {
+		if err := a.save(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
 }
 
 func (a *AuthService) GenerateDeviceToken(deviceID, deviceName string) (string, error) {
@@ -104,25 +150,69 @@ func (a *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// Tokens of revoked devices are rejected even before they expire
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.refresh()
+	device, exists := a.devices[claims.DeviceID]
+	if !exists {
+		if device = a.adopt(claims); device == nil {
+			return nil, fmt.Errorf("device not paired")
+		}
 	}
+	a.touch(device)
 
-	return nil, fmt.Errorf("invalid token")
+	return claims, nil
 }
 
 func (a *AuthService) ValidatePairingToken(token string) bool {
-	return token == a.config.Security.PairingToken
+	return token != "" && token == a.GetPairingToken()
 }
 
 func (a *AuthService) GetPairingToken() string {
-	return a.config.Security.PairingToken
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.refresh()
+	return a.pairingToken
+}
+
+// RotatePairingToken replaces a generated pairing token with a new one, so
+// the old token can no longer be used to pair devices
+func (a *AuthService) RotatePairingToken() (string, error) {
+	if a.tokenConfigured {
+		return "", ErrPairingTokenConfigured
+	}
+
+	token, err := generateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.refresh()
+	a.state.PairingToken = token
+	if err := a.save(); err != nil {
+		return "", err
+	}
+	a.pairingToken = token
+
+	a.logger.Info("Pairing token rotated")
+	return token, nil
 }
 
 func (a *AuthService) GenerateQRData() (map[string]interface{}, error) {
 	return map[string]interface{}{
 		"url":       fmt.Sprintf("http://%s", a.config.GetAddr()),
-		"token":     a.config.Security.PairingToken,
+		"token":     a.GetPairingToken(),
 		"device_id": a.config.MDNS.DeviceName,
 		"timestamp": time.Now().Unix(),
 	}, nil
@@ -132,16 +222,25 @@ func (a *AuthService) CreateDevice(deviceID, deviceName string) (*Device, error)
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
+	a.refresh()
+
+	now := time.Now()
 	device := &Device{
 		ID:       deviceID,
 		Name:     deviceName,
-		Created:  time.Now(),
-		LastSeen: time.Now(),
+		Created:  now,
+		LastSeen: now,
 		Trusted:  true, // Auto-trust devices that complete pairing
 	}
+	// Pairing again keeps the original pairing date
+	if existing, ok := a.devices[deviceID]; ok {
+		device.Created = existing.Created
+	}
 
-	// Store device in memory map
 	a.devices[deviceID] = device
+	if err := a.save(); err != nil {
+		return nil, err
+	}
 
 	a.logger.WithFields(logrus.Fields{
 		"device_id":   deviceID,
@@ -152,28 +251,34 @@ func (a *AuthService) CreateDevice(deviceID, deviceName string) (*Device, error)
 }
 
 func (a *AuthService) GetDevice(deviceID string) (*Device, error) {
-	a.mutex.RLock()
-	defer a.mutex.RUnlock()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 
+	a.refresh()
 	device, exists := a.devices[deviceID]
 	if !exists {
-		return nil, fmt.Errorf("device not found")
+		return nil, ErrDeviceNotFound
 	}
 
 	// Update last seen time
-	device.LastSeen = time.Now()
-	return device, nil
+	a.touch(device)
+	copied := *device
+	return &copied, nil
 }
 
 func (a *AuthService) ListDevices() ([]*Device, error) {
-	a.mutex.RLock()
-	defer a.mutex.RUnlock()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.refresh()
 
 	// Return slice of all devices
 	devices := make([]*Device, 0, len(a.devices))
 	for _, device := range a.devices {
-		devices = append(devices, device)
+		copied := *device
+		devices = append(devices, &copied)
 	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Created.Before(devices[j].Created) })
 
 	return devices, nil
 }
@@ -182,19 +287,28 @@ func (a *AuthService) RemoveDevice(deviceID string) error {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
+	a.refresh()
 	if _, exists := a.devices[deviceID]; !exists {
-		return fmt.Errorf("device not found")
+		return ErrDeviceNotFound
 	}
 
 	delete(a.devices, deviceID)
+	if a.migrating(time.Now()) {
+		a.state.Revoked = append(a.state.Revoked, deviceID)
+	}
+	if err := a.save(); err != nil {
+		return err
+	}
+
 	a.logger.WithField("device_id", deviceID).Info("Device removed")
 	return nil
 }
 
 func (a *AuthService) IsDeviceTrusted(deviceID string) bool {
-	a.mutex.RLock()
-	defer a.mutex.RUnlock()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 
+	a.refresh()
 	device, exists := a.devices[deviceID]
 	if !exists {
 		return false
@@ -0,0 +1,21 @@
+package security
+
+import "context"
+
+type deviceContextKey struct{}
+
+type deviceIdentity struct {
+	id   string
+	name string
+}
+
+// WithDevice returns a context carrying the verified device making a request
+func WithDevice(ctx context.Context, deviceID, deviceName string) context.Context {
+	return context.WithValue(ctx, deviceContextKey{}, deviceIdentity{id: deviceID, name: deviceName})
+}
+
+// DeviceFromContext returns the device ID and name stored by WithDevice, if any
+func DeviceFromContext(ctx context.Context) (string, string) {
+	device, _ := ctx.Value(deviceContextKey{}).(deviceIdentity)
+	return device.id, device.name
+}
@@ -0,0 +1,196 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// StateFileName is the file inside Storage.DataDir holding the paired
+// devices and the generated secrets
+const StateFileName = "auth.json"
+
+// lastSeenInterval is how stale the persisted last seen time of a device may
+// get, so validating every request does not rewrite the state file
+const lastSeenInterval = time.Minute
+
+// authState is the content of the state file. Secrets set in the
+// configuration are not stored.
+type authState struct {
+	JWTSecret    string    `json:"jwt_secret,omitempty"`
+	PairingToken string    `json:"pairing_token,omitempty"`
+	Devices      []*Device `json:"devices"`
+
+	// Created is when the state file was first written. Devices paired
+	// before were only kept in memory; tokens issued to them before Created
+	// are accepted and their devices recorded, see adopt.
+	Created time.Time `json:"created"`
+	Revoked []string  `json:"revoked,omitempty"` // devices removed while such tokens may still be valid
+}
+
+// fileStamp identifies a version of the state file
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+func statePath(cfg *config.Config) string {
+	return filepath.Join(cfg.Storage.DataDir, StateFileName)
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{modified: info.ModTime(), size: info.Size()}
+}
+
+// load reads the state file, a missing file is an empty state
+func (a *AuthService) load() error {
+	data, err := os.ReadFile(a.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read auth state: %w", err)
+	}
+	info, err := os.Stat(a.statePath)
+	if err != nil {
+		return fmt.Errorf("failed to read auth state: %w", err)
+	}
+
+	var state authState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse auth state %s: %w", a.statePath, err)
+	}
+	if state.Created.IsZero() {
+		// Written before the field existed, when every paired device was
+		// already recorded
+		state.Created = time.Unix(0, 0)
+	}
+
+	devices := make(map[string]*Device, len(state.Devices))
+	for _, device := range state.Devices {
+		if device != nil && device.ID != "" {
+			devices[device.ID] = device
+		}
+	}
+	state.Devices = nil
+
+	a.state = state
+	a.devices = devices
+	a.stateStamp = stampOf(info)
+	if !a.tokenConfigured && state.PairingToken != "" {
+		a.pairingToken = state.PairingToken
+	}
+	return nil
+}
+
+// refresh picks up changes other processes made to the state file, like an
+// administrator revoking a device while the server runs. The caller holds
+// the mutex.
+func (a *AuthService) refresh() {
+	info, err := os.Stat(a.statePath)
+	if err != nil || stampOf(info) == a.stateStamp {
+		return
+	}
+	if err := a.load(); err != nil {
+		a.logger.WithError(err).Warn("Failed to reload auth state, keeping the current one")
+	}
+}
+
+// save writes the state file. The caller holds the mutex, or has the
+// service to itself.
+func (a *AuthService) save() error {
+	if !a.migrating(time.Now()) {
+		a.state.Revoked = nil
+	}
+	state := a.state
+	state.Devices = make([]*Device, 0, len(a.devices))
+	for _, device := range a.devices {
+		state.Devices = append(state.Devices, device)
+	}
+	sort.Slice(state.Devices, func(i, j int) bool { return state.Devices[i].Created.Before(state.Devices[j].Created) })
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.statePath), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// The file holds secrets, so only the owner may read it
+	tmp := a.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write auth state: %w", err)
+	}
+	if err := os.Rename(tmp, a.statePath); err != nil {
+		return fmt.Errorf("failed to write auth state: %w", err)
+	}
+
+	if info, err := os.Stat(a.statePath); err == nil {
+		a.stateStamp = stampOf(info)
+	}
+	return nil
+}
+
+// touch records that a device was seen. The time is only updated once it is
+// lastSeenInterval old, so it is accurate to that interval. The caller holds
+// the mutex.
+func (a *AuthService) touch(device *Device) {
+	now := time.Now()
+	if now.Sub(device.LastSeen) < lastSeenInterval {
+		return
+	}
+	device.LastSeen = now
+	if err := a.save(); err != nil {
+		a.logger.WithError(err).Warn("Failed to save device last seen time")
+	}
+}
+
+// migrating reports whether tokens issued before the state file was created
+// may still be valid
+func (a *AuthService) migrating(now time.Time) bool {
+	expiry, err := a.config.GetJWTTokenExpiry()
+	if err != nil {
+		expiry = 24 * time.Hour
+	}
+	return now.Before(a.state.Created.Add(expiry))
+}
+
+// adopt records the device of a valid token that is not paired, when the
+// token was issued before paired devices were persisted and the device was
+// not revoked since. Tokens issued later all belong to recorded devices, so
+// their devices are unknown only once revoked. The caller holds the mutex.
+func (a *AuthService) adopt(claims *Claims) *Device {
+	if claims.DeviceID == "" || claims.IssuedAt == nil || !claims.IssuedAt.Before(a.state.Created) {
+		return nil
+	}
+	for _, id := range a.state.Revoked {
+		if id == claims.DeviceID {
+			return nil
+		}
+	}
+
+	device := &Device{
+		ID:       claims.DeviceID,
+		Name:     claims.DeviceName,
+		Created:  claims.IssuedAt.Time,
+		LastSeen: time.Now(),
+		Trusted:  true,
+	}
+	a.devices[device.ID] = device
+	if err := a.save(); err != nil {
+		a.logger.WithError(err).Warn("Failed to save device paired before the upgrade")
+	}
+
+	a.logger.WithFields(logrus.Fields{
+		"device_id":   device.ID,
+		"device_name": device.Name,
+	}).Info("Recorded device paired before paired devices were saved")
+	return device
+}
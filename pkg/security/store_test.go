@@ -0,0 +1,293 @@
+package security
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestAuth opens the auth state in dir, like a server or an admin
+// command sharing the data directory would
+func newTestAuth(t *testing.T, dir string, configure func(cfg *config.Config)) *AuthService {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.DataDir = dir
+	if configure != nil {
+		configure(cfg)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	a, err := NewAuthService(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func withSecret(cfg *config.Config) {
+	cfg.Security.JWTSecret = "configured-secret"
+}
+
+// readState returns the state file in dir
+func readState(t *testing.T, dir string) authState {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, StateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state authState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+// issue returns a token for a device signed with the configured secret and
+// issued at issued, like one from before devices were persisted
+func issue(t *testing.T, deviceID string, issued time.Time) string {
+	t.Helper()
+	claims := &Claims{
+		DeviceID:   deviceID,
+		DeviceName: deviceID + " name",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(issued),
+			Subject:   deviceID,
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("configured-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestStatePersists(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAuth(t, dir, nil)
+	if _, err := a.CreateDevice("phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := a.GenerateDeviceToken("phone-id", "Phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, StateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("state file mode %s", perm)
+	}
+
+	// A restarted server keeps the generated secrets and the devices
+	b := newTestAuth(t, dir, nil)
+	if b.config.Security.JWTSecret != a.config.Security.JWTSecret || b.GetPairingToken() != a.GetPairingToken() {
+		t.Error("generated secrets not kept")
+	}
+	if _, err := b.ValidateToken(token); err != nil {
+		t.Errorf("token after restart: %v", err)
+	}
+	device, err := b.GetDevice("phone-id")
+	if err != nil || device.Name != "Phone" || !device.Trusted {
+		t.Errorf("device after restart: %+v, %v", device, err)
+	}
+}
+
+func TestConfiguredSecretsNotStored(t *testing.T) {
+	dir := t.TempDir()
+	newTestAuth(t, dir, func(cfg *config.Config) {
+		withSecret(cfg)
+		cfg.Security.PairingToken = "configured-token"
+	})
+
+	state := readState(t, dir)
+	if state.JWTSecret != "" || state.PairingToken != "" {
+		t.Errorf("configured secrets stored: %+v", state)
+	}
+}
+
+func TestLoadInvalidState(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, StateFileName), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.DataDir = dir
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if _, err := NewAuthService(cfg, logger); err == nil || !strings.Contains(err.Error(), "failed to parse auth state") {
+		t.Errorf("got %v, want a parse error", err)
+	}
+}
+
+func TestRevokeFromAnotherProcess(t *testing.T) {
+	dir := t.TempDir()
+	server := newTestAuth(t, dir, nil)
+	if _, err := server.CreateDevice("phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := server.GenerateDeviceToken("phone-id", "Phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ValidateToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// An admin command revokes the device while the server runs
+	admin := newTestAuth(t, dir, nil)
+	if err := admin.RemoveDevice("phone-id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ValidateToken(token); err == nil {
+		t.Error("token of a revoked device accepted")
+	}
+	if server.IsDeviceTrusted("phone-id") {
+		t.Error("revoked device still trusted")
+	}
+
+	// A rotated pairing token is picked up as well
+	rotated, err := admin.RotatePairingToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.ValidatePairingToken(rotated) {
+		t.Error("rotated pairing token rejected")
+	}
+}
+
+func TestRefreshKeepsStateOnError(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAuth(t, dir, nil)
+	if _, err := a.CreateDevice("phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, StateFileName), []byte("{broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetDevice("phone-id"); err != nil {
+		t.Errorf("device lost after an unreadable update: %v", err)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAuth(t, dir, nil)
+	if _, err := a.CreateDevice("phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := a.GenerateDeviceToken("phone-id", "Phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seen recently: the state file is not rewritten
+	stamp := a.stateStamp
+	if _, err := a.ValidateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if a.stateStamp != stamp {
+		t.Error("state saved for a device seen just now")
+	}
+
+	stale := time.Now().Add(-2 * lastSeenInterval)
+	a.devices["phone-id"].LastSeen = stale
+	if _, err := a.ValidateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	state := readState(t, dir)
+	if len(state.Devices) != 1 || !state.Devices[0].LastSeen.After(stale) {
+		t.Errorf("last seen time not saved: %+v", state.Devices)
+	}
+}
+
+func TestAdoptDevicesPairedBeforeUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now().Add(-time.Hour)
+	legacy := issue(t, "phone-id", before)
+
+	// The first start with persisted devices knows none of them
+	a := newTestAuth(t, dir, withSecret)
+	claims, err := a.ValidateToken(legacy)
+	if err != nil {
+		t.Fatalf("token from before the upgrade: %v", err)
+	}
+	if claims.DeviceID != "phone-id" {
+		t.Errorf("claims %+v", claims)
+	}
+
+	// The device is recorded, so it is listed and survives restarts
+	state := readState(t, dir)
+	if len(state.Devices) != 1 || state.Devices[0].ID != "phone-id" || state.Devices[0].Name != "phone-id name" {
+		t.Fatalf("recorded devices %+v", state.Devices)
+	}
+	b := newTestAuth(t, dir, withSecret)
+	if _, err := b.GetDevice("phone-id"); err != nil {
+		t.Error(err)
+	}
+
+	// Unknown devices with tokens issued since were revoked
+	if _, err := b.ValidateToken(issue(t, "laptop-id", time.Now().Add(time.Second))); err == nil {
+		t.Error("token issued after the upgrade accepted for an unknown device")
+	}
+
+	// Revoking an adopted device is final
+	if err := b.RemoveDevice("phone-id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ValidateToken(legacy); err == nil {
+		t.Error("token of a revoked device adopted again")
+	}
+	if state := readState(t, dir); len(state.Revoked) != 1 || state.Revoked[0] != "phone-id" {
+		t.Errorf("revoked %v", state.Revoked)
+	}
+}
+
+func TestAdoptionEnds(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAuth(t, dir, withSecret)
+	if _, err := a.CreateDevice("phone-id", "Phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveDevice("phone-id"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once tokens from before the upgrade expired, revoked devices are
+	// forgotten
+	a.state.Created = time.Now().Add(-48 * time.Hour)
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+	if state := readState(t, dir); len(state.Revoked) != 0 {
+		t.Errorf("revoked %v", state.Revoked)
+	}
+}
+
+func TestNoAdoptionForOlderStateFiles(t *testing.T) {
+	dir := t.TempDir()
+	// A state file written before its creation time was recorded
+	if err := os.WriteFile(filepath.Join(dir, StateFileName), []byte(`{"devices":[]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAuth(t, dir, withSecret)
+	if _, err := a.ValidateToken(issue(t, "phone-id", time.Now().Add(-time.Hour))); err == nil {
+		t.Error("unknown device adopted")
+	}
+}
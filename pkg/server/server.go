@@ -3,18 +3,33 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/clipboard"
 	"github.com/easy-sync/easy-sync/pkg/config"
 	"github.com/easy-sync/easy-sync/pkg/download"
+	"github.com/easy-sync/easy-sync/pkg/foldersync"
+	"github.com/easy-sync/easy-sync/pkg/hooks"
+	"github.com/easy-sync/easy-sync/pkg/retention"
+	"github.com/easy-sync/easy-sync/pkg/search"
 	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/share"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/thumbnail"
 	"github.com/easy-sync/easy-sync/pkg/upload"
 	"github.com/easy-sync/easy-sync/pkg/websocket"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"github.com/tus/tusd/v2/pkg/handler"
 )
 
 type Server struct {
@@ -25,6 +40,13 @@ type Server struct {
 	wsManager       *websocket.Manager
 	tusHandler      *upload.TusHandler
 	downloadHandler *download.Handler
+	thumbnails      *thumbnail.Service
+	shares          *share.Service
+	syncFolders     *foldersync.Service
+	retention       *retention.Service
+	search          *search.Service
+	clipboard       *clipboard.Service // nil when clipboard sync is disabled
+	index           *catalog.Index
 	auth            *security.AuthService
 	finalAddr       string // Store the final bound address
 }
@@ -104,15 +126,80 @@ func NewServer(cfg *config.Config, logger *logrus.Logger) (*Server, error) {
 		}).Info("HTTP Request")
 	})
 
-	auth := security.NewAuthService(cfg, logger)
+	auth, err := security.NewAuthService(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up authentication: %w", err)
+	}
 	wsManager := websocket.NewManager(cfg, logger, auth)
 
-	tusHandler, err := upload.NewTusHandler(cfg, logger)
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file index: %w", err)
+	}
+
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	tusHandler, err := upload.NewTusHandler(cfg, logger, index, backend)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create TUS handler: %w", err)
 	}
 
-	downloadHandler := download.NewHandler(cfg, logger)
+	// Let every connected device follow uploads in flight
+	tusHandler.BroadcastTo(wsManager)
+
+	if _, err := hooks.NewPipeline(cfg, logger, tusHandler, backend); err != nil {
+		return nil, fmt.Errorf("failed to set up upload hooks: %w", err)
+	}
+
+	thumbnails, err := thumbnail.NewService(cfg, logger, index, backend, tusHandler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up thumbnails: %w", err)
+	}
+
+	shares, err := share.NewService(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up shared folders: %w", err)
+	}
+
+	downloadHandler := download.NewHandler(cfg, logger, index, backend)
+
+	// Tell uploaders when a device has received their file
+	downloadHandler.SendReceiptsTo(wsManager)
+
+	// Thumbnails go with the file once it leaves the trash
+	downloadHandler.OnPurge(thumbnails.Remove)
+
+	// Keep the search index up to date with uploads, purges and chat
+	searchService, err := search.NewService(logger, index, auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build search index: %w", err)
+	}
+	tusHandler.Subscribe(searchService.HandleUploadEvent)
+	downloadHandler.OnPurge(searchService.RemoveFile)
+	wsManager.OnChat(searchService.RecordChat)
+
+	syncFolders, err := foldersync.NewService(cfg, logger, index, auth, downloadHandler, tusHandler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up sync folders: %w", err)
+	}
+
+	retentionService, err := retention.NewService(cfg, logger, index, downloadHandler, tusHandler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up retention rules: %w", err)
+	}
+
+	// Relay clipboard items between the devices that opt in
+	var clipboardService *clipboard.Service
+	if cfg.Clipboard.Enabled {
+		clipboardService, err = clipboard.NewService(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up clipboard sync: %w", err)
+		}
+		clipboardService.SendTo(wsManager)
+	}
 
 	server := &Server{
 		config:          cfg,
@@ -121,6 +208,13 @@ func NewServer(cfg *config.Config, logger *logrus.Logger) (*Server, error) {
 		wsManager:       wsManager,
 		tusHandler:      tusHandler,
 		downloadHandler: downloadHandler,
+		thumbnails:      thumbnails,
+		shares:          shares,
+		syncFolders:     syncFolders,
+		retention:       retentionService,
+		search:          searchService,
+		clipboard:       clipboardService,
+		index:           index,
 		auth:            auth,
 	}
 
@@ -146,6 +240,58 @@ func (s *Server) setupRoutes() {
 		// File management
 		api.GET("/files", s.auth.RequireAuth(), s.listFiles)
 		api.DELETE("/files/:id", s.auth.RequireAuth(), s.deleteFile)
+		api.GET("/files/:id/downloads", s.auth.RequireAuth(), s.getDownloads)
+		api.PUT("/files/:id/pin", s.auth.RequireAuth(), s.pinFile)
+		api.DELETE("/files/:id/pin", s.auth.RequireAuth(), s.pinFile)
+
+		// Deleted files stay in the trash until restored or purged
+		api.GET("/trash", s.auth.RequireAuth(), s.listTrash)
+		api.DELETE("/trash", s.auth.RequireAuth(), s.emptyTrash)
+		api.POST("/trash/:id/restore", s.auth.RequireAuth(), s.restoreFile)
+		api.DELETE("/trash/:id", s.auth.RequireAuth(), s.purgeFile)
+
+		api.GET("/batches", s.auth.RequireAuth(), s.listBatches)
+		api.GET("/batches/:id", s.auth.RequireAuth(), s.getBatch)
+		api.POST("/files/from-blob", s.auth.RequireAuth(), s.createFromBlob)
+		api.POST("/archive", s.auth.RequireAuth(), s.createArchive)
+
+		// Deduplication: lets clients skip uploading content the server already stores
+		api.GET("/blobs/:sha256", s.auth.RequireAuth(), s.getBlob)
+		api.HEAD("/blobs/:sha256", s.auth.RequireAuth(), s.getBlob)
+
+		// Shared folders of this computer
+		api.GET("/shares", s.auth.RequireAuth(), s.listShares)
+		api.GET("/shares/:name/list", s.auth.RequireAuth(), s.listShareDir)
+		api.GET("/shares/:name/stat", s.auth.RequireAuth(), s.statShareEntry)
+		api.GET("/shares/:name/download", s.auth.RequireAuth(), s.downloadShareFile)
+		api.HEAD("/shares/:name/download", s.auth.RequireAuth(), s.downloadShareFile)
+		api.PUT("/shares/:name/upload", s.auth.RequireAuth(), s.uploadShareFile)
+		api.POST("/shares/:name/mkdir", s.auth.RequireAuth(), s.makeShareDir)
+		api.DELETE("/shares/:name", s.auth.RequireAuth(), s.deleteShareEntry)
+
+		// Sync folders: files are uploaded through /tus and downloaded from /files
+		api.GET("/sync", s.auth.RequireAuth(), s.listSyncFolders)
+		api.GET("/sync/:name/manifest", s.auth.RequireAuth(), s.getSyncManifest)
+		api.POST("/sync/:name/delta", s.auth.RequireAuth(), s.getSyncDelta)
+		api.GET("/sync/:name/journal", s.auth.RequireAuth(), s.getSyncJournal)
+		api.DELETE("/sync/:name/files", s.auth.RequireAuth(), s.deleteSyncFile)
+
+		// Retention rules: report what they would remove before enforcing them
+		api.GET("/retention", s.auth.RequireAuth(), s.getRetention)
+		api.GET("/retention/report", s.auth.RequireAuth(), s.getRetentionReport)
+		api.POST("/retention/run", s.auth.RequireAuth(), s.runRetention)
+
+		// Search file metadata and chat messages
+		api.GET("/search", s.auth.RequireAuth(), s.searchAll)
+
+		// Clipboard sync between paired devices
+		api.GET("/clipboard", s.auth.RequireAuth(), s.getClipboard)
+		api.POST("/clipboard", s.auth.RequireAuth(), s.pushClipboard)
+		api.DELETE("/clipboard", s.auth.RequireAuth(), s.clearClipboard)
+		api.GET("/clipboard/:id/image", s.auth.RequireAuth(), s.getClipboardImage)
+
+		// Storage usage and quotas
+		api.GET("/usage", s.auth.RequireAuth(), s.getUsage)
 
 		// Messages
 		api.GET("/messages", s.auth.RequireAuth(), s.getMessages)
@@ -158,15 +304,20 @@ func (s *Server) setupRoutes() {
 	s.router.GET("/ws", func(c *gin.Context) { s.wsManager.HandleWebSocket(c.Writer, c.Request) })
 
 	// TUS file upload endpoints
-	s.router.POST("/tus/*filepath", func(c *gin.Context) { s.tusHandler.HandleRequest(c.Writer, c.Request) })
-	s.router.PATCH("/tus/*filepath", func(c *gin.Context) { s.tusHandler.HandleRequest(c.Writer, c.Request) })
-	s.router.HEAD("/tus/*filepath", func(c *gin.Context) { s.tusHandler.HandleRequest(c.Writer, c.Request) })
-	s.router.GET("/tus/*filepath", func(c *gin.Context) { s.tusHandler.HandleRequest(c.Writer, c.Request) })
-	s.router.OPTIONS("/tus/*filepath", func(c *gin.Context) { s.tusHandler.HandleRequest(c.Writer, c.Request) })
+	s.router.POST("/tus/*filepath", s.handleTus)
+	s.router.PATCH("/tus/*filepath", s.handleTus)
+	s.router.HEAD("/tus/*filepath", s.handleTus)
+	s.router.GET("/tus/*filepath", s.handleTus)
+	s.router.DELETE("/tus/*filepath", s.handleTus)
+	s.router.OPTIONS("/tus/*filepath", s.handleTus)
 
 	// File download endpoint
-	s.router.GET("/files/:id", func(c *gin.Context) { s.downloadHandler.HandleDownload(c.Writer, c.Request) })
+	s.router.GET("/files/:id", s.identifyDevice, func(c *gin.Context) { s.downloadHandler.HandleDownload(c.Writer, c.Request) })
+	s.router.HEAD("/files/:id", s.identifyDevice, func(c *gin.Context) { s.downloadHandler.HandleDownload(c.Writer, c.Request) })
 	s.router.GET("/files/:id/sha256", func(c *gin.Context) { s.downloadHandler.HandleSHA256(c.Writer, c.Request) })
+	s.router.GET("/files/:id/checksum", s.auth.RequireAuth(), func(c *gin.Context) { s.downloadHandler.HandleChecksum(c.Writer, c.Request) })
+	s.router.GET("/files/:id/thumbnail", func(c *gin.Context) { s.thumbnails.HandleThumbnail(c.Writer, c.Request) })
+	s.router.HEAD("/files/:id/thumbnail", func(c *gin.Context) { s.thumbnails.HandleThumbnail(c.Writer, c.Request) })
 
 	// Static files (web UI)
 	s.router.Static("/static", "./web/public")
@@ -285,6 +436,27 @@ func (s *Server) Stop(ctx context.Context) error {
 	return nil
 }
 
+// identifyDevice attributes a request to the paired device when it carries a
+// valid token. Requests without one are let through anonymously.
+func (s *Server) identifyDevice(c *gin.Context) {
+	token := c.GetHeader("Authorization")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if token != "" {
+		if claims, err := s.auth.ValidateToken(token); err == nil {
+			c.Request = c.Request.WithContext(security.WithDevice(c.Request.Context(), claims.DeviceID, claims.DeviceName))
+		}
+	}
+}
+
+// handleTus forwards upload requests to the TUS handler, attributing them to
+// the paired device when the request carries a valid token
+func (s *Server) handleTus(c *gin.Context) {
+	s.identifyDevice(c)
+	s.tusHandler.HandleRequest(c.Writer, c.Request)
+}
+
 func (s *Server) healthCheck(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"status":    "ok",
@@ -297,7 +469,7 @@ func (s *Server) generateQR(c *gin.Context) {
 	// TODO: Implement QR code generation
 	qrData := map[string]interface{}{
 		"url":   fmt.Sprintf("http://%s", s.config.GetAddr()),
-		"token": s.config.Security.PairingToken,
+		"token": s.auth.GetPairingToken(),
 	}
 
 	c.JSON(200, qrData)
@@ -310,7 +482,7 @@ func (s *Server) getPairingToken(c *gin.Context) {
 	}
 
 	c.JSON(200, gin.H{
-		"token":      s.config.Security.PairingToken,
+		"token":      s.auth.GetPairingToken(),
 		"server_url": fmt.Sprintf("%s://%s", protocol, s.finalAddr),
 		"timestamp":  time.Now().Unix(),
 	})
@@ -328,7 +500,7 @@ func (s *Server) pairDevice(c *gin.Context) {
 		return
 	}
 
-	if request.Token != s.config.Security.PairingToken {
+	if !s.auth.ValidatePairingToken(request.Token) {
 		c.JSON(401, gin.H{"error": "Invalid pairing token"})
 		return
 	}
@@ -369,7 +541,7 @@ func (s *Server) removeDevice(c *gin.Context) {
 
 	err := s.auth.RemoveDevice(deviceID)
 	if err != nil {
-		if err.Error() == "device not found" {
+		if errors.Is(err, security.ErrDeviceNotFound) {
 			c.JSON(404, gin.H{"error": "Device not found"})
 		} else {
 			c.JSON(500, gin.H{"error": "Failed to remove device"})
@@ -381,19 +553,740 @@ func (s *Server) removeDevice(c *gin.Context) {
 }
 
 func (s *Server) listFiles(c *gin.Context) {
-	// TODO: Implement file listing
-	c.JSON(200, gin.H{"files": []interface{}{}})
+	files, err := s.downloadHandler.ListFiles()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list files")
+		c.JSON(500, gin.H{"error": "Failed to list files"})
+		return
+	}
+
+	c.JSON(200, gin.H{"files": files})
 }
 
 func (s *Server) deleteFile(c *gin.Context) {
 	fileID := c.Param("id")
-	// TODO: Implement file deletion
+
+	if err := s.downloadHandler.DeleteFile(fileID, c.GetString("device_id"), c.GetString("device_name")); err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "File not found"})
+		} else {
+			s.logger.WithError(err).Error("Failed to delete file")
+			c.JSON(500, gin.H{"error": "Failed to delete file"})
+		}
+		return
+	}
+
+	if s.config.Trash.Enabled {
+		c.JSON(200, gin.H{"message": fmt.Sprintf("File %s moved to trash", fileID), "trashed": true})
+		return
+	}
+	c.JSON(200, gin.H{"message": fmt.Sprintf("File %s deleted", fileID), "trashed": false})
+}
+
+func (s *Server) pinFile(c *gin.Context) {
+	pinned := c.Request.Method == http.MethodPut
+
+	meta, err := s.index.Update(c.Param("id"), func(meta *catalog.FileMeta) error {
+		meta.Pinned = pinned
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "File not found"})
+		} else {
+			s.logger.WithError(err).Error("Failed to update file")
+			c.JSON(500, gin.H{"error": "Failed to update file"})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{"file": meta})
+}
+
+func (s *Server) getRetention(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"enabled":  s.config.Retention.Enabled,
+		"interval": s.config.Retention.Interval,
+		"rules":    s.config.Retention.Rules,
+		"last_run": s.retention.LastRun(),
+	})
+}
+
+func (s *Server) getRetentionReport(c *gin.Context) {
+	report, err := s.retention.Evaluate()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to evaluate retention rules")
+		c.JSON(500, gin.H{"error": "Failed to evaluate retention rules"})
+		return
+	}
+
+	c.JSON(200, report)
+}
+
+func (s *Server) runRetention(c *gin.Context) {
+	report, err := s.retention.Enforce(c.Request.Context())
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to enforce retention rules")
+		c.JSON(500, gin.H{"error": "Failed to enforce retention rules"})
+		return
+	}
+
+	c.JSON(200, report)
+}
+
+func (s *Server) searchAll(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(400, gin.H{"error": "Query required"})
+		return
+	}
+
+	kind := c.Query("type")
+	if kind != "" && kind != search.KindFile && kind != search.KindMessage {
+		c.JSON(400, gin.H{"error": "type must be file or message"})
+		return
+	}
+
+	limit := search.DefaultLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	c.JSON(200, gin.H{
+		"query":   query,
+		"results": s.search.Search(query, kind, limit),
+	})
+}
+
+// clipboardService returns the clipboard service, answering 403 when
+// clipboard sync is disabled
+func (s *Server) clipboardService(c *gin.Context) (*clipboard.Service, bool) {
+	if s.clipboard == nil {
+		c.JSON(403, gin.H{"error": "Clipboard sync is disabled"})
+		return nil, false
+	}
+	return s.clipboard, true
+}
+
+func (s *Server) getClipboard(c *gin.Context) {
+	cb, ok := s.clipboardService(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, gin.H{"items": cb.History()})
+}
+
+// pushClipboard accepts a JSON clipboard item, or the copied text or image
+// as the request body with its content type
+func (s *Server) pushClipboard(c *gin.Context) {
+	cb, ok := s.clipboardService(c)
+	if !ok {
+		return
+	}
+
+	var kind, text string
+	var image []byte
+	contentType := c.ContentType()
+	switch {
+	case contentType == "application/json":
+		var item websocket.ClipboardItem
+		if err := c.ShouldBindJSON(&item); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid clipboard item"})
+			return
+		}
+		kind, text = item.Kind, item.Text
+		if kind == websocket.ClipboardImage {
+			data, err := base64.StdEncoding.DecodeString(item.Data)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Image data must be base64"})
+				return
+			}
+			image = data
+		}
+	case strings.HasPrefix(contentType, "image/"), strings.HasPrefix(contentType, "text/"):
+		// Read one byte past the limits so oversized items are reported as such
+		var body io.Reader = c.Request.Body
+		maxText, _ := s.config.GetClipboardMaxTextBytes()
+		maxImage, _ := s.config.GetClipboardMaxImageBytes()
+		if maxText > 0 && maxImage > 0 {
+			body = io.LimitReader(body, max(maxText, maxImage)+1)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Failed to read clipboard item"})
+			return
+		}
+		if strings.HasPrefix(contentType, "image/") {
+			kind, image = websocket.ClipboardImage, data
+		} else {
+			kind, text = websocket.ClipboardText, string(data)
+		}
+	default:
+		c.JSON(415, gin.H{"error": "Unsupported content type"})
+		return
+	}
+
+	item, err := cb.Push(c.GetString("device_id"), c.GetString("device_name"), kind, text, image)
+	if err != nil {
+		switch {
+		case errors.Is(err, clipboard.ErrTooLarge):
+			c.JSON(413, gin.H{"error": err.Error()})
+		case errors.Is(err, clipboard.ErrInvalid):
+			c.JSON(400, gin.H{"error": err.Error()})
+		default:
+			s.logger.WithError(err).Error("Failed to push clipboard item")
+			c.JSON(500, gin.H{"error": "Failed to push clipboard item"})
+		}
+		return
+	}
+
+	c.JSON(201, item)
+}
+
+func (s *Server) clearClipboard(c *gin.Context) {
+	cb, ok := s.clipboardService(c)
+	if !ok {
+		return
+	}
+
+	cleared, err := cb.Clear()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to clear clipboard history")
+		c.JSON(500, gin.H{"error": "Failed to clear clipboard history"})
+		return
+	}
+
+	c.JSON(200, gin.H{"cleared": cleared})
+}
+
+func (s *Server) getClipboardImage(c *gin.Context) {
+	cb, ok := s.clipboardService(c)
+	if !ok {
+		return
+	}
+
+	item, data, err := cb.Image(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, clipboard.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "Clipboard image not found"})
+		} else {
+			s.logger.WithError(err).Error("Failed to read clipboard image")
+			c.JSON(500, gin.H{"error": "Failed to read clipboard image"})
+		}
+		return
+	}
+
+	c.Data(200, item.MimeType, data)
+}
+
+func (s *Server) listTrash(c *gin.Context) {
+	trash, err := s.downloadHandler.Trash()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list trash")
+		c.JSON(500, gin.H{"error": "Failed to list trash"})
+		return
+	}
+
+	c.JSON(200, trash)
+}
+
+func (s *Server) restoreFile(c *gin.Context) {
+	meta, err := s.downloadHandler.RestoreFile(c.Param("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, catalog.ErrNotFound):
+			c.JSON(404, gin.H{"error": "File not found in trash"})
+		case errors.Is(err, catalog.ErrExists):
+			c.JSON(409, gin.H{"error": "File already exists"})
+		default:
+			s.logger.WithError(err).Error("Failed to restore file")
+			c.JSON(500, gin.H{"error": "Failed to restore file"})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{"file": meta})
+}
+
+func (s *Server) purgeFile(c *gin.Context) {
+	fileID := c.Param("id")
+
+	if err := s.downloadHandler.PurgeFile(fileID); err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "File not found in trash"})
+		} else {
+			s.logger.WithError(err).Error("Failed to purge file")
+			c.JSON(500, gin.H{"error": "Failed to purge file"})
+		}
+		return
+	}
+
 	c.JSON(200, gin.H{"message": fmt.Sprintf("File %s deleted", fileID)})
 }
 
+func (s *Server) emptyTrash(c *gin.Context) {
+	purged, err := s.downloadHandler.EmptyTrash()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to empty trash")
+		c.JSON(500, gin.H{"error": "Failed to empty trash", "purged": purged})
+		return
+	}
+
+	c.JSON(200, gin.H{"purged": purged})
+}
+
+func (s *Server) getDownloads(c *gin.Context) {
+	records, active, err := s.downloadHandler.DownloadHistory(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "File not found"})
+		} else {
+			s.logger.WithError(err).Error("Failed to load download history")
+			c.JSON(500, gin.H{"error": "Failed to load download history"})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"downloads": records,
+		"active":    active,
+	})
+}
+
+func (s *Server) listBatches(c *gin.Context) {
+	batches, err := s.index.ListBatches()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list batches")
+		c.JSON(500, gin.H{"error": "Failed to list batches"})
+		return
+	}
+
+	c.JSON(200, gin.H{"batches": batches})
+}
+
+func (s *Server) getBatch(c *gin.Context) {
+	batch, err := s.index.GetBatch(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "Batch not found"})
+		} else {
+			s.logger.WithError(err).Error("Failed to load batch")
+			c.JSON(500, gin.H{"error": "Failed to load batch"})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"batch": batch,
+		"files": s.index.BatchFiles(batch),
+	})
+}
+
+func (s *Server) getBlob(c *gin.Context) {
+	blob, err := s.tusHandler.LookupBlob(c.Request.Context(), c.Param("sha256"))
+	if err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			c.JSON(404, gin.H{"error": "Content not found"})
+		} else {
+			s.logger.WithError(err).Error("Failed to load blob")
+			c.JSON(500, gin.H{"error": "Failed to load blob"})
+		}
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"sha256": blob.SHA256,
+		"size":   blob.Size,
+		"refs":   len(blob.Refs),
+	})
+}
+
+// createFromBlob adds a file from content the server already stores. A 404
+// tells the client to upload the file over TUS instead.
+func (s *Server) createFromBlob(c *gin.Context) {
+	var req struct {
+		SHA256       string `json:"sha256" binding:"required"`
+		Filename     string `json:"filename" binding:"required"`
+		Filetype     string `json:"filetype"`
+		RelativePath string `json:"relative_path"`
+		BatchID      string `json:"batch_id"`
+		BatchName    string `json:"batch_name"`
+		BatchTotal   int    `json:"batch_total"`
+		BatchSize    int64  `json:"batch_size"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	metadata := handler.MetaData{
+		"filename":     req.Filename,
+		"filetype":     req.Filetype,
+		"relativePath": req.RelativePath,
+		"batchId":      req.BatchID,
+		"batchName":    req.BatchName,
+	}
+	if req.BatchTotal > 0 {
+		metadata["batchTotal"] = strconv.Itoa(req.BatchTotal)
+	}
+	if req.BatchSize > 0 {
+		metadata["batchSize"] = strconv.FormatInt(req.BatchSize, 10)
+	}
+
+	ctx := security.WithDevice(c.Request.Context(), c.GetString("device_id"), c.GetString("device_name"))
+	meta, err := s.tusHandler.CreateFromBlob(ctx, req.SHA256, metadata)
+	if err != nil {
+		var tusErr handler.Error
+		switch {
+		case errors.Is(err, catalog.ErrNotFound):
+			c.JSON(404, gin.H{"error": "Content not found, upload the file"})
+		case errors.As(err, &tusErr):
+			c.JSON(tusErr.HTTPResponse.StatusCode, gin.H{"error": tusErr.Message, "code": tusErr.ErrorCode})
+		default:
+			s.logger.WithError(err).Error("Failed to create file from stored content")
+			c.JSON(500, gin.H{"error": "Failed to create file"})
+		}
+		return
+	}
+
+	c.JSON(201, meta)
+}
+
+// createArchive streams the requested files as a single ZIP or TAR download.
+// Form posts are accepted too, so browsers can save the archive directly.
+func (s *Server) createArchive(c *gin.Context) {
+	var req struct {
+		IDs     []string `json:"ids" form:"ids"`
+		BatchID string   `json:"batch_id" form:"batch_id"`
+		Format  string   `json:"format" form:"format"`
+		Name    string   `json:"name" form:"name"`
+	}
+	if err := c.ShouldBind(&req); err != nil || (len(req.IDs) == 0 && req.BatchID == "") {
+		c.JSON(400, gin.H{"error": "File IDs or batch ID required"})
+		return
+	}
+	if req.Format != "" && req.Format != download.ArchiveZip && req.Format != download.ArchiveTar {
+		c.JSON(400, gin.H{"error": "Format must be zip or tar"})
+		return
+	}
+
+	files, name, err := s.downloadHandler.ArchiveFiles(c.Request, req.IDs, req.BatchID)
+	if err != nil {
+		var missing *download.MissingFilesError
+		switch {
+		case errors.As(err, &missing):
+			c.JSON(404, gin.H{"error": "Files not found", "missing": missing.IDs})
+		case errors.Is(err, catalog.ErrNotFound):
+			c.JSON(404, gin.H{"error": "Batch not found"})
+		default:
+			s.logger.WithError(err).Error("Failed to prepare archive")
+			c.JSON(500, gin.H{"error": "Failed to prepare archive"})
+		}
+		return
+	}
+	if req.Name != "" {
+		name = req.Name
+	}
+
+	if err := s.downloadHandler.ServeArchive(c.Writer, c.Request, name, req.Format, files); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) listShares(c *gin.Context) {
+	c.JSON(200, gin.H{"shares": s.shares.List(c.GetString("device_id"))})
+}
+
+// share returns the share named in the URL, writing an error response when
+// the device may not use it
+func (s *Server) share(c *gin.Context) (*share.Share, bool) {
+	sh, err := s.shares.Get(c.Param("name"), c.GetString("device_id"))
+	if err != nil {
+		s.shareError(c, err)
+		return nil, false
+	}
+	return sh, true
+}
+
+// shareError answers with the status matching a share error
+func (s *Server) shareError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, share.ErrNotFound):
+		c.JSON(404, gin.H{"error": "Not found"})
+	case errors.Is(err, share.ErrForbidden):
+		c.JSON(403, gin.H{"error": "Access denied"})
+	case errors.Is(err, share.ErrReadOnly):
+		c.JSON(403, gin.H{"error": "Share is read-only"})
+	case errors.Is(err, share.ErrInvalidPath):
+		c.JSON(400, gin.H{"error": "Invalid path"})
+	case errors.Is(err, share.ErrConflict):
+		c.JSON(409, gin.H{"error": "Conflicting file or folder"})
+	case errors.As(err, &tooLarge):
+		c.JSON(413, gin.H{"error": "File too large"})
+	default:
+		s.logger.WithError(err).Error("Shared folder operation failed")
+		c.JSON(500, gin.H{"error": "Shared folder operation failed"})
+	}
+}
+
+func (s *Server) listShareDir(c *gin.Context) {
+	sh, ok := s.share(c)
+	if !ok {
+		return
+	}
+
+	entries, err := sh.ReadDir(c.Query("path"))
+	if err != nil {
+		s.shareError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"entries": entries})
+}
+
+func (s *Server) statShareEntry(c *gin.Context) {
+	sh, ok := s.share(c)
+	if !ok {
+		return
+	}
+
+	entry, err := sh.Stat(c.Query("path"))
+	if err != nil {
+		s.shareError(c, err)
+		return
+	}
+
+	c.JSON(200, entry)
+}
+
+func (s *Server) downloadShareFile(c *gin.Context) {
+	sh, ok := s.share(c)
+	if !ok {
+		return
+	}
+
+	file, entry, err := sh.Open(c.Query("path"))
+	if err != nil {
+		s.shareError(c, err)
+		return
+	}
+	defer file.Close()
+
+	s.downloadHandler.ServeLocalFile(c.Writer, c.Request, file, entry.Name)
+}
+
+func (s *Server) uploadShareFile(c *gin.Context) {
+	sh, ok := s.share(c)
+	if !ok {
+		return
+	}
+
+	body := c.Request.Body
+	if maxSize, err := s.config.GetMaxFileSizeBytes(); err == nil && maxSize > 0 {
+		body = http.MaxBytesReader(c.Writer, body, maxSize)
+	}
+
+	entry, err := sh.Create(c.Query("path"), body)
+	if err != nil {
+		s.shareError(c, err)
+		return
+	}
+
+	c.JSON(201, entry)
+}
+
+func (s *Server) makeShareDir(c *gin.Context) {
+	sh, ok := s.share(c)
+	if !ok {
+		return
+	}
+
+	entry, err := sh.Mkdir(c.Query("path"))
+	if err != nil {
+		s.shareError(c, err)
+		return
+	}
+
+	c.JSON(201, entry)
+}
+
+func (s *Server) deleteShareEntry(c *gin.Context) {
+	sh, ok := s.share(c)
+	if !ok {
+		return
+	}
+
+	if err := sh.Remove(c.Query("path")); err != nil {
+		s.shareError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": fmt.Sprintf("%s deleted", c.Query("path"))})
+}
+
+func (s *Server) listSyncFolders(c *gin.Context) {
+	folders, err := s.syncFolders.List(c.GetString("device_id"))
+	if err != nil {
+		s.syncError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"folders": folders})
+}
+
+func (s *Server) syncFolder(c *gin.Context) (*foldersync.Folder, bool) {
+	f, err := s.syncFolders.Get(c.Param("name"), c.GetString("device_id"))
+	if err != nil {
+		s.syncError(c, err)
+		return nil, false
+	}
+	return f, true
+}
+
+func (s *Server) syncError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, foldersync.ErrNotFound):
+		c.JSON(404, gin.H{"error": "Not found"})
+	case errors.Is(err, foldersync.ErrForbidden):
+		c.JSON(403, gin.H{"error": "Access denied"})
+	case errors.Is(err, foldersync.ErrInvalidPath):
+		c.JSON(400, gin.H{"error": err.Error()})
+	case errors.Is(err, foldersync.ErrConflict):
+		c.JSON(409, gin.H{"error": "File changed on the server"})
+	default:
+		s.logger.WithError(err).Error("Sync folder operation failed")
+		c.JSON(500, gin.H{"error": "Sync folder operation failed"})
+	}
+}
+
+func (s *Server) getSyncManifest(c *gin.Context) {
+	f, ok := s.syncFolder(c)
+	if !ok {
+		return
+	}
+
+	manifest, err := s.syncFolders.Manifest(f)
+	if err != nil {
+		s.syncError(c, err)
+		return
+	}
+
+	c.JSON(200, manifest)
+}
+
+func (s *Server) getSyncDelta(c *gin.Context) {
+	f, ok := s.syncFolder(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Files []foldersync.LocalFile `json:"files"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	delta, err := s.syncFolders.Delta(f, c.GetString("device_id"), c.GetString("device_name"), req.Files)
+	if err != nil {
+		s.syncError(c, err)
+		return
+	}
+
+	c.JSON(200, delta)
+}
+
+func (s *Server) getSyncJournal(c *gin.Context) {
+	f, ok := s.syncFolder(c)
+	if !ok {
+		return
+	}
+
+	var since int64
+	if v := c.Query("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "Invalid since"})
+			return
+		}
+		since = n
+	}
+	limit := 1000
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	entries, err := s.syncFolders.Journal(f, since, limit)
+	if err != nil {
+		s.syncError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"entries": entries})
+}
+
+func (s *Server) deleteSyncFile(c *gin.Context) {
+	f, ok := s.syncFolder(c)
+	if !ok {
+		return
+	}
+
+	p := c.Query("path")
+	if err := s.syncFolders.Delete(f, c.GetString("device_id"), c.GetString("device_name"), p, c.Query("base")); err != nil {
+		s.syncError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{"message": fmt.Sprintf("%s deleted", p)})
+}
+
+func (s *Server) getUsage(c *gin.Context) {
+	usage, err := s.tusHandler.Usage()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to compute storage usage")
+		c.JSON(500, gin.H{"error": "Failed to compute storage usage"})
+		return
+	}
+
+	c.JSON(200, usage)
+}
+
+// getMessages returns the newest chat messages, oldest first
 func (s *Server) getMessages(c *gin.Context) {
-	// TODO: Implement message retrieval
-	c.JSON(200, gin.H{"messages": []interface{}{}})
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	messages, err := s.index.Messages()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to read chat history")
+		c.JSON(500, gin.H{"error": "Failed to read chat history"})
+		return
+	}
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+
+	c.JSON(200, gin.H{"messages": messages})
 }
 
 func (s *Server) getConfig(c *gin.Context) {
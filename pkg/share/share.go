@@ -0,0 +1,504 @@
+package share
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotFound is returned for unknown shares and missing paths
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when a device may not use a share or a path
+	// leaves the share through a symbolic link
+	ErrForbidden = errors.New("access denied")
+	// ErrReadOnly is returned for changes to a share that is not writable
+	ErrReadOnly = errors.New("share is read-only")
+	// ErrInvalidPath is returned for paths with ".." or other unsafe segments
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrConflict is returned when a path exists with the wrong type, or a
+	// folder to be deleted is not empty
+	ErrConflict = errors.New("conflicting file or folder")
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Entry describes a file or folder inside a share
+type Entry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"` // relative to the share root, forward slashes
+	IsDir    bool      `json:"is_dir"`
+	Size     int64     `json:"size"`
+	MimeType string    `json:"mime_type,omitempty"` // guessed from the extension
+	Modified time.Time `json:"modified"`
+}
+
+// Info is what devices are told about a share. The folder on this computer
+// is not revealed.
+type Info struct {
+	Name     string `json:"name"`
+	Writable bool   `json:"writable"`
+}
+
+// Share is a configured share root
+type Share struct {
+	config.Share
+	root    string // absolute, with symbolic links resolved
+	devices map[string]bool
+	logger  *logrus.Logger
+}
+
+// Service holds the configured shares
+type Service struct {
+	logger *logrus.Logger
+	shares map[string]*Share
+	order  []string
+}
+
+func NewService(cfg *config.Config, logger *logrus.Logger) (*Service, error) {
+	s := &Service{
+		logger: logger,
+		shares: make(map[string]*Share),
+	}
+
+	for i, sc := range cfg.Shares {
+		sh, err := newShare(sc, logger)
+		if err != nil {
+			name := sc.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("invalid share %s: %w", name, err)
+		}
+		if _, dup := s.shares[sh.Name]; dup {
+			return nil, fmt.Errorf("duplicate share name %q", sh.Name)
+		}
+		s.shares[sh.Name] = sh
+		s.order = append(s.order, sh.Name)
+
+		logger.WithFields(logrus.Fields{
+			"share":    sh.Name,
+			"path":     sh.root,
+			"writable": sh.Writable,
+			"symlinks": sh.Symlinks,
+		}).Info("Sharing folder")
+	}
+
+	return s, nil
+}
+
+func newShare(sc config.Share, logger *logrus.Logger) (*Share, error) {
+	if !namePattern.MatchString(sc.Name) {
+		return nil, fmt.Errorf("name must consist of letters, digits, \"-\" and \"_\"")
+	}
+
+	switch sc.Symlinks {
+	case "":
+		sc.Symlinks = config.SymlinksInside
+	case config.SymlinksDeny, config.SymlinksInside, config.SymlinksFollow:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy %q", sc.Symlinks)
+	}
+
+	if sc.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	root, err := filepath.Abs(sc.Path)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", root)
+	}
+
+	sh := &Share{Share: sc, root: root, logger: logger}
+	if len(sc.Devices) > 0 {
+		sh.devices = make(map[string]bool)
+		for _, id := range sc.Devices {
+			sh.devices[id] = true
+		}
+	}
+	return sh, nil
+}
+
+// List returns the shares deviceID may use
+func (s *Service) List(deviceID string) []Info {
+	shares := make([]Info, 0, len(s.order))
+	for _, name := range s.order {
+		if sh := s.shares[name]; sh.allowed(deviceID) {
+			shares = append(shares, Info{Name: sh.Name, Writable: sh.Writable})
+		}
+	}
+	return shares
+}
+
+// Get returns the share called name if deviceID may use it
+func (s *Service) Get(name, deviceID string) (*Share, error) {
+	sh, ok := s.shares[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !sh.allowed(deviceID) {
+		return nil, ErrForbidden
+	}
+	return sh, nil
+}
+
+func (sh *Share) allowed(deviceID string) bool {
+	return sh.devices == nil || sh.devices[deviceID]
+}
+
+// ReadDir lists the folder at rel, folders first. Entries that are neither
+// regular files nor folders are left out, as are symbolic links the policy
+// does not allow.
+func (sh *Share) ReadDir(rel string) ([]Entry, error) {
+	rel, full, err := sh.resolve(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(full); err != nil {
+		return nil, statError(err)
+	} else if !info.IsDir() {
+		return nil, ErrConflict
+	}
+
+	dirEntries, err := os.ReadDir(full)
+	if err != nil {
+		return nil, statError(err)
+	}
+
+	entries := make([]Entry, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		entryPath := path.Join(rel, de.Name())
+
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if _, target, err := sh.resolve(entryPath); err != nil {
+				continue
+			} else if info, err = os.Stat(target); err != nil {
+				continue
+			}
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+
+		entries = append(entries, newEntry(entryPath, info))
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].IsDir != entries[b].IsDir {
+			return entries[a].IsDir
+		}
+		return strings.ToLower(entries[a].Name) < strings.ToLower(entries[b].Name)
+	})
+	return entries, nil
+}
+
+// Stat describes the file or folder at rel
+func (sh *Share) Stat(rel string) (*Entry, error) {
+	rel, full, err := sh.resolve(rel)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, statError(err)
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, ErrNotFound
+	}
+	entry := newEntry(rel, info)
+	return &entry, nil
+}
+
+// Open opens the regular file at rel for reading
+func (sh *Share) Open(rel string) (*os.File, *Entry, error) {
+	rel, full, err := sh.resolve(rel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check before opening: opening a named pipe would block
+	if info, err := os.Stat(full); err != nil {
+		return nil, nil, statError(err)
+	} else if info.IsDir() {
+		return nil, nil, ErrConflict
+	} else if !info.Mode().IsRegular() {
+		return nil, nil, ErrNotFound
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		return nil, nil, statError(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, ErrNotFound
+	}
+
+	entry := newEntry(rel, info)
+	return file, &entry, nil
+}
+
+// Create writes the file at rel from r, replacing an existing file. The
+// folder it goes into must exist. The content only appears under its name
+// once it is complete.
+func (sh *Share) Create(rel string, r io.Reader) (*Entry, error) {
+	if !sh.Writable {
+		return nil, ErrReadOnly
+	}
+	rel, full, err := sh.resolveNew(rel)
+	if err != nil {
+		return nil, err
+	}
+	if isDir(full) {
+		return nil, ErrConflict
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".easysync-*")
+	if err != nil {
+		return nil, statError(err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), full); err != nil {
+		return nil, err
+	}
+	sh.logger.WithFields(logrus.Fields{
+		"share": sh.Name,
+		"path":  rel,
+	}).Info("Stored in share")
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	entry := newEntry(rel, info)
+	return &entry, nil
+}
+
+// Mkdir creates the folder at rel. Its parent must exist.
+func (sh *Share) Mkdir(rel string) (*Entry, error) {
+	if !sh.Writable {
+		return nil, ErrReadOnly
+	}
+	rel, full, err := sh.resolveNew(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Mkdir(full, 0755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, ErrConflict
+		}
+		return nil, statError(err)
+	}
+
+	info, err := os.Stat(full)
+	if err != nil {
+		return nil, err
+	}
+	entry := newEntry(rel, info)
+	return &entry, nil
+}
+
+// Remove deletes the file or empty folder at rel. A symbolic link is removed
+// itself, never its target.
+func (sh *Share) Remove(rel string) error {
+	if !sh.Writable {
+		return ErrReadOnly
+	}
+	rel, full, err := sh.resolveNew(rel)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(full); err != nil {
+		return statError(err)
+	}
+
+	if err := os.Remove(full); err != nil {
+		if isDir(full) {
+			return ErrConflict
+		}
+		return statError(err)
+	}
+
+	sh.logger.WithFields(logrus.Fields{
+		"share": sh.Name,
+		"path":  rel,
+	}).Info("Removed from share")
+	return nil
+}
+
+// cleanPath validates a client supplied path and returns its segments.
+// Rather than being cleaned away, ".." is rejected, as are backslashes and
+// other characters with special meaning on some filesystems.
+func cleanPath(rel string) ([]string, error) {
+	if strings.ContainsAny(rel, "\\\x00:") {
+		return nil, ErrInvalidPath
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(rel, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return nil, ErrInvalidPath
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// resolve maps rel to a path on disk and applies the symlink policy. The
+// cleaned relative path is returned along with it.
+func (sh *Share) resolve(rel string) (string, string, error) {
+	segments, err := cleanPath(rel)
+	if err != nil {
+		return "", "", err
+	}
+	full := filepath.Join(append([]string{sh.root}, segments...)...)
+
+	if err := sh.checkLinks(full, segments, len(segments)); err != nil {
+		return "", "", err
+	}
+	return path.Join(segments...), full, nil
+}
+
+// resolveNew is resolve for a path that is created or removed: the symlink
+// policy applies to its parent folder, the last segment must be a safe file
+// name and the share root itself is refused.
+func (sh *Share) resolveNew(rel string) (string, string, error) {
+	segments, err := cleanPath(rel)
+	if err != nil {
+		return "", "", err
+	}
+	if len(segments) == 0 {
+		return "", "", ErrInvalidPath
+	}
+	// New names must be valid on this computer's filesystem
+	if name := segments[len(segments)-1]; upload.SanitizeFileName(name) != name {
+		return "", "", ErrInvalidPath
+	}
+	full := filepath.Join(append([]string{sh.root}, segments...)...)
+
+	parent := filepath.Dir(full)
+	if err := sh.checkLinks(parent, segments, len(segments)-1); err != nil {
+		return "", "", err
+	}
+	if !isDir(parent) {
+		return "", "", ErrNotFound
+	}
+	return path.Join(segments...), full, nil
+}
+
+// checkLinks applies the symlink policy to full, which is made of the first
+// n segments below the root
+func (sh *Share) checkLinks(full string, segments []string, n int) error {
+	switch sh.Symlinks {
+	case config.SymlinksFollow:
+		return nil
+
+	case config.SymlinksDeny:
+		p := sh.root
+		for _, segment := range segments[:n] {
+			p = filepath.Join(p, segment)
+			info, err := os.Lstat(p)
+			if err != nil {
+				return statError(err)
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return ErrForbidden
+			}
+		}
+		return nil
+
+	default:
+		target, err := filepath.EvalSymlinks(full)
+		if err != nil {
+			return statError(err)
+		}
+		if !within(sh.root, target) {
+			return ErrForbidden
+		}
+		return nil
+	}
+}
+
+// within reports whether p is root or lies below it
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+func statError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, os.ErrPermission):
+		return ErrForbidden
+	}
+	return err
+}
+
+func newEntry(rel string, info os.FileInfo) Entry {
+	// The name comes from the path: info describes the target of a link
+	entry := Entry{
+		Path:     rel,
+		IsDir:    info.IsDir(),
+		Modified: info.ModTime(),
+	}
+	if rel != "" {
+		entry.Name = path.Base(rel)
+	}
+	if !entry.IsDir {
+		entry.Size = info.Size()
+		entry.MimeType = mime.TypeByExtension(strings.ToLower(path.Ext(entry.Name)))
+	}
+	return entry
+}
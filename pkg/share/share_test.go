@@ -0,0 +1,173 @@
+package share
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestShare creates a writable share holding links that stay inside and
+// links that leave it:
+//
+//	share/docs/a.txt
+//	share/docs/up       -> ../..
+//	share/inner         -> docs
+//	share/inner.txt     -> docs/a.txt
+//	share/outer         -> ../outside
+//	share/outer.txt     -> ../outside/secret.txt
+//	outside/secret.txt
+func newTestShare(t *testing.T, policy string) (*Share, string) {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "share")
+	outside := filepath.Join(dir, "outside")
+
+	for _, p := range []string{filepath.Join(root, "docs"), outside} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(root, "docs", "a.txt"): "inside",
+		filepath.Join(outside, "secret.txt"): "secret",
+	}
+	for p, content := range files {
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "docs", "up"): filepath.Join("..", ".."),
+		filepath.Join(root, "inner"):      "docs",
+		filepath.Join(root, "inner.txt"):  filepath.Join("docs", "a.txt"),
+		filepath.Join(root, "outer"):      filepath.Join("..", "outside"),
+		filepath.Join(root, "outer.txt"):  filepath.Join("..", "outside", "secret.txt"),
+	}
+	for p, target := range links {
+		if err := os.Symlink(target, p); err != nil {
+			t.Skipf("symbolic links not supported: %v", err)
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sh, err := newShare(config.Share{Name: "test", Path: root, Writable: true, Symlinks: policy}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sh, outside
+}
+
+var policies = []string{config.SymlinksDeny, config.SymlinksInside, config.SymlinksFollow}
+
+func TestResolve(t *testing.T) {
+	// Expected errors for deny, inside and follow
+	tests := []struct {
+		path string
+		want [3]error
+	}{
+		{"", [3]error{nil, nil, nil}},
+		{"docs/a.txt", [3]error{nil, nil, nil}},
+		{"/docs//./a.txt", [3]error{nil, nil, nil}},
+		{"missing.txt", [3]error{ErrNotFound, ErrNotFound, ErrNotFound}},
+
+		// ".." is rejected before the filesystem is looked at
+		{"..", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"../outside/secret.txt", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"docs/../../outside/secret.txt", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"docs/..", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{`docs\..\..\outside`, [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"C:/outside", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+
+		// Links staying inside the share
+		{"inner", [3]error{ErrForbidden, nil, nil}},
+		{"inner/a.txt", [3]error{ErrForbidden, nil, nil}},
+		{"inner.txt", [3]error{ErrForbidden, nil, nil}},
+
+		// Links leaving the share
+		{"outer", [3]error{ErrForbidden, ErrForbidden, nil}},
+		{"outer/secret.txt", [3]error{ErrForbidden, ErrForbidden, nil}},
+		{"outer.txt", [3]error{ErrForbidden, ErrForbidden, nil}},
+		{"docs/up/outside/secret.txt", [3]error{ErrForbidden, ErrForbidden, nil}},
+		{"inner/up/outside/secret.txt", [3]error{ErrForbidden, ErrForbidden, nil}},
+	}
+
+	for i, policy := range policies {
+		sh, _ := newTestShare(t, policy)
+		for _, tt := range tests {
+			_, err := sh.Stat(tt.path)
+			if !errors.Is(err, tt.want[i]) {
+				t.Errorf("%s: Stat(%q) = %v, want %v", policy, tt.path, err, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestResolveNew(t *testing.T) {
+	// Expected errors for deny, inside and follow
+	tests := []struct {
+		path string
+		want [3]error
+	}{
+		{"new.txt", [3]error{nil, nil, nil}},
+		{"docs/new.txt", [3]error{nil, nil, nil}},
+		{"", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"../new.txt", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"docs/../../new.txt", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"docs/new?.txt", [3]error{ErrInvalidPath, ErrInvalidPath, ErrInvalidPath}},
+		{"missing/new.txt", [3]error{ErrNotFound, ErrNotFound, ErrNotFound}},
+		{"inner/new.txt", [3]error{ErrForbidden, nil, nil}},
+		{"outer/new.txt", [3]error{ErrForbidden, ErrForbidden, nil}},
+		{"docs/up/outside/new.txt", [3]error{ErrForbidden, ErrForbidden, nil}},
+	}
+
+	for i, policy := range policies {
+		sh, outside := newTestShare(t, policy)
+		for _, tt := range tests {
+			_, err := sh.Create(tt.path, strings.NewReader("new"))
+			if !errors.Is(err, tt.want[i]) {
+				t.Errorf("%s: Create(%q) = %v, want %v", policy, tt.path, err, tt.want[i])
+			}
+		}
+		_, err := os.Stat(filepath.Join(outside, "new.txt"))
+		if written := err == nil; written != (policy == config.SymlinksFollow) {
+			t.Errorf("%s: file written outside the share: %v", policy, written)
+		}
+
+		// Removing a link removes the link, never its target
+		if err := sh.Remove("outer.txt"); err != nil {
+			t.Errorf("%s: Remove of a link: %v", policy, err)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+			t.Errorf("%s: target of a removed link: %v", policy, err)
+		}
+	}
+}
+
+func TestReadDirHidesForbiddenLinks(t *testing.T) {
+	want := map[string]string{
+		config.SymlinksDeny:   "docs",
+		config.SymlinksInside: "docs,inner,inner.txt",
+		config.SymlinksFollow: "docs,inner,outer,inner.txt,outer.txt",
+	}
+	for _, policy := range policies {
+		sh, _ := newTestShare(t, policy)
+		entries, err := sh.ReadDir("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if got := strings.Join(names, ","); got != want[policy] {
+			t.Errorf("%s: ReadDir listed %s, want %s", policy, got, want[policy])
+		}
+	}
+}
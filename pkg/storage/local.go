@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores objects as files below a root directory. Folders are created
+// as needed and removed again once they are empty.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &Local{root: filepath.Clean(root)}, nil
+}
+
+// Path returns the file that holds the object stored under key
+func (l *Local) Path(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", invalidKey(key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dst, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// Write next to the destination so the final rename is atomic
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("short write for %s: %d of %d bytes", key, written, size)
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, mapNotExist(err)
+	}
+	return file, nil
+}
+
+func (l *Local) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, mapNotExist(err)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, mapNotExist(err)
+	}
+	if info.IsDir() {
+		return nil, ErrNotExist
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the folder containing prefix. Hidden folders such as the upload
+// staging area are only entered when the prefix points into them.
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := l.root
+	if dir, _ := path.Split(prefix); dir != "" {
+		if !ValidKey(strings.TrimSuffix(dir, "/")) {
+			return nil, invalidKey(prefix)
+		}
+		start = filepath.Join(l.root, filepath.FromSlash(dir))
+	}
+
+	objects := make([]ObjectInfo, 0)
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if p != start && strings.HasPrefix(d.Name(), ".") && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l.pruneDirs(filepath.Dir(p))
+	return nil
+}
+
+// pruneDirs removes dir and its parents up to the root while they are empty
+func (l *Local) pruneDirs(dir string) {
+	for ; dir != l.root && strings.HasPrefix(dir, l.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// Move renames a local file into the store; srcPath must be on the same filesystem
+func (l *Local) Move(ctx context.Context, srcPath, key string) error {
+	dst, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(srcPath, dst)
+}
+
+// Rename moves an object to a new key
+func (l *Local) Rename(ctx context.Context, srcKey, dstKey string) error {
+	src, err := l.Path(srcKey)
+	if err != nil {
+		return err
+	}
+	if err := l.Move(ctx, src, dstKey); err != nil {
+		return mapNotExist(err)
+	}
+	l.pruneDirs(filepath.Dir(src))
+	return nil
+}
+
+// Link makes dstKey a hard link to srcKey
+func (l *Local) Link(ctx context.Context, srcKey, dstKey string) error {
+	src, err := l.Path(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := l.Path(dstKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return mapNotExist(os.Link(src, dst))
+}
+
+func mapNotExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	testBucket    = "easysync"
+	testAccessKey = "test-access-key"
+)
+
+// fakeS3 is a minimal in-memory S3 compatible service, standing in for
+// MinIO. It serves one bucket with path style addressing.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	uploads  map[string]map[int][]byte // multipart uploads in progress by upload ID
+	nextID   int
+	pageSize int // keys per listing page
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string]fakeObject),
+		uploads:  make(map[string]map[int][]byte),
+		pageSize: 2,
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential="+testAccessKey+"/") || r.Header.Get("X-Amz-Date") == "" {
+		s3ErrorResponse(w, http.StatusForbidden, "AccessDenied", "missing or foreign signature")
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket)
+	if !ok {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchBucket", "unknown bucket")
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchUpload", "unknown upload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		parts[number] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchUpload", "unknown upload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			s3ErrorResponse(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"part-%d"`, i+1) {
+				s3ErrorResponse(w, http.StatusBadRequest, "InvalidPart", "parts out of order")
+				return
+			}
+			data = append(data, parts[part.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = fakeObject{data: data, modified: time.Now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+		}{Key: key})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		f.objects[key] = fakeObject{data: data, modified: time.Now()}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			s3ErrorResponse(w, http.StatusNotFound, "NoSuchKey", "no such key")
+			return
+		}
+		http.ServeContent(w, r, key, object.modified, bytes.NewReader(object.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3ErrorResponse(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// list answers a ListObjectsV2 request, paging after the continuation token
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	if query.Get("list-type") != "2" {
+		s3ErrorResponse(w, http.StatusBadRequest, "InvalidArgument", "only ListObjectsV2 is supported")
+		return
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		object := f.objects[key]
+		result.Contents = append(result.Contents, content{Key: key, Size: int64(len(object.data)), LastModified: object.modified.UTC()})
+	}
+	writeXML(w, result)
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3ErrorResponse(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return nil, false
+	}
+	if int64(len(data)) != r.ContentLength {
+		s3ErrorResponse(w, http.StatusBadRequest, "IncompleteBody", "body does not match Content-Length")
+		return nil, false
+	}
+	return data, true
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		s3Error
+	}{s3Error: s3Error{Code: code, Message: message}})
+}
+
+// newTestS3 returns an S3 backend talking to a fake service
+func newTestS3(t *testing.T, prefix string) (*S3, *fakeS3) {
+	t.Helper()
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.Backend = BackendS3
+	cfg.Storage.S3.Endpoint = server.URL
+	cfg.Storage.S3.Bucket = testBucket
+	cfg.Storage.S3.Prefix = prefix
+	cfg.Storage.S3.AccessKey = testAccessKey
+	cfg.Storage.S3.SecretKey = "test-secret-key"
+	cfg.Storage.S3.PathStyle = true
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	b, err := NewS3(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, fake
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestS3Backend(t *testing.T) {
+	b, fake := newTestS3(t, "/files/")
+	testBackend(t, b)
+
+	// Every object lives below the configured prefix
+	for _, key := range fake.keys() {
+		if !strings.HasPrefix(key, "files/") {
+			t.Errorf("object %q stored outside the prefix", key)
+		}
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	b, fake := newTestS3(t, "")
+	b.partSize = 4 // below the S3 minimum, but the fake does not mind
+	ctx := context.Background()
+
+	content := "0123456789abcdefghi"
+	if err := b.Put(ctx, "large.bin", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Get(ctx, "large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); string(data) != content {
+		t.Errorf("multipart object holds %q, want %q", data, content)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(fake.uploads))
+	}
+
+	// A short body aborts the upload instead of storing a truncated object
+	if err := b.Put(ctx, "short.bin", strings.NewReader("0123456"), 10); err == nil {
+		t.Error("Put of a short body succeeded")
+	}
+	if _, err := b.Stat(ctx, "short.bin"); err != ErrNotExist {
+		t.Errorf("Stat of the aborted object: %v", err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open after a failure", len(fake.uploads))
+	}
+}
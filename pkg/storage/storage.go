@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// Backend names accepted in Storage.Backend
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// ErrNotExist is returned when no object is stored under a key
+var ErrNotExist = errors.New("object does not exist")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Backend stores completed files. Keys are slash separated paths relative to
+// the storage root, such as "phone/IMG_0001.jpg".
+type Backend interface {
+	// Put stores size bytes read from r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object for reading
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange opens length bytes of the object starting at offset
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns information about the object
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// List returns all objects whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes the object; deleting a missing object is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// Mover is implemented by backends that can take over a local file without
+// copying it
+type Mover interface {
+	Move(ctx context.Context, srcPath, key string) error
+}
+
+// Renamer is implemented by backends that can change the key of an object
+// without copying it
+type Renamer interface {
+	Rename(ctx context.Context, srcKey, dstKey string) error
+}
+
+// Linker is implemented by backends where two keys can share one stored copy
+// of the same content
+type Linker interface {
+	Link(ctx context.Context, srcKey, dstKey string) error
+}
+
+// New creates the backend selected by Storage.Backend
+func New(cfg *config.Config, logger *logrus.Logger) (Backend, error) {
+	switch cfg.Storage.Backend {
+	case "", BackendLocal:
+		return NewLocal(cfg.Storage.UploadDir)
+	case BackendS3:
+		return NewS3(cfg, logger)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
+
+// PutFile stores the local file at srcPath under key and removes the local
+// file afterwards
+func PutFile(ctx context.Context, b Backend, srcPath, key string) error {
+	if m, ok := b.(Mover); ok {
+		return m.Move(ctx, srcPath, key)
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(ctx, key, file, info.Size()); err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Remove(srcPath)
+}
+
+// Rename moves the object at srcKey to dstKey, copying it when the backend
+// cannot rename in place
+func Rename(ctx context.Context, b Backend, srcKey, dstKey string) error {
+	if r, ok := b.(Renamer); ok {
+		return r.Rename(ctx, srcKey, dstKey)
+	}
+
+	info, err := b.Stat(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	src, err := b.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := b.Put(ctx, dstKey, src, info.Size); err != nil {
+		return err
+	}
+	return b.Delete(ctx, srcKey)
+}
+
+// Exists reports whether key names an object or a folder of objects
+func Exists(ctx context.Context, b Backend, key string) (bool, error) {
+	if _, err := b.Stat(ctx, key); err == nil {
+		return true, nil
+	} else if !errors.Is(err, ErrNotExist) {
+		return false, err
+	}
+
+	objects, err := b.List(ctx, key+"/")
+	if err != nil {
+		return false, err
+	}
+	return len(objects) > 0, nil
+}
+
+// ValidKey rejects keys that are empty, absolute or could escape the storage root
+func ValidKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func invalidKey(key string) error {
+	return fmt.Errorf("invalid storage key %q", key)
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"file.txt", true},
+		{"phone/IMG_0001.jpg", true},
+		{".blobs/ab/abcdef", true},
+		{"a/..b/c", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../outside", false},
+		{"a/../../outside", false},
+		{"a/./b", false},
+		{"a//b", false},
+		{"a/", false},
+		{".", false},
+		{`a\..\b`, false},
+	}
+	for _, tt := range tests {
+		if got := ValidKey(tt.key); got != tt.want {
+			t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	b, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
+
+// testBackend checks the behavior every backend must share
+func testBackend(t *testing.T, b Backend) {
+	ctx := context.Background()
+
+	put := func(key, content string) {
+		t.Helper()
+		if err := b.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	read := func(r io.ReadCloser, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	t.Run("PutGet", func(t *testing.T) {
+		put("docs/report.txt", "first version")
+		put("docs/report.txt", "second version")
+		if got := read(b.Get(ctx, "docs/report.txt")); got != "second version" {
+			t.Errorf("Get returned %q", got)
+		}
+
+		info, err := b.Stat(ctx, "docs/report.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "docs/report.txt" || info.Size != int64(len("second version")) || info.ModTime.IsZero() {
+			t.Errorf("Stat returned %+v", info)
+		}
+	})
+
+	t.Run("GetRange", func(t *testing.T) {
+		put("range.txt", "0123456789")
+		tests := []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, 10, "0123456789"},
+			{0, 1, "0"},
+			{3, 4, "3456"},
+			{9, 1, "9"},
+		}
+		for _, tt := range tests {
+			if got := read(b.GetRange(ctx, "range.txt", tt.offset, tt.length)); got != tt.want {
+				t.Errorf("GetRange(%d, %d) = %q, want %q", tt.offset, tt.length, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("NotExist", func(t *testing.T) {
+		if _, err := b.Get(ctx, "missing.txt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Get: %v", err)
+		}
+		if _, err := b.Stat(ctx, "missing.txt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat: %v", err)
+		}
+		if err := b.Delete(ctx, "missing.txt"); err != nil {
+			t.Errorf("Delete: %v", err)
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		if err := b.Put(ctx, "../escape.txt", strings.NewReader("x"), 1); err == nil {
+			t.Error("Put accepted a key leaving the root")
+		}
+		if _, err := b.Get(ctx, "/absolute.txt"); err == nil {
+			t.Error("Get accepted an absolute key")
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		put("list/a.txt", "a")
+		put("list/sub/b.txt", "bb")
+		put("listing.txt", "c")
+
+		objects, err := b.List(ctx, "list/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([]string, 0, len(objects))
+		sizes := make(map[string]int64)
+		for _, o := range objects {
+			keys = append(keys, o.Key)
+			sizes[o.Key] = o.Size
+		}
+		sort.Strings(keys)
+		if want := []string{"list/a.txt", "list/sub/b.txt"}; strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("List returned %v, want %v", keys, want)
+		}
+		if sizes["list/sub/b.txt"] != 2 {
+			t.Errorf("List reported size %d for list/sub/b.txt", sizes["list/sub/b.txt"])
+		}
+
+		if objects, err := b.List(ctx, "nothing/"); err != nil || len(objects) != 0 {
+			t.Errorf("List of an empty prefix returned %v, %v", objects, err)
+		}
+		if ok, err := Exists(ctx, b, "list/sub"); err != nil || !ok {
+			t.Errorf("Exists on a folder returned %v, %v", ok, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		put("gone/file.txt", "x")
+		if err := b.Delete(ctx, "gone/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Stat(ctx, "gone/file.txt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Stat after Delete: %v", err)
+		}
+		if ok, err := Exists(ctx, b, "gone"); err != nil || ok {
+			t.Errorf("Exists after Delete returned %v, %v", ok, err)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		content := bytes.Repeat([]byte("rename "), 100)
+		if err := b.Put(ctx, "from/file.txt", bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		if err := Rename(ctx, b, "from/file.txt", "to/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(b.Get(ctx, "to/file.txt")); got != string(content) {
+			t.Errorf("renamed object holds %d bytes, want %d", len(got), len(content))
+		}
+		if _, err := b.Stat(ctx, "from/file.txt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("source still exists after Rename: %v", err)
+		}
+		if err := Rename(ctx, b, "from/file.txt", "to/other.txt"); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Rename of a missing object: %v", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+)
+
+// cacheMaxAge is how long clients may reuse a thumbnail without asking again.
+// The thumbnail of a file ID never changes, the ETag covers the rest.
+const cacheMaxAge = 7 * 24 * 60 * 60
+
+// HandleThumbnail serves GET /files/{id}/thumbnail?size=N
+func (s *Service) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, If-None-Match, If-Modified-Since")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+	fileID = strings.TrimSuffix(fileID, "/thumbnail")
+	if fileID == "" {
+		http.Error(w, "File ID required", http.StatusBadRequest)
+		return
+	}
+
+	requested := 0
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
+			return
+		}
+		requested = n
+	}
+
+	meta, err := s.index.Get(fileID)
+	if err != nil {
+		if errors.Is(err, catalog.ErrNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+		} else {
+			s.logger.WithError(err).Error("Failed to load file metadata")
+			http.Error(w, "Failed to load file metadata", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if len(s.sizes) == 0 {
+		http.Error(w, "Thumbnails are disabled", http.StatusNotFound)
+		return
+	}
+	if !s.Supported(meta) {
+		http.Error(w, ErrUnsupported.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	size := s.Size(requested)
+	thumbPath, err := s.Get(meta, size)
+	if err != nil {
+		s.logger.WithError(err).WithField("file_id", fileID).Warn("Failed to generate thumbnail")
+		http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(thumbPath)
+	if err != nil {
+		http.Error(w, "Failed to open thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open thumbnail", http.StatusInternalServerError)
+		return
+	}
+
+	version := meta.SHA256
+	if version == "" {
+		version = meta.ID
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, version, size))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", cacheMaxAge))
+
+	// ServeContent answers If-None-Match and If-Modified-Since with 304
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
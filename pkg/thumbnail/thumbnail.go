@@ -0,0 +1,425 @@
+package thumbnail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// DirName is the directory under Storage.DataDir holding cached thumbnails
+const DirName = "thumbnails"
+
+// maxSourcePixels guards against images that would need too much memory to decode
+const maxSourcePixels = 64 * 1000 * 1000
+
+// generateTimeout bounds the work for one file, including ffmpeg
+const generateTimeout = 2 * time.Minute
+
+// ErrUnsupported is returned for files no thumbnail can be made of
+var ErrUnsupported = errors.New("no thumbnail available for this file type")
+
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Service renders thumbnails of completed uploads and caches them per file
+// and size. Thumbnails are made in the background when an upload completes,
+// and on demand for files that were uploaded before.
+type Service struct {
+	config  *config.Config
+	logger  *logrus.Logger
+	index   *catalog.Index
+	backend storage.Backend
+	dir     string
+	sizes   []int
+	quality int
+	ffmpeg  string
+	queue   chan string
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+func NewService(cfg *config.Config, logger *logrus.Logger, index *catalog.Index, backend storage.Backend, uploads *upload.TusHandler) (*Service, error) {
+	s := &Service{
+		config:   cfg,
+		logger:   logger,
+		index:    index,
+		backend:  backend,
+		dir:      filepath.Join(cfg.Storage.DataDir, DirName),
+		quality:  cfg.Thumbnails.Quality,
+		queue:    make(chan string, 256),
+		inflight: make(map[string]chan struct{}),
+	}
+	if !cfg.Thumbnails.Enabled {
+		return s, nil
+	}
+
+	for _, size := range cfg.Thumbnails.Sizes {
+		if size < 16 || size > 4096 {
+			return nil, fmt.Errorf("invalid thumbnail size %d, must be between 16 and 4096", size)
+		}
+		s.sizes = append(s.sizes, size)
+	}
+	if len(s.sizes) == 0 {
+		s.sizes = []int{256}
+	}
+	if s.quality < 1 || s.quality > 100 {
+		s.quality = jpeg.DefaultQuality
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail directory: %w", err)
+	}
+
+	if cfg.Thumbnails.Video {
+		if ffmpeg, err := exec.LookPath(cfg.Thumbnails.FFmpeg); err == nil {
+			s.ffmpeg = ffmpeg
+		} else {
+			logger.WithField("ffmpeg", cfg.Thumbnails.FFmpeg).Info("ffmpeg not found, video thumbnails disabled")
+		}
+	}
+
+	uploads.Subscribe(s.enqueue)
+	go s.run()
+
+	return s, nil
+}
+
+// Supported reports whether a thumbnail can be made of the file
+func (s *Service) Supported(meta *catalog.FileMeta) bool {
+	if len(s.sizes) == 0 {
+		return false
+	}
+	mimeType := baseMimeType(meta.MimeType)
+	return imageTypes[mimeType] || (s.ffmpeg != "" && strings.HasPrefix(mimeType, "video/"))
+}
+
+// Size picks the cached size for a requested one: the smallest configured
+// size that is at least as large, or the largest. 0 selects the default.
+func (s *Service) Size(requested int) int {
+	if requested <= 0 {
+		return s.sizes[0]
+	}
+	sorted := append([]int(nil), s.sizes...)
+	sort.Ints(sorted)
+	for _, size := range sorted {
+		if size >= requested {
+			return size
+		}
+	}
+	return sorted[len(sorted)-1]
+}
+
+// Get returns the cached thumbnail of the file, rendering it first if needed
+func (s *Service) Get(meta *catalog.FileMeta, size int) (string, error) {
+	if !s.Supported(meta) {
+		return "", ErrUnsupported
+	}
+
+	target := s.path(meta.ID, size)
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+	if err := s.ensure(meta); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// Remove deletes the cached thumbnails of a file
+func (s *Service) Remove(id string) {
+	if len(s.sizes) == 0 || id == "" || strings.ContainsAny(id, `/\.`) {
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+		s.logger.WithError(err).WithField("file_id", id).Warn("Failed to remove thumbnails")
+	}
+}
+
+func (s *Service) path(id string, size int) string {
+	return filepath.Join(s.dir, id, strconv.Itoa(size)+".jpg")
+}
+
+func (s *Service) enqueue(event upload.Event) {
+	if event.Type != upload.EventCompleted || event.File == nil {
+		return
+	}
+	select {
+	case s.queue <- event.File.ID:
+	default:
+		// Rendered on demand instead
+	}
+}
+
+func (s *Service) run() {
+	for id := range s.queue {
+		// Reload the record, hooks may have moved the file meanwhile
+		meta, err := s.index.Get(id)
+		if err != nil || !s.Supported(meta) {
+			continue
+		}
+		if err := s.ensure(meta); err != nil {
+			s.logger.WithError(err).WithFields(logrus.Fields{
+				"file_id": meta.ID,
+				"name":    meta.Name,
+			}).Warn("Failed to generate thumbnails")
+		}
+	}
+}
+
+// ensure renders all missing sizes of the file. Concurrent callers for the
+// same file wait for the first one instead of rendering again.
+func (s *Service) ensure(meta *catalog.FileMeta) error {
+	s.mu.Lock()
+	if done, ok := s.inflight[meta.ID]; ok {
+		s.mu.Unlock()
+		<-done
+		if _, err := os.Stat(s.path(meta.ID, s.sizes[0])); err != nil {
+			return fmt.Errorf("thumbnail generation failed")
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	s.inflight[meta.ID] = done
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.inflight, meta.ID)
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	var missing []int
+	for _, size := range s.sizes {
+		if _, err := os.Stat(s.path(meta.ID, size)); err != nil {
+			missing = append(missing, size)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), generateTimeout)
+	defer cancel()
+
+	start := time.Now()
+	src, err := s.source(ctx, meta)
+	if err != nil {
+		return err
+	}
+
+	orientation := 0
+	if meta.Photo != nil {
+		orientation = meta.Photo.Orientation
+	}
+
+	// Scale the largest size from the source and each smaller one from the
+	// previous result, which is much cheaper for large photos. Turning the
+	// result upright is cheap once it is small.
+	sort.Sort(sort.Reverse(sort.IntSlice(missing)))
+	current := src
+	for i, size := range missing {
+		scaler := draw.Interpolator(draw.CatmullRom)
+		if i == 0 {
+			scaler = draw.BiLinear
+		}
+		current = scale(current, src.Bounds(), size, scaler)
+		if err := s.save(s.path(meta.ID, size), orient(current, orientation)); err != nil {
+			return err
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"file_id":  meta.ID,
+		"sizes":    missing,
+		"duration": time.Since(start),
+	}).Debug("Thumbnails generated")
+	return nil
+}
+
+// source decodes the image, or the poster frame of a video
+func (s *Service) source(ctx context.Context, meta *catalog.FileMeta) (image.Image, error) {
+	if strings.HasPrefix(baseMimeType(meta.MimeType), "video/") {
+		return s.posterFrame(ctx, meta)
+	}
+
+	// Check the dimensions before decoding the whole image
+	r, err := s.backend.Get(ctx, meta.Path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bufio.NewReader(r))
+	r.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return nil, fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	r, err = s.backend.Get(ctx, meta.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	img, _, err := image.Decode(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// orient turns the image upright according to its EXIF orientation
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = w-1-y, x
+			case 7: // transversed
+				dx, dy = w-1-y, h-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, h-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// posterFrame lets ffmpeg pick a representative frame from the start of the video
+func (s *Service) posterFrame(ctx context.Context, meta *catalog.FileMeta) (image.Image, error) {
+	input := "pipe:0"
+	var stdin io.ReadCloser
+	if local, ok := s.backend.(*storage.Local); ok {
+		p, err := local.Path(meta.Path)
+		if err != nil {
+			return nil, err
+		}
+		input = p
+	} else {
+		// Remote objects are streamed; formats that need seeking may fail
+		r, err := s.backend.Get(ctx, meta.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		stdin = r
+	}
+
+	cmd := exec.CommandContext(ctx, s.ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-i", input,
+		"-vf", "thumbnail", "-frames:v", "1",
+		"-f", "image2pipe", "-c:v", "png", "pipe:1")
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	img, err := png.Decode(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode video frame: %w", err)
+	}
+	return img, nil
+}
+
+// scale fits src into a size x size box, keeping the aspect ratio of the
+// original bounds. Images are never enlarged. Transparent areas become white
+// since thumbnails are stored as JPEG.
+func scale(src image.Image, original image.Rectangle, size int, scaler draw.Interpolator) image.Image {
+	w, h := original.Dx(), original.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	scaler.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// save writes the thumbnail next to its final name and renames it, so readers
+// never see a partial file
+func (s *Service) save(target string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: s.quality})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func baseMimeType(mimeType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+}
@@ -0,0 +1,279 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/easy-sync/easy-sync/pkg/upload"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+// newTestService returns a thumbnail service with sizes 64 and 128 and no
+// video support
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Thumbnails.Sizes = []int{128, 64}
+	cfg.Thumbnails.Video = false
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := upload.NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewService(cfg, logger, index, backend, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// storeImage stores a w x h PNG as file id
+func storeImage(t *testing.T, s *Service, id string, w, h int) *catalog.FileMeta {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return storeFile(t, s, id, "image/png", buf.Bytes())
+}
+
+func storeFile(t *testing.T, s *Service, id, mimeType string, content []byte) *catalog.FileMeta {
+	t.Helper()
+	key := id + ".bin"
+	if err := s.backend.Put(context.Background(), key, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	meta := &catalog.FileMeta{
+		ID:       id,
+		Name:     key,
+		Path:     key,
+		Size:     int64(len(content)),
+		MimeType: mimeType,
+		SHA256:   "digest-" + id,
+		Created:  time.Now(),
+	}
+	if err := s.index.Save(meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func getThumbnail(s *Service, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	s.HandleThumbnail(w, r)
+	return w
+}
+
+func TestSize(t *testing.T) {
+	s := newTestService(t)
+	tests := []struct {
+		requested int
+		expect    int
+	}{
+		{0, 128}, // first configured size
+		{1, 64},
+		{64, 64},
+		{65, 128},
+		{128, 128},
+		{4000, 128},
+	}
+	for _, tt := range tests {
+		if got := s.Size(tt.requested); got != tt.expect {
+			t.Errorf("Size(%d) = %d, want %d", tt.requested, got, tt.expect)
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	tests := []struct {
+		w, h, size       int
+		expectW, expectH int
+	}{
+		{400, 200, 100, 100, 50},
+		{200, 400, 100, 50, 100},
+		{1000, 1, 100, 100, 1},
+		{50, 30, 100, 50, 30}, // never enlarged
+	}
+	for _, tt := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+		got := scale(src, src.Bounds(), tt.size, draw.BiLinear).Bounds()
+		if got.Dx() != tt.expectW || got.Dy() != tt.expectH {
+			t.Errorf("%dx%d into %d: got %dx%d, want %dx%d", tt.w, tt.h, tt.size, got.Dx(), got.Dy(), tt.expectW, tt.expectH)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1 image with a red pixel on the left
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red := color.RGBA{R: 255, A: 255}
+	src.Set(0, 0, red)
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		redX, redY  int
+	}{
+		{1, 2, 1, 0, 0},
+		{2, 2, 1, 1, 0},
+		{3, 2, 1, 1, 0},
+		{6, 1, 2, 0, 0},
+		{8, 1, 2, 0, 1},
+	}
+	for _, tt := range tests {
+		img := orient(src, tt.orientation)
+		b := img.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if r, _, _, _ := img.At(tt.redX, tt.redY).RGBA(); r != 0xffff {
+			t.Errorf("orientation %d: red pixel not at %d,%d", tt.orientation, tt.redX, tt.redY)
+		}
+	}
+}
+
+func TestHandleThumbnail(t *testing.T) {
+	s := newTestService(t)
+	storeImage(t, s, "photo", 400, 200)
+	storeFile(t, s, "notes", "text/plain", []byte("not an image"))
+	storeFile(t, s, "broken", "image/png", []byte("not a png"))
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		width  int
+	}{
+		{"default size", "/files/photo/thumbnail", http.StatusOK, 128},
+		{"smaller size", "/files/photo/thumbnail?size=50", http.StatusOK, 64},
+		{"larger size", "/files/photo/thumbnail?size=100", http.StatusOK, 128},
+		{"above the largest size", "/files/photo/thumbnail?size=2000", http.StatusOK, 128},
+		{"invalid size", "/files/photo/thumbnail?size=big", http.StatusBadRequest, 0},
+		{"negative size", "/files/photo/thumbnail?size=-1", http.StatusBadRequest, 0},
+		{"unknown file", "/files/missing/thumbnail", http.StatusNotFound, 0},
+		{"unsupported type", "/files/notes/thumbnail", http.StatusUnsupportedMediaType, 0},
+		{"undecodable image", "/files/broken/thumbnail", http.StatusInternalServerError, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := getThumbnail(s, tt.target, nil)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+				t.Errorf("Content-Type %s", ct)
+			}
+			img, err := jpeg.Decode(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.width/2 {
+				t.Errorf("thumbnail %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.width/2)
+			}
+		})
+	}
+}
+
+func TestThumbnailCache(t *testing.T) {
+	s := newTestService(t)
+	meta := storeImage(t, s, "photo", 400, 200)
+
+	w := getThumbnail(s, "/files/photo/thumbnail?size=64", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag != `"digest-photo-64"` {
+		t.Errorf("ETag %s", etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "private, max-age=604800" {
+		t.Errorf("Cache-Control %s", cc)
+	}
+
+	// All sizes are rendered at once and cached
+	for _, size := range []int{64, 128} {
+		if _, err := os.Stat(s.path("photo", size)); err != nil {
+			t.Errorf("size %d not cached: %v", size, err)
+		}
+	}
+	cached, err := os.ReadFile(s.path("photo", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is served without reading the source again
+	if err := s.backend.Delete(context.Background(), meta.Path); err != nil {
+		t.Fatal(err)
+	}
+	w = getThumbnail(s, "/files/photo/thumbnail?size=64", nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), cached) {
+		t.Errorf("cached thumbnail not served: status %d", w.Code)
+	}
+
+	w = getThumbnail(s, "/files/photo/thumbnail?size=64", http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", w.Code)
+	}
+	w = getThumbnail(s, "/files/photo/thumbnail?size=128", http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusOK {
+		t.Errorf("ETag of another size matched: status %d", w.Code)
+	}
+
+	s.Remove("photo")
+	if _, err := os.Stat(s.path("photo", 64)); !os.IsNotExist(err) {
+		t.Errorf("thumbnail left after Remove: %v", err)
+	}
+	s.Remove("../" + DirName)
+	if _, err := os.Stat(s.dir); err != nil {
+		t.Errorf("Remove escaped the file directory: %v", err)
+	}
+}
+
+func TestThumbnailsDisabled(t *testing.T) {
+	s := newTestService(t)
+	storeImage(t, s, "photo", 40, 20)
+	s.sizes = nil
+
+	if w := getThumbnail(s, "/files/photo/thumbnail", nil); w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/sirupsen/logrus"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// Folder and multi-file transfers use these upload metadata keys:
+//
+//	relativePath  path of the file inside the sent folder, e.g. "Photos/2026-10/IMG_0001.jpg"
+//	batchId       client generated ID shared by all files of one transfer
+//	batchName     optional display name, defaults to the top folder of relativePath
+//	batchTotal    optional number of files in the transfer
+//	batchSize     optional total bytes of the transfer
+
+var (
+	ErrInvalidBatchID = handler.NewError("ERR_INVALID_BATCH_ID", "batchId must be 1-64 characters of A-Z, a-z, 0-9, '-' or '_'", http.StatusBadRequest)
+	ErrForeignBatch   = handler.NewError("ERR_FOREIGN_BATCH", "batch belongs to another device", http.StatusForbidden)
+)
+
+// batchName returns the display name of the transfer an upload belongs to
+func batchName(metadata handler.MetaData) string {
+	if name := metadata["batchName"]; name != "" {
+		return name
+	}
+
+	relative := SanitizeRelativePath(metadata["relativePath"])
+	if top, _, nested := strings.Cut(relative, "/"); nested {
+		return top
+	}
+	return ""
+}
+
+// registerBatchUpload counts a new upload of the batch named in its
+// metadata. A batch belongs to the device that started it, deviceID being
+// the paired device of the upload or "" for an anonymous one; uploads from
+// anyone else are refused with ErrForeignBatch.
+func (s *FileStore) registerBatchUpload(info handler.FileInfo, deviceID string) error {
+	batchID := info.MetaData["batchId"]
+
+	_, err := s.index.UpdateBatch(batchID, func(b *catalog.Batch) error {
+		if b.Updated.IsZero() {
+			// Never saved, the upload starts the batch
+			b.DeviceID = deviceID
+		} else if b.DeviceID != deviceID {
+			return ErrForeignBatch
+		}
+
+		b.Pending++
+		if b.Device == "" {
+			b.Device = deviceFromMeta(info.MetaData)
+		}
+		if b.Name == "" {
+			b.Name = batchName(info.MetaData)
+		}
+		if total, err := strconv.Atoi(info.MetaData["batchTotal"]); err == nil && total > 0 {
+			b.ExpectedFiles = total
+		}
+		if size, err := strconv.ParseInt(info.MetaData["batchSize"], 10, 64); err == nil && size > 0 {
+			b.ExpectedSize = size
+		}
+		return nil
+	})
+	if errors.Is(err, ErrForeignBatch) {
+		s.logger.WithFields(logrus.Fields{
+			"batch_id": batchID,
+			"device":   deviceID,
+		}).Warn("Upload to a batch of another device rejected")
+		return err
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("batch_id", batchID).Warn("Failed to register batch upload")
+	}
+	return nil
+}
+
+func (s *FileStore) completeBatchUpload(meta *catalog.FileMeta) {
+	batch, err := s.index.UpdateBatch(meta.BatchID, func(b *catalog.Batch) error {
+		if b.Pending > 0 {
+			b.Pending--
+		}
+		b.FileCount++
+		b.TotalSize += meta.Size
+		b.Files = append(b.Files, meta.ID)
+		if b.Name == "" && meta.RelativePath != "" {
+			b.Name = path.Dir(meta.RelativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.WithError(err).WithField("batch_id", meta.BatchID).Warn("Failed to update batch")
+		return
+	}
+
+	if batch.State == catalog.BatchCompleted {
+		s.logger.WithFields(logrus.Fields{
+			"batch_id": batch.ID,
+			"files":    batch.FileCount,
+			"size":     batch.TotalSize,
+		}).Infof("Transfer completed: %s", batch.Label)
+	}
+}
+
+func (s *FileStore) terminateBatchUpload(batchID string) {
+	_, err := s.index.UpdateBatch(batchID, func(b *catalog.Batch) error {
+		if b.Pending > 0 {
+			b.Pending--
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.WithError(err).WithField("batch_id", batchID).Warn("Failed to update batch")
+	}
+}
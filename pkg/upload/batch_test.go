@@ -0,0 +1,177 @@
+package upload
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// batchUpload starts the upload of relativePath as part of batch
+func batchUpload(t *testing.T, h *TusHandler, device, batch, relativePath string, size int64) (*FileUpload, error) {
+	t.Helper()
+	return createUploadWith(h, device, handler.MetaData{
+		"filename":     path.Base(relativePath),
+		"relativePath": relativePath,
+		"batchId":      batch,
+		"batchTotal":   "3",
+		"device":       "phone",
+	}, size)
+}
+
+// finish writes content to upload and completes it
+func finish(t *testing.T, h *TusHandler, upload *FileUpload, content string) *catalog.FileMeta {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := upload.WriteChunk(ctx, 0, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.FinishUpload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := h.store.index.Get(upload.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func getBatch(t *testing.T, h *TusHandler, id string) *catalog.Batch {
+	t.Helper()
+	batch, err := h.store.index.GetBatch(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return batch
+}
+
+func TestBatchCounters(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+
+	var uploads []*FileUpload
+	for _, rel := range []string{"Photos/a.jpg", "Photos/b.jpg", "Photos/2026/c.jpg"} {
+		upload, err := batchUpload(t, h, "phone-id", "trip", rel, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploads = append(uploads, upload)
+	}
+
+	batch := getBatch(t, h, "trip")
+	if batch.Pending != 3 || batch.FileCount != 0 || batch.State != catalog.BatchInProgress {
+		t.Errorf("after creation: %+v", batch)
+	}
+	if batch.DeviceID != "phone-id" || batch.Name != "Photos" || batch.ExpectedFiles != 3 {
+		t.Errorf("batch details: %+v", batch)
+	}
+
+	a := finish(t, h, uploads[0], "aaaaa")
+	c := finish(t, h, uploads[2], "ccccc")
+	batch = getBatch(t, h, "trip")
+	if batch.Pending != 1 || batch.FileCount != 2 || batch.TotalSize != 10 || batch.State != catalog.BatchInProgress {
+		t.Errorf("after two files: %+v", batch)
+	}
+	if a.Path != "Photos/a.jpg" || c.Path != "Photos/2026/c.jpg" || batch.Root != "Photos" {
+		t.Errorf("placed at %s and %s below %s", a.Path, c.Path, batch.Root)
+	}
+	if a.BatchID != "trip" || a.RelativePath != "Photos/a.jpg" {
+		t.Errorf("file record %+v", a)
+	}
+
+	// A cancelled upload no longer holds the batch open, but the expected
+	// file count does
+	if err := uploads[1].Terminate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	batch = getBatch(t, h, "trip")
+	if batch.Pending != 0 || batch.FileCount != 2 || batch.State != catalog.BatchInProgress || batch.Label != "Photos (2 files)" {
+		t.Errorf("after a cancelled upload: %+v", batch)
+	}
+
+	// The missing file is sent again
+	upload, err := batchUpload(t, h, "phone-id", "trip", "Photos/b.jpg", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := finish(t, h, upload, "bbbbb")
+	batch = getBatch(t, h, "trip")
+	if batch.FileCount != 3 || batch.State != catalog.BatchCompleted || b.Path != "Photos/b.jpg" {
+		t.Errorf("after all files: %+v, placed at %s", batch, b.Path)
+	}
+}
+
+func TestBatchRootReservation(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+
+	// Taken by an earlier transfer
+	if err := h.store.backend.Put(ctx, "Photos/old.jpg", strings.NewReader("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := batchUpload(t, h, "", "first", "Photos/a.jpg", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := batchUpload(t, h, "", "second", "Photos/a.jpg", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, err := batchUpload(t, h, "", "first", "Photos/b.jpg", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each transfer gets its own folder, reserved with its first file
+	if meta := finish(t, h, first, "a"); meta.Path != "Photos (1)/a.jpg" {
+		t.Errorf("first transfer placed at %s", meta.Path)
+	}
+	if meta := finish(t, h, second, "a"); meta.Path != "Photos (2)/a.jpg" {
+		t.Errorf("second transfer placed at %s", meta.Path)
+	}
+	if meta := finish(t, h, more, "b"); meta.Path != "Photos (1)/b.jpg" {
+		t.Errorf("second file of the first transfer placed at %s", meta.Path)
+	}
+	if root := getBatch(t, h, "second").Root; root != "Photos (2)" {
+		t.Errorf("second transfer reserved %s", root)
+	}
+}
+
+func TestBatchBoundToDevice(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string // device that starts the batch, "" for anonymous
+		device string
+		err    string
+	}{
+		{"same device", "phone-id", "phone-id", ""},
+		{"other device", "phone-id", "laptop-id", ErrForeignBatch.ErrorCode},
+		{"anonymous upload", "phone-id", "", ErrForeignBatch.ErrorCode},
+		{"anonymous batch", "", "", ""},
+		{"paired device joining an anonymous batch", "", "phone-id", ErrForeignBatch.ErrorCode},
+	}
+	for _, tt := range tests {
+		h := newTestHandler(t, nil)
+		if _, err := batchUpload(t, h, tt.owner, "trip", "Photos/a.jpg", 1); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := batchUpload(t, h, tt.device, "trip", "Photos/b.jpg", 1)
+		if got := errorCode(err); got != tt.err || (tt.err == "" && err != nil) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+
+		batch := getBatch(t, h, "trip")
+		want := 2
+		if tt.err != "" {
+			want = 1
+		}
+		if batch.Pending != want || batch.DeviceID != tt.owner {
+			t.Errorf("%s: batch %+v", tt.name, batch)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// placeContent stores a finished upload at target. With deduplication
+// enabled, content that is already stored is linked from the blob store and
+// src is dropped; new content is linked into the blob store so later uploads
+// can share it. It returns the final relative path and whether the content
+// was already stored.
+func (s *FileStore) placeContent(ctx context.Context, src, target, sum string, size int64, id string) (string, bool, error) {
+	if !s.dedup {
+		rel, err := s.placeFile(ctx, src, target)
+		return rel, false, err
+	}
+
+	linker := s.backend.(storage.Linker)
+	blobKey := catalog.BlobKey(sum)
+
+	if _, err := s.lookupBlob(ctx, sum); err == nil {
+		rel, err := s.placeWith(ctx, target, func(key string) error { return linker.Link(ctx, blobKey, key) })
+		if err == nil {
+			if err := os.Remove(src); err != nil {
+				s.logger.WithError(err).Warn("Failed to remove duplicate upload")
+			}
+			if err := s.index.AddBlobRef(sum, size, id); err != nil {
+				s.logger.WithError(err).Warn("Failed to record blob reference")
+			}
+			return rel, true, nil
+		}
+		// The blob may have been released meanwhile; store the upload itself
+		s.logger.WithError(err).Debug("Failed to link stored blob")
+	}
+
+	rel, err := s.placeFile(ctx, src, target)
+	if err != nil {
+		return "", false, err
+	}
+
+	// Keep a content addressed link; without hard link support on the
+	// filesystem the file is simply stored without deduplication
+	if err := s.backend.Delete(ctx, blobKey); err != nil {
+		s.logger.WithError(err).Warn("Failed to remove stale blob")
+		return rel, false, nil
+	}
+	if err := linker.Link(ctx, rel, blobKey); err != nil {
+		s.logger.WithError(err).Debug("Hard links unsupported, file stored without deduplication")
+		return rel, false, nil
+	}
+	if err := s.index.AddBlobRef(sum, size, id); err != nil {
+		s.logger.WithError(err).Warn("Failed to record blob reference")
+	}
+	return rel, false, nil
+}
+
+// lookupBlob returns the blob record for content that is still stored
+func (s *FileStore) lookupBlob(ctx context.Context, sum string) (*catalog.Blob, error) {
+	blob, err := s.index.GetBlob(sum)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.backend.Stat(ctx, catalog.BlobKey(sum)); err != nil {
+		if errors.Is(err, storage.ErrNotExist) {
+			return nil, catalog.ErrNotFound
+		}
+		return nil, err
+	}
+	return blob, nil
+}
+
+// LookupBlob returns the blob stored for a SHA-256 digest. catalog.ErrNotFound
+// is returned when the content is unknown or deduplication is unavailable.
+func (h *TusHandler) LookupBlob(ctx context.Context, sum string) (*catalog.Blob, error) {
+	if !h.store.dedup {
+		return nil, catalog.ErrNotFound
+	}
+	return h.store.lookupBlob(ctx, sum)
+}
+
+// CreateFromBlob adds a file whose content the server already stores, so a
+// client that knows the SHA-256 of a file can skip sending its bytes. The
+// metadata uses the same keys as a TUS upload. catalog.ErrNotFound is
+// returned when the content is unknown.
+func (h *TusHandler) CreateFromBlob(ctx context.Context, sum string, metadata handler.MetaData) (*catalog.FileMeta, error) {
+	s := h.store
+	blob, err := h.LookupBlob(ctx, sum)
+	if err != nil {
+		return nil, err
+	}
+
+	info := handler.FileInfo{
+		ID:       uuid.New().String(),
+		Size:     blob.Size,
+		Offset:   blob.Size,
+		MetaData: withContextDevice(ctx, metadata),
+	}
+	device, _ := security.DeviceFromContext(ctx)
+
+	fileName := info.MetaData["filename"]
+	if fileName == "" {
+		fileName = info.ID
+	}
+
+	batchID := info.MetaData["batchId"]
+	if batchID != "" && !catalog.ValidBatchID(batchID) {
+		return nil, ErrInvalidBatchID
+	}
+
+	s.quotaMu.Lock()
+	err = s.checkQuota(device, "", blob.Size, true)
+	s.quotaMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if batchID != "" {
+		if err := s.registerBatchUpload(info, device); err != nil {
+			return nil, err
+		}
+	}
+
+	u := &FileUpload{
+		id:        info.ID,
+		fileName:  fileName,
+		size:      blob.Size,
+		offset:    blob.Size,
+		info:      info,
+		device:    device,
+		store:     s,
+		createdAt: time.Now(),
+	}
+
+	blobKey := catalog.BlobKey(sum)
+	mimeType := s.detectStoredMimeType(ctx, blobKey, fileName, info.MetaData["filetype"])
+	photo, err := s.storedPhotoMeta(ctx, blobKey, mimeType)
+	if err != nil {
+		if batchID != "" {
+			s.terminateBatchUpload(batchID)
+		}
+		return nil, err
+	}
+
+	s.events.emit(u.event(EventCreated))
+
+	target, err := u.targetPath(ctx, sum)
+	if err == nil {
+		var relPath string
+		relPath, err = s.placeWith(ctx, target, func(key string) error { return s.backend.(storage.Linker).Link(ctx, blobKey, key) })
+		if err == nil {
+			meta := u.fileMeta(relPath, mimeType, sum)
+			meta.Photo = photo
+			if err := s.index.AddBlobRef(sum, blob.Size, meta.ID); err != nil {
+				s.logger.WithError(err).Warn("Failed to record blob reference")
+			}
+			if err := s.index.Save(meta); err != nil {
+				return nil, err
+			}
+			if batchID != "" {
+				s.completeBatchUpload(meta)
+			}
+
+			s.logger.WithFields(logrus.Fields{
+				"upload_id": meta.ID,
+				"filename":  fileName,
+				"path":      relPath,
+				"sha256":    sum,
+			}).Info("Upload completed from stored content")
+
+			event := u.event(EventCompleted)
+			event.File = meta
+			s.events.emit(event)
+			return meta, nil
+		}
+	}
+
+	if batchID != "" {
+		s.terminateBatchUpload(batchID)
+	}
+	event := u.event(EventFailed)
+	event.Error = err.Error()
+	s.events.emit(event)
+	return nil, err
+}
+
+// detectStoredMimeType sniffs the MIME type of a stored object
+func (s *FileStore) detectStoredMimeType(ctx context.Context, key, fileName, hint string) string {
+	r, err := s.backend.GetRange(ctx, key, 0, mimeSniffBytes)
+	if err != nil {
+		s.logger.WithError(err).Debug("Failed to read stored content for type detection")
+		return refineMimeType("application/octet-stream", fileName, hint)
+	}
+	defer r.Close()
+	return DetectMimeTypeReader(r, fileName, hint)
+}
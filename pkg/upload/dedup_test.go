@@ -0,0 +1,177 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadFile uploads content as fileName from device
+func uploadFile(t *testing.T, h *TusHandler, device, fileName, content string) *catalog.FileMeta {
+	t.Helper()
+	upload, err := createUploadWith(h, device, handler.MetaData{"filename": fileName}, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return finish(t, h, upload, content)
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	infoA, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+func TestDedupSharesBlob(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+	dir := h.config.Storage.UploadDir
+	content := "identical content"
+	sum := sha256Hex(content)
+	blobPath := filepath.Join(dir, filepath.FromSlash(catalog.BlobKey(sum)))
+
+	a := uploadFile(t, h, "phone", "a.txt", content)
+	b := uploadFile(t, h, "laptop", "b.txt", content)
+	if a.SHA256 != sum || b.SHA256 != sum {
+		t.Fatalf("digests %s and %s, want %s", a.SHA256, b.SHA256, sum)
+	}
+
+	blob, err := h.LookupBlob(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Size != int64(len(content)) || len(blob.Refs) != 2 || blob.Refs[0] != a.ID || blob.Refs[1] != b.ID {
+		t.Errorf("blob %+v, want references to %s and %s", blob, a.ID, b.ID)
+	}
+	if !sameFile(t, filepath.Join(dir, a.Path), blobPath) || !sameFile(t, filepath.Join(dir, b.Path), blobPath) {
+		t.Error("uploads do not share the stored blob")
+	}
+
+	// Deleting one file keeps the blob for the other
+	if err := os.Remove(filepath.Join(dir, a.Path)); err != nil {
+		t.Fatal(err)
+	}
+	last, err := h.store.index.ReleaseBlob(sum, a.ID)
+	if err != nil || last {
+		t.Fatalf("release of first reference: last=%v, err=%v", last, err)
+	}
+	if _, err := h.LookupBlob(ctx, sum); err != nil {
+		t.Errorf("blob lost after first delete: %v", err)
+	}
+
+	// A third upload still links to it
+	c := uploadFile(t, h, "phone", "c.txt", content)
+	if !sameFile(t, filepath.Join(dir, c.Path), blobPath) {
+		t.Error("later upload not linked to the stored blob")
+	}
+
+	// Releasing the last references drops the record
+	for _, id := range []string{b.ID, c.ID} {
+		last, err = h.store.index.ReleaseBlob(sum, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !last {
+		t.Error("last release not reported")
+	}
+	if _, err := h.store.index.GetBlob(sum); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("blob record after last release: %v", err)
+	}
+}
+
+func TestDedupReplacesReleasedBlob(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+	content := "stored twice"
+	sum := sha256Hex(content)
+
+	a := uploadFile(t, h, "phone", "a.txt", content)
+	// The stored blob disappears while its record is still there
+	if err := h.store.backend.Delete(ctx, catalog.BlobKey(sum)); err != nil {
+		t.Fatal(err)
+	}
+
+	b := uploadFile(t, h, "phone", "b.txt", content)
+	if b.Path == a.Path {
+		t.Fatalf("second upload stored at %s as well", b.Path)
+	}
+	blob, err := h.LookupBlob(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := h.config.Storage.UploadDir
+	if !sameFile(t, filepath.Join(dir, b.Path), filepath.Join(dir, filepath.FromSlash(catalog.BlobKey(sum)))) {
+		t.Error("blob not recreated from the new upload")
+	}
+	if len(blob.Refs) != 2 {
+		t.Errorf("references %v", blob.Refs)
+	}
+}
+
+func TestCreateFromBlob(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := security.WithDevice(context.Background(), "laptop", "Laptop")
+	content := "known content"
+	sum := sha256Hex(content)
+
+	if _, err := h.CreateFromBlob(ctx, sum, handler.MetaData{"filename": "copy.txt"}); !errors.Is(err, catalog.ErrNotFound) {
+		t.Fatalf("unknown hash: %v", err)
+	}
+	if files, _ := h.store.index.List(); len(files) != 0 {
+		t.Errorf("unknown hash created %d files", len(files))
+	}
+
+	a := uploadFile(t, h, "phone", "a.txt", content)
+	meta, err := h.CreateFromBlob(ctx, sum, handler.MetaData{"filename": "copy.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.SHA256 != sum || meta.Size != int64(len(content)) || meta.DeviceID != "laptop" || meta.Path == a.Path {
+		t.Errorf("created %+v", meta)
+	}
+	data, err := os.ReadFile(filepath.Join(h.config.Storage.UploadDir, meta.Path))
+	if err != nil || string(data) != content {
+		t.Errorf("content %q, %v", data, err)
+	}
+
+	blob, err := h.LookupBlob(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blob.Refs) != 2 || blob.Refs[1] != meta.ID {
+		t.Errorf("references %v, want %s added", blob.Refs, meta.ID)
+	}
+}
+
+func TestCreateFromBlobWithoutDedup(t *testing.T) {
+	h := newTestHandler(t, func(cfg *config.Config) { cfg.Storage.Dedup = false })
+	content := "not shared"
+	uploadFile(t, h, "phone", "a.txt", content)
+
+	_, err := h.CreateFromBlob(context.Background(), sha256Hex(content), handler.MetaData{"filename": "copy.txt"})
+	if !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
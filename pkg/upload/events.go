@@ -0,0 +1,212 @@
+package upload
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/sirupsen/logrus"
+)
+
+// EventType identifies a step in the life of an upload
+type EventType string
+
+const (
+	EventCreated    EventType = "created"
+	EventProgress   EventType = "progress"
+	EventCompleted  EventType = "completed"
+	EventTerminated EventType = "terminated"
+	EventFailed     EventType = "failed" // a chunk or the completion failed; the client may resume
+)
+
+// progressInterval is the minimum time between progress events of one upload
+const progressInterval = 500 * time.Millisecond
+
+// Event describes a change of an upload. File is only set once the upload
+// has completed.
+type Event struct {
+	Type       EventType         `json:"type"`
+	UploadID   string            `json:"upload_id"`
+	FileName   string            `json:"file_name"`
+	Size       int64             `json:"size"` // -1 while the length is deferred
+	Offset     int64             `json:"offset"`
+	Device     string            `json:"device"`              // device label from the upload metadata
+	DeviceID   string            `json:"device_id,omitempty"` // paired device that created the upload, empty without a token
+	DeviceName string            `json:"device_name,omitempty"`
+	MetaData   map[string]string `json:"metadata,omitempty"`
+	File       *catalog.FileMeta `json:"file,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// Listener receives upload events. It is called synchronously and must not block.
+type Listener func(Event)
+
+// events fans upload events out to listeners and throttles progress events
+type events struct {
+	mu           sync.RWMutex
+	listeners    []Listener
+	lastProgress map[string]time.Time
+}
+
+func newEvents() *events {
+	return &events{lastProgress: make(map[string]time.Time)}
+}
+
+func (e *events) subscribe(l Listener) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.listeners = append(e.listeners, l)
+}
+
+func (e *events) emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	e.mu.Lock()
+	switch event.Type {
+	case EventProgress:
+		if last, ok := e.lastProgress[event.UploadID]; ok && event.Time.Sub(last) < progressInterval {
+			e.mu.Unlock()
+			return
+		}
+		e.lastProgress[event.UploadID] = event.Time
+	case EventCreated:
+		// Forget uploads that were abandoned without finishing
+		for id, last := range e.lastProgress {
+			if event.Time.Sub(last) > time.Hour {
+				delete(e.lastProgress, id)
+			}
+		}
+	case EventCompleted, EventTerminated:
+		delete(e.lastProgress, event.UploadID)
+	}
+	listeners := e.listeners
+	e.mu.Unlock()
+
+	for _, l := range listeners {
+		l(event)
+	}
+}
+
+// EventQueue buffers upload events for a consumer running in its own
+// goroutine, so a slow consumer never holds up uploads. Progress events are
+// dropped once half of the queue is taken, other events only when it is
+// full, which is logged.
+type EventQueue struct {
+	name   string
+	size   int
+	logger *logrus.Logger
+	mu     sync.Mutex
+	events []Event
+	ready  chan struct{}
+}
+
+// NewEventQueue returns a queue holding up to size events; name tells the
+// queue apart in logs
+func NewEventQueue(name string, size int, logger *logrus.Logger) *EventQueue {
+	return &EventQueue{name: name, size: size, logger: logger, ready: make(chan struct{}, 1)}
+}
+
+// Push adds an event without blocking, it is meant to be passed to Subscribe
+func (q *EventQueue) Push(event Event) {
+	limit := q.size
+	if event.Type == EventProgress {
+		limit = q.size / 2
+	}
+
+	q.mu.Lock()
+	full := len(q.events) >= limit
+	if !full {
+		q.events = append(q.events, event)
+	}
+	q.mu.Unlock()
+
+	if full {
+		// A later progress event supersedes a dropped one
+		if event.Type != EventProgress {
+			q.logger.WithFields(logrus.Fields{
+				"queue":     q.name,
+				"event":     event.Type,
+				"upload_id": event.UploadID,
+			}).Warn("Upload event queue full, event dropped")
+		}
+		return
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Run hands the queued events to fn one at a time, in the order they were
+// pushed. It does not return.
+func (q *EventQueue) Run(fn func(Event)) {
+	for range q.ready {
+		for {
+			q.mu.Lock()
+			if len(q.events) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			event := q.events[0]
+			q.events[0] = Event{}
+			q.events = q.events[1:]
+			q.mu.Unlock()
+
+			fn(event)
+		}
+	}
+}
+
+// Subscribe registers a listener for upload events
+func (h *TusHandler) Subscribe(l Listener) {
+	h.store.events.subscribe(l)
+}
+
+// event builds an event for the upload's current state
+func (u *FileUpload) event(typ EventType) Event {
+	return Event{
+		Type:       typ,
+		UploadID:   u.id,
+		FileName:   u.fileName,
+		Size:       u.size,
+		Offset:     u.offset,
+		Device:     u.getDeviceFromMeta(),
+		DeviceID:   u.device,
+		DeviceName: u.info.MetaData["device_name"],
+		MetaData:   u.info.MetaData,
+	}
+}
+
+// emitFailed reports an error while writing or completing the upload
+func (u *FileUpload) emitFailed(err error) {
+	u.mu.RLock()
+	event := u.event(EventFailed)
+	u.mu.RUnlock()
+
+	event.Error = err.Error()
+	u.store.events.emit(event)
+}
+
+// progressReader reports progress events while a chunk is written
+type progressReader struct {
+	r      io.Reader
+	upload *FileUpload
+	start  int64
+	read   int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	event := p.upload.event(EventProgress)
+	event.Offset = p.start + p.read
+	p.upload.store.events.emit(event)
+
+	return n, err
+}
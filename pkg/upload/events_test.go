@@ -0,0 +1,51 @@
+package upload
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestEventQueueDoesNotBlock(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	q := NewEventQueue("test", 4, logger)
+
+	// Nothing consumes the queue yet, as with a hook stuck on a slow webhook
+	pushed := make(chan struct{})
+	go func() {
+		for _, typ := range []EventType{EventCreated, EventProgress, EventProgress, EventProgress, EventCompleted, EventCreated, EventCompleted} {
+			q.Push(Event{Type: typ})
+		}
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push blocked on a full queue")
+	}
+
+	var got []EventType
+	done := make(chan struct{})
+	go q.Run(func(event Event) {
+		got = append(got, event.Type)
+		if len(got) == 4 {
+			close(done)
+		}
+	})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queued events not delivered, got %v", got)
+	}
+
+	// Progress stops at half the queue, the rest fills it up in order
+	want := []EventType{EventCreated, EventProgress, EventCompleted, EventCreated}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Layouts for completed uploads inside Storage.UploadDir
+const (
+	LayoutFlat   = "flat"   // <name>
+	LayoutDevice = "device" // <device>/<name>
+	LayoutDate   = "date"   // <yyyy-mm-dd>/<name>
+)
+
+// maxNameBytes is the common file name limit of ext4, NTFS and APFS
+const maxNameBytes = 255
+
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFileName turns a client supplied name into a single safe path
+// component. Directory parts are dropped, characters that are invalid on
+// common filesystems are replaced and names that would be hidden, reserved
+// or empty get a safe form.
+func SanitizeFileName(name string) string {
+	// Clients may send full paths with either separator
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = path.Base(name)
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+
+	// Windows silently strips trailing dots and spaces
+	name = strings.TrimRight(name, ". ")
+	name = strings.TrimLeft(name, " ")
+	// Leading dots would hide the file or form "." and ".."
+	name = strings.TrimLeft(name, ".")
+
+	if name == "" {
+		return "file"
+	}
+
+	stem := strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	if reservedWindowsNames[stem] {
+		name = "_" + name
+	}
+
+	return truncateName(name, maxNameBytes)
+}
+
+// truncateName shortens name to at most max bytes, keeping the extension and
+// never splitting a UTF-8 sequence
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > max/2 {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	limit := max - len(ext)
+	for limit > 0 && !utf8.RuneStart(stem[limit]) {
+		limit--
+	}
+	return stem[:limit] + ext
+}
+
+// SanitizeRelativePath cleans a client supplied relative path such as
+// "Photos/2026-10/IMG_0001.jpg". Every segment is sanitized and "." and ".."
+// segments are dropped, so the result can never leave the directory it is
+// joined to. An empty string is returned when nothing usable remains.
+func SanitizeRelativePath(relPath string) string {
+	relPath = strings.ReplaceAll(relPath, `\`, "/")
+
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(relPath, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, SanitizeFileName(segment))
+	}
+	return strings.Join(segments, "/")
+}
+
+// layoutDir returns the folder the configured layout assigns to the upload
+func (u *FileUpload) layoutDir() string {
+	switch u.store.config.Storage.Layout {
+	case LayoutDevice:
+		device := u.info.MetaData["device_name"]
+		if device == "" {
+			device = u.getDeviceFromMeta()
+		}
+		return SanitizeFileName(device)
+	case LayoutDate:
+		return u.createdAt.Format("2006-01-02")
+	default:
+		return ""
+	}
+}
+
+// Placer chooses where a completed upload is stored in place of the
+// configured layout. It is given the upload and the SHA-256 of its content
+// and returns a path relative to the upload directory, or "" to leave the
+// upload to the layout. An error fails the upload.
+type Placer func(ctx context.Context, upload Event, sha256 string) (string, error)
+
+// HandlePlacement registers the placer consulted for every completed upload
+func (h *TusHandler) HandlePlacement(p Placer) {
+	h.store.placeMu.Lock()
+	defer h.store.placeMu.Unlock()
+
+	h.store.placer = p
+}
+
+// targetPath returns where the completed upload should be placed, relative
+// to the upload directory and using forward slashes. Uploads with a relative
+// path recreate their directory tree; within a batch the top folder is
+// resolved once so a resent folder does not merge into an existing one.
+func (u *FileUpload) targetPath(ctx context.Context, sum string) (string, error) {
+	u.store.placeMu.Lock()
+	placer := u.store.placer
+	u.store.placeMu.Unlock()
+
+	if placer != nil {
+		target, err := placer(ctx, u.event(EventCompleted), sum)
+		if err != nil || target != "" {
+			return target, err
+		}
+	}
+
+	dir := u.layoutDir()
+
+	relative := SanitizeRelativePath(u.info.MetaData["relativePath"])
+	if relative == "" {
+		return path.Join(dir, SanitizeFileName(u.fileName)), nil
+	}
+
+	batchID := u.info.MetaData["batchId"]
+	top, rest, nested := strings.Cut(relative, "/")
+	if batchID == "" || !nested {
+		return path.Join(dir, relative), nil
+	}
+
+	root, err := u.store.batchRoot(ctx, batchID, path.Join(dir, top))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(root, rest), nil
+}
+
+// batchRoot returns the folder a batch's top directory was placed in,
+// reserving a free name on first use
+func (s *FileStore) batchRoot(ctx context.Context, batchID, wanted string) (string, error) {
+	s.placeMu.Lock()
+	defer s.placeMu.Unlock()
+
+	if batch, err := s.index.GetBatch(batchID); err == nil && batch.Root != "" {
+		return batch.Root, nil
+	}
+
+	// Folders reserved by batches that have not stored a file yet
+	reserved := make(map[string]bool)
+	batches, err := s.index.ListBatches()
+	if err != nil {
+		return "", err
+	}
+	for _, b := range batches {
+		if b.Root != "" {
+			reserved[b.Root] = true
+		}
+	}
+
+	parent, name := path.Split(wanted)
+	for i := 0; i < 10000; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)", name, i)
+		}
+
+		rel := path.Join(parent, candidate)
+		if reserved[rel] {
+			continue
+		}
+		if taken, err := storage.Exists(ctx, s.backend, rel); err != nil {
+			return "", err
+		} else if taken {
+			continue
+		}
+
+		batch, err := s.index.UpdateBatch(batchID, func(b *catalog.Batch) error {
+			if b.Root == "" {
+				b.Root = rel
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return batch.Root, nil
+	}
+	return "", fmt.Errorf("no free folder name for %s", wanted)
+}
+
+// placeFile stores the local file src at relPath. When the name is taken,
+// " (1)", " (2)", ... is appended before the extension. The final relative
+// path is returned.
+func (s *FileStore) placeFile(ctx context.Context, src, relPath string) (string, error) {
+	return s.placeWith(ctx, relPath, func(key string) error { return storage.PutFile(ctx, s.backend, src, key) })
+}
+
+// placeWith creates the object at a free key derived from relPath using create
+func (s *FileStore) placeWith(ctx context.Context, relPath string, create func(key string) error) (string, error) {
+	s.placeMu.Lock()
+	defer s.placeMu.Unlock()
+
+	dir, name := path.Split(relPath)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 0; i < 10000; i++ {
+		candidate := name
+		if i > 0 {
+			suffix := fmt.Sprintf(" (%d)", i)
+			candidate = truncateName(stem+suffix+ext, maxNameBytes)
+			if !strings.Contains(candidate, suffix) {
+				candidate = truncateName(stem, maxNameBytes-len(suffix)-len(ext)) + suffix + ext
+			}
+		}
+
+		rel := path.Join(dir, candidate)
+		if taken, err := storage.Exists(ctx, s.backend, rel); err != nil {
+			return "", err
+		} else if taken {
+			continue
+		}
+
+		if err := create(rel); err != nil {
+			return "", err
+		}
+		return rel, nil
+	}
+
+	return "", fmt.Errorf("no free file name for %s", relPath)
+}
+
+// Relocate moves a stored file into folder, keeping its name, and updates
+// its metadata. meta may be outdated, the current record is moved and
+// returned; catalog.ErrNotFound is returned when the file was deleted.
+func (h *TusHandler) Relocate(ctx context.Context, meta *catalog.FileMeta, folder string) (*catalog.FileMeta, error) {
+	s := h.store
+
+	current, err := s.index.Get(meta.ID)
+	if err != nil {
+		return nil, err
+	}
+	target := path.Join(SanitizeRelativePath(folder), path.Base(current.Path))
+	if target == current.Path {
+		return current, nil
+	}
+
+	rel, err := s.placeWith(ctx, target, func(key string) error { return storage.Rename(ctx, s.backend, current.Path, key) })
+	if err != nil {
+		return nil, err
+	}
+
+	moved, err := s.index.Update(meta.ID, func(m *catalog.FileMeta) error {
+		m.Path = rel
+		return nil
+	})
+	if err != nil {
+		// Deleted while it moved; trashed files keep their storage path
+		if err := storage.Rename(ctx, s.backend, rel, current.Path); err != nil {
+			s.logger.WithError(err).WithField("file_id", meta.ID).Error("Failed to move file back")
+		}
+		return nil, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"file_id": meta.ID,
+		"from":    current.Path,
+		"to":      rel,
+	}).Info("File moved")
+	return moved, nil
+}
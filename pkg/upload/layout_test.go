@@ -0,0 +1,85 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+)
+
+// completeUpload uploads content anonymously and returns its metadata
+func completeUpload(t *testing.T, h *TusHandler, content string) *catalog.FileMeta {
+	t.Helper()
+	ctx := context.Background()
+
+	upload, err := createUpload(h, "", "desktop", int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.WriteChunk(ctx, 0, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.FinishUpload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := h.store.index.Get(upload.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func TestRelocateKeepsCurrentRecord(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+	snapshot := completeUpload(t, h, "hello")
+
+	// Changed after the snapshot was taken, as a checksum job or a pin would
+	if _, err := h.store.index.Update(snapshot.ID, func(meta *catalog.FileMeta) error {
+		meta.Pinned = true
+		meta.MD5 = "5d41402abc4b2a76b9719d911017c592"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := h.Relocate(ctx, snapshot, "documents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Path != "documents/file.txt" || !moved.Pinned || moved.MD5 == "" {
+		t.Errorf("relocated record %+v lost changes", moved)
+	}
+	if saved, _ := h.store.index.Get(snapshot.ID); saved.Path != moved.Path || !saved.Pinned {
+		t.Errorf("saved record %+v differs from the returned one", saved)
+	}
+	if _, err := h.store.backend.Stat(ctx, "documents/file.txt"); err != nil {
+		t.Errorf("content not moved: %v", err)
+	}
+}
+
+func TestRelocateDeletedFile(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+	snapshot := completeUpload(t, h, "hello")
+
+	if _, err := h.store.index.MoveToTrash(snapshot.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Relocate(ctx, snapshot, "documents"); !errors.Is(err, catalog.ErrNotFound) {
+		t.Fatalf("Relocate of a trashed file: %v", err)
+	}
+	if _, err := h.store.index.Get(snapshot.ID); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("trashed file came back: %v", err)
+	}
+	if _, err := h.store.backend.Stat(ctx, snapshot.Path); err != nil {
+		t.Errorf("content of the trashed file moved: %v", err)
+	}
+	if _, err := h.store.backend.Stat(ctx, "documents/file.txt"); !errors.Is(err, storage.ErrNotExist) {
+		t.Errorf("content appeared at the target: %v", err)
+	}
+}
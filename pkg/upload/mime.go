@@ -0,0 +1,152 @@
+package upload
+
+import (
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// extraMimeTypes fills gaps in the stdlib extension registry, which only
+// knows a handful of types unless the OS ships a mime.types file
+var extraMimeTypes = map[string]string{
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".dng":  "image/x-adobe-dng",
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".3gp":  "video/3gpp",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".wav":  "audio/wav",
+	".amr":  "audio/amr",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".zip":  "application/zip",
+	".7z":   "application/x-7z-compressed",
+	".rar":  "application/vnd.rar",
+	".gz":   "application/gzip",
+	".tar":  "application/x-tar",
+	".apk":  "application/vnd.android.package-archive",
+	".ipa":  "application/octet-stream",
+	".epub": "application/epub+zip",
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+func init() {
+	for ext, typ := range extraMimeTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+}
+
+// mimeSniffBytes is how much content is read to detect a type
+const mimeSniffBytes = 3072
+
+// genericMimeTypes are sniffing results too vague to override a more
+// specific type derived from the file name
+var genericMimeTypes = []string{
+	"application/octet-stream",
+	"text/plain",
+	"application/zip",
+	"application/x-ole-storage",
+}
+
+// DetectMimeType determines the MIME type of the file at path. The content
+// is sniffed first; the extension of fileName refines generic results such as
+// a plain ZIP container; the client declared hint is only used when neither
+// gives an answer.
+func DetectMimeType(path, fileName, hint string) string {
+	sniffed := "application/octet-stream"
+	if detected, err := mimetype.DetectFile(path); err == nil {
+		sniffed = detected.String()
+	}
+	return refineMimeType(sniffed, fileName, hint)
+}
+
+// DetectMimeTypeReader is DetectMimeType for content read from r
+func DetectMimeTypeReader(r io.Reader, fileName, hint string) string {
+	sniffed := "application/octet-stream"
+	if detected, err := mimetype.DetectReader(r); err == nil {
+		sniffed = detected.String()
+	}
+	return refineMimeType(sniffed, fileName, hint)
+}
+
+func refineMimeType(sniffed, fileName, hint string) string {
+	if !isGenericMimeType(sniffed) {
+		return sniffed
+	}
+
+	byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName)))
+	if byExt != "" && extensionMatchesContent(sniffed, byExt) {
+		return byExt
+	}
+
+	if sniffed == "application/octet-stream" && validMimeType(hint) {
+		return hint
+	}
+
+	return sniffed
+}
+
+func isGenericMimeType(typ string) bool {
+	base, _, _ := mime.ParseMediaType(typ)
+	for _, generic := range genericMimeTypes {
+		if base == generic {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionMatchesContent reports whether an extension based type is
+// plausible for content that sniffed as the generic type sniffed
+func extensionMatchesContent(sniffed, byExt string) bool {
+	sniffedBase, _, _ := mime.ParseMediaType(sniffed)
+	extBase, _, _ := mime.ParseMediaType(byExt)
+
+	switch sniffedBase {
+	case "text/plain":
+		// Text content may only be refined to another textual type
+		return strings.HasPrefix(extBase, "text/") ||
+			strings.HasSuffix(extBase, "+json") || strings.HasSuffix(extBase, "+xml") ||
+			extBase == "application/json" || extBase == "application/xml" || extBase == "application/javascript"
+	case "application/zip":
+		// Many formats are ZIP containers: apk, ipa, docx, epub, ...
+		return !strings.HasPrefix(extBase, "text/")
+	default:
+		return true
+	}
+}
+
+func validMimeType(typ string) bool {
+	if typ == "" {
+		return false
+	}
+	base, _, err := mime.ParseMediaType(typ)
+	return err == nil && strings.Contains(base, "/")
+}
@@ -0,0 +1,78 @@
+package upload
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zipContent returns a ZIP archive holding one file
+func zipContent(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("classes.dex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("dex\n035\x00"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectMimeType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n")
+	text := []byte("hello, world\n")
+	binary := []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff, 0x10, 0x80}
+	archive := zipContent(t)
+
+	tests := []struct {
+		name     string
+		content  []byte
+		fileName string
+		hint     string
+		want     string
+	}{
+		// Content wins over a misleading name or hint
+		{"png", png, "photo.png", "", "image/png"},
+		{"png named txt", png, "notes.txt", "text/plain", "image/png"},
+		{"pdf without extension", pdf, "download", "", "application/pdf"},
+		{"pdf with wrong hint", pdf, "report.pdf", "image/jpeg", "application/pdf"},
+
+		// Generic content is refined by the extension
+		{"text", text, "notes.txt", "", "text/plain; charset=utf-8"},
+		{"markdown", text, "README.md", "", "text/markdown; charset=utf-8"},
+		{"csv", text, "table.csv", "", "text/csv; charset=utf-8"},
+		{"text named png", text, "fake.png", "image/png", "text/plain; charset=utf-8"},
+		{"apk", archive, "app.apk", "", "application/vnd.android.package-archive"},
+		{"zip named txt", archive, "archive.txt", "", "application/zip"},
+		{"upper case extension", archive, "APP.APK", "", "application/vnd.android.package-archive"},
+
+		// The hint is only used when nothing else is known
+		{"unknown binary", binary, "blob", "", "application/octet-stream"},
+		{"unknown binary with hint", binary, "blob", "application/x-custom", "application/x-custom"},
+		{"unknown binary with invalid hint", binary, "blob", "not a type", "application/octet-stream"},
+		{"unknown binary with extension", binary, "clip.mov", "application/x-custom", "video/quicktime"},
+		{"text ignores hint", text, "blob", "application/x-custom", "text/plain; charset=utf-8"},
+		{"empty", nil, "empty", "", "text/plain"},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		p := filepath.Join(dir, "content")
+		if err := os.WriteFile(p, tt.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := DetectMimeType(p, tt.fileName, tt.hint); got != tt.want {
+			t.Errorf("%s: DetectMimeType = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := DetectMimeTypeReader(bytes.NewReader(tt.content), tt.fileName, tt.hint); got != tt.want {
+			t.Errorf("%s: DetectMimeTypeReader = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/photo"
+)
+
+// photoHeadBytes is how much of a stored image is read for its metadata; EXIF
+// and the image header come before the image data
+const photoHeadBytes = 256 * 1024
+
+// photoMeta reads the photo metadata of a finished upload. With StripGPS the
+// location is removed from the file before it is stored, and not recorded.
+func (s *FileStore) photoMeta(filePath, mimeType string) (*catalog.PhotoMeta, error) {
+	if (!s.config.Photos.Exif && !s.config.Photos.StripGPS) || !photo.Supported(mimeType) {
+		return nil, nil
+	}
+
+	stripped := false
+	if s.config.Photos.StripGPS && photo.CanStripGPS(mimeType) {
+		// Never hand out a photo whose location could not be removed
+		var err error
+		if stripped, err = photo.StripGPS(filePath); err != nil {
+			return nil, fmt.Errorf("failed to remove GPS location: %w", err)
+		}
+	}
+
+	if !s.config.Photos.Exif {
+		return nil, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	p, err := photo.Extract(file, mimeType)
+	file.Close()
+	if err != nil {
+		s.logger.WithError(err).Debug("Failed to read photo metadata")
+		return nil, nil
+	}
+	if p != nil {
+		p.GPSStripped = stripped
+	}
+	return p, nil
+}
+
+// storedPhotoMeta reads the photo metadata of stored content. Stored content
+// is shared and cannot be changed, so with StripGPS content that still
+// carries a location, or whose metadata cannot be checked, is reported as
+// unknown and must be uploaded again.
+func (s *FileStore) storedPhotoMeta(ctx context.Context, key, mimeType string) (*catalog.PhotoMeta, error) {
+	if (!s.config.Photos.Exif && !s.config.Photos.StripGPS) || !photo.Supported(mimeType) {
+		return nil, nil
+	}
+
+	r, err := s.backend.GetRange(ctx, key, 0, photoHeadBytes)
+	if err != nil {
+		return nil, err
+	}
+	head, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Photos.StripGPS && photo.CanStripGPS(mimeType) {
+		if found, err := photo.HasGPS(bytes.NewReader(head)); err != nil || found {
+			return nil, catalog.ErrNotFound
+		}
+	}
+
+	if !s.config.Photos.Exif {
+		return nil, nil
+	}
+	p, err := photo.Extract(bytes.NewReader(head), mimeType)
+	if err != nil {
+		s.logger.WithError(err).Debug("Failed to read photo metadata")
+		return nil, nil
+	}
+	return p, nil
+}
@@ -0,0 +1,89 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// xmpPhoto returns a JPEG image with an APP1 segment holding data
+func xmpPhoto(t *testing.T, data string) string {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	length := len(data) + 2
+	b := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte(length >> 8), byte(length)}, data...)
+	return string(append(b, img.Bytes()[2:]...))
+}
+
+const gpsXMP = "http://ns.adobe.com/xap/1.0/\x00" +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="51,30.0N" exif:GPSLongitude="0,7.0W"/>` +
+	`</rdf:RDF></x:xmpmeta>`
+
+func TestStripGPSOnUpload(t *testing.T) {
+	h := newTestHandler(t, func(cfg *config.Config) { cfg.Photos.StripGPS = true })
+	ctx := context.Background()
+	content := xmpPhoto(t, gpsXMP)
+
+	meta := uploadFile(t, h, "phone", "photo.jpg", content)
+	data, err := os.ReadFile(filepath.Join(h.config.Storage.UploadDir, meta.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(content) || strings.Contains(string(data), "51,30.0N") {
+		t.Error("location stored")
+	}
+	if meta.Photo == nil || !meta.Photo.GPSStripped || meta.Photo.GPS != nil {
+		t.Errorf("photo metadata %+v", meta.Photo)
+	}
+	if meta.SHA256 != sha256Hex(string(data)) {
+		t.Error("digest of the original content recorded")
+	}
+
+	// Metadata that cannot be checked keeps the file out
+	upload, err := createUploadWith(h, "phone", handler.MetaData{"filename": "vendor.jpg"}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := xmpPhoto(t, "Vendor\x00data")
+	if _, err := upload.WriteChunk(ctx, 0, strings.NewReader(broken)); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.DeclareLength(ctx, int64(len(broken))); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.FinishUpload(ctx); err == nil {
+		t.Fatal("photo with an unknown APP1 segment accepted")
+	}
+	if _, err := h.store.index.Get(upload.id); !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("rejected photo recorded: %v", err)
+	}
+}
+
+func TestCreateFromBlobWithGPS(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := security.WithDevice(context.Background(), "laptop", "Laptop")
+	content := xmpPhoto(t, gpsXMP)
+	uploadFile(t, h, "phone", "photo.jpg", content)
+
+	// Stored before StripGPS was turned on, the location is still there
+	h.config.Photos.StripGPS = true
+	_, err := h.CreateFromBlob(ctx, sha256Hex(content), handler.MetaData{"filename": "copy.jpg"})
+	if !errors.Is(err, catalog.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,136 @@
+package upload
+
+import (
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+)
+
+// rateWindow is the period the transfer rate is averaged over
+const rateWindow = 5 * time.Second
+
+// transferIdleTime is how long a transfer without events is tracked. The end
+// of a transfer is missed when the event queue drops its terminal event.
+const transferIdleTime = 10 * time.Minute
+
+type progressSample struct {
+	offset int64
+	time   time.Time
+}
+
+// transfer tracks the recent progress of one upload
+type transfer struct {
+	samples []progressSample
+	rate    float64
+}
+
+// add records a progress sample and updates the rate over the last rateWindow
+func (t *transfer) add(offset int64, at time.Time) {
+	t.samples = append(t.samples, progressSample{offset: offset, time: at})
+
+	// Keep one sample at or before the window start as the reference point
+	for len(t.samples) > 2 && at.Sub(t.samples[1].time) >= rateWindow {
+		t.samples = t.samples[1:]
+	}
+
+	first := t.samples[0]
+	if elapsed := at.Sub(first.time).Seconds(); elapsed > 0 && offset >= first.offset {
+		t.rate = float64(offset-first.offset) / elapsed
+	}
+}
+
+// progressBroadcaster forwards upload events to WebSocket clients
+type progressBroadcaster struct {
+	manager   *websocket.Manager
+	transfers map[string]*transfer
+	lastSweep time.Time
+}
+
+// BroadcastTo publishes upload events to all clients of manager, so devices
+// other than the uploader can follow transfers in flight
+func (h *TusHandler) BroadcastTo(manager *websocket.Manager) {
+	b := &progressBroadcaster{
+		manager:   manager,
+		transfers: make(map[string]*transfer),
+	}
+	queue := NewEventQueue("websocket", 256, h.logger)
+	h.Subscribe(queue.Push)
+	go queue.Run(b.broadcast)
+}
+
+// broadcast sends an upload event to the clients
+func (b *progressBroadcaster) broadcast(event Event) {
+	status := websocket.UploadStatus{
+		UploadID:   event.UploadID,
+		FileName:   event.FileName,
+		Size:       event.Size,
+		Offset:     event.Offset,
+		Device:     event.Device,
+		DeviceName: event.DeviceName,
+		Error:      event.Error,
+	}
+
+	b.sweep(event.Time)
+
+	switch event.Type {
+	case EventCreated:
+		t := &transfer{}
+		t.add(event.Offset, event.Time)
+		b.transfers[event.UploadID] = t
+		b.manager.BroadcastUpload(websocket.MessageTypeUploadStarted, status)
+
+	case EventProgress:
+		b.updateRate(event, &status)
+		b.manager.BroadcastUpload(websocket.MessageTypeUploadProgress, status)
+
+	case EventCompleted:
+		if t := b.transfers[event.UploadID]; t != nil {
+			status.Rate = t.rate
+		}
+		if event.File != nil {
+			status.FileID = event.File.ID
+		}
+		delete(b.transfers, event.UploadID)
+		b.manager.BroadcastUpload(websocket.MessageTypeUploadCompleted, status)
+
+	case EventFailed, EventTerminated:
+		if event.Type == EventTerminated {
+			status.Error = "upload cancelled"
+		}
+		// A failed upload may be resumed; restart the rate measurement then
+		delete(b.transfers, event.UploadID)
+		b.manager.BroadcastUpload(websocket.MessageTypeUploadFailed, status)
+	}
+}
+
+// sweep forgets transfers that have been idle for transferIdleTime, checking
+// at most once per rateWindow
+func (b *progressBroadcaster) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < rateWindow {
+		return
+	}
+	b.lastSweep = now
+
+	for id, t := range b.transfers {
+		if now.Sub(t.samples[len(t.samples)-1].time) >= transferIdleTime {
+			delete(b.transfers, id)
+		}
+	}
+}
+
+// updateRate derives the transfer rate and remaining time from the recent
+// progress events of the same upload
+func (b *progressBroadcaster) updateRate(event Event, status *websocket.UploadStatus) {
+	t := b.transfers[event.UploadID]
+	if t == nil {
+		// Resumed upload, possibly after a server restart
+		t = &transfer{}
+		b.transfers[event.UploadID] = t
+	}
+	t.add(event.Offset, event.Time)
+
+	status.Rate = t.rate
+	if event.Size > 0 && t.rate > 0 {
+		status.ETA = float64(event.Size-event.Offset) / t.rate
+	}
+}
@@ -0,0 +1,73 @@
+package upload
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestBroadcaster(t *testing.T) *progressBroadcaster {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.DataDir = t.TempDir()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	auth, err := security.NewAuthService(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := websocket.NewManager(cfg, logger, auth)
+	manager.Start()
+
+	return &progressBroadcaster{manager: manager, transfers: make(map[string]*transfer)}
+}
+
+func TestTransferRate(t *testing.T) {
+	start := time.Now()
+	tr := &transfer{}
+	for i := 0; i <= 10; i++ {
+		tr.add(int64(i)*1000, start.Add(time.Duration(i)*time.Second))
+	}
+	if tr.rate != 1000 {
+		t.Errorf("rate %v, want 1000", tr.rate)
+	}
+	// Only the samples of the last rateWindow are kept
+	if first := tr.samples[0].time; start.Add(10*time.Second).Sub(first) > rateWindow+time.Second {
+		t.Errorf("oldest sample from %v", first.Sub(start))
+	}
+}
+
+func TestBroadcastForgetsTransfers(t *testing.T) {
+	b := newTestBroadcaster(t)
+	start := time.Now()
+
+	b.broadcast(Event{Type: EventCreated, UploadID: "done", Size: 100, Time: start})
+	b.broadcast(Event{Type: EventProgress, UploadID: "done", Size: 100, Offset: 50, Time: start.Add(time.Second)})
+	b.broadcast(Event{Type: EventCompleted, UploadID: "done", Size: 100, Offset: 100, Time: start.Add(2 * time.Second)})
+	if len(b.transfers) != 0 {
+		t.Fatalf("completed transfer still tracked: %v", b.transfers)
+	}
+
+	// Uploads whose terminal event was dropped are forgotten once idle
+	b.broadcast(Event{Type: EventCreated, UploadID: "lost", Size: 100, Time: start})
+	b.broadcast(Event{Type: EventProgress, UploadID: "active", Size: 100, Offset: 10, Time: start.Add(transferIdleTime - time.Minute)})
+	if len(b.transfers) != 2 {
+		t.Fatalf("tracked %d transfers, want 2", len(b.transfers))
+	}
+
+	b.broadcast(Event{Type: EventProgress, UploadID: "active", Size: 100, Offset: 20, Time: start.Add(transferIdleTime + time.Minute)})
+	if _, ok := b.transfers["lost"]; ok {
+		t.Error("idle transfer not forgotten")
+	}
+	if _, ok := b.transfers["active"]; !ok {
+		t.Error("active transfer forgotten")
+	}
+}
@@ -0,0 +1,323 @@
+package upload
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// QuotaLimits holds the parsed quota settings, a zero value means unlimited
+type QuotaLimits struct {
+	MaxTotalBytes  int64 `json:"max_total_bytes"`
+	MaxDeviceBytes int64 `json:"max_device_bytes"`
+	MaxDeviceFiles int   `json:"max_device_files"`
+	MinFreeBytes   int64 `json:"min_free_bytes"`
+}
+
+// DeviceUsage is the storage used by a single device
+type DeviceUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// Usage describes the storage used by the upload directory. Unfinished
+// uploads count with their declared size so concurrent uploads cannot
+// overcommit a quota. Files in the trash still take up space and count
+// toward the total, but not toward the device that uploaded them. Devices
+// holds the paired devices; uploads made without a device token share the
+// Anonymous quota.
+type Usage struct {
+	TotalBytes int64                   `json:"total_bytes"`
+	TotalFiles int                     `json:"total_files"`
+	TrashBytes int64                   `json:"trash_bytes"`
+	TrashFiles int                     `json:"trash_files"`
+	Devices    map[string]*DeviceUsage `json:"devices"`
+	Anonymous  *DeviceUsage            `json:"anonymous"`
+	DiskFree   int64                   `json:"disk_free"`
+	Limits     QuotaLimits             `json:"limits"`
+}
+
+// device returns the usage of a paired device, or of anonymous uploads for ""
+func (u *Usage) device(id string) *DeviceUsage {
+	if id == "" {
+		return u.Anonymous
+	}
+	du, ok := u.Devices[id]
+	if !ok {
+		du = &DeviceUsage{}
+		u.Devices[id] = du
+	}
+	return du
+}
+
+func (u *Usage) add(device string, bytes int64, files int) {
+	du := u.device(device)
+	du.Bytes += bytes
+	du.Files += files
+	u.TotalBytes += bytes
+	u.TotalFiles += files
+}
+
+// pendingRecountInterval is how long the unfinished uploads are tracked in
+// memory before the upload directory is read again, which picks up uploads
+// other processes removed
+const pendingRecountInterval = 10 * time.Minute
+
+// pendingUpload is an unfinished upload as it counts toward the quotas
+type pendingUpload struct {
+	device   string // paired device that created the upload, "" when anonymous
+	declared int64  // 0 while the length is deferred
+	written  int64
+}
+
+func (p *pendingUpload) size() int64 {
+	return max(p.declared, p.written)
+}
+
+// quotaOwner names whose quota a device ID is for in errors
+func quotaOwner(device string) string {
+	if device == "" {
+		return "anonymous uploads"
+	}
+	return "device " + device
+}
+
+var (
+	ErrDeviceQuotaExceeded   = handler.NewError("ERR_DEVICE_QUOTA_EXCEEDED", "device storage quota exceeded", http.StatusRequestEntityTooLarge)
+	ErrDeviceFileLimit       = handler.NewError("ERR_DEVICE_FILE_LIMIT", "device file count limit reached", http.StatusRequestEntityTooLarge)
+	ErrInboxQuotaExceeded    = handler.NewError("ERR_INBOX_QUOTA_EXCEEDED", "upload directory quota exceeded", http.StatusInsufficientStorage)
+	ErrInsufficientDiskSpace = handler.NewError("ERR_INSUFFICIENT_DISK_SPACE", "not enough free disk space", http.StatusInsufficientStorage)
+)
+
+func loadQuotaLimits(cfg *config.Config, logger *logrus.Logger) QuotaLimits {
+	var limits QuotaLimits
+	var err error
+
+	if limits.MaxTotalBytes, err = cfg.GetQuotaMaxTotalBytes(); err != nil {
+		logger.WithError(err).Warn("Invalid total quota, upload directory size is unlimited")
+	}
+	if limits.MaxDeviceBytes, err = cfg.GetQuotaMaxDeviceBytes(); err != nil {
+		logger.WithError(err).Warn("Invalid device quota, device storage is unlimited")
+	}
+	if limits.MinFreeBytes, err = cfg.GetQuotaMinFreeBytes(); err != nil {
+		logger.WithError(err).Warn("Invalid minimum free space, disk space guard disabled")
+	}
+	if cfg.Quota.MaxDeviceFiles > 0 {
+		limits.MaxDeviceFiles = cfg.Quota.MaxDeviceFiles
+	}
+
+	return limits
+}
+
+// Usage reports the current storage usage
+func (s *FileStore) Usage() (*Usage, error) {
+	s.quotaMu.Lock()
+	usage, err := s.usage("")
+	s.quotaMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	usage.DiskFree, err = diskFree(s.basePath)
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to get free disk space")
+		usage.DiskFree = -1
+	}
+	usage.Limits = s.quota
+
+	return usage, nil
+}
+
+// usage sums completed files, kept up to date by the index, and unfinished
+// uploads per device. The upload identified by excludeID is left out. The
+// caller holds quotaMu.
+func (s *FileStore) usage(excludeID string) (*Usage, error) {
+	stored, err := s.index.Usage()
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(s.counted) >= pendingRecountInterval {
+		if err := s.countPending(); err != nil {
+			return nil, err
+		}
+	}
+
+	usage := &Usage{
+		Devices:    make(map[string]*DeviceUsage),
+		Anonymous:  &DeviceUsage{},
+		TrashBytes: stored.Trash.Bytes,
+		TrashFiles: stored.Trash.Files,
+		TotalBytes: stored.Trash.Bytes,
+	}
+	for device, t := range stored.Devices {
+		usage.add(device, t.Bytes, t.Files)
+	}
+	for id, p := range s.pending {
+		if id != excludeID {
+			usage.add(p.device, p.size(), 1)
+		}
+	}
+	return usage, nil
+}
+
+// countPending reads the unfinished uploads from the upload directory. The
+// caller holds quotaMu.
+func (s *FileStore) countPending() error {
+	entries, err := os.ReadDir(s.incomingPath)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[string]*pendingUpload)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, s.config.TUS.TempSuffix) {
+			continue
+		}
+
+		id := strings.TrimSuffix(name, s.config.TUS.TempSuffix)
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		p := &pendingUpload{written: fileInfo.Size()}
+		if state, err := s.loadUploadInfo(id); err == nil {
+			p.device = state.DeviceID
+			if !state.Info.SizeIsDeferred {
+				p.declared = state.Info.Size
+			}
+		}
+		pending[id] = p
+	}
+
+	s.pending = pending
+	s.counted = time.Now()
+	return nil
+}
+
+// trackUpload counts a new unfinished upload; the caller holds quotaMu
+func (s *FileStore) trackUpload(id, device string, declared int64) {
+	if s.pending == nil {
+		s.pending = make(map[string]*pendingUpload)
+	}
+	s.pending[id] = &pendingUpload{device: device, declared: declared}
+}
+
+// updateUpload applies fn to the counted state of an unfinished upload
+func (s *FileStore) updateUpload(id string, fn func(*pendingUpload)) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	if p := s.pending[id]; p != nil {
+		fn(p)
+	}
+}
+
+// untrackUpload stops counting an upload that finished or was removed
+func (s *FileStore) untrackUpload(id string) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	delete(s.pending, id)
+}
+
+// checkQuota verifies that an upload of size bytes from device fits within the
+// quotas. newFile counts the upload against the device file limit. The caller
+// holds quotaMu.
+func (s *FileStore) checkQuota(device, excludeID string, size int64, newFile bool) error {
+	usage, err := s.usage(excludeID)
+	if err != nil {
+		return fmt.Errorf("failed to compute storage usage: %w", err)
+	}
+	var written int64
+	if p := s.pending[excludeID]; p != nil {
+		written = p.written
+	}
+
+	deviceUsage := usage.device(device)
+	owner := quotaOwner(device)
+
+	if s.quota.MaxDeviceFiles > 0 && newFile && deviceUsage.Files+1 > s.quota.MaxDeviceFiles {
+		return quotaError(ErrDeviceFileLimit, "%s: %d of %d files already stored", owner, deviceUsage.Files, s.quota.MaxDeviceFiles)
+	}
+	if s.quota.MaxDeviceBytes > 0 && deviceUsage.Bytes+size > s.quota.MaxDeviceBytes {
+		return quotaError(ErrDeviceQuotaExceeded, "%s would use %d of %d bytes", owner, deviceUsage.Bytes+size, s.quota.MaxDeviceBytes)
+	}
+	if s.quota.MaxTotalBytes > 0 && usage.TotalBytes+size > s.quota.MaxTotalBytes {
+		return quotaError(ErrInboxQuotaExceeded, "upload directory would use %d of %d bytes", usage.TotalBytes+size, s.quota.MaxTotalBytes)
+	}
+
+	if s.quota.MinFreeBytes > 0 {
+		free, err := diskFree(s.basePath)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to get free disk space")
+			return nil
+		}
+		if need := size - written; free-need < s.quota.MinFreeBytes {
+			return quotaError(ErrInsufficientDiskSpace, "%d bytes free, %d needed, %d must stay free", free, need, s.quota.MinFreeBytes)
+		}
+	}
+
+	return nil
+}
+
+// chunkAllowance returns how many more bytes the upload may write starting at
+// offset, or -1 when no quota applies. When a limit applies, the returned error
+// is the one to report once the allowance is used up; an allowance of 0 is
+// always accompanied by an error.
+func (s *FileStore) chunkAllowance(device, id string, offset int64) (int64, error) {
+	allowance := int64(-1)
+	var limitErr error
+
+	limit := func(remaining int64, err error) {
+		if remaining < 0 {
+			remaining = 0
+		}
+		if allowance < 0 || remaining < allowance {
+			allowance = remaining
+			limitErr = err
+		}
+	}
+
+	if s.quota.MaxDeviceBytes > 0 || s.quota.MaxTotalBytes > 0 {
+		s.quotaMu.Lock()
+		usage, err := s.usage(id)
+		s.quotaMu.Unlock()
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to compute storage usage")
+		} else {
+			if s.quota.MaxDeviceBytes > 0 {
+				limit(s.quota.MaxDeviceBytes-usage.device(device).Bytes-offset,
+					quotaError(ErrDeviceQuotaExceeded, "%s reached the quota of %d bytes", quotaOwner(device), s.quota.MaxDeviceBytes))
+			}
+			if s.quota.MaxTotalBytes > 0 {
+				limit(s.quota.MaxTotalBytes-usage.TotalBytes-offset,
+					quotaError(ErrInboxQuotaExceeded, "upload directory reached its quota of %d bytes", s.quota.MaxTotalBytes))
+			}
+		}
+	}
+
+	if s.quota.MinFreeBytes > 0 {
+		free, err := diskFree(s.basePath)
+		if err != nil {
+			s.logger.WithError(err).Warn("Failed to get free disk space")
+		} else {
+			limit(free-s.quota.MinFreeBytes,
+				quotaError(ErrInsufficientDiskSpace, "%d bytes must stay free on disk", s.quota.MinFreeBytes))
+		}
+	}
+
+	return allowance, limitErr
+}
+
+// quotaError returns a copy of a quota error with a detailed message
+func quotaError(base handler.Error, format string, args ...interface{}) handler.Error {
+	return handler.NewError(base.ErrorCode, base.Message+": "+fmt.Sprintf(format, args...), base.HTTPResponse.StatusCode)
+}
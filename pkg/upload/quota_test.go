@@ -0,0 +1,223 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/easy-sync/easy-sync/pkg/catalog"
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/tus/tusd/v2/pkg/handler"
+)
+
+// newTestHandler returns a TUS handler storing into temporary directories
+func newTestHandler(t *testing.T, configure func(*config.Config)) *TusHandler {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.UploadDir = t.TempDir()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Quota.MinFreeSpace = ""
+	if configure != nil {
+		configure(cfg)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	index, err := catalog.NewIndex(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := storage.New(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewTusHandler(cfg, logger, index, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// createUpload starts an upload of size bytes, -1 for a deferred length,
+// claiming to come from the device label. device is the authenticated
+// device, "" for an anonymous upload.
+func createUpload(h *TusHandler, device, label string, size int64) (*FileUpload, error) {
+	return createUploadWith(h, device, handler.MetaData{"filename": "file.txt", "device": label}, size)
+}
+
+// createUploadWith is createUpload with the given metadata
+func createUploadWith(h *TusHandler, device string, metadata handler.MetaData, size int64) (*FileUpload, error) {
+	ctx := context.Background()
+	if device != "" {
+		ctx = security.WithDevice(ctx, device, device)
+	}
+	info := handler.FileInfo{Size: size, MetaData: metadata}
+	if size < 0 {
+		info.Size, info.SizeIsDeferred = 0, true
+	}
+	upload, err := h.store.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return upload.(*FileUpload), nil
+}
+
+func errorCode(err error) string {
+	var tusErr handler.Error
+	if errors.As(err, &tusErr) {
+		return tusErr.ErrorCode
+	}
+	return ""
+}
+
+func TestQuotaBuckets(t *testing.T) {
+	h := newTestHandler(t, func(cfg *config.Config) { cfg.Quota.MaxDeviceFiles = 1 })
+
+	tests := []struct {
+		name   string
+		device string
+		label  string
+		err    string
+	}{
+		{"first anonymous upload", "", "desktop", ""},
+		{"anonymous upload with another label", "", "mobile", ErrDeviceFileLimit.ErrorCode},
+		{"anonymous upload claiming a paired device", "", "phone", ErrDeviceFileLimit.ErrorCode},
+		{"paired device", "phone", "phone", ""},
+		{"paired device again", "phone", "desktop", ErrDeviceFileLimit.ErrorCode},
+		{"other paired device", "laptop", "laptop", ""},
+	}
+	for _, tt := range tests {
+		_, err := createUpload(h, tt.device, tt.label, 10)
+		if got := errorCode(err); got != tt.err || (tt.err == "" && err != nil) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	usage, err := h.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Anonymous.Files != 1 || usage.Devices["phone"].Files != 1 || usage.Devices["laptop"].Files != 1 {
+		t.Errorf("unexpected usage: anonymous %+v, devices %v", usage.Anonymous, usage.Devices)
+	}
+	if _, ok := usage.Devices["desktop"]; ok {
+		t.Errorf("metadata label counted as a device: %v", usage.Devices)
+	}
+}
+
+func TestChunkAllowance(t *testing.T) {
+	h := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Quota.MaxDeviceSize = "100B"
+		cfg.Quota.MaxTotalSize = "250B"
+	})
+
+	if _, err := createUpload(h, "", "desktop", 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUpload(h, "phone", "phone", 30); err != nil {
+		t.Fatal(err)
+	}
+	deferred, err := createUpload(h, "phone", "phone", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous, err := createUpload(h, "", "mobile", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		upload *FileUpload
+		offset int64
+		want   int64
+		err    string
+	}{
+		{"device quota minus the other upload", deferred, 0, 70, ErrDeviceQuotaExceeded.ErrorCode},
+		{"bytes before the offset count", deferred, 50, 20, ErrDeviceQuotaExceeded.ErrorCode},
+		{"device quota used up", deferred, 70, 0, ErrDeviceQuotaExceeded.ErrorCode},
+		{"anonymous uploads share the quota", anonymous, 0, 40, ErrDeviceQuotaExceeded.ErrorCode},
+	}
+	for _, tt := range tests {
+		got, err := h.store.chunkAllowance(tt.upload.device, tt.upload.id, tt.offset)
+		if got != tt.want || errorCode(err) != tt.err {
+			t.Errorf("%s: got %d, %v; want %d, %s", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+
+	// The total quota applies once it is the tighter limit
+	if _, err := createUpload(h, "laptop", "laptop", 100); err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.store.chunkAllowance(deferred.device, deferred.id, 0)
+	if got != 60 || errorCode(err) != ErrInboxQuotaExceeded.ErrorCode {
+		t.Errorf("total quota: got %d, %v; want 60, %s", got, err, ErrInboxQuotaExceeded.ErrorCode)
+	}
+}
+
+func TestUsageFollowsFiles(t *testing.T) {
+	h := newTestHandler(t, nil)
+	ctx := context.Background()
+
+	upload, err := createUpload(h, "phone", "phone", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string, device catalog.Tally, pending int, trash catalog.Tally) {
+		t.Helper()
+		usage, err := h.Usage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		du := usage.Devices["phone"]
+		if du == nil {
+			du = &DeviceUsage{}
+		}
+		if du.Bytes != device.Bytes || du.Files != device.Files || usage.TrashBytes != trash.Bytes || usage.TrashFiles != trash.Files {
+			t.Errorf("%s: device %+v, trash %d/%d; want %+v, %+v", step, du, usage.TrashBytes, usage.TrashFiles, device, trash)
+		}
+		if len(h.store.pending) != pending {
+			t.Errorf("%s: %d pending uploads, want %d", step, len(h.store.pending), pending)
+		}
+	}
+
+	check("created", catalog.Tally{Bytes: 5, Files: 1}, 1, catalog.Tally{})
+
+	if _, err := upload.WriteChunk(ctx, 0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.FinishUpload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check("finished", catalog.Tally{Bytes: 5, Files: 1}, 0, catalog.Tally{})
+
+	meta, err := h.store.index.Get(upload.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DeviceID != "phone" {
+		t.Errorf("file recorded for device %q, want phone", meta.DeviceID)
+	}
+
+	if _, err := h.store.index.MoveToTrash(upload.id, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("deleted", catalog.Tally{}, 0, catalog.Tally{Bytes: 5, Files: 1})
+
+	if _, err := h.store.index.RestoreFromTrash(upload.id); err != nil {
+		t.Fatal(err)
+	}
+	check("restored", catalog.Tally{Bytes: 5, Files: 1}, 0, catalog.Tally{})
+
+	if err := h.store.index.Delete(upload.id); err != nil {
+		t.Fatal(err)
+	}
+	check("removed", catalog.Tally{}, 0, catalog.Tally{})
+}
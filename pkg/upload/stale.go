@@ -0,0 +1,64 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RemoveStaleUploads deletes unfinished uploads that received no data for
+// longer than maxIdle, returning how many were removed and the bytes freed.
+// Clients can no longer resume them.
+func (h *TusHandler) RemoveStaleUploads(maxIdle time.Duration) (int, int64, error) {
+	return h.store.removeStaleUploads(maxIdle, time.Now())
+}
+
+func (s *FileStore) removeStaleUploads(maxIdle time.Duration, now time.Time) (int, int64, error) {
+	entries, err := os.ReadDir(s.incomingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	removed, freed := 0, int64(0)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), s.config.TUS.TempSuffix)
+		if entry.IsDir() || !ok || id == "" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < maxIdle {
+			continue
+		}
+
+		// Read the state before it goes, the batch needs to know
+		state, _ := s.loadUploadInfo(id)
+		if err := os.Remove(filepath.Join(s.incomingPath, entry.Name())); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, freed, err
+		}
+		s.removeUploadInfo(id)
+		s.untrackUpload(id)
+		if state != nil {
+			if batchID := state.Info.MetaData["batchId"]; batchID != "" {
+				s.terminateBatchUpload(batchID)
+			}
+		}
+
+		removed++
+		freed += info.Size()
+		s.logger.WithFields(logrus.Fields{
+			"upload_id": id,
+			"offset":    info.Size(),
+			"idle":      now.Sub(info.ModTime()).Round(time.Second),
+		}).Info("Stale upload removed")
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,205 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/tus/tusd/v2/pkg/handler"
+	"golang.org/x/time/rate"
+)
+
+// throttleChunk is the most data read before waiting for the rate limiters.
+// Small steps let simultaneous uploads take turns, so they share the
+// bandwidth evenly instead of one upload draining the whole budget.
+const throttleChunk = 32 * 1024
+
+// slotWait is how long a chunk waits for a free transfer slot of its device.
+// It stays below tusd's network timeout so the client gets an answer and
+// retries the chunk later.
+const slotWait = 30 * time.Second
+
+// throttleIdleTime is how long the limiters of a device are kept after its
+// last chunk. An upload waiting longer starts with a fresh limiter.
+const throttleIdleTime = 10 * time.Minute
+
+// ErrDeviceUploadLimit is returned while a device already transfers the
+// maximum number of uploads. tus clients retry on 423.
+var ErrDeviceUploadLimit = handler.NewError("ERR_DEVICE_UPLOAD_LIMIT", "too many concurrent uploads from this device", http.StatusLocked)
+
+// throttle limits the upload bandwidth in total and per device, and the
+// number of chunks a device may transfer at the same time. Devices are the
+// paired devices that created the uploads; uploads made without a device
+// token share the limits of one device.
+type throttle struct {
+	global     *rate.Limiter
+	deviceRate int64
+	maxActive  int
+
+	mu      sync.Mutex
+	devices map[string]*deviceThrottle
+	swept   time.Time // last removal of idle devices
+}
+
+type deviceThrottle struct {
+	limiter *rate.Limiter
+	slots   chan struct{}
+	users   int       // chunks in progress or waiting, guarded by throttle.mu
+	idle    time.Time // when the last chunk ended
+}
+
+func newThrottle(cfg *config.Config, logger *logrus.Logger) *throttle {
+	t := &throttle{
+		maxActive: cfg.Throttle.MaxDeviceUploads,
+		devices:   make(map[string]*deviceThrottle),
+	}
+
+	globalRate, err := cfg.GetThrottleUploadRate()
+	if err != nil {
+		logger.WithError(err).Warn("Invalid upload rate, upload bandwidth is unlimited")
+	}
+	if globalRate > 0 {
+		t.global = newLimiter(globalRate)
+	}
+
+	if t.deviceRate, err = cfg.GetThrottleDeviceUploadRate(); err != nil {
+		logger.WithError(err).Warn("Invalid device upload rate, device bandwidth is unlimited")
+	}
+
+	if globalRate > 0 || t.deviceRate > 0 || t.maxActive > 0 {
+		logger.WithFields(logrus.Fields{
+			"upload_rate":        globalRate,
+			"device_upload_rate": t.deviceRate,
+			"max_device_uploads": t.maxActive,
+		}).Info("Upload throttling enabled")
+	}
+
+	return t
+}
+
+// newLimiter allows bytesPerSec with a burst of at most one throttle step
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	burst := int64(throttleChunk)
+	if bytesPerSec < burst {
+		burst = bytesPerSec
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
+
+// device returns the limiters of a device. The caller holds t.mu.
+func (t *throttle) device(id string) *deviceThrottle {
+	now := time.Now()
+	if now.Sub(t.swept) >= throttleIdleTime {
+		for key, d := range t.devices {
+			if d.users == 0 && now.Sub(d.idle) >= throttleIdleTime {
+				delete(t.devices, key)
+			}
+		}
+		t.swept = now
+	}
+
+	d := t.devices[id]
+	if d == nil {
+		d = &deviceThrottle{}
+		if t.deviceRate > 0 {
+			d.limiter = newLimiter(t.deviceRate)
+		}
+		if t.maxActive > 0 {
+			d.slots = make(chan struct{}, t.maxActive)
+		}
+		t.devices[id] = d
+	}
+	return d
+}
+
+// acquire waits for a transfer slot of the device and keeps its limiters
+// until the returned function is called
+func (t *throttle) acquire(ctx context.Context, deviceID string) (func(), error) {
+	t.mu.Lock()
+	d := t.device(deviceID)
+	d.users++
+	t.mu.Unlock()
+
+	done := func() {
+		t.mu.Lock()
+		d.users--
+		d.idle = time.Now()
+		t.mu.Unlock()
+	}
+	if d.slots == nil {
+		return done, nil
+	}
+
+	timer := time.NewTimer(slotWait)
+	defer timer.Stop()
+
+	select {
+	case d.slots <- struct{}{}:
+		return func() {
+			<-d.slots
+			done()
+		}, nil
+	case <-timer.C:
+		done()
+		return nil, ErrDeviceUploadLimit
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+}
+
+// reader wraps r so reading from it honours the device and global rates.
+// It is used between acquire and the release of the device.
+func (t *throttle) reader(ctx context.Context, deviceID string, r io.Reader) io.Reader {
+	t.mu.Lock()
+	d := t.device(deviceID)
+	t.mu.Unlock()
+
+	var limiters []*rate.Limiter
+	if d.limiter != nil {
+		limiters = append(limiters, d.limiter)
+	}
+	if t.global != nil {
+		limiters = append(limiters, t.global)
+	}
+	if len(limiters) == 0 {
+		return r
+	}
+
+	step := throttleChunk
+	for _, l := range limiters {
+		if l.Burst() < step {
+			step = l.Burst()
+		}
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters, step: step}
+}
+
+// throttledReader reads at most one step at a time and waits until all
+// limiters allow the data read
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+	step     int
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > t.step {
+		b = b[:t.step]
+	}
+
+	n, err := t.r.Read(b)
+	if n > 0 {
+		for _, l := range t.limiters {
+			if waitErr := l.WaitN(t.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func TestThrottleEvictsIdleDevices(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg := config.DefaultConfig()
+	cfg.Throttle.MaxDeviceUploads = 1
+	th := newThrottle(cfg, logger)
+	ctx := context.Background()
+
+	idle, err := th.acquire(ctx, "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle()
+	busy, err := th.acquire(ctx, "busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy()
+
+	// Pretend both were last used long ago
+	past := time.Now().Add(-2 * throttleIdleTime)
+	th.mu.Lock()
+	th.swept = past
+	for _, d := range th.devices {
+		d.idle = past
+	}
+	th.mu.Unlock()
+
+	release, err := th.acquire(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if _, ok := th.devices["idle"]; ok {
+		t.Error("idle device kept")
+	}
+	if _, ok := th.devices["busy"]; !ok {
+		t.Error("device holding a slot evicted")
+	}
+	if d := th.devices[""]; d == nil || d.users != 0 {
+		t.Errorf("anonymous device after release: %+v", d)
+	}
+}
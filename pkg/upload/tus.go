@@ -10,11 +10,14 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/easy-sync/easy-sync/pkg/catalog"
 	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/easy-sync/easy-sync/pkg/storage"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/tus/tusd/v2/pkg/handler"
@@ -28,35 +31,62 @@ type TusHandler struct {
 	handler  *handler.Handler
 }
 
-type FileStore struct {
-	basePath string
-	logger   *logrus.Logger
-	config   *config.Config
-}
+// IncomingDirName is the directory inside Storage.UploadDir holding unfinished
+// uploads. Completed uploads are handed to the storage backend.
+const IncomingDirName = ".incoming"
 
-type FileMeta struct {
-	ID       string    `json:"id"`
-	Name     string    `json:"name"`
-	Size     int64     `json:"size"`
-	MimeType string    `json:"mime_type"`
-	SHA256   string    `json:"sha256"`
-	UploadID string    `json:"upload_id"`
-	Created  time.Time `json:"created"`
-	Device   string    `json:"device"`
+type FileStore struct {
+	basePath     string
+	incomingPath string
+	logger       *logrus.Logger
+	config       *config.Config
+	index        *catalog.Index
+	backend      storage.Backend
+	events       *events
+	dedup        bool
+	quota        QuotaLimits
+	throttle     *throttle
+	quotaMu      sync.Mutex
+	pending      map[string]*pendingUpload // unfinished uploads, guarded by quotaMu
+	counted      time.Time                 // when pending was last read from disk
+	placeMu      sync.Mutex
+	placer       Placer // guarded by placeMu
 }
 
-func NewTusHandler(cfg *config.Config, logger *logrus.Logger) (*TusHandler, error) {
+func NewTusHandler(cfg *config.Config, logger *logrus.Logger, index *catalog.Index, backend storage.Backend) (*TusHandler, error) {
 	store := &FileStore{
-		basePath: cfg.Storage.UploadDir,
-		logger:   logger,
-		config:   cfg,
+		basePath:     cfg.Storage.UploadDir,
+		incomingPath: filepath.Join(cfg.Storage.UploadDir, IncomingDirName),
+		logger:       logger,
+		config:       cfg,
+		index:        index,
+		backend:      backend,
+		events:       newEvents(),
+		quota:        loadQuotaLimits(cfg, logger),
+		throttle:     newThrottle(cfg, logger),
 	}
 
-	// Ensure upload directory exists
-	if err := os.MkdirAll(cfg.Storage.UploadDir, 0755); err != nil {
+	// Deduplication shares content through links, which not every backend has
+	if cfg.Storage.Dedup {
+		if _, ok := backend.(storage.Linker); ok {
+			store.dedup = true
+		} else {
+			logger.WithField("backend", cfg.Storage.Backend).Info("Storage backend does not support deduplication, disabled")
+		}
+	}
+
+	// Ensure upload directories exist
+	if err := os.MkdirAll(store.incomingPath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create upload directory: %w", err)
 	}
 
+	// Files uploaded before the metadata index existed keep their place on disk
+	if imported, err := index.ImportLegacy(); err != nil {
+		logger.WithError(err).Warn("Failed to import legacy file metadata")
+	} else if imported > 0 {
+		logger.WithField("files", imported).Info("Imported legacy file metadata")
+	}
+
 	composer := handler.NewStoreComposer()
 	store.useIn(composer)
 
@@ -77,20 +107,36 @@ func NewTusHandler(cfg *config.Config, logger *logrus.Logger) (*TusHandler, erro
 		return nil, fmt.Errorf("failed to create tus handler: %w", err)
 	}
 
-	return &TusHandler{
+	h := &TusHandler{
 		config:   cfg,
 		logger:   logger,
 		store:    store,
 		composer: composer,
 		handler:  tusHandler,
-	}, nil
+	}
+
+	// tusd blocks on its notification channels until they are read
+	go h.handleEvents()
+
+	return h, nil
+}
+
+func (h *TusHandler) handleEvents() {
+	for {
+		select {
+		case event := <-h.handler.CompleteUploads:
+			h.logger.WithField("upload_id", event.Upload.ID).Debug("Upload complete event")
+		case event := <-h.handler.TerminatedUploads:
+			h.logger.WithField("upload_id", event.Upload.ID).Debug("Upload terminated event")
+		}
+	}
 }
 
 func (h *TusHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	// Add CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, HEAD, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Upload-Length, Upload-Offset, Tus-Resumable, Upload-Metadata")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, HEAD, GET, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Upload-Length, Upload-Offset, Upload-Defer-Length, Tus-Resumable, Upload-Metadata, Authorization")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusNoContent)
@@ -104,8 +150,13 @@ func (h *TusHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		"remote": r.RemoteAddr,
 	}).Info("TUS upload request")
 
-	// Use a custom HTTP handler to ensure proper routing
-	h.handler.ServeHTTP(w, r)
+	// The tus handler routes on paths relative to its base path
+	http.StripPrefix(h.config.TUS.BasePath, h.handler).ServeHTTP(w, r)
+}
+
+// Usage returns the current storage usage together with the configured quotas
+func (h *TusHandler) Usage() (*Usage, error) {
+	return h.store.Usage()
 }
 
 func (s *FileStore) useIn(composer *handler.StoreComposer) {
@@ -118,6 +169,10 @@ func (s *FileStore) useIn(composer *handler.StoreComposer) {
 func (s *FileStore) NewUpload(ctx context.Context, info handler.FileInfo) (handler.Upload, error) {
 	// Generate unique file ID
 	fileID := uuid.New().String()
+	info.ID = fileID
+
+	info.MetaData = withContextDevice(ctx, info.MetaData)
+	device, _ := security.DeviceFromContext(ctx)
 
 	// Extract filename from metadata
 	var fileName string
@@ -127,14 +182,57 @@ func (s *FileStore) NewUpload(ctx context.Context, info handler.FileInfo) (handl
 		fileName = fileID
 	}
 
+	batchID := info.MetaData["batchId"]
+	if batchID != "" && !catalog.ValidBatchID(batchID) {
+		return nil, ErrInvalidBatchID
+	}
+
+	// Quota check and file creation must not interleave with other creations,
+	// otherwise two uploads could both claim the last free slot
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	size := info.Size
+	if info.SizeIsDeferred {
+		size = 0
+	}
+	if err := s.checkQuota(device, "", size, true); err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"filename": fileName,
+			"size":     info.Size,
+		}).WithError(err).Warn("Upload rejected by quota")
+		return nil, err
+	}
+
+	if batchID != "" {
+		if err := s.registerBatchUpload(info, device); err != nil {
+			return nil, err
+		}
+	}
+	// fail releases the batch slot of an upload that could not be created
+	fail := func(err error) (handler.Upload, error) {
+		if batchID != "" {
+			s.terminateBatchUpload(batchID)
+		}
+		return nil, err
+	}
+
 	// Create file path
-	filePath := filepath.Join(s.basePath, fileID+s.config.TUS.TempSuffix)
+	filePath := filepath.Join(s.incomingPath, fileID+s.config.TUS.TempSuffix)
 
 	// Create the file
 	file, err := os.Create(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create upload file: %w", err)
+		return fail(fmt.Errorf("failed to create upload file: %w", err))
+	}
+
+	createdAt := time.Now()
+	if err := s.saveUploadInfo(uploadInfo{Info: info, Created: createdAt, DeviceID: device}); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return fail(fmt.Errorf("failed to save upload info: %w", err))
 	}
+	s.trackUpload(fileID, device, size)
 
 	s.logger.WithFields(logrus.Fields{
 		"upload_id": fileID,
@@ -142,21 +240,30 @@ func (s *FileStore) NewUpload(ctx context.Context, info handler.FileInfo) (handl
 		"size":      info.Size,
 	}).Info("New upload created")
 
-	return &FileUpload{
+	size = info.Size
+	if info.SizeIsDeferred {
+		size = -1
+	}
+
+	upload := &FileUpload{
 		id:        fileID,
 		file:      file,
 		filePath:  filePath,
 		fileName:  fileName,
-		size:      info.Size,
+		size:      size,
 		offset:    0,
 		info:      info,
+		device:    device,
 		store:     s,
-		createdAt: time.Now(),
-	}, nil
+		createdAt: createdAt,
+	}
+	s.events.emit(upload.event(EventCreated))
+
+	return upload, nil
 }
 
 func (s *FileStore) GetUpload(ctx context.Context, id string) (handler.Upload, error) {
-	filePath := filepath.Join(s.basePath, id+s.config.TUS.TempSuffix)
+	filePath := filepath.Join(s.incomingPath, id+s.config.TUS.TempSuffix)
 
 	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
 	if err != nil {
@@ -170,13 +277,37 @@ func (s *FileStore) GetUpload(ctx context.Context, id string) (handler.Upload, e
 		return nil, fmt.Errorf("failed to get file info: %w", err)
 	}
 
+	// Restore the upload state saved at creation
+	state, err := s.loadUploadInfo(id)
+	if err != nil {
+		s.logger.WithError(err).WithField("upload_id", id).Warn("Failed to load upload info")
+		state = &uploadInfo{
+			Info:    handler.FileInfo{ID: id, SizeIsDeferred: true, MetaData: handler.MetaData{}},
+			Created: fileInfo.ModTime(),
+		}
+	}
+
+	size := state.Info.Size
+	if state.Info.SizeIsDeferred {
+		size = -1
+	}
+
+	fileName := state.Info.MetaData["filename"]
+	if fileName == "" {
+		fileName = id
+	}
+
 	return &FileUpload{
-		id:       id,
-		file:     file,
-		filePath: filePath,
-		size:     -1, // Unknown size
-		offset:   fileInfo.Size(),
-		store:    s,
+		id:        id,
+		file:      file,
+		filePath:  filePath,
+		fileName:  fileName,
+		size:      size,
+		offset:    fileInfo.Size(),
+		info:      state.Info,
+		device:    state.DeviceID,
+		store:     s,
+		createdAt: state.Created,
 	}, nil
 }
 
@@ -200,28 +331,66 @@ type FileUpload struct {
 	size      int64
 	offset    int64
 	info      handler.FileInfo
+	device    string // paired device that created the upload, "" when anonymous
 	store     *FileStore
 	createdAt time.Time
 	mu        sync.RWMutex
 }
 
 func (u *FileUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	// Wait for a transfer slot before locking, so status requests still answer
+	release, err := u.store.throttle.acquire(ctx, u.device)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	n, err := u.writeChunk(ctx, offset, src)
+	if err != nil {
+		u.emitFailed(err)
+	}
+	return n, err
+}
+
+func (u *FileUpload) writeChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
-	if offset != u.offset {
-		_, err := u.file.Seek(offset, io.SeekStart)
-		if err != nil {
-			return 0, fmt.Errorf("failed to seek to offset %d: %w", offset, err)
-		}
+	// The file is reopened for every request, so always position it
+	if _, err := u.file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek to offset %d: %w", offset, err)
+	}
+
+	// Limit the chunk to what the quotas still allow
+	allowance, quotaErr := u.store.chunkAllowance(u.device, u.id, offset)
+	if allowance == 0 && quotaErr != nil {
+		return 0, quotaErr
+	}
+
+	throttled := u.store.throttle.reader(ctx, u.device, src)
+	var reader io.Reader = &progressReader{r: throttled, upload: u, start: offset}
+	if allowance > 0 {
+		reader = io.LimitReader(reader, allowance)
 	}
 
-	n, err := io.Copy(u.file, src)
+	n, err := io.Copy(u.file, reader)
+	u.offset = offset + n
+	u.store.updateUpload(u.id, func(p *pendingUpload) { p.written = max(p.written, u.offset) })
 	if err != nil {
 		return n, fmt.Errorf("failed to write chunk: %w", err)
 	}
 
-	u.offset = offset + n
+	// The limit was reached; any remaining data means the quota is exceeded
+	if allowance > 0 && n == allowance {
+		var probe [1]byte
+		if m, _ := src.Read(probe[:]); m > 0 {
+			u.store.logger.WithFields(logrus.Fields{
+				"upload_id": u.id,
+				"offset":    u.offset,
+			}).WithError(quotaErr).Warn("Upload stopped by quota")
+			return n, quotaErr
+		}
+	}
 
 	u.store.logger.WithFields(logrus.Fields{
 		"upload_id":  u.id,
@@ -254,6 +423,14 @@ func (u *FileUpload) GetReader(ctx context.Context) (io.ReadCloser, error) {
 }
 
 func (u *FileUpload) FinishUpload(ctx context.Context) error {
+	err := u.finishUpload(ctx)
+	if err != nil {
+		u.emitFailed(err)
+	}
+	return err
+}
+
+func (u *FileUpload) finishUpload(ctx context.Context) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
@@ -262,6 +439,14 @@ func (u *FileUpload) FinishUpload(ctx context.Context) error {
 		return fmt.Errorf("failed to close file: %w", err)
 	}
 
+	mimeType := DetectMimeType(u.filePath, u.fileName, u.info.MetaData["filetype"])
+
+	// Read the photo metadata first, removing the location may change the content
+	photo, err := u.store.photoMeta(u.filePath, mimeType)
+	if err != nil {
+		return err
+	}
+
 	// Calculate SHA256
 	hash, err := u.calculateSHA256()
 	if err != nil {
@@ -269,38 +454,72 @@ func (u *FileUpload) FinishUpload(ctx context.Context) error {
 	}
 
 	// Move to final location
-	finalPath := filepath.Join(u.store.basePath, u.id)
-	if err := os.Rename(u.filePath, finalPath); err != nil {
+	target, err := u.targetPath(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("failed to resolve final location: %w", err)
+	}
+	relPath, deduped, err := u.store.placeContent(ctx, u.filePath, target, hash, u.offset, u.id)
+	if err != nil {
 		return fmt.Errorf("failed to move file to final location: %w", err)
 	}
+	u.store.removeUploadInfo(u.id)
 
 	// Create metadata file
-	meta := FileMeta{
-		ID:       u.id,
-		Name:     u.fileName,
-		Size:     u.offset,
-		MimeType: u.getMimeType(),
-		SHA256:   hash,
-		UploadID: u.id,
-		Created:  u.createdAt,
-		Device:   u.getDeviceFromMeta(),
-	}
+	meta := u.fileMeta(relPath, mimeType, hash)
+	meta.Photo = photo
 
-	if err := u.saveMetadata(meta); err != nil {
+	if err := u.store.index.Save(meta); err != nil {
 		u.store.logger.WithError(err).Error("Failed to save file metadata")
 		// Continue anyway - the upload is complete
 	}
+	u.store.untrackUpload(u.id)
+
+	if meta.BatchID != "" {
+		u.store.completeBatchUpload(meta)
+	}
 
 	u.store.logger.WithFields(logrus.Fields{
 		"upload_id": u.id,
 		"filename":  u.fileName,
+		"path":      relPath,
 		"size":      u.offset,
 		"sha256":    hash,
+		"deduped":   deduped,
 	}).Info("Upload completed")
 
+	event := u.event(EventCompleted)
+	event.File = meta
+	u.store.events.emit(event)
+
 	return nil
 }
 
+// fileMeta builds the metadata record of the completed upload
+func (u *FileUpload) fileMeta(relPath, mimeType, hash string) *catalog.FileMeta {
+	meta := &catalog.FileMeta{
+		ID:       u.id,
+		Name:     u.fileName,
+		Path:     relPath,
+		Size:     u.offset,
+		MimeType: mimeType,
+		SHA256:   hash,
+		UploadID: u.id,
+		Created:  u.createdAt,
+		Device:   u.getDeviceFromMeta(),
+		DeviceID: u.device,
+
+		RelativePath: SanitizeRelativePath(u.info.MetaData["relativePath"]),
+		BatchID:      u.info.MetaData["batchId"],
+	}
+
+	// Modification time on the device, in Unix seconds
+	if sec, err := strconv.ParseInt(u.info.MetaData["mtime"], 10, 64); err == nil && sec > 0 {
+		modified := time.Unix(sec, 0).UTC()
+		meta.Modified = &modified
+	}
+	return meta
+}
+
 func (u *FileUpload) Terminate(ctx context.Context) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -312,16 +531,19 @@ func (u *FileUpload) Terminate(ctx context.Context) error {
 		return fmt.Errorf("failed to remove upload file: %w", err)
 	}
 
-	// Remove metadata file if it exists
-	metaPath := filepath.Join(u.store.basePath, u.id+u.store.config.TUS.MetaSuffix)
-	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
-		u.store.logger.WithError(err).Warn("Failed to remove metadata file")
+	u.store.removeUploadInfo(u.id)
+	u.store.untrackUpload(u.id)
+
+	if batchID := u.info.MetaData["batchId"]; batchID != "" {
+		u.store.terminateBatchUpload(batchID)
 	}
 
 	u.store.logger.WithFields(logrus.Fields{
 		"upload_id": u.id,
 	}).Info("Upload terminated")
 
+	u.store.events.emit(u.event(EventTerminated))
+
 	return nil
 }
 
@@ -334,8 +556,20 @@ func (u *FileUpload) DeclareLength(ctx context.Context, length int64) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
+	// A deferred length is checked against the quotas once it becomes known
+	u.store.quotaMu.Lock()
+	defer u.store.quotaMu.Unlock()
+	if err := u.store.checkQuota(u.device, u.id, length, false); err != nil {
+		return err
+	}
+
 	u.size = length
-	return nil
+	u.info.Size = length
+	u.info.SizeIsDeferred = false
+	if p := u.store.pending[u.id]; p != nil {
+		p.declared = length
+	}
+	return u.store.saveUploadInfo(uploadInfo{Info: u.info, Created: u.createdAt, DeviceID: u.device})
 }
 
 func (u *FileUpload) calculateSHA256() (string, error) {
@@ -353,53 +587,70 @@ func (u *FileUpload) calculateSHA256() (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func (u *FileUpload) getMimeType() string {
-	// Try to determine MIME type from file extension
-	ext := strings.ToLower(filepath.Ext(u.fileName))
-	switch ext {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".gif":
-		return "image/gif"
-	case ".mp4":
-		return "video/mp4"
-	case ".mov":
-		return "video/quicktime"
-	case ".avi":
-		return "video/x-msvideo"
-	case ".mp3":
-		return "audio/mpeg"
-	case ".wav":
-		return "audio/wav"
-	case ".pdf":
-		return "application/pdf"
-	case ".txt":
-		return "text/plain"
-	case ".zip":
-		return "application/zip"
-	default:
-		return "application/octet-stream"
+func (u *FileUpload) getDeviceFromMeta() string {
+	return deviceFromMeta(u.info.MetaData)
+}
+
+// withContextDevice stores the authenticated device in the metadata; it takes
+// precedence over client supplied values
+func withContextDevice(ctx context.Context, metadata handler.MetaData) handler.MetaData {
+	if metadata == nil {
+		metadata = handler.MetaData{}
 	}
+	if deviceID, deviceName := security.DeviceFromContext(ctx); deviceID != "" {
+		metadata["device"] = deviceID
+		metadata["device_name"] = deviceName
+	}
+	return metadata
 }
 
-func (u *FileUpload) getDeviceFromMeta() string {
-	if deviceMeta, ok := u.info.MetaData["device"]; ok {
+func deviceFromMeta(metadata handler.MetaData) string {
+	if deviceMeta, ok := metadata["device"]; ok && deviceMeta != "" {
 		return deviceMeta
 	}
 	return "unknown"
 }
 
-func (u *FileUpload) saveMetadata(meta FileMeta) error {
-	metaPath := filepath.Join(u.store.basePath, u.id+u.store.config.TUS.MetaSuffix)
+// uploadInfo is the state of an unfinished upload persisted next to its
+// partial file, so a resumed upload keeps its name, size and device.
+// DeviceID is the paired device that created the upload; unlike the device
+// in the metadata, clients cannot set it.
+type uploadInfo struct {
+	Info     handler.FileInfo `json:"info"`
+	Created  time.Time        `json:"created"`
+	DeviceID string           `json:"device_id,omitempty"`
+}
+
+func (s *FileStore) infoPath(id string) string {
+	return filepath.Join(s.incomingPath, id+s.config.TUS.InfoSuffix)
+}
 
-	file, err := os.Create(metaPath)
+func (s *FileStore) saveUploadInfo(state uploadInfo) error {
+	data, err := json.Marshal(state)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	return os.WriteFile(s.infoPath(state.Info.ID), data, 0644)
+}
 
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(meta)
+func (s *FileStore) loadUploadInfo(id string) (*uploadInfo, error) {
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var state uploadInfo
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Info.MetaData == nil {
+		state.Info.MetaData = handler.MetaData{}
+	}
+	return &state, nil
+}
+
+func (s *FileStore) removeUploadInfo(id string) {
+	if err := os.Remove(s.infoPath(id)); err != nil && !os.IsNotExist(err) {
+		s.logger.WithError(err).Warn("Failed to remove upload info file")
+	}
 }
@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -23,17 +24,93 @@ const (
 	MessageTypeDeliveryAck  MessageType = "delivery_ack"
 	MessageTypeTyping       MessageType = "typing"
 	MessageTypePresence     MessageType = "presence"
+
+	// Uploads in flight, sent to all clients
+	MessageTypeUploadStarted   MessageType = "upload_started"
+	MessageTypeUploadProgress  MessageType = "upload_progress"
+	MessageTypeUploadCompleted MessageType = "upload_completed"
+	MessageTypeUploadFailed    MessageType = "upload_failed"
+
+	// Sent to the uploader once a device has received the whole file
+	MessageTypeDownloadCompleted MessageType = "download_completed"
+
+	// Clipboard items pushed by a device, relayed to the other devices that
+	// announced the clipboard capability
+	MessageTypeClipboard MessageType = "clipboard"
 )
 
+// CapabilityClipboard in a hello message opts the connection in to
+// receiving clipboard items
+const CapabilityClipboard = "clipboard"
+
 type Message struct {
 	Type      MessageType `json:"type"`
 	ID        string      `json:"id,omitempty"`
+	ClientID  string      `json:"client_id,omitempty"` // ID the sender gave its chat message
 	Timestamp int64       `json:"timestamp"`
 	Device    string      `json:"device,omitempty"`
 	Text      string      `json:"text,omitempty"`
 	From      string      `json:"from,omitempty"`
 	OfferID   string      `json:"offer_id,omitempty"`
 	Accepted  bool        `json:"accepted,omitempty"`
+
+	Upload    *UploadStatus    `json:"upload,omitempty"`
+	Download  *DownloadReceipt `json:"download,omitempty"`
+	Clipboard *ClipboardItem   `json:"clipboard,omitempty"`
+	Error     string           `json:"error,omitempty"` // why a message of the client was rejected
+}
+
+// Clipboard item kinds
+const (
+	ClipboardText  = "text"
+	ClipboardImage = "image"
+)
+
+// ClipboardItem is text or a small image copied on one device
+type ClipboardItem struct {
+	ID         string `json:"id,omitempty"`
+	Kind       string `json:"kind"` // text or image
+	Text       string `json:"text,omitempty"`
+	MimeType   string `json:"mime_type,omitempty"` // for images
+	Data       string `json:"data,omitempty"`      // base64 image content
+	Size       int    `json:"size"`                // bytes of text or image
+	Device     string `json:"device,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	Time       int64  `json:"time"`
+}
+
+// ClipboardHandler accepts a clipboard item pushed by a device. The handler
+// delivers the item to the other devices; an error is reported back to the
+// device that pushed it.
+type ClipboardHandler func(deviceID, deviceName string, item ClipboardItem) error
+
+// UploadStatus describes an upload in flight for upload_* messages
+type UploadStatus struct {
+	UploadID   string  `json:"upload_id"`
+	FileID     string  `json:"file_id,omitempty"` // set once completed
+	FileName   string  `json:"file_name"`
+	Size       int64   `json:"size"` // -1 while the length is unknown
+	Offset     int64   `json:"offset"`
+	Rate       float64 `json:"rate"`          // bytes per second
+	ETA        float64 `json:"eta,omitempty"` // seconds, 0 when unknown
+	Device     string  `json:"device"`
+	DeviceName string  `json:"device_name,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// DownloadReceipt tells an uploader that a file was received
+type DownloadReceipt struct {
+	FileID      string  `json:"file_id"`
+	FileName    string  `json:"file_name"`
+	Size        int64   `json:"size"`
+	Device      string  `json:"device,omitempty"`
+	DeviceName  string  `json:"device_name,omitempty"`
+	Remote      string  `json:"remote"`
+	Started     int64   `json:"started"`
+	Finished    int64   `json:"finished"`
+	Duration    float64 `json:"duration"`     // seconds
+	AverageRate float64 `json:"average_rate"` // bytes per second
+	Requests    int     `json:"requests"`
 }
 
 type FileOfferMessage struct {
@@ -62,6 +139,7 @@ type Client struct {
 	Manager     *Manager
 	LastPing    time.Time
 	IsConnected bool
+	Clipboard   bool // announced the clipboard capability
 	mu          sync.RWMutex
 }
 
@@ -75,8 +153,16 @@ type Manager struct {
 	auth       *security.AuthService
 	upgrader   websocket.Upgrader
 	mu         sync.RWMutex
+
+	chatMu        sync.RWMutex
+	chatListeners []ChatListener
+	clipboard     ClipboardHandler
 }
 
+// ChatListener receives every chat message relayed between devices together
+// with the ID of the paired device that sent it
+type ChatListener func(deviceID string, msg Message)
+
 func NewManager(cfg *config.Config, logger *logrus.Logger, auth *security.AuthService) *Manager {
 	return &Manager{
 		clients:    make(map[string]*Client),
@@ -296,7 +382,7 @@ func (c *Client) readPump() {
 		readTimeout = 60 * time.Second
 	}
 
-	c.Connection.SetReadLimit(c.Manager.config.WebSocket.ReadLimit)
+	c.Connection.SetReadLimit(c.Manager.readLimit(false))
 	c.Connection.SetReadDeadline(time.Now().Add(readTimeout))
 	c.Connection.SetPongHandler(func(string) error {
 		c.mu.Lock()
@@ -316,6 +402,15 @@ func (c *Client) readPump() {
 			break
 		}
 
+		// Only clipboard items may exceed the configured read limit
+		if limit := c.Manager.config.WebSocket.ReadLimit; limit > 0 && int64(len(msg)) > limit && !isClipboardMessage(msg) {
+			c.Manager.logger.WithFields(logrus.Fields{
+				"client_id": c.ID,
+				"size":      len(msg),
+			}).Warn("WebSocket message exceeds read limit")
+			break
+		}
+
 		c.handleMessage(msg)
 	}
 }
@@ -382,6 +477,9 @@ func (c *Client) handleMessage(msg json.RawMessage) {
 	case MessageTypeFileOfferAck:
 		c.handleFileOfferAckMessage(msg)
 
+	case MessageTypeClipboard:
+		c.handleClipboardMessage(msg)
+
 	default:
 		c.Manager.logger.WithField("type", baseMsg.Type).Warn("Unknown message type")
 	}
@@ -396,8 +494,20 @@ func (c *Client) handleHelloMessage(msg json.RawMessage) {
 
 	c.mu.Lock()
 	c.DeviceName = helloMsg.Device
+	c.Clipboard = false
+	for _, capability := range helloMsg.Capabilities {
+		if capability == CapabilityClipboard {
+			c.Clipboard = true
+		}
+	}
+	clipboard := c.Clipboard
 	c.mu.Unlock()
 
+	// Connections are authenticated before the upgrade; only those that
+	// opted in to clipboard sync may send messages the size of an item.
+	// handleMessage runs on the reading goroutine, which owns the limit.
+	c.Connection.SetReadLimit(c.Manager.readLimit(clipboard))
+
 	c.Manager.logger.WithFields(logrus.Fields{
 		"client_id":   c.ID,
 		"device_name": helloMsg.Device,
@@ -422,10 +532,129 @@ func (c *Client) handleChatMessage(msg json.RawMessage) {
 
 	chatMsg.From = c.DeviceName
 	chatMsg.Timestamp = time.Now().Unix()
+	// Clients cannot choose the ID the history is keyed by; theirs is
+	// relayed for matching the echo to the message sent
+	chatMsg.ClientID = chatMsg.ID
+	chatMsg.ID = uuid.New().String()
+
+	c.Manager.chatMu.RLock()
+	for _, l := range c.Manager.chatListeners {
+		l(c.DeviceID, chatMsg)
+	}
+	c.Manager.chatMu.RUnlock()
 
 	c.Manager.broadcast <- chatMsg
 }
 
+// OnChat registers a listener for chat messages
+func (m *Manager) OnChat(l ChatListener) {
+	m.chatMu.Lock()
+	defer m.chatMu.Unlock()
+
+	m.chatListeners = append(m.chatListeners, l)
+}
+
+// readLimit is the largest message accepted from a client: the configured
+// read limit, raised to fit the largest clipboard item for clients that opted
+// in to clipboard sync while it is enabled. readPump holds other messages to
+// the configured limit.
+func (m *Manager) readLimit(clipboard bool) int64 {
+	limit := m.config.WebSocket.ReadLimit
+	if limit <= 0 || !clipboard || !m.config.Clipboard.Enabled {
+		return limit
+	}
+
+	text, err := m.config.GetClipboardMaxTextBytes()
+	if err != nil {
+		return limit
+	}
+	image, err := m.config.GetClipboardMaxImageBytes()
+	if err != nil {
+		return limit
+	}
+	// JSON escaping can take six bytes per byte of text, base64 four per
+	// three bytes of image
+	return max(limit, text*6+4096, image*4/3+4096)
+}
+
+func isClipboardMessage(msg json.RawMessage) bool {
+	var baseMsg struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(msg, &baseMsg) == nil && MessageType(baseMsg.Type) == MessageTypeClipboard
+}
+
+func (c *Client) handleClipboardMessage(msg json.RawMessage) {
+	var clipMsg Message
+	if err := json.Unmarshal(msg, &clipMsg); err != nil {
+		c.Manager.logger.WithError(err).Error("Failed to parse clipboard message")
+		return
+	}
+
+	c.Manager.mu.RLock()
+	handler := c.Manager.clipboard
+	c.Manager.mu.RUnlock()
+
+	var err error
+	switch {
+	case handler == nil:
+		err = errors.New("clipboard sync is disabled")
+	case clipMsg.Clipboard == nil:
+		err = errors.New("clipboard item missing")
+	default:
+		c.mu.RLock()
+		deviceName := c.DeviceName
+		c.mu.RUnlock()
+		err = handler(c.DeviceID, deviceName, *clipMsg.Clipboard)
+	}
+	if err == nil {
+		return
+	}
+
+	c.Manager.logger.WithError(err).WithField("client_id", c.ID).Warn("Clipboard item rejected")
+	select {
+	case c.Send <- Message{Type: MessageTypeClipboard, ID: clipMsg.ID, Error: err.Error(), Timestamp: time.Now().Unix()}:
+	default:
+	}
+}
+
+// HandleClipboard registers the handler for clipboard items pushed by
+// devices. Without one, clipboard messages are rejected.
+func (m *Manager) HandleClipboard(h ClipboardHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.clipboard = h
+}
+
+// BroadcastClipboard sends a clipboard item to the clients that opted in to
+// clipboard sync, except those of the device it came from
+func (m *Manager) BroadcastClipboard(item ClipboardItem) {
+	message := Message{
+		Type:      MessageTypeClipboard,
+		ID:        item.ID,
+		From:      item.DeviceName,
+		Timestamp: item.Time,
+		Clipboard: &item,
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, client := range m.clients {
+		client.mu.RLock()
+		receive := client.IsConnected && client.Clipboard && client.DeviceID != item.Device
+		client.mu.RUnlock()
+		if !receive {
+			continue
+		}
+		select {
+		case client.Send <- message:
+		default:
+		}
+	}
+}
+
 func (c *Client) handleFileOfferAckMessage(msg json.RawMessage) {
 	var ackMsg Message
 	if err := json.Unmarshal(msg, &ackMsg); err != nil {
@@ -479,6 +708,50 @@ func (m *Manager) SendFileOffer(offer FileOfferMessage) error {
 	return nil
 }
 
+// BroadcastUpload sends an upload status message to all clients. Progress
+// messages are dropped rather than delaying the upload when the manager is busy.
+func (m *Manager) BroadcastUpload(typ MessageType, status UploadStatus) {
+	message := Message{
+		Type:      typ,
+		ID:        status.UploadID,
+		Timestamp: time.Now().Unix(),
+		From:      status.DeviceName,
+		Upload:    &status,
+	}
+
+	if typ == MessageTypeUploadProgress {
+		select {
+		case m.broadcast <- message:
+		default:
+		}
+		return
+	}
+	m.broadcast <- message
+}
+
+// SendToDevice sends a message to the clients of one paired device and
+// reports whether any of them was connected
+func (m *Manager) SendToDevice(deviceID string, message Message) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sent := false
+	for _, client := range m.clients {
+		client.mu.RLock()
+		receive := client.IsConnected && client.DeviceID == deviceID
+		client.mu.RUnlock()
+		if !receive {
+			continue
+		}
+		select {
+		case client.Send <- message:
+			sent = true
+		default:
+		}
+	}
+	return sent
+}
+
 func (m *Manager) GetConnectedDevices() []map[string]interface{} {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
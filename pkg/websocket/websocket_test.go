@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/easy-sync/easy-sync/pkg/config"
+	"github.com/easy-sync/easy-sync/pkg/security"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestManager serves a manager with clipboard sync enabled and returns
+// its address and a valid device token
+func newTestManager(t *testing.T) (*Manager, string, string) {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.WebSocket.ReadLimit = 512
+	cfg.Clipboard.Enabled = true
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	auth, err := security.NewAuthService(cfg, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.CreateDevice("laptop-id", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.GenerateDeviceToken("laptop-id", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(cfg, logger, auth)
+	m.Start()
+	server := httptest.NewServer(http.HandlerFunc(m.HandleWebSocket))
+	t.Cleanup(server.Close)
+	return m, "ws" + strings.TrimPrefix(server.URL, "http"), token
+}
+
+func TestClipboardReadLimit(t *testing.T) {
+	m, url, token := newTestManager(t)
+	received := make(chan ClipboardItem, 1)
+	m.HandleClipboard(func(deviceID, deviceName string, item ClipboardItem) error {
+		received <- item
+		return nil
+	})
+
+	text := strings.Repeat("x", 2048) // above the read limit of 512 bytes
+	item := Message{Type: MessageTypeClipboard, Clipboard: &ClipboardItem{Kind: "text", Text: text, Size: len(text)}}
+
+	tests := []struct {
+		name         string
+		capabilities []string // nil sends no hello
+		accepted     bool
+	}{
+		{"no hello", nil, false},
+		{"without clipboard", []string{}, false},
+		{"clipboard", []string{CapabilityClipboard}, true},
+	}
+	for _, tt := range tests {
+		conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.capabilities != nil {
+			if err := conn.WriteJSON(HelloMessage{Type: string(MessageTypeHello), Device: "laptop", Capabilities: tt.capabilities}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := conn.WriteJSON(item); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-received:
+			if !tt.accepted {
+				t.Errorf("%s: oversized message accepted", tt.name)
+			} else if got.Text != text {
+				t.Errorf("%s: received %d bytes of text", tt.name, len(got.Text))
+			}
+		case <-time.After(time.Second):
+			if tt.accepted {
+				t.Errorf("%s: clipboard item not received", tt.name)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestSendToDevice(t *testing.T) {
+	m, url, token := newTestManager(t)
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The hello updates the client while messages are addressed to it
+	if err := conn.WriteJSON(HelloMessage{Type: string(MessageTypeHello), Device: "laptop", Capabilities: []string{CapabilityClipboard}}); err != nil {
+		t.Fatal(err)
+	}
+
+	message := Message{Type: MessageTypeDownloadCompleted, ID: "receipt-1"}
+	deadline := time.Now().Add(time.Second)
+	for !m.SendToDevice("laptop-id", message) {
+		if time.Now().After(deadline) {
+			t.Fatal("device never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.SendToDevice("phone-id", message) {
+		t.Error("message sent to a device that is not connected")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var got Message
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Type == MessageTypeDownloadCompleted {
+			if got.ID != "receipt-1" {
+				t.Errorf("received %+v", got)
+			}
+			break
+		}
+	}
+}
+
+func TestChatMessageID(t *testing.T) {
+	m, url, token := newTestManager(t)
+	received := make(chan Message, 2)
+	m.OnChat(func(deviceID string, msg Message) {
+		if deviceID == "laptop-id" {
+			received <- msg
+		}
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ids := make(map[string]bool)
+	for _, text := range []string{"first", "second"} {
+		// Both messages claim the same ID
+		if err := conn.WriteJSON(Message{Type: MessageTypeChat, ID: "mine", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-received:
+			if got.ID == "" || got.ID == "mine" || got.ClientID != "mine" || got.Text != text {
+				t.Errorf("relayed %+v", got)
+			}
+			ids[got.ID] = true
+		case <-time.After(time.Second):
+			t.Fatal("chat message not relayed")
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("messages share the ID %v", ids)
+	}
+}
@@ -10,6 +10,11 @@ function formatSize(n: number) {
   return `${v.toFixed(1)} ${units[i]}`;
 }
 
+// Types the server is willing to show inline instead of as a download
+function previewable(mime: string) {
+  return /^(image\/(jpeg|png|gif|webp|avif|bmp)|video\/(mp4|webm|ogg|quicktime)|audio\/(mpeg|mp4|aac|ogg|wav|flac|webm)|application\/pdf|text\/plain)\b/.test(mime || "");
+}
+
 export default function FileList() {
   const { token } = useAuth();
   const [files, setFiles] = useState<any[]>([]);
@@ -35,14 +40,28 @@ export default function FileList() {
     await loadFiles();
   }
 
+  // The token lets the server tell the uploader who received the file
   function download(id: string) {
-    window.open(`/files/${id}`, "_blank");
+    window.open(`/files/${id}${token ? `?token=${encodeURIComponent(token)}` : ""}`, "_blank");
+  }
+
+  function preview(id: string) {
+    window.open(`/files/${id}?inline=1${token ? `&token=${encodeURIComponent(token)}` : ""}`, "_blank");
   }
 
   async function verify(id: string) {
-    const res = await fetch(`/files/${id}/sha256`);
-    const data = await res.json();
-    alert(`SHA-256: ${data.sha256 || "unknown"}`);
+    if (!token) return;
+    // Large files are hashed in the background, ask again until done
+    for (;;) {
+      const res = await fetch(`/files/${id}/checksum?algorithm=sha256,blake3`, { headers: { Authorization: `Bearer ${token}` } });
+      const data = await res.json();
+      if (res.status !== 202) {
+        const sums = data.checksums || {};
+        alert(`SHA-256: ${sums.sha256 || "unknown"}\nBLAKE3: ${sums.blake3 || "unknown"}`);
+        return;
+      }
+      await new Promise((resolve) => setTimeout(resolve, 2000));
+    }
   }
 
   useEffect(() => { loadFiles(); }, [token]);
@@ -64,6 +83,9 @@ export default function FileList() {
             </div>
             <div className="flex gap-2">
               <button onClick={() => verify(f.id)} className="rounded-md bg-slate-700 px-2.5 py-1.5 text-xs hover:bg-slate-600">校验</button>
+              {previewable(f.mime_type) && (
+                <button onClick={() => preview(f.id)} className="rounded-md bg-slate-700 px-2.5 py-1.5 text-xs hover:bg-slate-600">预览</button>
+              )}
               <button onClick={() => download(f.id)} className="rounded-md bg-sky-600 px-2.5 py-1.5 text-xs hover:bg-sky-500">下载</button>
               <button onClick={() => del(f.id)} className="rounded-md bg-rose-600 px-2.5 py-1.5 text-xs hover:bg-rose-500">删除</button>
             </div>